@@ -2,14 +2,18 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/ikwerre-dev/EmojiDB/core"
 	"github.com/ikwerre-dev/EmojiDB/query"
 	"github.com/ikwerre-dev/EmojiDB/safety"
+	"github.com/ikwerre-dev/EmojiDB/sql"
 )
 
 type Request struct {
@@ -24,8 +28,23 @@ type Response struct {
 	Error string      `json:"error,omitempty"`
 }
 
+// Event pushes a change to a client that sent a subscribe request, whose
+// id is Subscription. An Event with an Error ends the subscription.
+type Event struct {
+	Subscription string       `json:"subscription"`
+	Event        *core.Change `json:"event,omitempty"`
+	Error        string       `json:"error,omitempty"`
+}
+
 var db *core.Database
 
+var (
+	// out keeps replies and events from interleaving on stdout.
+	out           sync.Mutex
+	subsMu        sync.Mutex
+	subscriptions = make(map[string]*core.Subscription)
+)
+
 func main() {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
@@ -59,15 +78,16 @@ func handle(req Request) {
 
 	case "define_schema":
 		var p struct {
-			Table  string       `json:"table"`
-			Fields []core.Field `json:"fields"`
+			Table       string            `json:"table"`
+			Fields      []core.Field      `json:"fields"`
+			Constraints []core.Constraint `json:"constraints"`
 		}
 		json.Unmarshal(req.Params, &p)
 		if db == nil {
 			sendError(req.ID, "db not open")
 			return
 		}
-		err := db.DefineSchema(p.Table, p.Fields)
+		err := db.DefineSchema(p.Table, p.Fields, p.Constraints...)
 		if err != nil {
 			sendError(req.ID, err.Error())
 		} else {
@@ -76,22 +96,62 @@ func handle(req Request) {
 
 	case "sync_schema":
 		var p struct {
-			Table  string       `json:"table"`
-			Fields []core.Field `json:"fields"`
-			Force  bool         `json:"force"`
+			Table       string            `json:"table"`
+			Fields      []core.Field      `json:"fields"`
+			Constraints []core.Constraint `json:"constraints"`
+			Force       bool              `json:"force"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		err := db.SyncSchema(p.Table, p.Fields, p.Force, p.Constraints...)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, "migrated")
+		}
+
+	case "migrate_schema":
+		var p struct {
+			Table       string               `json:"table"`
+			Steps       []core.MigrationStep `json:"steps"`
+			Fields      []core.Field         `json:"fields"`
+			Constraints []core.Constraint    `json:"constraints"`
+			Force       bool                 `json:"force"`
 		}
 		json.Unmarshal(req.Params, &p)
 		if db == nil {
 			sendError(req.ID, "db not open")
 			return
 		}
-		err := db.SyncSchema(p.Table, p.Fields, p.Force)
+		err := db.Migrate(p.Table, p.Steps, p.Fields, p.Force, p.Constraints...)
 		if err != nil {
 			sendError(req.ID, err.Error())
 		} else {
 			sendSuccess(req.ID, "migrated")
 		}
 
+	case "dry_run":
+		var p struct {
+			Table       string               `json:"table"`
+			Steps       []core.MigrationStep `json:"steps"`
+			Fields      []core.Field         `json:"fields"`
+			Constraints []core.Constraint    `json:"constraints"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		report, err := db.DryRun(p.Table, p.Steps, p.Fields, p.Constraints...)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, report)
+		}
+
 	case "count":
 		var p struct {
 			Table string                 `json:"table"`
@@ -137,6 +197,64 @@ func handle(req Request) {
 			sendSuccess(req.ID, "pulled")
 		}
 
+	case "inspect_orphans":
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		sendSuccess(req.ID, db.InspectOrphans())
+
+	case "infer_schema":
+		var p struct {
+			Table string `json:"table"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		inferred, err := db.InferSchema(p.Table)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, inferred)
+		}
+
+	case "adopt_orphans":
+		var p struct {
+			Table       string            `json:"table"`
+			Fields      []core.Field      `json:"fields"`
+			Constraints []core.Constraint `json:"constraints"`
+			Force       bool              `json:"force"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		err := db.AdoptOrphans(p.Table, p.Fields, p.Force, p.Constraints...)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, "adopted")
+		}
+
+	case "schema_history":
+		var p struct {
+			Table string `json:"table"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		history, err := db.SchemaHistory(p.Table)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, history)
+		}
+
 	case "list_tables":
 		if db == nil {
 			sendError(req.ID, "db not open")
@@ -173,14 +291,12 @@ func handle(req Request) {
 			sendError(req.ID, "db not open")
 			return
 		}
-		err := safety.Update(db, p.Table, func(r core.Row) bool {
-			for k, v := range p.Match {
-				if r[k] != v {
-					return false
-				}
-			}
-			return true
-		}, p.Update)
+		matches, err := db.Matcher(p.Table, p.Match)
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+		err = safety.Update(db, p.Table, matches, p.Update)
 		if err != nil {
 			sendError(req.ID, err.Error())
 		} else {
@@ -197,14 +313,12 @@ func handle(req Request) {
 			sendError(req.ID, "db not open")
 			return
 		}
-		err := safety.Delete(db, p.Table, func(r core.Row) bool {
-			for k, v := range p.Match {
-				if r[k] != v {
-					return false
-				}
-			}
-			return true
-		})
+		matches, err := db.Matcher(p.Table, p.Match)
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+		err = safety.Delete(db, p.Table, matches)
 		if err != nil {
 			sendError(req.ID, err.Error())
 		} else {
@@ -228,37 +342,148 @@ func handle(req Request) {
 			sendSuccess(req.ID, "inserted")
 		}
 
+	case "upsert":
+		var p struct {
+			Table    string     `json:"table"`
+			Row      core.Row   `json:"row"`
+			Records  []core.Row `json:"records"`
+			Conflict []string   `json:"conflict"`
+			Mode     string     `json:"mode"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		mode, err := core.ParseUpsertMode(p.Mode)
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+		records := p.Records
+		if p.Row != nil {
+			records = append(records, p.Row)
+		}
+		result, err := db.BulkUpsert(p.Table, records, p.Conflict, mode)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, result)
+		}
+
 	case "query":
+		var p queryParams
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		q, err := p.build()
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+
+		results, err := q.Execute()
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, results)
+		}
+
+	case "explain":
+		var p queryParams
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		q, err := p.build()
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+
+		explanation, err := q.Explain()
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, explanation)
+		}
+
+	case "search":
 		var p struct {
 			Table string `json:"table"`
-			// Note: Complex filters via bridge are tricky.
-			// For now, let's support a simple key-value filter.
+			Field string `json:"field"`
+			// Query holds words, "quoted phrases" and prefix* terms.
+			Query string                 `json:"query"`
 			Match map[string]interface{} `json:"match"`
+			Limit int                    `json:"limit"`
 		}
 		json.Unmarshal(req.Params, &p)
 		if db == nil {
 			sendError(req.ID, "db not open")
 			return
 		}
-
-		q := query.NewQuery(db, p.Table)
+		var filter func(core.Row) bool
 		if len(p.Match) > 0 {
-			q = q.Filter(func(r core.Row) bool {
-				for k, v := range p.Match {
-					if r[k] != v {
-						return false
-					}
-				}
-				return true
-			})
+			matches, err := db.Matcher(p.Table, p.Match)
+			if err != nil {
+				sendError(req.ID, err.Error())
+				return
+			}
+			filter = matches
 		}
 
-		results, err := q.Execute()
+		hits, err := db.Search(p.Table, p.Field, p.Query, filter, p.Limit)
 		if err != nil {
 			sendError(req.ID, err.Error())
 		} else {
-			sendSuccess(req.ID, results)
+			sendSuccess(req.ID, hits)
+		}
+
+	case "sql":
+		var p struct {
+			Query string `json:"query"`
+			// Params bind to ? and $n placeholders, in order.
+			Params []interface{} `json:"params"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+
+		result, err := sql.Exec(context.Background(), db, p.Query, p.Params...)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, result)
+		}
+
+	case "verify":
+		var p struct {
+			Table string `json:"table"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		tables := []string{p.Table}
+		if p.Table == "" {
+			tables = db.ListTables()
 		}
+		var reports []*core.VerifyReport
+		for _, name := range tables {
+			report, err := db.Verify(name)
+			if err != nil {
+				sendError(req.ID, err.Error())
+				return
+			}
+			reports = append(reports, report)
+		}
+		sendSuccess(req.ID, reports)
 
 	case "secure":
 		if db == nil {
@@ -305,6 +530,153 @@ func handle(req Request) {
 			sendSuccess(req.ID, "flushed")
 		}
 
+	case "set_ttl":
+		var p struct {
+			Table string `json:"table"`
+			// TTL is nil to stop expiring rows.
+			TTL *core.TTL `json:"ttl"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		err := db.SetTTL(p.Table, p.TTL)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, "ttl set")
+		}
+
+	case "set_temporal":
+		var p struct {
+			Table string `json:"table"`
+			// Temporal is nil to stop keeping history.
+			Temporal *core.Temporal `json:"temporal"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		err := db.SetTemporal(p.Table, p.Temporal)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, "temporal set")
+		}
+
+	case "set_rules":
+		var p struct {
+			Table string `json:"table"`
+			// Rules replace the table's rules; empty removes them.
+			Rules []core.Rule `json:"rules"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		err := db.SetRules(p.Table, p.Rules)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, "rules set")
+		}
+
+	case "create_view":
+		var p struct {
+			Name string `json:"name"`
+			// The table, match and select of the view, as in query.
+			queryParams
+			GroupBy      []string             `json:"groupBy"`
+			Aggregates   []core.ViewAggregate `json:"aggregates"`
+			Materialized bool                 `json:"materialized"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		q, err := p.build()
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+		view, err := q.View(p.GroupBy, p.Aggregates...)
+		if err == nil {
+			view.Materialized = p.Materialized
+			err = db.CreateView(p.Name, view)
+		}
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, "view created")
+		}
+
+	case "refresh_view":
+		var p struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		err := db.RefreshView(p.Name)
+		if err != nil {
+			sendError(req.ID, err.Error())
+		} else {
+			sendSuccess(req.ID, "view refreshed")
+		}
+
+	case "subscribe":
+		var p struct {
+			// Table, Kinds and Match narrow the changes sent; all are
+			// optional, but Match needs Table.
+			Table string                 `json:"table"`
+			Kinds []core.ChangeKind      `json:"kinds"`
+			Match map[string]interface{} `json:"match"`
+			// From is the position of the last change seen, to resume after.
+			From string `json:"from"`
+		}
+		json.Unmarshal(req.Params, &p)
+		if db == nil {
+			sendError(req.ID, "db not open")
+			return
+		}
+		filter, err := changeFilter(p.Table, p.Kinds, p.Match)
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+		sub, err := db.Subscribe(p.From, filter)
+		if err != nil {
+			sendError(req.ID, err.Error())
+			return
+		}
+		subsMu.Lock()
+		subscriptions[req.ID] = sub
+		subsMu.Unlock()
+		sendSuccess(req.ID, "subscribed")
+		go forward(req.ID, sub)
+
+	case "unsubscribe":
+		var p struct {
+			Subscription string `json:"subscription"`
+		}
+		json.Unmarshal(req.Params, &p)
+		subsMu.Lock()
+		sub, ok := subscriptions[p.Subscription]
+		delete(subscriptions, p.Subscription)
+		subsMu.Unlock()
+		if !ok {
+			sendError(req.ID, "subscription not found: "+p.Subscription)
+			return
+		}
+		sub.Close()
+		sendSuccess(req.ID, "unsubscribed")
+
 	case "close":
 		if db != nil {
 			db.Close()
@@ -318,12 +690,113 @@ func handle(req Request) {
 	}
 }
 
-func sendSuccess(id string, data interface{}) {
-	res, _ := json.Marshal(Response{ID: id, Data: data})
+// queryParams are the parameters of query and explain.
+type queryParams struct {
+	Table string `json:"table"`
+	// Match values are either plain values or operator maps such as
+	// {"$gte": 18}; see core.Schema.Matcher.
+	Match  map[string]interface{} `json:"match"`
+	Sort   []query.SortKey        `json:"sort"`
+	Limit  int                    `json:"limit"`
+	Select []string               `json:"select"`
+	// Joins name the joined tables; their columns come back prefixed by
+	// table name.
+	Joins []query.Join `json:"joins"`
+	// Nearest ranks the results by vector distance; see query.Nearest.
+	Nearest *query.Nearest `json:"nearest"`
+	// AsOf reads the table as it was at a past time, and Between every
+	// version current from one time to another; see query.Period.
+	AsOf    *time.Time    `json:"asOf"`
+	Between *query.Period `json:"between"`
+}
+
+func (p queryParams) build() (*query.Query, error) {
+	q := query.NewQuery(db, p.Table)
+	q.Joins = p.Joins
+	q.Near = p.Nearest
+	switch {
+	case p.AsOf != nil && p.Between != nil:
+		return nil, errors.New("asOf and between cannot be combined")
+	case p.AsOf != nil:
+		q = q.AsOf(*p.AsOf)
+	case p.Between != nil:
+		q = q.Between(p.Between.From, p.Between.To)
+	}
+	if len(p.Match) > 0 {
+		if err := q.Where(p.Match); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range p.Sort {
+		q = q.OrderBy(key.Field, key.Desc)
+	}
+	q = q.Limit(p.Limit)
+	if len(p.Select) > 0 {
+		q = q.Select(p.Select...)
+	}
+	return q, nil
+}
+
+// changeFilter builds the filter of a subscription. Match is tested on the
+// row after an insert or update and before a delete.
+func changeFilter(table string, kinds []core.ChangeKind, match map[string]interface{}) (func(core.Change) bool, error) {
+	var matches func(core.Row) bool
+	if len(match) > 0 {
+		if table == "" {
+			return nil, errors.New("match needs a table")
+		}
+		var err error
+		if matches, err = db.Matcher(table, match); err != nil {
+			return nil, err
+		}
+	}
+	return func(c core.Change) bool {
+		if table != "" && c.Table != table {
+			return false
+		}
+		if len(kinds) > 0 {
+			wanted := false
+			for _, k := range kinds {
+				wanted = wanted || k == c.Kind
+			}
+			if !wanted {
+				return false
+			}
+		}
+		if matches == nil {
+			return true
+		}
+		if c.After != nil {
+			return matches(c.After)
+		}
+		return matches(c.Before)
+	}, nil
+}
+
+// forward sends the changes of sub as events until it ends.
+func forward(id string, sub *core.Subscription) {
+	for c := range sub.C {
+		send(Event{Subscription: id, Event: &c})
+	}
+	subsMu.Lock()
+	delete(subscriptions, id)
+	subsMu.Unlock()
+	if err := sub.Err(); err != nil {
+		send(Event{Subscription: id, Error: err.Error()})
+	}
+}
+
+func send(v interface{}) {
+	res, _ := json.Marshal(v)
+	out.Lock()
 	fmt.Println(string(res))
+	out.Unlock()
+}
+
+func sendSuccess(id string, data interface{}) {
+	send(Response{ID: id, Data: data})
 }
 
 func sendError(id string, err string) {
-	res, _ := json.Marshal(Response{ID: id, Error: err})
-	fmt.Println(string(res))
+	send(Response{ID: id, Error: err})
 }
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Aggregate functions, as used by views and by SQL.
+const (
+	AggCount = "count"
+	AggSum   = "sum"
+	AggAvg   = "avg"
+	AggMin   = "min"
+	AggMax   = "max"
+)
+
+// Accumulator computes one aggregate function over values added one at a
+// time. Null values are skipped. Sums of whole numbers stay whole, sums
+// involving a decimal are exact decimals, and anything else is a float.
+//
+// Values may also be removed again, for views kept up to date as rows
+// change. Removing the current minimum or maximum leaves it unknown until
+// the values are added again; see Stale.
+type Accumulator struct {
+	Func    string
+	count   int
+	sum     *big.Rat
+	float   bool
+	decimal bool
+	best    interface{}
+	stale   bool
+}
+
+// NewAccumulator returns an empty accumulator for fn.
+func NewAccumulator(fn string) *Accumulator {
+	return &Accumulator{Func: fn, sum: new(big.Rat)}
+}
+
+// Add counts v into the result.
+func (a *Accumulator) Add(v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	switch a.Func {
+	case AggMin, AggMax:
+		c := Compare(v, a.best)
+		if a.count == 0 || (a.Func == AggMin && c < 0) || (a.Func == AggMax && c > 0) {
+			a.best = v
+		}
+	case AggSum, AggAvg:
+		r, err := a.number(v)
+		if err != nil {
+			return err
+		}
+		a.sum.Add(a.sum, r)
+	}
+	a.count++
+	return nil
+}
+
+// Remove takes a value added earlier back out of the result.
+func (a *Accumulator) Remove(v interface{}) error {
+	if v == nil {
+		return nil
+	}
+	switch a.Func {
+	case AggMin, AggMax:
+		if Equal(v, a.best) {
+			a.stale = true
+		}
+	case AggSum, AggAvg:
+		r, err := a.number(v)
+		if err != nil {
+			return err
+		}
+		a.sum.Sub(a.sum, r)
+	}
+	a.count--
+	return nil
+}
+
+// Stale reports whether the minimum or maximum was removed, so the values
+// left must be added to a Reset accumulator to find the new one.
+func (a *Accumulator) Stale() bool {
+	return a.stale
+}
+
+// Reset empties the accumulator.
+func (a *Accumulator) Reset() {
+	*a = *NewAccumulator(a.Func)
+}
+
+func (a *Accumulator) number(v interface{}) (*big.Rat, error) {
+	switch n := v.(type) {
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), nil
+	case int64:
+		return new(big.Rat).SetInt64(n), nil
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(n) == nil {
+			return nil, fmt.Errorf("%v is not a finite number", n)
+		}
+		a.float = a.float || n != float64(int64(n))
+		return r, nil
+	case Decimal:
+		a.decimal = true
+		return n.Rat(), nil
+	}
+	return nil, fmt.Errorf("%v is not a number", v)
+}
+
+// Result returns the value of the aggregate: null for the sum, average,
+// minimum or maximum of no values.
+func (a *Accumulator) Result() interface{} {
+	switch a.Func {
+	case AggCount:
+		return int64(a.count)
+	case AggMin, AggMax:
+		if a.count == 0 {
+			return nil
+		}
+		return a.best
+	}
+	if a.count == 0 {
+		return nil
+	}
+	r := a.sum
+	if a.Func == AggAvg {
+		r = new(big.Rat).Quo(a.sum, new(big.Rat).SetInt64(int64(a.count)))
+	}
+	switch {
+	case a.decimal:
+		d, _ := ParseDecimal(r.FloatString(16))
+		return d
+	case a.Func == AggSum && !a.float && r.IsInt():
+		return r.Num().Int64()
+	}
+	f, _ := r.Float64()
+	return f
+}
+
+// state returns what the accumulator needs to carry on from its result,
+// for storing alongside it.
+func (a *Accumulator) state() map[string]interface{} {
+	s := map[string]interface{}{"n": a.count}
+	switch a.Func {
+	case AggSum, AggAvg:
+		s["sum"] = a.sum.RatString()
+		if a.float {
+			s["float"] = true
+		}
+		if a.decimal {
+			s["decimal"] = true
+		}
+	case AggMin, AggMax:
+		s["best"] = a.best
+	}
+	return s
+}
+
+// accumulatorFrom restores an accumulator for fn from its state. best is
+// read back with the type of the field it came from.
+func accumulatorFrom(fn string, s map[string]interface{}, typ FieldType) (*Accumulator, error) {
+	a := NewAccumulator(fn)
+	n, ok := toFloat(s["n"])
+	if !ok {
+		return nil, errors.New("invalid aggregate state")
+	}
+	a.count = int(n)
+	switch fn {
+	case AggSum, AggAvg:
+		str, _ := s["sum"].(string)
+		if _, ok := a.sum.SetString(str); !ok {
+			return nil, errors.New("invalid aggregate state")
+		}
+		a.float, _ = s["float"].(bool)
+		a.decimal, _ = s["decimal"].(bool)
+	case AggMin, AggMax:
+		a.best = s["best"]
+		if a.best != nil {
+			if v, err := normalizeValue(a.best, typ); err == nil {
+				a.best = v
+			}
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultChangeLogSize is how many changes are kept for subscribers to
+// resume from when Config.ChangeLogSize is zero.
+const defaultChangeLogSize = 10000
+
+// ChangeKind is what a change did to its row.
+type ChangeKind string
+
+const (
+	ChangeInsert ChangeKind = "insert"
+	ChangeUpdate ChangeKind = "update"
+	ChangeDelete ChangeKind = "delete"
+)
+
+// Change is one row written to the database, as published by the change
+// feed. Before is the row as it was, for updates and deletes, and After the
+// row as it is, for inserts and updates. Both are copies of the stored rows
+// without their hidden keys; the id is RowID.
+type Change struct {
+	// Position identifies the change within the feed. Subscribing from it
+	// resumes with the change after it.
+	Position string
+	Kind     ChangeKind
+	Table    string
+	RowID    int64
+	Before   Row `json:",omitempty"`
+	After    Row `json:",omitempty"`
+	Time     time.Time
+}
+
+// changeFeed keeps the latest changes of a database in the order they were
+// made. Changes are published under the lock of their table, and the feed's
+// own lock is taken last, so the order of the changes to a table is the
+// order they were applied in.
+//
+// Positions are "<epoch>-<seq>": the time the database was opened, in hex,
+// and the change's number since then. The feed is not persisted, so
+// positions from before a reopen cannot be resumed from.
+type changeFeed struct {
+	mu     sync.Mutex
+	wake   *sync.Cond
+	epoch  int64
+	first  uint64
+	log    []Change
+	closed bool
+}
+
+func (f *changeFeed) open() {
+	f.wake = sync.NewCond(&f.mu)
+	f.epoch = time.Now().UnixNano()
+	f.first = 1
+}
+
+// next returns the number the next change will get. The caller must hold
+// f.mu.
+func (f *changeFeed) next() uint64 {
+	return f.first + uint64(len(f.log))
+}
+
+func (f *changeFeed) position(seq uint64) string {
+	return strconv.FormatInt(f.epoch, 16) + "-" + strconv.FormatUint(seq, 10)
+}
+
+// parse returns the number of the change after the one at pos.
+func (f *changeFeed) parse(pos string) (uint64, error) {
+	epoch, seq, ok := strings.Cut(pos, "-")
+	e, err1 := strconv.ParseInt(epoch, 16, 64)
+	n, err2 := strconv.ParseUint(seq, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid change position: %s", pos)
+	}
+	if e != f.epoch || n+1 < f.first || n >= f.next() {
+		return 0, fmt.Errorf("change position expired: %s", pos)
+	}
+	return n + 1, nil
+}
+
+// publish appends a change for every row of befores and afters, which are
+// paired by position when both are given. Once the log holds twice size
+// changes, the older half is dropped.
+func (f *changeFeed) publish(size int, table string, kind ChangeKind, befores, afters []Row) {
+	n := max(len(befores), len(afters))
+	if n == 0 {
+		return
+	}
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	for i := 0; i < n; i++ {
+		c := Change{Position: f.position(f.next()), Kind: kind, Table: table, Time: now}
+		if i < len(befores) {
+			c.Before = befores[i]
+			c.RowID, _ = RowID(c.Before)
+		}
+		if i < len(afters) {
+			c.After = afters[i]
+			c.RowID, _ = RowID(c.After)
+		}
+		f.log = append(f.log, c)
+	}
+	if len(f.log) >= 2*size {
+		drop := len(f.log) - size
+		f.log = append([]Change(nil), f.log[drop:]...)
+		f.first += uint64(drop)
+	}
+	f.wake.Broadcast()
+}
+
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	f.closed = true
+	f.wake.Broadcast()
+	f.mu.Unlock()
+}
+
+// publish adds the changes to the rows of t to the feed, and to its history
+// when it keeps one. The caller must hold the table's lock, so that changes
+// to a table are published in the order they are applied.
+func (t *Table) publish(kind ChangeKind, befores, afters []Row) {
+	t.recordLocked(befores, afters)
+	t.Db.changes.publish(t.Db.ChangeLogSize(), t.Name, kind, befores, afters)
+}
+
+// ChangeLogSize returns how many changes are kept for subscribers that fall
+// behind or resume from a position.
+func (db *Database) ChangeLogSize() int {
+	if db.Config != nil && db.Config.ChangeLogSize > 0 {
+		return db.Config.ChangeLogSize
+	}
+	return defaultChangeLogSize
+}
+
+// ChangePosition returns the position of the latest change. Subscribing
+// from it delivers only the changes made after this call.
+func (db *Database) ChangePosition() string {
+	f := &db.changes
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.position(f.next() - 1)
+}
+
+// Subscription delivers changes from the feed on C, in order. C is closed
+// when the subscription ends; Err then tells why.
+type Subscription struct {
+	C <-chan Change
+
+	c      chan Change
+	feed   *changeFeed
+	next   uint64
+	filter func(Change) bool
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// Subscribe delivers every change accepted by filter, or every change when
+// filter is nil, starting after the change at from. An empty from starts
+// with the next change made. Rows inserted and then updated or deleted are
+// delivered as each of those changes.
+//
+// Changes are kept for resuming as set by Config.ChangeLogSize; a position
+// older than that, or from before the database was reopened, is refused, and
+// a subscriber that falls that far behind is ended with an error. Schema
+// changes, migrations and dropped tables are not in the feed.
+func (db *Database) Subscribe(from string, filter func(Change) bool) (*Subscription, error) {
+	f := &db.changes
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil, errors.New("database closed")
+	}
+	next := f.next()
+	if from != "" {
+		var err error
+		if next, err = f.parse(from); err != nil {
+			f.mu.Unlock()
+			return nil, err
+		}
+	}
+	f.mu.Unlock()
+
+	c := make(chan Change, 64)
+	s := &Subscription{C: c, c: c, feed: f, next: next, filter: filter, done: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+// Close ends the subscription. Changes already on C may still be read.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.feed.mu.Lock()
+		s.feed.wake.Broadcast()
+		s.feed.mu.Unlock()
+	})
+}
+
+// Err returns why the subscription ended: nil after Close, otherwise the
+// error that ended it. It is only meaningful once C is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+func (s *Subscription) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Subscription) run() {
+	defer close(s.c)
+	f := s.feed
+	for {
+		f.mu.Lock()
+		for s.next >= f.next() && !f.closed && !s.stopped() {
+			f.wake.Wait()
+		}
+		switch {
+		case s.stopped():
+			f.mu.Unlock()
+			return
+		case s.next < f.first:
+			s.err = fmt.Errorf("change position expired: %s", f.position(s.next-1))
+			f.mu.Unlock()
+			return
+		case s.next >= f.next():
+			s.err = errors.New("database closed")
+			f.mu.Unlock()
+			return
+		}
+		batch := append([]Change(nil), f.log[s.next-f.first:]...)
+		s.next = f.next()
+		f.mu.Unlock()
+
+		for _, c := range batch {
+			if c.Before != nil {
+				c.Before = withoutHidden(c.Before)
+			}
+			if c.After != nil {
+				c.After = withoutHidden(c.After)
+			}
+			if s.filter != nil && !s.filter(c) {
+				continue
+			}
+			select {
+			case s.c <- c:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var patternCache sync.Map
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patternCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patternCache.Store(pattern, re)
+	return re, nil
+}
+
+// hasRules reports whether the field carries any value rule beyond its type.
+func (f Field) hasRules() bool {
+	return f.Min != nil || f.Max != nil || f.MinLength != nil || f.MaxLength != nil ||
+		f.Pattern != "" || len(f.Enum) > 0 || f.NotEmpty
+}
+
+func (f Field) sameRules(o Field) bool {
+	return reflect.DeepEqual(f.Min, o.Min) && reflect.DeepEqual(f.Max, o.Max) &&
+		reflect.DeepEqual(f.MinLength, o.MinLength) && reflect.DeepEqual(f.MaxLength, o.MaxLength) &&
+		f.Pattern == o.Pattern && reflect.DeepEqual(f.Enum, o.Enum) && f.NotEmpty == o.NotEmpty
+}
+
+func checkViolation(field, rule string, args ...interface{}) error {
+	if len(args) > 0 {
+		rule += " " + fmt.Sprint(args...)
+	}
+	return fmt.Errorf("check constraint violation: %s: %s", field, rule)
+}
+
+// Check validates v against the rules of the field. Null values only fail
+// NotEmpty, so nullable references and newly added fields pass.
+func (f Field) Check(v interface{}) error {
+	if f.NotEmpty && isEmpty(v) {
+		return checkViolation(f.Name, "not_empty")
+	}
+	if v == nil {
+		return nil
+	}
+
+	if f.Min != nil || f.Max != nil {
+		n, ok := toFloat(v)
+		if !ok {
+			return checkViolation(f.Name, "min/max requires a number")
+		}
+		if f.Min != nil && n < *f.Min {
+			return checkViolation(f.Name, "min", *f.Min)
+		}
+		if f.Max != nil && n > *f.Max {
+			return checkViolation(f.Name, "max", *f.Max)
+		}
+	}
+
+	if f.MinLength != nil || f.MaxLength != nil || f.Pattern != "" {
+		s, ok := v.(string)
+		if !ok {
+			return checkViolation(f.Name, "length/pattern requires a string")
+		}
+		n := utf8.RuneCountInString(s)
+		if f.MinLength != nil && n < *f.MinLength {
+			return checkViolation(f.Name, "min_length", *f.MinLength)
+		}
+		if f.MaxLength != nil && n > *f.MaxLength {
+			return checkViolation(f.Name, "max_length", *f.MaxLength)
+		}
+		if f.Pattern != "" {
+			re, err := compilePattern(f.Pattern)
+			if err != nil {
+				return checkViolation(f.Name, "pattern", err)
+			}
+			if !re.MatchString(s) {
+				return checkViolation(f.Name, "pattern", f.Pattern)
+			}
+		}
+	}
+
+	if len(f.Enum) > 0 {
+		key := IndexKey(v)
+		allowed := false
+		for _, e := range f.Enum {
+			if IndexKey(e) == key {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return checkViolation(f.Name, "enum", f.Enum)
+		}
+	}
+
+	return nil
+}
+
+// checkRow validates every field of row that carries rules.
+func (s *Schema) checkRow(row Row) error {
+	for _, f := range s.Fields {
+		if !f.hasRules() {
+			continue
+		}
+		if err := f.Check(row[f.Name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateFields(fields []Field) error {
+	for _, f := range fields {
+		if strings.ContainsRune(f.Name, 0) {
+			return fmt.Errorf("field name cannot contain NUL: %q", f.Name)
+		}
+		if f.Name == RowValidFromField || f.Name == RowValidToField {
+			return fmt.Errorf("field name is reserved for history: %s", f.Name)
+		}
+		if f.Pattern != "" {
+			if _, err := compilePattern(f.Pattern); err != nil {
+				return fmt.Errorf("invalid pattern for field %s: %v", f.Name, err)
+			}
+		}
+		if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+			return fmt.Errorf("field %s: min is greater than max", f.Name)
+		}
+		if f.MinLength != nil && f.MaxLength != nil && *f.MinLength > *f.MaxLength {
+			return fmt.Errorf("field %s: min_length is greater than max_length", f.Name)
+		}
+		if f.FullText && f.Type != FieldTypeString {
+			return fmt.Errorf("field %s: full_text needs a string field", f.Name)
+		}
+		if f.Type == FieldTypeVector && f.Dimensions <= 0 {
+			return fmt.Errorf("field %s: a vector field needs dimensions", f.Name)
+		}
+		if f.Type != FieldTypeVector && f.Dimensions != 0 {
+			return fmt.Errorf("field %s: dimensions need a vector field", f.Name)
+		}
+		if f.VectorIndex != "" && (f.Type != FieldTypeVector || f.VectorIndex != VectorIndexIVF) {
+			return fmt.Errorf("field %s: vector_index must be %q on a vector field", f.Name, VectorIndexIVF)
+		}
+		if f.Lists < 0 || f.Lists > 0 && f.VectorIndex == "" {
+			return fmt.Errorf("field %s: lists needs a vector index and cannot be negative", f.Name)
+		}
+		if f.Stored && f.Expr == "" {
+			return fmt.Errorf("field %s: stored needs an expression", f.Name)
+		}
+		if f.Expr != "" {
+			if _, err := compileExpr(f.Expr, fields); err != nil {
+				return fmt.Errorf("field %s: invalid expression: %v", f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func isEmpty(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return true
+	case string:
+		return strings.TrimSpace(x) == ""
+	case []interface{}:
+		return len(x) == 0
+	case map[string]interface{}:
+		return len(x) == 0
+	case []byte:
+		return len(x) == 0
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case bool:
+		return 0, false
+	case Decimal:
+		f, _ := x.Rat().Float64()
+		return f, true
+	}
+	n, ok := IndexKey(v).(float64)
+	return n, ok
+}
+
+// countRuleViolations returns how many rows would fail the rules of f.
+func (t *Table) countRuleViolations(f Field) int {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+
+	n := 0
+	t.eachRowLocked(func(row Row) {
+		if v, ok := row[f.Name]; ok && f.Check(v) != nil {
+			n++
+		}
+	})
+	return n
+}
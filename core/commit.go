@@ -0,0 +1,126 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/ikwerre-dev/EmojiDB/storage"
+)
+
+const pendingSuffix = ".migrate"
+
+// commitLocked replaces the data file and the schema file as one unit. Both
+// are written next to the originals first; the data file is renamed into
+// place before the schema, so recoverPending can tell how far a crash got.
+// The caller must hold db.Mu.
+func (db *Database) commitLocked() error {
+	schemaPath := db.Path + ".schema.json"
+	dataTmp := db.Path + pendingSuffix
+	schemaTmp := schemaPath + pendingSuffix
+
+	schemaData, err := json.MarshalIndent(db.Schemas, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(dataTmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(dataTmp)
+		os.Remove(schemaTmp)
+		return err
+	}
+
+	if err := storage.WriteHeader(file); err != nil {
+		return fail(err)
+	}
+	for tableName, table := range db.Tables {
+		table.Mu.RLock()
+		table.unsaveVectors()
+		for _, clump := range table.SealedClumps {
+			if len(clump.Rows) == 0 {
+				continue
+			}
+			if err := db.writeClumpLocked(file, tableName, clump, table.clumpIndexes(clump.Rows)); err != nil {
+				table.Mu.RUnlock()
+				return fail(err)
+			}
+		}
+		if err := db.writeVersionsLocked(file, tableName, table.savedVersions()); err != nil {
+			table.Mu.RUnlock()
+			return fail(err)
+		}
+		table.Mu.RUnlock()
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := writeSynced(schemaTmp, schemaData); err != nil {
+		return fail(err)
+	}
+
+	if err := os.Rename(dataTmp, db.Path); err != nil {
+		return fail(err)
+	}
+	syncDir(db.Path)
+	if err := os.Rename(schemaTmp, schemaPath); err != nil {
+		file.Close()
+		return err
+	}
+	syncDir(db.Path)
+
+	schFile, err := os.OpenFile(schemaPath, os.O_RDWR, 0600)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	db.File.Close()
+	db.SchemaFile.Close()
+	db.File = file
+	db.SchemaFile = schFile
+	return nil
+}
+
+// recoverPending finishes or discards a commit interrupted by a crash. A
+// pending data file means the old files are still intact; a pending schema
+// file alone means the new data file is already in place.
+func recoverPending(path string) error {
+	dataTmp := path + pendingSuffix
+	schemaTmp := path + ".schema.json" + pendingSuffix
+
+	if _, err := os.Stat(dataTmp); err == nil {
+		os.Remove(schemaTmp)
+		return os.Remove(dataTmp)
+	}
+	if _, err := os.Stat(schemaTmp); err == nil {
+		return os.Rename(schemaTmp, path+".schema.json")
+	}
+	return nil
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(path string) {
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
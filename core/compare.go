@@ -0,0 +1,118 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// valueRank orders values of different kinds: null, bools, numbers and
+// decimals, strings, timestamps, bytes, arrays, then objects.
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case Decimal:
+		return 2
+	case string:
+		return 3
+	case time.Time:
+		return 4
+	case []byte:
+		return 5
+	case []interface{}:
+		return 6
+	case map[string]interface{}, Row:
+		return 7
+	}
+	if _, ok := toFloat(v); ok {
+		return 2
+	}
+	return 8
+}
+
+// Compare orders two stored values, returning -1, 0 or 1. Numbers of any Go
+// type compare by value, decimals exactly, timestamps by instant, arrays
+// element by element and objects by their JSON form. Values of different
+// kinds are ordered by kind so sorting never fails.
+func Compare(a, b interface{}) int {
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch ra {
+	case 0:
+		return 0
+	case 1:
+		x, y := a.(bool), b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case 2:
+		da, aDec := a.(Decimal)
+		db, bDec := b.(Decimal)
+		if aDec || bDec {
+			return numberRat(a, da, aDec).Cmp(numberRat(b, db, bDec))
+		}
+		x, _ := toFloat(a)
+		y, _ := toFloat(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case 3:
+		return strings.Compare(a.(string), b.(string))
+	case 4:
+		return a.(time.Time).Compare(b.(time.Time))
+	case 5:
+		return bytes.Compare(a.([]byte), b.([]byte))
+	case 6:
+		x, y := a.([]interface{}), b.([]interface{})
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := Compare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		switch {
+		case len(x) < len(y):
+			return -1
+		case len(x) > len(y):
+			return 1
+		}
+		return 0
+	}
+
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Compare(ja, jb)
+}
+
+// Equal reports whether two stored values are the same under Compare.
+func Equal(a, b interface{}) bool {
+	return Compare(a, b) == 0
+}
+
+func numberRat(v interface{}, d Decimal, isDecimal bool) *big.Rat {
+	if isDecimal {
+		return d.Rat()
+	}
+	n, _ := toFloat(v)
+	r := new(big.Rat)
+	r.SetFloat64(n)
+	return r
+}
@@ -0,0 +1,144 @@
+package core
+
+import "fmt"
+
+// compute returns the value of a computed field for row.
+func (f Field) compute(row Row) (interface{}, error) {
+	e, err := parseExpr(f.Expr)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %v", f.Name, err)
+	}
+	v, err := e.eval(row)
+	if err == nil {
+		v, err = computedValue(v, f.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %v", f.Name, err)
+	}
+	return v, nil
+}
+
+// hasComputed reports whether any field of the schema is computed.
+func (s *Schema) hasComputed() bool {
+	for _, f := range s.Fields {
+		if f.Expr != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// computeRow sets the computed fields of row, which must already be
+// normalized, from the fields they read.
+func (s *Schema) computeRow(row Row) error {
+	for _, f := range s.Fields {
+		if f.Expr == "" {
+			continue
+		}
+		v, err := f.compute(row)
+		if err != nil {
+			return err
+		}
+		row[f.Name] = v
+	}
+	return nil
+}
+
+// virtualFields returns the computed fields that are not stored.
+func (s *Schema) virtualFields() []string {
+	var names []string
+	for _, f := range s.Fields {
+		if f.Expr != "" && !f.Stored {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// withoutVirtual returns clump as it is written to disk: without the
+// values of the virtual fields of schema, which may be nil.
+func withoutVirtual(schema *Schema, clump *SealedClump) *SealedClump {
+	if schema == nil {
+		return clump
+	}
+	virtual := schema.virtualFields()
+	if len(virtual) == 0 {
+		return clump
+	}
+	copied := *clump
+	copied.Rows = make([]Row, len(clump.Rows))
+	for i, row := range clump.Rows {
+		out := make(Row, len(row))
+		for k, v := range row {
+			out[k] = v
+		}
+		for _, name := range virtual {
+			delete(out, name)
+		}
+		copied.Rows[i] = out
+	}
+	return &copied
+}
+
+// computeLoadedLocked fills in the computed fields of rows read from disk:
+// every virtual field, and stored fields the rows were written without.
+// Rows that fail to compute get null. The caller must hold the table's
+// lock, before the rows are indexed.
+func (t *Table) computeLoadedLocked() {
+	var computed []Field
+	for _, f := range t.Schema.Fields {
+		if f.Expr != "" {
+			computed = append(computed, f)
+		}
+	}
+	if len(computed) == 0 {
+		return
+	}
+	for _, clump := range t.SealedClumps {
+		for _, row := range clump.Rows {
+			for _, f := range computed {
+				if _, ok := row[f.Name]; ok && f.Stored {
+					continue
+				}
+				row[f.Name], _ = f.compute(row)
+			}
+		}
+	}
+}
+
+// recomputeLocked brings the computed fields of every row up to date with
+// the schema, giving null to those that fail to compute. It reports whether
+// a sealed clump changed. The caller must hold the table's lock.
+func (t *Table) recomputeLocked() bool {
+	if !t.Schema.hasComputed() {
+		return false
+	}
+	var olds, news []Row
+	t.eachRowLocked(func(row Row) {
+		next := merged(row, nil)
+		for _, f := range t.Schema.Fields {
+			if f.Expr != "" {
+				next[f.Name], _ = f.compute(next)
+			}
+		}
+		if !sameValues(row, next) {
+			olds = append(olds, row)
+			news = append(news, next)
+		}
+	})
+	return t.replaceLocked(olds, news)
+}
+
+// countComputeFailures returns how many rows f fails to compute for.
+func (t *Table) countComputeFailures(f Field) int {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+
+	n := 0
+	t.eachRowLocked(func(row Row) {
+		if _, err := f.compute(row); err != nil {
+			n++
+		}
+	})
+	return n
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,6 +19,12 @@ type Config struct {
 	MemoryLimitMB   int
 	ClumpSizeMB     int
 	FlushIntervalMS int
+	// ScanWorkers bounds how many clumps a query or count scans at once.
+	// Zero uses one worker per CPU.
+	ScanWorkers int
+	// ChangeLogSize is how many changes are kept for subscribers to resume
+	// from. Zero keeps 10000.
+	ChangeLogSize int
 }
 
 type Database struct {
@@ -33,6 +40,19 @@ type Database struct {
 	Orphans    map[string][]*SealedClump
 	SyncSafety bool
 	stopFlush  chan struct{}
+	// segments holds the full-text postings read from the data file until
+	// their table is set up.
+	segments map[string][]textSegment
+	// vectorSegments does the same for the lists of vector indexes.
+	vectorSegments map[string][]vectorSegment
+	// versionSegments does the same for the past versions of rows.
+	versionSegments map[string][]Row
+	// changes is the feed of row changes; see Subscribe.
+	changes changeFeed
+	// triggers holds the triggers added in Go, by table.
+	triggers map[string][]*Trigger
+	// views keeps the materialized views up to date.
+	views viewMaintainer
 }
 
 type Table struct {
@@ -42,7 +62,20 @@ type Table struct {
 	Schema        *Schema
 	HotHeap       *HotHeap
 	SealedClumps  []*SealedClump
-	UniqueIndices map[string]map[interface{}]struct{}
+	UniqueIndices map[string]map[interface{}]Row
+	upgraded      int
+	nextID        int64
+	// text holds the full-text index of each FullText field.
+	text map[string]*textIndex
+	// vectors holds the approximate index of each indexed vector field.
+	vectors map[string]*vectorIndex
+	// versions holds the past versions of the rows, in the order they were
+	// replaced, when the table keeps history. The first versionsSaved of
+	// them are in the data file.
+	versions      []Row
+	versionsSaved int
+	// rules holds the triggers compiled from the schema's rules.
+	rules ruleCache
 }
 
 func Open(path, key string) (*Database, error) {
@@ -59,6 +92,10 @@ func Open(path, key string) (*Database, error) {
 	baseName := filepath.Base(path)
 	fullPath := filepath.Join(dir, baseName)
 
+	if err := recoverPending(fullPath); err != nil {
+		return nil, fmt.Errorf("failed to recover interrupted migration: %v", err)
+	}
+
 	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
@@ -91,6 +128,7 @@ func Open(path, key string) (*Database, error) {
 		Orphans:    make(map[string][]*SealedClump),
 		SyncSafety: true,
 	}
+	db.changes.open()
 
 	// Read header and load orphans/clumps
 	if err := db.Load(); err != nil {
@@ -104,28 +142,51 @@ func Open(path, key string) (*Database, error) {
 	if err := db.LoadSchemas(); err != nil {
 		// Non-fatal if schema file is new/empty
 	}
+	db.startViews()
 
 	return db, nil
 }
 
-func (db *Database) DefineSchema(tableName string, fields []Field) error {
+func (db *Database) DefineSchema(tableName string, fields []Field, constraints ...Constraint) error {
+	if err := validateFields(fields); err != nil {
+		return err
+	}
+	if err := validateConstraints(fields, constraints); err != nil {
+		return err
+	}
+
 	db.Mu.Lock()
 	if db.Schemas == nil {
 		db.Schemas = make(map[string]*Schema)
 	}
-	schema := &Schema{Version: 1, Fields: fields}
+	if err := db.validateForeignKeys(tableName, fields, constraints); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	if err := db.reshapeLocked(tableName, fields); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	changes := []string{"TABLE_NEW: table defined"}
+	if _, exists := db.Schemas[tableName]; exists {
+		changes = []string{"TABLE_REDEFINE: schema replaced by define_schema"}
+	}
+	schema := nextSchema(db.Schemas[tableName], fields, constraints, changes)
 	db.Schemas[tableName] = schema
 
-	indices := make(map[string]map[interface{}]struct{})
-	for _, f := range fields {
-		if f.Unique {
-			indices[f.Name] = make(map[interface{}]struct{})
-		}
-	}
+	indices := newUniqueIndices(schema.uniqueKeys())
 
+	rewrite := false
 	if table, ok := db.Tables[tableName]; ok {
+		table.Mu.Lock()
 		table.Schema = schema
 		table.UniqueIndices = indices
+		table.text = newTextIndexes(schema)
+		table.vectors = newVectorIndexes(schema)
+		table.eachRowLocked(table.indexRow)
+		rewrite = table.recomputeLocked()
+		table.trainVectorsLocked()
+		table.Mu.Unlock()
 	} else {
 		db.Tables[tableName] = &Table{
 			Db:            db,
@@ -134,39 +195,43 @@ func (db *Database) DefineSchema(tableName string, fields []Field) error {
 			HotHeap:       NewHotHeap(1000),
 			SealedClumps:  make([]*SealedClump, 0),
 			UniqueIndices: indices,
+			text:          newTextIndexes(schema),
+			vectors:       newVectorIndexes(schema),
 		}
 
 		// Restore orphans if any
 		if orphans, ok := db.Orphans[tableName]; ok {
 			fmt.Printf("   Restoring %d clumps for table '%s'\n", len(orphans), tableName)
-			db.Tables[tableName].SealedClumps = orphans
-			// Populate unique indices from restored data
-			for _, clump := range orphans {
-				for _, row := range clump.Rows {
-					for _, f := range fields {
-						if f.Unique {
-							val := row[f.Name]
-							db.Tables[tableName].UniqueIndices[f.Name][val] = struct{}{}
-						}
-					}
-				}
-			}
-			delete(db.Orphans, tableName)
+			db.Tables[tableName].restoreLocked(orphans)
 		}
 	}
 	db.Mu.Unlock()
 
-	return db.SaveSchemas()
+	if err := db.SaveSchemas(); err != nil {
+		return err
+	}
+	if rewrite {
+		// Stored fields of sealed rows changed.
+		if err := db.Rewrite(); err != nil {
+			return err
+		}
+	}
+	return db.refreshViewsOf(tableName)
 }
 
-func (db *Database) DiffSchema(tableName string, newFields []Field) ConflictReport {
+func (db *Database) DiffSchema(tableName string, newFields []Field, constraints ...Constraint) ConflictReport {
 	db.Mu.RLock()
-	currentSchema, ok := db.Schemas[tableName]
-	db.Mu.RUnlock()
+	defer db.Mu.RUnlock()
+	return db.diffLocked(tableName, db.Schemas[tableName], db.Tables[tableName], newFields, constraints)
+}
 
+// diffLocked compares currentSchema and the rows of table against the new
+// definition. table may be a staged copy that is not registered in the
+// database. The caller must hold db.Mu.
+func (db *Database) diffLocked(tableName string, currentSchema *Schema, table *Table, newFields []Field, constraints []Constraint) ConflictReport {
 	report := ConflictReport{Compatiable: true}
 
-	if !ok {
+	if currentSchema == nil {
 		report.Conflicts = append(report.Conflicts, "TABLE_NEW: table does not exist on disk")
 		return report
 	}
@@ -184,11 +249,52 @@ func (db *Database) DiffSchema(tableName string, newFields []Field) ConflictRepo
 				report.Compatiable = false
 				report.Conflicts = append(report.Conflicts, fmt.Sprintf("TYPE_MISMATCH: field '%s' change from %v to %v", f.Name, oldF.Type, f.Type))
 			}
+			if !oldF.sameRules(f) && f.hasRules() && table != nil {
+				if n := table.countRuleViolations(f); n > 0 {
+					report.Compatiable = false
+					report.Destructive = true
+					report.Conflicts = append(report.Conflicts, fmt.Sprintf("CHECK_VIOLATION: %d rows violate the rules of field '%s' and will be dropped", n, f.Name))
+				} else {
+					report.Conflicts = append(report.Conflicts, fmt.Sprintf("CHECK_CHANGE: rules of field '%s' change, existing rows comply", f.Name))
+				}
+			}
 		} else {
 			report.Conflicts = append(report.Conflicts, fmt.Sprintf("FIELD_ADD: new field '%s' will be added", f.Name))
 		}
 	}
 
+	for _, f := range newFields {
+		if f.Expr == "" {
+			continue
+		}
+		e, err := compileExpr(f.Expr, newFields)
+		if err != nil {
+			report.Compatiable = false
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("COMPUTE_INVALID: field '%s' cannot be computed: %v", f.Name, err))
+			continue
+		}
+		// The field is computed again when it or its inputs change.
+		oldF, exists := currentFieldMap[f.Name]
+		changed := !exists || oldF.Expr != f.Expr || oldF.Type != f.Type
+		for _, in := range e.inputs {
+			if oldIn, ok := currentFieldMap[in]; !ok || oldIn.Type != newFieldMap[in].Type || oldIn.Expr != "" {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if table != nil {
+			if n := table.countComputeFailures(f); n > 0 {
+				report.Compatiable = false
+				report.Destructive = true
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("COMPUTE_FAILURE: %d rows fail to compute field '%s' and will be dropped", n, f.Name))
+				continue
+			}
+		}
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf("COMPUTE_CHANGE: field '%s' will be computed from (%s)", f.Name, strings.Join(e.inputs, ", ")))
+	}
+
 	for oldName := range currentFieldMap {
 		if _, exists := newFieldMap[oldName]; !exists {
 			report.Destructive = true
@@ -196,11 +302,66 @@ func (db *Database) DiffSchema(tableName string, newFields []Field) ConflictRepo
 		}
 	}
 
+	currentKeys := make(map[string]bool)
+	for _, k := range currentSchema.uniqueKeys() {
+		currentKeys[strings.Join(k.Fields, ",")] = true
+	}
+	for _, k := range uniqueKeysOf(newFields, constraints) {
+		if currentKeys[strings.Join(k.Fields, ",")] {
+			continue
+		}
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf("UNIQUE_ADD: unique index '%s' on (%s) will be enforced", k.Name, strings.Join(k.Fields, ", ")))
+		if table == nil {
+			continue
+		}
+		if dups := table.countDuplicates(k); dups > 0 {
+			report.Compatiable = false
+			report.Destructive = true
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("UNIQUE_VIOLATION: %d rows collide on '%s' and will be dropped", dups, k.Name))
+		}
+	}
+
+	currentFKs := make(map[string]bool)
+	for _, c := range currentSchema.Constraints {
+		if c.Kind == ConstraintForeignKey {
+			currentFKs[c.IndexName()+"->"+c.RefTable] = true
+		}
+	}
+	for _, c := range constraints {
+		if c.Kind != ConstraintForeignKey {
+			continue
+		}
+		if currentFKs[c.IndexName()+"->"+c.RefTable] {
+			delete(currentFKs, c.IndexName()+"->"+c.RefTable)
+			continue
+		}
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf("FOREIGN_KEY_ADD: (%s) will reference %s(%s)", strings.Join(c.Fields, ", "), c.RefTable, strings.Join(c.RefFields, ", ")))
+		parent, ok := db.Tables[c.RefTable]
+		if table == nil || !ok || parent == table || c.RefTable == tableName {
+			continue
+		}
+		if orphans := countOrphans(table, parent, c); orphans > 0 {
+			report.Compatiable = false
+			report.Destructive = true
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("FOREIGN_KEY_VIOLATION: %d rows reference missing %s rows and will be dropped", orphans, c.RefTable))
+		}
+	}
+	for name := range currentFKs {
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf("FOREIGN_KEY_REMOVE: %s will no longer be enforced", name))
+	}
+
 	return report
 }
 
-func (db *Database) SyncSchema(tableName string, newFields []Field, force bool) error {
-	report := db.DiffSchema(tableName, newFields)
+func (db *Database) SyncSchema(tableName string, newFields []Field, force bool, constraints ...Constraint) error {
+	if err := validateFields(newFields); err != nil {
+		return err
+	}
+	if err := validateConstraints(newFields, constraints); err != nil {
+		return err
+	}
+
+	report := db.DiffSchema(tableName, newFields, constraints...)
 	if !report.Compatiable {
 		if !force {
 			return fmt.Errorf("incompatible schema change: %v", report.Conflicts)
@@ -209,96 +370,160 @@ func (db *Database) SyncSchema(tableName string, newFields []Field, force bool)
 	}
 
 	db.Mu.Lock()
-	schema := &Schema{Version: 1, Fields: newFields}
+	if err := db.validateForeignKeys(tableName, newFields, constraints); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	if err := db.reshapeLocked(tableName, newFields); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	schema := nextSchema(db.Schemas[tableName], newFields, constraints, report.Conflicts)
 	db.Schemas[tableName] = schema
 
 	if table, ok := db.Tables[tableName]; ok {
-		table.Schema = schema
+		table.Mu.Lock()
+		db.applySchemaLocked(table, schema, nil)
+		table.Mu.Unlock()
+	}
+	db.Mu.Unlock()
 
-		// Update unique indices definition
-		indices := make(map[string]map[interface{}]struct{})
-		for _, f := range newFields {
-			if f.Unique {
-				indices[f.Name] = make(map[interface{}]struct{})
-			}
+	if force {
+		if err := db.Rewrite(); err != nil {
+			return err
 		}
-		table.UniqueIndices = indices
+	}
+
+	if err := db.SaveSchemas(); err != nil {
+		return err
+	}
+	return db.refreshViewsOf(tableName)
+}
 
-		filterRows := func(rows []Row) []Row {
-			var valid []Row
-			for _, row := range rows {
-				keep := true
-				prunedRow := make(Row)
-
-				for _, f := range newFields {
-					val, exists := row[f.Name]
-					if exists {
-						if f.Unique {
-							if _, seen := indices[f.Name][val]; seen {
-								keep = false
-								break
-							}
-							indices[f.Name][val] = struct{}{}
-						}
-						prunedRow[f.Name] = val
+// applySchemaLocked moves table onto schema: rows keep only the fields of the
+// schema, and rows breaking a unique key, a foreign key or a field rule are
+// dropped and passed to onDrop, which may be nil. The caller must hold db.Mu
+// and the table's lock.
+func (db *Database) applySchemaLocked(table *Table, schema *Schema, onDrop func(row Row, kind ConflictKind, name string)) {
+	table.Schema = schema
+
+	// Update unique indices definition
+	keys := schema.uniqueKeys()
+	indices := newUniqueIndices(keys)
+	table.UniqueIndices = indices
+	table.text = newTextIndexes(schema)
+	table.vectors = newVectorIndexes(schema)
+
+	// Rows pointing at missing parents are pruned like duplicates.
+	// Self references are left alone since the index is being rebuilt.
+	var fks []foreignKey
+	for _, c := range schema.Constraints {
+		if c.Kind != ConstraintForeignKey || c.RefTable == table.Name {
+			continue
+		}
+		parent, ok := db.Tables[c.RefTable]
+		if !ok {
+			continue
+		}
+		if pk, ok := parent.Schema.uniqueKeyFor(c.RefFields); ok {
+			fks = append(fks, foreignKey{Constraint: c, child: table, parent: parent, parentKey: pk})
+		}
+	}
+
+	drop := func(row Row, kind ConflictKind, name string) {
+		if onDrop != nil {
+			onDrop(row, kind, name)
+		}
+	}
+
+	filterRows := func(rows []Row) []Row {
+		var valid []Row
+	rowLoop:
+		for _, row := range rows {
+			prunedRow := Row{}
+			for k, v := range row {
+				if hidden(k) {
+					prunedRow[k] = v
+				}
+			}
+			for _, f := range schema.Fields {
+				if val, exists := row[f.Name]; exists && f.Expr == "" {
+					prunedRow[f.Name] = val
+					if f.Check(val) != nil {
+						drop(row, ConflictCheckViolation, f.Name)
+						continue rowLoop
 					}
 				}
-
-				if keep {
-					valid = append(valid, prunedRow)
+			}
+			// Computed fields are derived again, from the fields kept.
+			for _, f := range schema.Fields {
+				if f.Expr == "" {
+					continue
+				}
+				val, err := f.compute(prunedRow)
+				if err != nil {
+					drop(row, ConflictComputeFailure, f.Name)
+					continue rowLoop
+				}
+				prunedRow[f.Name] = val
+				if f.Check(val) != nil {
+					drop(row, ConflictCheckViolation, f.Name)
+					continue rowLoop
+				}
+			}
+			for _, fk := range fks {
+				if fk.check(prunedRow) != nil {
+					drop(row, ConflictForeignKeyViolation, fk.IndexName())
+					continue rowLoop
+				}
+			}
+			for _, k := range keys {
+				if _, seen := indices[k.Name][k.key(prunedRow)]; seen {
+					drop(row, ConflictUniqueViolation, k.Name)
+					continue rowLoop
 				}
 			}
-			return valid
-		}
 
-		for _, clump := range table.SealedClumps {
-			clump.Rows = filterRows(clump.Rows)
-			clump.Metadata.RowCount = len(clump.Rows)
+			table.indexRow(prunedRow)
+			valid = append(valid, prunedRow)
 		}
-
-		table.HotHeap.Rows = filterRows(table.HotHeap.Rows)
+		return valid
 	}
-	db.Mu.Unlock()
 
-	if force {
-		return db.Rewrite()
+	for _, clump := range table.SealedClumps {
+		clump.Rows = filterRows(clump.Rows)
+		clump.Metadata.RowCount = len(clump.Rows)
+		clump.Metadata.SchemaVersion = schema.Version
 	}
+	table.upgraded = schema.Version
 
-	return db.SaveSchemas()
+	table.HotHeap.Rows = filterRows(table.HotHeap.Rows)
+	table.trainVectorsLocked()
 }
 
 func (db *Database) Count(tableName string, match map[string]interface{}) (int, error) {
-	db.Mu.RLock()
-	table, ok := db.Tables[tableName]
-	db.Mu.RUnlock()
-
-	if !ok {
-		return 0, errors.New("table not found: " + tableName)
+	table, err := db.Table(tableName)
+	if err != nil {
+		return 0, err
 	}
 
-	table.Mu.RLock()
-	defer table.Mu.RUnlock()
-
-	count := 0
-	check := func(r Row) {
-		matchCount := 0
-		for k, v := range match {
-			if r[k] == v {
-				matchCount++
-			}
-		}
-		if matchCount == len(match) {
-			count++
-		}
+	// Counting reads a snapshot, so it never holds up writers.
+	snap := table.Snapshot()
+	matches, err := snap.Schema.Matcher(match)
+	if err != nil {
+		return 0, err
 	}
-
-	for _, clump := range table.SealedClumps {
-		for _, row := range clump.Rows {
-			check(row)
+	counts := make([]int, snap.Batches())
+	parallel(snap.Batches(), db.ScanWorkers(), func(i int) {
+		for _, row := range snap.batches[i] {
+			if snap.visible(row) && matches(row) {
+				counts[i]++
+			}
 		}
-	}
-	for _, row := range table.HotHeap.Rows {
-		check(row)
+	})
+	count := 0
+	for _, n := range counts {
+		count += n
 	}
 
 	return count, nil
@@ -306,6 +531,17 @@ func (db *Database) Count(tableName string, match map[string]interface{}) (int,
 
 func (db *Database) DropTable(tableName string) error {
 	db.Mu.Lock()
+	_, incoming := db.foreignKeyGraph()
+	for _, fk := range incoming[tableName] {
+		if fk.child.Name != tableName {
+			db.Mu.Unlock()
+			return fmt.Errorf("cannot drop %s: referenced by foreign key %s.%s", tableName, fk.child.Name, fk.IndexName())
+		}
+	}
+	if views := db.viewsOfLocked(tableName); len(views) > 0 {
+		db.Mu.Unlock()
+		return fmt.Errorf("cannot drop %s: view %s reads it", tableName, views[0].Name)
+	}
 	delete(db.Schemas, tableName)
 	delete(db.Tables, tableName)
 	db.Mu.Unlock()
@@ -333,15 +569,21 @@ func (db *Database) Rewrite() error {
 
 	for tableName, table := range db.Tables {
 		table.Mu.RLock()
+		table.unsaveVectors()
 		for _, clump := range table.SealedClumps {
 			if len(clump.Rows) == 0 {
 				continue
 			}
-			if err := storage.InternalPersistClump(db.File, tableName, clump, db.Key, crypto.Encrypt, crypto.EncodeToEmojis); err != nil {
+			if err := db.writeClumpLocked(db.File, tableName, clump, table.clumpIndexes(clump.Rows)); err != nil {
 				table.Mu.RUnlock()
 				return err
 			}
 		}
+		// Versions not yet saved are written by the next flush.
+		if err := db.writeVersionsLocked(db.File, tableName, table.savedVersions()); err != nil {
+			table.Mu.RUnlock()
+			return err
+		}
 		table.Mu.RUnlock()
 	}
 
@@ -349,6 +591,16 @@ func (db *Database) Rewrite() error {
 }
 
 func (db *Database) Insert(tableName string, record Row) error {
+	return db.insert(tableName, []Row{record}, false)
+}
+
+// BulkInsert inserts records all or none: the whole batch is checked before
+// any of it is applied.
+func (db *Database) BulkInsert(tableName string, records []Row) error {
+	return db.insert(tableName, records, true)
+}
+
+func (db *Database) insert(tableName string, records []Row, bulk bool) error {
 	db.Mu.RLock()
 	table, ok := db.Tables[tableName]
 	db.Mu.RUnlock()
@@ -357,123 +609,193 @@ func (db *Database) Insert(tableName string, record Row) error {
 		return errors.New("table not found: " + tableName)
 	}
 
-	table.Mu.Lock()
-	defer table.Mu.Unlock()
+	outgoing, _ := db.foreignKeys(tableName)
+	tx := db.begin(table)
+	release := lockParents(table, outgoing, tx.held)
+	tx.lock(table)
+	err := tx.end(table.insertLocked(tx, records, outgoing, bulk))
+	tx.unlock(table)
+	release()
+	return tx.close(err)
+}
 
-	// Check constraints
-	for _, field := range table.Schema.Fields {
-		val, ok := record[field.Name]
-		if !ok {
-			return errors.New("missing field: " + field.Name)
+// insertLocked checks records and adds them to the table. Errors of a bulk
+// insert name the record they are about. The caller must hold the table's
+// lock and read locks on its parents.
+func (t *Table) insertLocked(tx *Tx, records []Row, outgoing []foreignKey, bulk bool) error {
+	if err := t.writable(); err != nil {
+		return err
+	}
+	fail := func(i int, err error) error {
+		if bulk {
+			return fmt.Errorf("row %d: %v", i, err)
 		}
+		return err
+	}
+	// Before triggers may replace records, and the caller's maps are left
+	// alone.
+	records = append([]Row(nil), records...)
 
-		if field.Unique {
-			if _, exists := table.UniqueIndices[field.Name][val]; exists {
-				return errors.New("unique constraint violation: " + field.Name)
-			}
+	// 1. Validation Phase (All or Nothing)
+	for i, record := range records {
+		ev := &HookEvent{Kind: ChangeInsert, Table: t.Name, After: merged(record, nil)}
+		if err := tx.before(t, ev); err != nil {
+			return fail(i, err)
 		}
-	}
+		record = ev.After
+		records[i] = record
 
-	// Apply unique indices
-	for _, field := range table.Schema.Fields {
-		if field.Unique {
-			table.UniqueIndices[field.Name][record[field.Name]] = struct{}{}
+		for _, field := range t.Schema.Fields {
+			if _, ok := record[field.Name]; !ok && field.Expr == "" {
+				return fail(i, errors.New("missing field: "+field.Name))
+			}
+		}
+		if err := t.Schema.normalizeRow(record); err != nil {
+			return fail(i, err)
+		}
+		if err := t.Schema.computeRow(record); err != nil {
+			return fail(i, err)
+		}
+		if err := t.Schema.checkRow(record); err != nil {
+			return fail(i, err)
+		}
+		if err := t.checkUnique(record, nil); err != nil {
+			return fail(i, err)
+		}
+		if err := checkForeignKeys(outgoing, record); err != nil {
+			return fail(i, err)
+		}
+		// Also check against other rows in this batch to prevent duplicates within the batch
+		for _, k := range t.Schema.uniqueKeys() {
+			key := k.key(record)
+			for j := 0; j < i; j++ {
+				if k.key(records[j]) == key {
+					return fail(i, errors.New("duplicate value in batch for field: "+k.Name))
+				}
+			}
 		}
 	}
 
-	table.HotHeap.Rows = append(table.HotHeap.Rows, record)
-
-	if len(table.HotHeap.Rows) >= table.HotHeap.MaxRows {
-		// Auto-flush
-		// Actually table.Mu is held.
-		// Let's do a safe auto-flush.
-		clump := &SealedClump{
-			Rows:     table.HotHeap.Rows,
-			SealedAt: time.Now(),
-			Metadata: ClumpMetadata{
-				RowCount:      len(table.HotHeap.Rows),
-				CreatedAt:     table.HotHeap.CreatedAt,
-				SchemaVersion: table.Schema.Version,
-			},
+	// 2. Application Phase
+	changes := []change{{table: t, kind: ChangeInsert, afters: records}}
+	tx.apply(t, changes, func() bool {
+		for _, record := range records {
+			t.assignID(record)
+			t.Schema.stampInserted(record)
+			t.indexRow(record)
+			t.HotHeap.Rows = append(t.HotHeap.Rows, record)
 		}
-		table.SealedClumps = append(table.SealedClumps, clump)
-		table.HotHeap = NewHotHeap(1000)
+		return false
+	})
+	return tx.after(t, changes)
+}
 
-		// Persistence happens outside table lock to avoid deadlocks with db.Mu
-		go db.PersistClump(tableName, clump)
+// autoFlushLocked seals the HotHeap once it is full. The caller must hold
+// table.Mu; persistence happens outside the table lock to avoid deadlocks
+// with db.Mu.
+func (t *Table) autoFlushLocked() {
+	if len(t.HotHeap.Rows) < t.HotHeap.MaxRows {
+		return
 	}
-
-	return nil
+	clump := &SealedClump{
+		Rows:     t.HotHeap.Rows,
+		SealedAt: time.Now(),
+		Metadata: ClumpMetadata{
+			RowCount:      len(t.HotHeap.Rows),
+			CreatedAt:     t.HotHeap.CreatedAt,
+			SchemaVersion: t.Schema.Version,
+		},
+	}
+	t.SealedClumps = append(t.SealedClumps, clump)
+	t.HotHeap = NewHotHeap(1000)
+	t.trainVectorsLocked()
+	go t.Db.PersistClump(t.Name, clump)
 }
 
-func (db *Database) BulkInsert(tableName string, records []Row) error {
+func (db *Database) PersistClump(tableName string, clump *SealedClump) error {
+	// The indexes of the clump are read before taking db.Mu, since writers
+	// take db.Mu for safety backups while holding their table's lock.
 	db.Mu.RLock()
-	table, ok := db.Tables[tableName]
+	table := db.Tables[tableName]
 	db.Mu.RUnlock()
+	var idx clumpIndexes
+	if table != nil {
+		table.Mu.RLock()
+		idx = table.clumpIndexes(clump.Rows)
+		table.Mu.RUnlock()
+	}
 
-	if !ok {
-		return errors.New("table not found: " + tableName)
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	if err := db.writeClumpLocked(db.File, tableName, clump, idx); err != nil {
+		return err
 	}
+	return db.File.Sync()
+}
 
-	table.Mu.Lock()
-	defer table.Mu.Unlock()
+// clumpIndexes are the index records persisted after a clump: the full-text
+// postings and vector index lists of its rows, when the table has such
+// indexes.
+type clumpIndexes struct {
+	text    textSegment
+	vectors vectorSegment
+}
 
-	// 1. Validation Phase (All or Nothing)
-	for i, record := range records {
-		for _, field := range table.Schema.Fields {
-			val, ok := record[field.Name]
-			if !ok {
-				return fmt.Errorf("row %d: missing field: %s", i, field.Name)
-			}
-			if field.Unique {
-				if _, exists := table.UniqueIndices[field.Name][val]; exists {
-					return fmt.Errorf("row %d: unique constraint violation: %s", i, field.Name)
-				}
-				// Also check against other rows in this batch to prevent duplicates within the batch
-				for j := 0; j < i; j++ {
-					if records[j][field.Name] == val {
-						return fmt.Errorf("row %d: duplicate value in batch for field: %s", i, field.Name)
-					}
-				}
-			}
-		}
-	}
+// clumpIndexes builds the index records of rows. The caller must hold at
+// least the table's read lock.
+func (t *Table) clumpIndexes(rows []Row) clumpIndexes {
+	return clumpIndexes{text: t.segment(rows), vectors: t.vectorSegment(rows)}
+}
 
-	// 2. Application Phase
-	for _, record := range records {
-		for _, field := range table.Schema.Fields {
-			if field.Unique {
-				table.UniqueIndices[field.Name][record[field.Name]] = struct{}{}
-			}
-		}
-		table.HotHeap.Rows = append(table.HotHeap.Rows, record)
+// writeClumpLocked appends clump to file, followed by its index records. The
+// caller must hold db.Mu.
+func (db *Database) writeClumpLocked(file *os.File, tableName string, clump *SealedClump, idx clumpIndexes) error {
+	clump = withoutVirtual(db.Schemas[tableName], clump)
+	if err := storage.InternalPersistClump(file, tableName, clump, db.Key, crypto.Encrypt, crypto.EncodeToEmojis); err != nil {
+		return err
 	}
-
-	// Check for auto-flush once at the end
-	if len(table.HotHeap.Rows) >= table.HotHeap.MaxRows {
-		clump := &SealedClump{
-			Rows:     table.HotHeap.Rows,
-			SealedAt: time.Now(),
-			Metadata: ClumpMetadata{
-				RowCount:      len(table.HotHeap.Rows),
-				CreatedAt:     table.HotHeap.CreatedAt,
-				SchemaVersion: table.Schema.Version,
-			},
+	if idx.text != nil {
+		if err := storage.InternalPersistClump(file, textSegmentPrefix+tableName, idx.text, db.Key, crypto.Encrypt, crypto.EncodeToEmojis); err != nil {
+			return err
 		}
-		table.SealedClumps = append(table.SealedClumps, clump)
-		table.HotHeap = NewHotHeap(1000)
-		go db.PersistClump(tableName, clump)
 	}
-
+	if idx.vectors != nil {
+		return storage.InternalPersistClump(file, vectorSegmentPrefix+tableName, idx.vectors, db.Key, crypto.Encrypt, crypto.EncodeToEmojis)
+	}
 	return nil
 }
 
-func (db *Database) PersistClump(tableName string, clump *SealedClump) error {
-	return storage.PersistClump(db.File, &db.Mu, tableName, clump, db.Key, crypto.Encrypt, crypto.EncodeToEmojis)
-}
-
 func (db *Database) Load() error {
 	handleClump := func(tableName string, data []byte) error {
+		if name, ok := strings.CutPrefix(tableName, textSegmentPrefix); ok {
+			var seg textSegment
+			if err := json.Unmarshal(data, &seg); err != nil {
+				return err
+			}
+			db.Mu.Lock()
+			if db.segments == nil {
+				db.segments = make(map[string][]textSegment)
+			}
+			db.segments[name] = append(db.segments[name], seg)
+			db.Mu.Unlock()
+			return nil
+		}
+		if name, ok := strings.CutPrefix(tableName, vectorSegmentPrefix); ok {
+			var seg vectorSegment
+			if err := json.Unmarshal(data, &seg); err != nil {
+				return err
+			}
+			db.Mu.Lock()
+			if db.vectorSegments == nil {
+				db.vectorSegments = make(map[string][]vectorSegment)
+			}
+			db.vectorSegments[name] = append(db.vectorSegments[name], seg)
+			db.Mu.Unlock()
+			return nil
+		}
+		if name, ok := strings.CutPrefix(tableName, versionSegmentPrefix); ok {
+			return db.loadVersions(name, data)
+		}
 		var clump SealedClump
 		if err := json.Unmarshal(data, &clump); err != nil {
 			return err
@@ -481,7 +803,11 @@ func (db *Database) Load() error {
 		db.Mu.Lock()
 		table, ok := db.Tables[tableName]
 		if ok {
+			table.Mu.Lock()
 			table.SealedClumps = append(table.SealedClumps, &clump)
+			table.decodeRowsLocked()
+			table.adoptIDsLocked()
+			table.Mu.Unlock()
 		} else {
 			db.Orphans[tableName] = append(db.Orphans[tableName], &clump)
 		}
@@ -540,8 +866,9 @@ func (db *Database) ChangeKey(newKey string, masterKey string) error {
 	// 3. Re-persist all existing sealed clumps with new key
 	for tableName, table := range db.Tables {
 		table.Mu.RLock()
+		table.unsaveVectors()
 		for _, clump := range table.SealedClumps {
-			if err := storage.InternalPersistClump(db.File, tableName, clump, db.Key, crypto.Encrypt, crypto.EncodeToEmojis); err != nil {
+			if err := db.writeClumpLocked(db.File, tableName, clump, table.clumpIndexes(clump.Rows)); err != nil {
 				db.Key = oldKey // Rollback
 				table.Mu.RUnlock()
 				return err
@@ -565,7 +892,7 @@ func (db *Database) Flush(tableName string) error {
 	table.Mu.Lock()
 	if len(table.HotHeap.Rows) == 0 {
 		table.Mu.Unlock()
-		return nil
+		return db.sweep(tableName)
 	}
 
 	clump := &SealedClump{
@@ -579,9 +906,22 @@ func (db *Database) Flush(tableName string) error {
 	}
 	table.SealedClumps = append(table.SealedClumps, clump)
 	table.HotHeap = NewHotHeap(1000)
+	table.trainVectorsLocked()
 	table.Mu.Unlock()
 
-	return storage.PersistClump(db.File, &db.Mu, tableName, clump, db.Key, crypto.Encrypt, crypto.EncodeToEmojis)
+	if err := db.PersistClump(tableName, clump); err != nil {
+		return err
+	}
+	return db.sweep(tableName)
+}
+
+// sweep removes the expired rows of a table and saves the past versions of
+// its rows, as part of a flush.
+func (db *Database) sweep(tableName string) error {
+	if _, err := db.Expire(tableName); err != nil {
+		return err
+	}
+	return db.saveVersions(tableName)
 }
 
 func (db *Database) ListTables() []string {
@@ -595,24 +935,16 @@ func (db *Database) ListTables() []string {
 }
 
 func (db *Database) DumpAsJSON(tableName string) (string, error) {
-	db.Mu.RLock()
-	table, ok := db.Tables[tableName]
-	db.Mu.RUnlock()
-
-	if !ok {
-		return "", errors.New("table not found")
+	table, err := db.Table(tableName)
+	if err != nil {
+		return "", err
 	}
 
-	table.Mu.RLock()
-	defer table.Mu.RUnlock()
-
 	var allRows []Row
-	for _, clump := range table.SealedClumps {
-		allRows = append(allRows, clump.Rows...)
-	}
-	if table.HotHeap != nil {
-		allRows = append(allRows, table.HotHeap.Rows...)
-	}
+	snap := table.Snapshot()
+	snap.each(func(r Row) {
+		allRows = append(allRows, snap.output(r))
+	})
 
 	data, err := json.MarshalIndent(allRows, "", "  ")
 	if err != nil {
@@ -665,12 +997,7 @@ func (db *Database) LoadSchemas() error {
 	for name, schema := range schemas {
 		if _, ok := db.Tables[name]; !ok {
 			// We skip calling db.DefineSchema recursively and just init the table maps
-			indices := make(map[string]map[interface{}]struct{})
-			for _, f := range schema.Fields {
-				if f.Unique {
-					indices[f.Name] = make(map[interface{}]struct{})
-				}
-			}
+			indices := newUniqueIndices(schema.uniqueKeys())
 			db.Tables[name] = &Table{
 				Db:            db,
 				Name:          name,
@@ -678,21 +1005,12 @@ func (db *Database) LoadSchemas() error {
 				HotHeap:       NewHotHeap(1000),
 				SealedClumps:  make([]*SealedClump, 0),
 				UniqueIndices: indices,
+				text:          newTextIndexes(schema),
+				vectors:       newVectorIndexes(schema),
 			}
-			// Restore orphans if any
-			if orphans, ok := db.Orphans[name]; ok {
-				db.Tables[name].SealedClumps = orphans
-				for _, clump := range orphans {
-					for _, row := range clump.Rows {
-						for _, f := range schema.Fields {
-							if f.Unique {
-								val := row[f.Name]
-								db.Tables[name].UniqueIndices[f.Name][val] = struct{}{}
-							}
-						}
-					}
-				}
-				delete(db.Orphans, name)
+			// Restore orphans if any, and the past versions of their rows
+			if orphans, ok := db.Orphans[name]; ok || db.versionSegments[name] != nil {
+				db.Tables[name].restoreLocked(orphans)
 			}
 		}
 	}
@@ -700,6 +1018,31 @@ func (db *Database) LoadSchemas() error {
 	return nil
 }
 
+// restoreLocked gives a table set up from its schema the clumps loaded for
+// it, and builds its indexes. The caller must hold db.Mu.
+func (t *Table) restoreLocked(clumps []*SealedClump) {
+	t.SealedClumps = clumps
+	t.decodeRowsLocked()
+	// Computed fields may be indexed, so they come first.
+	t.computeLoadedLocked()
+	for _, clump := range clumps {
+		for _, row := range clump.Rows {
+			for _, k := range t.Schema.uniqueKeys() {
+				t.UniqueIndices[k.Name][k.key(row)] = row
+			}
+		}
+	}
+	t.adoptIDsLocked()
+	// Text and vectors need row ids, so they are indexed last.
+	t.adoptTextLocked(t.Db.segments[t.Name])
+	delete(t.Db.segments, t.Name)
+	t.adoptVectorsLocked(t.Db.vectorSegments[t.Name])
+	delete(t.Db.vectorSegments, t.Name)
+	t.adoptVersionsLocked(t.Db.versionSegments[t.Name])
+	delete(t.Db.versionSegments, t.Name)
+	delete(t.Db.Orphans, t.Name)
+}
+
 func (db *Database) StartAutoFlush(interval time.Duration) {
 	db.stopFlush = make(chan struct{})
 	go func() {
@@ -742,9 +1085,13 @@ func (db *Database) Close() error {
 	}
 	db.Mu.RUnlock()
 
+	// The views take in the last writes before anything is flushed.
+	db.syncViews()
 	for _, name := range tableNames {
 		_ = db.Flush(name)
 	}
+	db.changes.close()
+	db.stopViews()
 
 	db.Mu.Lock()
 	defer db.Mu.Unlock()
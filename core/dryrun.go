@@ -0,0 +1,234 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ConflictKind classifies one finding of a schema diff or dry run.
+type ConflictKind string
+
+const (
+	ConflictTableNew            ConflictKind = "TABLE_NEW"
+	ConflictFieldAdd            ConflictKind = "FIELD_ADD"
+	ConflictFieldRemove         ConflictKind = "FIELD_REMOVE"
+	ConflictTypeMismatch        ConflictKind = "TYPE_MISMATCH"
+	ConflictCheckViolation      ConflictKind = "CHECK_VIOLATION"
+	ConflictUniqueViolation     ConflictKind = "UNIQUE_VIOLATION"
+	ConflictForeignKeyViolation ConflictKind = "FOREIGN_KEY_VIOLATION"
+	ConflictForeignKeyOrphan    ConflictKind = "FOREIGN_KEY_ORPHAN"
+	ConflictFieldRename         ConflictKind = "FIELD_RENAME"
+	ConflictFieldCast           ConflictKind = "FIELD_CAST"
+	ConflictCastFailure         ConflictKind = "CAST_FAILURE"
+	ConflictFieldBackfill       ConflictKind = "FIELD_BACKFILL"
+	ConflictComputeFailure      ConflictKind = "COMPUTE_FAILURE"
+)
+
+// sampleSize caps the rows kept per conflict.
+const sampleSize = 5
+
+// Conflict counts the rows of Table that a migration would drop or alter
+// because of Field, which names a field, unique index or foreign key.
+// Sample holds copies of up to sampleSize of those rows.
+type Conflict struct {
+	Kind    ConflictKind
+	Table   string
+	Field   string `json:",omitempty"`
+	Dropped int
+	Altered int
+	Sample  []Row `json:",omitempty"`
+}
+
+// impacts collects conflicts in the order they are first seen.
+type impacts struct {
+	list []*Conflict
+	by   map[string]*Conflict
+}
+
+func (im *impacts) add(kind ConflictKind, table, field string, row Row, dropped bool) {
+	if im.by == nil {
+		im.by = make(map[string]*Conflict)
+	}
+	key := string(kind) + "\x00" + table + "\x00" + field
+	c, ok := im.by[key]
+	if !ok {
+		c = &Conflict{Kind: kind, Table: table, Field: field}
+		im.by[key] = c
+		im.list = append(im.list, c)
+	}
+	if dropped {
+		c.Dropped++
+	} else {
+		c.Altered++
+	}
+	if len(c.Sample) < sampleSize {
+		c.Sample = append(c.Sample, withoutHidden(row))
+	}
+}
+
+// DryRun reports what Migrate with force, or SyncSchema with force when steps
+// is empty, would do to the data without changing anything. Besides the
+// messages of DiffSchema, Details lists every conflict with the number of rows
+// dropped or altered per table and a sample of their ids.
+func (db *Database) DryRun(tableName string, steps []MigrationStep, newFields []Field, constraints ...Constraint) (ConflictReport, error) {
+	if err := validateFields(newFields); err != nil {
+		return ConflictReport{}, err
+	}
+	if err := validateConstraints(newFields, constraints); err != nil {
+		return ConflictReport{}, err
+	}
+
+	// Bring old clumps up to date first so stale fields are not reported.
+	_, lookupErr := db.Table(tableName)
+
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+
+	table, ok := db.Tables[tableName]
+	if !ok {
+		if len(steps) > 0 {
+			return ConflictReport{}, lookupErr
+		}
+		report := db.diffLocked(tableName, nil, nil, newFields, constraints)
+		report.Details = []Conflict{{Kind: ConflictTableNew, Table: tableName}}
+		return report, nil
+	}
+
+	var im impacts
+	var dropped []Row
+	castFailed := false
+
+	table.Mu.RLock()
+	plan, err := planMigration(tableName, table.Schema, steps)
+	if err != nil {
+		table.Mu.RUnlock()
+		return ConflictReport{}, err
+	}
+	if _, exists := db.Tables[plan.name]; exists && plan.name != tableName {
+		table.Mu.RUnlock()
+		return ConflictReport{}, errors.New("table already exists: " + plan.name)
+	}
+	plan.dryRun = true
+	plan.observe = func(n int, row Row, failed bool) {
+		step := plan.steps[n]
+		if failed {
+			drop := step.onFailure() == CastDrop
+			if drop {
+				dropped = append(dropped, row)
+			}
+			if step.onFailure() == CastFail {
+				castFailed = true
+			}
+			im.add(ConflictCastFailure, tableName, step.Field, row, drop)
+			return
+		}
+		kind := ConflictFieldCast
+		switch step.Kind {
+		case MigrateRenameField:
+			kind = ConflictFieldRename
+		case MigrateBackfill:
+			kind = ConflictFieldBackfill
+		}
+		im.add(kind, tableName, step.Field, row, false)
+	}
+	staged, err := table.stage(plan)
+	table.Mu.RUnlock()
+	if err != nil {
+		return ConflictReport{}, err
+	}
+
+	schemas := make(map[string]*Schema, len(db.Schemas))
+	for name, schema := range db.Schemas {
+		if name != tableName {
+			schemas[name] = schema
+		}
+	}
+	for name, schema := range schemas {
+		schemas[name], _ = plan.retarget(tableName, schema)
+	}
+	if err := validateForeignKeysIn(schemas, plan.name, newFields, constraints); err != nil {
+		return ConflictReport{}, err
+	}
+
+	report := db.diffLocked(plan.name, staged.Schema, staged, newFields, constraints)
+	report.Conflicts = append(append([]string(nil), plan.changes...), report.Conflicts...)
+
+	// Field level changes alter rows without dropping them.
+	current := make(map[string]Field, len(staged.Schema.Fields))
+	for _, f := range staged.Schema.Fields {
+		current[f.Name] = f
+	}
+	target := make(map[string]bool, len(newFields))
+	for _, f := range newFields {
+		target[f.Name] = true
+	}
+	staged.eachRowLocked(func(row Row) {
+		for _, f := range newFields {
+			old, exists := current[f.Name]
+			switch {
+			case !exists && row[f.Name] == nil:
+				im.add(ConflictFieldAdd, plan.name, f.Name, row, false)
+			case exists && old.Type != f.Type && row[f.Name] != nil:
+				im.add(ConflictTypeMismatch, plan.name, f.Name, row, false)
+			}
+		}
+		for _, f := range staged.Schema.Fields {
+			if !target[f.Name] && row[f.Name] != nil {
+				im.add(ConflictFieldRemove, plan.name, f.Name, row, false)
+			}
+		}
+	})
+
+	// Rows breaking the new rules, keys and references are dropped.
+	db.applySchemaLocked(staged, &Schema{Version: staged.Schema.Version + 1, Fields: newFields, Constraints: constraints}, func(row Row, kind ConflictKind, name string) {
+		dropped = append(dropped, row)
+		im.add(kind, plan.name, name, row, true)
+	})
+
+	// Other tables keep pointing at rows that are dropped.
+	for name, schema := range schemas {
+		child := db.Tables[name]
+		if child == nil || len(dropped) == 0 {
+			continue
+		}
+		for _, c := range schema.Constraints {
+			if c.Kind != ConstraintForeignKey || c.RefTable != plan.name {
+				continue
+			}
+			db.countDanglingLocked(&im, child, c, dropped)
+		}
+	}
+
+	if castFailed {
+		report.Compatiable = false
+	}
+	for _, c := range im.list {
+		if c.Kind == ConflictCastFailure {
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("CAST_FAILURE: %d values of field '%s' do not convert", c.Dropped+c.Altered, c.Field))
+		}
+		if c.Dropped > 0 {
+			report.Destructive = true
+		}
+		report.Details = append(report.Details, *c)
+	}
+	return report, nil
+}
+
+// countDanglingLocked records the rows of child whose foreign key c points at
+// one of the dropped parent rows. The caller must hold db.Mu.
+func (db *Database) countDanglingLocked(im *impacts, child *Table, c Constraint, dropped []Row) {
+	parentKey := uniqueKey{Fields: c.RefFields}
+	keys := make(map[interface{}]bool, len(dropped))
+	for _, row := range dropped {
+		keys[parentKey.key(row)] = true
+	}
+	fk := foreignKey{Constraint: c, parentKey: parentKey}
+
+	child.Mu.RLock()
+	defer child.Mu.RUnlock()
+	child.eachRowLocked(func(row Row) {
+		if key, ok := fk.lookup(row); ok && keys[key] {
+			im.add(ConflictForeignKeyOrphan, child.Name, c.IndexName(), row, false)
+		}
+	})
+}
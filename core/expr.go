@@ -0,0 +1,602 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// expression is a compiled Field.Expr. Expressions are small: numbers,
+// 'strings', true, false and null; field paths such as price or
+// address.city; the arithmetic operators + - * / % and || for joining
+// strings; parentheses; and the functions lower, upper, trim, length,
+// concat, coalesce, abs and round. Any null operand makes the result null,
+// except in concat, which skips nulls, and coalesce, which returns its first
+// value that is not null.
+//
+// Whole numbers stay whole through + - * and %, an operand that is a
+// decimal makes the result an exact decimal, and anything else, / included,
+// is a float.
+type expression struct {
+	eval func(Row) (interface{}, error)
+	// inputs are the fields the expression reads.
+	inputs []string
+}
+
+// exprFuncs are the functions an expression may call, by name, with the
+// number of arguments they take; -1 takes one or more.
+var exprFuncs = map[string]int{
+	"lower": 1, "upper": 1, "trim": 1, "length": 1, "abs": 1,
+	"round": -1, "concat": -1, "coalesce": -1,
+}
+
+// exprCache holds parsed expressions by source, like patternCache.
+var exprCache sync.Map
+
+// compileExpr parses src and checks it against fields: paths must start at
+// a field that is not computed itself.
+func compileExpr(src string, fields []Field) (*expression, error) {
+	e, err := parseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]Field, len(fields))
+	for _, f := range fields {
+		known[f.Name] = f
+	}
+	for _, name := range e.inputs {
+		f, ok := known[name]
+		if !ok {
+			return nil, errors.New("unknown field: " + name)
+		}
+		if f.Expr != "" {
+			return nil, errors.New("cannot read computed field: " + name)
+		}
+	}
+	return e, nil
+}
+
+func parseExpr(src string) (*expression, error) {
+	if e, ok := exprCache.Load(src); ok {
+		return e.(*expression), nil
+	}
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens, seen: make(map[string]bool)}
+	eval, err := p.concat()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != exprEnd {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	e := &expression{eval: eval, inputs: p.inputs}
+	exprCache.Store(src, e)
+	return e, nil
+}
+
+type exprTokenKind int
+
+const (
+	exprEnd exprTokenKind = iota
+	exprNumber
+	exprString
+	exprIdent
+	exprSymbol
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{exprNumber, src[i:j]})
+			i = j
+		case c == '\'':
+			// Quotes inside a string are doubled, as in SQL.
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, errors.New("unterminated string")
+				}
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						b.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(src[j])
+				j++
+			}
+			tokens = append(tokens, exprToken{exprString, b.String()})
+			i = j + 1
+		case strings.HasPrefix(src[i:], "||"):
+			tokens = append(tokens, exprToken{exprSymbol, "||"})
+			i += 2
+		case strings.ContainsRune("+-*/%(),.[]", rune(c)):
+			tokens = append(tokens, exprToken{exprSymbol, string(c)})
+			i++
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			if r != '_' && !unicode.IsLetter(r) {
+				return nil, fmt.Errorf("unexpected %q", r)
+			}
+			j := i
+			for j < len(src) {
+				r, size := utf8.DecodeRuneInString(src[j:])
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += size
+			}
+			tokens = append(tokens, exprToken{exprIdent, src[i:j]})
+			i = j
+		}
+	}
+	return append(tokens, exprToken{kind: exprEnd}), nil
+}
+
+type exprEval = func(Row) (interface{}, error)
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	seen   map[string]bool
+	inputs []string
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != exprEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) accept(symbol string) bool {
+	if t := p.peek(); t.kind == exprSymbol && t.text == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(symbol string) error {
+	if !p.accept(symbol) {
+		return fmt.Errorf("expected %q", symbol)
+	}
+	return nil
+}
+
+// binary parses operands joined by any of ops, left to right.
+func (p *exprParser) binary(operand func() (exprEval, error), ops ...string) (exprEval, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range ops {
+			if p.accept(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(row Row) (interface{}, error) {
+			a, err := l(row)
+			if err != nil {
+				return nil, err
+			}
+			b, err := right(row)
+			if err != nil || a == nil || b == nil {
+				return nil, err
+			}
+			return applyOp(op, a, b)
+		}
+	}
+}
+
+func (p *exprParser) concat() (exprEval, error) {
+	return p.binary(p.additive, "||")
+}
+
+func (p *exprParser) additive() (exprEval, error) {
+	return p.binary(p.multiplicative, "+", "-")
+}
+
+func (p *exprParser) multiplicative() (exprEval, error) {
+	return p.binary(p.unary, "*", "/", "%")
+}
+
+func (p *exprParser) unary() (exprEval, error) {
+	if !p.accept("-") {
+		return p.primary()
+	}
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(row Row) (interface{}, error) {
+		v, err := operand(row)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		return applyOp("-", int64(0), v)
+	}, nil
+}
+
+func (p *exprParser) primary() (exprEval, error) {
+	t := p.next()
+	switch t.kind {
+	case exprNumber:
+		var v interface{}
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			v = n
+		} else if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+			v = f
+		} else {
+			return nil, fmt.Errorf("invalid number: %s", t.text)
+		}
+		return func(Row) (interface{}, error) { return v, nil }, nil
+	case exprString:
+		s := t.text
+		return func(Row) (interface{}, error) { return s, nil }, nil
+	case exprSymbol:
+		if t.text != "(" {
+			break
+		}
+		inner, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case exprIdent:
+		switch strings.ToLower(t.text) {
+		case "true", "false":
+			b := strings.EqualFold(t.text, "true")
+			return func(Row) (interface{}, error) { return b, nil }, nil
+		case "null":
+			return func(Row) (interface{}, error) { return nil, nil }, nil
+		}
+		if p.accept("(") {
+			return p.call(strings.ToLower(t.text))
+		}
+		return p.path(t.text)
+	case exprEnd:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// path parses the rest of a field path starting at name.
+func (p *exprParser) path(name string) (exprEval, error) {
+	if !p.seen[name] {
+		p.seen[name] = true
+		p.inputs = append(p.inputs, name)
+	}
+	path := name
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != exprIdent {
+				return nil, errors.New("expected a field name after '.'")
+			}
+			path += "." + t.text
+		case p.accept("["):
+			t := p.next()
+			if t.kind != exprNumber {
+				return nil, errors.New("expected an index after '['")
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			path += "[" + t.text + "]"
+		default:
+			return func(row Row) (interface{}, error) {
+				v, _ := Lookup(row, path)
+				return v, nil
+			}, nil
+		}
+	}
+}
+
+func (p *exprParser) call(name string) (exprEval, error) {
+	arity, ok := exprFuncs[name]
+	if !ok {
+		return nil, errors.New("unknown function: " + name)
+	}
+	var args []exprEval
+	if !p.accept(")") {
+		for {
+			arg, err := p.concat()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.accept(")") {
+				break
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	switch {
+	case arity >= 0 && len(args) != arity:
+		return nil, fmt.Errorf("%s takes %d argument(s)", name, arity)
+	case len(args) == 0:
+		return nil, fmt.Errorf("%s needs an argument", name)
+	case name == "round" && len(args) > 2:
+		return nil, errors.New("round takes a number and optional digits")
+	}
+	return func(row Row) (interface{}, error) {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			v, err := arg(row)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return callFunc(name, values)
+	}, nil
+}
+
+func callFunc(name string, args []interface{}) (interface{}, error) {
+	switch name {
+	case "concat":
+		var b strings.Builder
+		for _, v := range args {
+			if v != nil {
+				b.WriteString(exprText(v))
+			}
+		}
+		return b.String(), nil
+	case "coalesce":
+		for _, v := range args {
+			if v != nil {
+				return v, nil
+			}
+		}
+		return nil, nil
+	}
+	for _, v := range args {
+		if v == nil {
+			return nil, nil
+		}
+	}
+	switch name {
+	case "lower", "upper", "trim", "length":
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s needs a string, got %v", name, args[0])
+		}
+		switch name {
+		case "lower":
+			return strings.ToLower(s), nil
+		case "upper":
+			return strings.ToUpper(s), nil
+		case "trim":
+			return strings.TrimSpace(s), nil
+		}
+		return int64(utf8.RuneCountInString(s)), nil
+	case "abs":
+		if Compare(args[0], int64(0)) < 0 {
+			return applyOp("-", int64(0), args[0])
+		}
+		return applyOp("+", int64(0), args[0])
+	}
+	// round
+	digits := 0.0
+	if len(args) == 2 {
+		d, ok := toFloat(args[1])
+		if !ok || d != math.Trunc(d) {
+			return nil, fmt.Errorf("round needs whole digits, got %v", args[1])
+		}
+		digits = d
+	}
+	if d, ok := args[0].(Decimal); ok {
+		s := d.Rat().FloatString(int(max(digits, 0)))
+		return ParseDecimal(s)
+	}
+	n, ok := toFloat(args[0])
+	if !ok {
+		return nil, fmt.Errorf("round needs a number, got %v", args[0])
+	}
+	scale := math.Pow(10, digits)
+	r := math.Round(n*scale) / scale
+	if digits <= 0 && math.Abs(r) < 1<<53 {
+		return int64(r), nil
+	}
+	return r, nil
+}
+
+// exprText is how || and concat write a value.
+func exprText(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case Decimal:
+		return string(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// applyOp applies a binary operator to two values that are not null.
+func applyOp(op string, a, b interface{}) (interface{}, error) {
+	if op == "||" {
+		return exprText(a) + exprText(b), nil
+	}
+	ia, aInt := wholeNumber(a)
+	ib, bInt := wholeNumber(b)
+	if aInt && bInt && op != "/" {
+		switch op {
+		case "+":
+			return ia + ib, nil
+		case "-":
+			return ia - ib, nil
+		case "*":
+			return ia * ib, nil
+		case "%":
+			if ib == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return ia % ib, nil
+		}
+	}
+	_, aDec := a.(Decimal)
+	_, bDec := b.(Decimal)
+	if aDec || bDec {
+		ra, rb := exprRat(a), exprRat(b)
+		if ra == nil || rb == nil {
+			return nil, fmt.Errorf("cannot apply %s to %v and %v", op, a, b)
+		}
+		r := new(big.Rat)
+		switch op {
+		case "+":
+			r.Add(ra, rb)
+		case "-":
+			r.Sub(ra, rb)
+		case "*":
+			r.Mul(ra, rb)
+		default:
+			if rb.Sign() == 0 {
+				return nil, errors.New("division by zero")
+			}
+			if op == "%" {
+				return nil, errors.New("% needs whole numbers")
+			}
+			r.Quo(ra, rb)
+		}
+		return decimalFromRat(r), nil
+	}
+	fa, okA := exprFloat(a)
+	fb, okB := exprFloat(b)
+	if !okA || !okB {
+		return nil, fmt.Errorf("cannot apply %s to %v and %v", op, a, b)
+	}
+	switch op {
+	case "+":
+		return fa + fb, nil
+	case "-":
+		return fa - fb, nil
+	case "*":
+		return fa * fb, nil
+	case "/":
+		if fb == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return fa / fb, nil
+	}
+	if fb == 0 {
+		return nil, errors.New("division by zero")
+	}
+	return math.Mod(fa, fb), nil
+}
+
+// wholeNumber returns the value of an integer.
+func wholeNumber(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+// exprFloat returns a number as a float; booleans and strings are not
+// numbers.
+func exprFloat(v interface{}) (float64, bool) {
+	switch v.(type) {
+	case int, int32, int64, float32, float64, Decimal:
+		return toFloat(v)
+	}
+	return 0, false
+}
+
+func exprRat(v interface{}) *big.Rat {
+	switch n := v.(type) {
+	case Decimal:
+		return n.Rat()
+	case float64:
+		return new(big.Rat).SetFloat64(n)
+	}
+	if i, ok := wholeNumber(v); ok {
+		return new(big.Rat).SetInt64(i)
+	}
+	return nil
+}
+
+// computedValue turns the result of a field's expression into a value of
+// its type. Numbers convert between int, float and decimal as long as no
+// digits are lost.
+func computedValue(v interface{}, typ FieldType) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch typ {
+	case FieldTypeInt:
+		if i, ok := wholeNumber(v); ok {
+			return i, nil
+		}
+		if f, ok := exprFloat(v); ok && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return int64(f), nil
+		}
+	case FieldTypeFloat:
+		if f, ok := exprFloat(v); ok {
+			return f, nil
+		}
+	case FieldTypeString:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case FieldTypeBool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	default:
+		return normalizeValue(v, typ)
+	}
+	return nil, fmt.Errorf("cannot use %v as %v", v, typ)
+}
@@ -0,0 +1,378 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ReferentialAction decides what happens to referencing rows when the row
+// they point at is deleted.
+type ReferentialAction string
+
+const (
+	ActionRestrict ReferentialAction = "restrict"
+	ActionCascade  ReferentialAction = "cascade"
+	ActionSetNull  ReferentialAction = "set_null"
+)
+
+// foreignKey is a foreign key constraint resolved against the live tables.
+// The depths of its tables give the order they are locked in; see
+// foreignKeyDepths.
+type foreignKey struct {
+	Constraint
+	child       *Table
+	parent      *Table
+	parentKey   uniqueKey
+	childDepth  int
+	parentDepth int
+}
+
+// lookup returns the parent index key a child row points at. It reports false
+// when every referencing field is null, which never violates the constraint.
+func (fk foreignKey) lookup(row Row) (interface{}, bool) {
+	ref := make(Row, len(fk.Fields))
+	nulls := 0
+	for i, f := range fk.Fields {
+		v := fieldValue(row, f)
+		if v == nil {
+			nulls++
+		}
+		ref[fk.RefFields[i]] = v
+	}
+	if nulls == len(fk.Fields) {
+		return nil, false
+	}
+	return fk.parentKey.key(ref), true
+}
+
+// check verifies that row points at an existing parent row. The caller must
+// hold the parent's lock.
+func (fk foreignKey) check(row Row) error {
+	key, ok := fk.lookup(row)
+	if !ok {
+		return nil
+	}
+	if _, exists := fk.parent.UniqueIndices[fk.parentKey.Name][key]; !exists {
+		return fmt.Errorf("foreign key violation: %s references missing row in %s", fk.IndexName(), fk.RefTable)
+	}
+	return nil
+}
+
+func (fk foreignKey) action() ReferentialAction {
+	if fk.OnDelete == "" {
+		return ActionRestrict
+	}
+	return fk.OnDelete
+}
+
+// uniqueKeyFor finds the unique index covering exactly fields, in any order.
+func (s *Schema) uniqueKeyFor(fields []string) (uniqueKey, bool) {
+	want := append([]string(nil), fields...)
+	sort.Strings(want)
+	for _, k := range s.uniqueKeys() {
+		have := append([]string(nil), k.Fields...)
+		sort.Strings(have)
+		if strings.Join(have, ",") == strings.Join(want, ",") {
+			return k, true
+		}
+	}
+	return uniqueKey{}, false
+}
+
+// foreignKeyGraph resolves every foreign key of the database. It returns the
+// keys declared by each table and the keys pointing at each table. The caller
+// must hold db.Mu.
+func (db *Database) foreignKeyGraph() (outgoing, incoming map[string][]foreignKey) {
+	outgoing = make(map[string][]foreignKey)
+	incoming = make(map[string][]foreignKey)
+	for name, table := range db.Tables {
+		for _, c := range table.Schema.Constraints {
+			if c.Kind != ConstraintForeignKey {
+				continue
+			}
+			parent, ok := db.Tables[c.RefTable]
+			if !ok {
+				continue
+			}
+			pk, ok := parent.Schema.uniqueKeyFor(c.RefFields)
+			if !ok {
+				continue
+			}
+			fk := foreignKey{Constraint: c, child: table, parent: parent, parentKey: pk}
+			outgoing[name] = append(outgoing[name], fk)
+		}
+	}
+	depths := foreignKeyDepths(outgoing)
+	for name, fks := range outgoing {
+		for i := range fks {
+			fk := &fks[i]
+			fk.childDepth, fk.parentDepth = depths[fk.child], depths[fk.parent]
+			incoming[fk.RefTable] = append(incoming[fk.RefTable], *fk)
+		}
+		outgoing[name] = fks
+	}
+	return outgoing, incoming
+}
+
+// lockOrder sorts tables the way every writer locks them: parents before
+// their children, then by name.
+func lockOrder(tables []*Table, depth func(*Table) int) {
+	sort.Slice(tables, func(i, j int) bool {
+		a, b := tables[i], tables[j]
+		if da, db := depth(a), depth(b); da != db {
+			return da < db
+		}
+		return a.Name < b.Name
+	})
+}
+
+func (db *Database) foreignKeys(tableName string) (outgoing, incoming []foreignKey) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+	out, in := db.foreignKeyGraph()
+	return out[tableName], in[tableName]
+}
+
+// validateForeignKeys checks that every foreign key declared for tableName
+// points at a unique index and sets no unique field to null, that no chain of
+// foreign keys leads back to tableName, and that tables referencing
+// tableName still find their target in the new definition. The caller must
+// hold db.Mu.
+func (db *Database) validateForeignKeys(tableName string, fields []Field, constraints []Constraint) error {
+	return validateForeignKeysIn(db.Schemas, tableName, fields, constraints)
+}
+
+func validateForeignKeysIn(schemas map[string]*Schema, tableName string, fields []Field, constraints []Constraint) error {
+	self := &Schema{Fields: fields, Constraints: constraints}
+	for _, c := range constraints {
+		if c.Kind != ConstraintForeignKey {
+			continue
+		}
+		parent := self
+		if c.RefTable != tableName {
+			schema, ok := schemas[c.RefTable]
+			if !ok {
+				return fmt.Errorf("foreign key %s references unknown table: %s", c.IndexName(), c.RefTable)
+			}
+			parent = schema
+		}
+		if _, ok := parent.uniqueKeyFor(c.RefFields); !ok {
+			return fmt.Errorf("foreign key %s must reference a unique key of %s", c.IndexName(), c.RefTable)
+		}
+		if c.OnDelete == ActionSetNull {
+			// Unique indexes hold nulls like any other value, so two nulled
+			// rows would collide.
+			nulled := make(map[string]bool, len(c.Fields))
+			for _, f := range c.Fields {
+				nulled[f] = true
+			}
+			for _, k := range self.uniqueKeys() {
+				for _, f := range k.Fields {
+					if nulled[f] {
+						return fmt.Errorf("foreign key %s cannot set unique field %s to null", c.IndexName(), f)
+					}
+				}
+			}
+		}
+	}
+	if cycle := foreignKeyCycle(schemas, tableName, constraints); cycle != nil {
+		return fmt.Errorf("foreign keys form a cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	for name, schema := range schemas {
+		if name == tableName {
+			continue
+		}
+		for _, c := range schema.Constraints {
+			if c.Kind == ConstraintForeignKey && c.RefTable == tableName {
+				if _, ok := self.uniqueKeyFor(c.RefFields); !ok {
+					return fmt.Errorf("foreign key %s.%s still references (%s)", name, c.IndexName(), strings.Join(c.RefFields, ", "))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// foreignKeyCycle returns the tables on a path of foreign keys leading from
+// tableName back to itself, or nil if there is none. Writers lock parents
+// before children, so such a path could never be locked in order. A table
+// referencing itself needs no other lock and is not a cycle.
+func foreignKeyCycle(schemas map[string]*Schema, tableName string, constraints []Constraint) []string {
+	refs := func(name string) []string {
+		cs := constraints
+		if name != tableName {
+			schema, ok := schemas[name]
+			if !ok {
+				return nil
+			}
+			cs = schema.Constraints
+		}
+		var out []string
+		for _, c := range cs {
+			if c.Kind == ConstraintForeignKey && c.RefTable != name {
+				out = append(out, c.RefTable)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	visited := make(map[string]bool)
+	var walk func(path []string) []string
+	walk = func(path []string) []string {
+		for _, next := range refs(path[len(path)-1]) {
+			if next == tableName {
+				return append(path, next)
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			if cycle := walk(append(path, next)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return walk([]string{tableName})
+}
+
+// foreignKeyDepths returns, for every table with foreign keys, the length of
+// the longest chain of keys from it up to a table referencing no other, so
+// that parents always come before their children. Tables without foreign
+// keys are at depth 0.
+func foreignKeyDepths(outgoing map[string][]foreignKey) map[*Table]int {
+	depths := make(map[*Table]int)
+	visiting := make(map[*Table]bool)
+	var depth func(t *Table) int
+	depth = func(t *Table) int {
+		if d, ok := depths[t]; ok {
+			return d
+		}
+		if visiting[t] {
+			// A cycle saved before they were rejected.
+			return 0
+		}
+		visiting[t] = true
+		d := 0
+		for _, fk := range outgoing[t.Name] {
+			if fk.parent != t {
+				if pd := depth(fk.parent) + 1; pd > d {
+					d = pd
+				}
+			}
+		}
+		visiting[t] = false
+		depths[t] = d
+		return d
+	}
+	for _, fks := range outgoing {
+		for _, fk := range fks {
+			depth(fk.child)
+		}
+	}
+	return depths
+}
+
+// lockParents read-locks the tables referenced by fks, skipping self and the
+// tables held by a transaction. Parents are always locked before their
+// children, and each other in lockOrder, matching cascading deletes.
+func lockParents(self *Table, fks []foreignKey, held map[*Table]bool) func() {
+	var parents []*Table
+	depths := make(map[*Table]int)
+	for _, fk := range fks {
+		if _, seen := depths[fk.parent]; fk.parent != self && !seen && !held[fk.parent] {
+			depths[fk.parent] = fk.parentDepth
+			parents = append(parents, fk.parent)
+		}
+	}
+	lockOrder(parents, func(t *Table) int { return depths[t] })
+	for _, p := range parents {
+		p.Mu.RLock()
+	}
+	return func() {
+		for _, p := range parents {
+			p.Mu.RUnlock()
+		}
+	}
+}
+
+func checkForeignKeys(fks []foreignKey, row Row) error {
+	for _, fk := range fks {
+		if err := fk.check(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkReferencesKept refuses changes to referenced key values while another
+// row still points at the old value. The caller must hold the locks of the
+// referencing tables.
+func checkReferencesKept(incoming []foreignKey, oldRows, newRows []Row) error {
+	for _, fk := range incoming {
+		changed := make(map[interface{}]bool)
+		for i, old := range oldRows {
+			oldKey := fk.parentKey.key(old)
+			if oldKey != fk.parentKey.key(newRows[i]) {
+				changed[oldKey] = true
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		var err error
+		fk.child.eachRowLocked(func(row Row) {
+			if key, ok := fk.lookup(row); ok && changed[key] && err == nil {
+				err = fmt.Errorf("foreign key violation: %s.%s still references %s", fk.child.Name, fk.IndexName(), fk.RefTable)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countOrphans returns how many rows of child point at no row of parent
+// under the constraint c.
+func countOrphans(child *Table, parent *Table, c Constraint) int {
+	pk, ok := parent.Schema.uniqueKeyFor(c.RefFields)
+	if !ok {
+		return 0
+	}
+	fk := foreignKey{Constraint: c, child: child, parent: parent, parentKey: pk}
+	if parent != child {
+		parent.Mu.RLock()
+		defer parent.Mu.RUnlock()
+	}
+	child.Mu.RLock()
+	defer child.Mu.RUnlock()
+
+	orphans := 0
+	child.eachRowLocked(func(row Row) {
+		if fk.check(row) != nil {
+			orphans++
+		}
+	})
+	return orphans
+}
+
+// rowSet tracks rows by identity rather than by value.
+type rowSet map[uintptr]bool
+
+func (s rowSet) add(row Row) bool {
+	p := reflect.ValueOf(row).Pointer()
+	if s[p] {
+		return false
+	}
+	s[p] = true
+	return true
+}
+
+func (s rowSet) has(row Row) bool {
+	return s[reflect.ValueOf(row).Pointer()]
+}
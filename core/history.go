@@ -0,0 +1,147 @@
+package core
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+// SchemaRevision is one entry of a table's schema history.
+type SchemaRevision struct {
+	Version     int
+	Fields      []Field
+	Constraints []Constraint `json:",omitempty"`
+	Changes     []string     `json:",omitempty"`
+	ChangedAt   time.Time
+}
+
+// nextSchema builds the schema replacing prev, which is nil for a new table.
+// Any change bumps the version and is appended to the history; an identical
+// definition returns prev untouched.
+func nextSchema(prev *Schema, fields []Field, constraints []Constraint, changes []string) *Schema {
+	if prev == nil {
+		return &Schema{
+			Version:     1,
+			Fields:      fields,
+			Constraints: constraints,
+			History: []SchemaRevision{{
+				Version:     1,
+				Fields:      fields,
+				Constraints: constraints,
+				Changes:     changes,
+				ChangedAt:   time.Now(),
+			}},
+		}
+	}
+
+	if reflect.DeepEqual(prev.Fields, fields) && reflect.DeepEqual(prev.Constraints, constraints) {
+		return prev
+	}
+	return reviseSchema(prev, fields, constraints, changes)
+}
+
+// reviseSchema appends a new revision to prev even when the definition is
+// unchanged, for migrations that only touch the data.
+func reviseSchema(prev *Schema, fields []Field, constraints []Constraint, changes []string) *Schema {
+	history := append([]SchemaRevision(nil), prev.History...)
+	if len(history) == 0 {
+		// Schemas written before history was kept start with their
+		// current definition.
+		history = append(history, SchemaRevision{
+			Version:     prev.Version,
+			Fields:      prev.Fields,
+			Constraints: prev.Constraints,
+		})
+	}
+	version := prev.Version + 1
+	history = append(history, SchemaRevision{
+		Version:     version,
+		Fields:      fields,
+		Constraints: constraints,
+		Changes:     changes,
+		ChangedAt:   time.Now(),
+	})
+
+	schema := &Schema{
+		Version:     version,
+		Fields:      fields,
+		Constraints: constraints,
+		History:     history,
+	}
+	// The TTL survives as long as its field does.
+	if prev.TTL != nil && prev.TTL.validate(fields) == nil {
+		schema.TTL = prev.TTL
+	}
+	schema.Rules = prev.Rules
+	schema.View = prev.View
+	schema.Temporal = prev.Temporal
+	return schema
+}
+
+// SchemaHistory returns every recorded revision of a table's schema, oldest
+// first.
+func (db *Database) SchemaHistory(tableName string) ([]SchemaRevision, error) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+
+	schema, ok := db.Schemas[tableName]
+	if !ok {
+		return nil, errors.New("table not found: " + tableName)
+	}
+	if len(schema.History) == 0 {
+		return []SchemaRevision{{Version: schema.Version, Fields: schema.Fields, Constraints: schema.Constraints}}, nil
+	}
+	return append([]SchemaRevision(nil), schema.History...), nil
+}
+
+// Table returns the named table. Clumps written under an older schema version
+// are upgraded to the current one on first access.
+func (db *Database) Table(tableName string) (*Table, error) {
+	db.Mu.RLock()
+	table, ok := db.Tables[tableName]
+	db.Mu.RUnlock()
+
+	if !ok {
+		return nil, errors.New("table not found: " + tableName)
+	}
+
+	table.Mu.RLock()
+	stale := table.upgraded != table.Schema.Version
+	table.Mu.RUnlock()
+	if stale {
+		table.Mu.Lock()
+		table.upgradeLocked()
+		table.Mu.Unlock()
+	}
+	return table, nil
+}
+
+// upgradeLocked brings every sealed clump up to the current schema version.
+// Fields the schema no longer knows are dropped from the rows.
+func (t *Table) upgradeLocked() {
+	known := map[string]bool{ViewStateField: true}
+	for _, f := range t.Schema.Fields {
+		known[f.Name] = true
+	}
+	var olds, news []Row
+	for _, clump := range t.SealedClumps {
+		if clump.Metadata.SchemaVersion >= t.Schema.Version {
+			continue
+		}
+		for _, row := range clump.Rows {
+			pruned := make(Row, len(row))
+			for k, v := range row {
+				if known[k] || hidden(k) {
+					pruned[k] = v
+				}
+			}
+			if len(pruned) != len(row) {
+				olds = append(olds, row)
+				news = append(news, pruned)
+			}
+		}
+		clump.Metadata.SchemaVersion = t.Schema.Version
+	}
+	t.replaceLocked(olds, news)
+	t.upgraded = t.Schema.Version
+}
@@ -0,0 +1,477 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxTriggerDepth bounds how deeply the writes of after triggers may fire
+// further triggers, so triggers that write to each other's tables stop.
+const maxTriggerDepth = 16
+
+// HookEvent is the row a trigger fires for. Before is the row as it was, for
+// updates and deletes; After is the row about to be written, for inserts and
+// updates. A before trigger may change After, or replace it.
+type HookEvent struct {
+	Kind   ChangeKind
+	Table  string
+	Before Row
+	After  Row
+}
+
+// Trigger runs Go code around the writes to a table. Before runs for each
+// row before anything is checked or changed: it may fill in or rewrite the
+// row, and returning an error aborts the whole write. After runs once each
+// row is written, with the final rows, while the table is still locked; the
+// writes it makes through tx land with the write that fired it or not at
+// all, and an error undoes them both.
+//
+// Writes names every table After writes to. Those tables are locked with
+// the table for the whole write, so After may not write anywhere else.
+// Rows changed by a foreign key's OnDelete action, restored from a backup or
+// removed by a TTL do not fire triggers.
+type Trigger struct {
+	Name  string
+	Table string
+	// On lists the kinds of write the trigger fires for; empty is all.
+	On     []ChangeKind
+	Before func(ev *HookEvent) error
+	After  func(tx *Tx, ev *HookEvent) error
+	Writes []string
+}
+
+func (tr *Trigger) fires(kind ChangeKind) bool {
+	if len(tr.On) == 0 {
+		return true
+	}
+	for _, k := range tr.On {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// AddTrigger registers a trigger on its table. Triggers run in the order
+// they were added, after the rules kept with the schema. They live as long
+// as the Database; see SetRules for triggers that are kept.
+func (db *Database) AddTrigger(tr Trigger) error {
+	if tr.Name == "" {
+		return errors.New("trigger needs a name")
+	}
+	if tr.Before == nil && tr.After == nil {
+		return fmt.Errorf("trigger %s: needs a before or an after function", tr.Name)
+	}
+	for _, k := range tr.On {
+		if k != ChangeInsert && k != ChangeUpdate && k != ChangeDelete {
+			return fmt.Errorf("trigger %s: unknown kind: %s", tr.Name, k)
+		}
+	}
+
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	if _, ok := db.Tables[tr.Table]; !ok {
+		return errors.New("table not found: " + tr.Table)
+	}
+	if err := db.notView(tr.Table); err != nil {
+		return err
+	}
+	for _, name := range tr.Writes {
+		if _, ok := db.Tables[name]; !ok {
+			return errors.New("table not found: " + name)
+		}
+		if err := db.notView(name); err != nil {
+			return err
+		}
+	}
+	for _, other := range db.triggers[tr.Table] {
+		if other.Name == tr.Name {
+			return fmt.Errorf("trigger already exists: %s", tr.Name)
+		}
+	}
+	if db.triggers == nil {
+		db.triggers = make(map[string][]*Trigger)
+	}
+	copied := tr
+	copied.On = append([]ChangeKind(nil), tr.On...)
+	copied.Writes = append([]string(nil), tr.Writes...)
+	db.triggers[tr.Table] = append(db.triggers[tr.Table], &copied)
+	return nil
+}
+
+// renameTriggersLocked moves the triggers added in Go to a renamed table,
+// and points the writes of every trigger to it at the new name. The caller
+// must hold db.Mu.
+func (db *Database) renameTriggersLocked(from, to string) {
+	if triggers, ok := db.triggers[from]; ok {
+		delete(db.triggers, from)
+		db.triggers[to] = triggers
+		for _, tr := range triggers {
+			tr.Table = to
+		}
+	}
+	for _, triggers := range db.triggers {
+		for _, tr := range triggers {
+			writes := make([]string, len(tr.Writes))
+			for i, name := range tr.Writes {
+				if name == from {
+					name = to
+				}
+				writes[i] = name
+			}
+			tr.Writes = writes
+		}
+	}
+}
+
+// DropTrigger removes a trigger added with AddTrigger.
+func (db *Database) DropTrigger(tableName, name string) error {
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	triggers := db.triggers[tableName]
+	for i, tr := range triggers {
+		if tr.Name == name {
+			db.triggers[tableName] = append(triggers[:i:i], triggers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("trigger not found: %s", name)
+}
+
+// tableTriggersLocked returns the triggers of a table: its rules, then the
+// triggers added in Go. The caller must hold db.Mu.
+func (db *Database) tableTriggersLocked(t *Table) []*Trigger {
+	var triggers []*Trigger
+	if t.Schema != nil && len(t.Schema.Rules) > 0 {
+		triggers = t.rules.get(t.Name, t.Schema)
+	}
+	// The cached slice is shared, so the Go triggers go on a copy.
+	return append(triggers[:len(triggers):len(triggers)], db.triggers[t.Name]...)
+}
+
+// Tx is a write in progress. Every write runs in one, so its changes are
+// published to the change feed only once it has succeeded; after triggers
+// get it to make their own writes in, which are undone with the rest if
+// anything fails.
+type Tx struct {
+	db       *Database
+	triggers map[*Table][]*Trigger
+	// writes are the table written and those its after triggers write to,
+	// directly or through theirs. It is empty when no after trigger can
+	// fire.
+	writes map[*Table]bool
+	// held are the tables locked for the whole write: the writes and every
+	// table linked to them by foreign keys.
+	held     map[*Table]bool
+	outgoing map[string][]foreignKey
+	incoming map[string][]foreignKey
+	undo     []func()
+	changes  []change
+	inserted map[*Table]bool
+	rewrite  bool
+	depth    int
+}
+
+// change is one write to the rows of a table, as published by the feed.
+type change struct {
+	table   *Table
+	kind    ChangeKind
+	befores []Row
+	afters  []Row
+}
+
+// begin starts a write to t. When after triggers may fire, it locks t, every
+// table they write to and every table those reach through foreign keys,
+// parents before children as other writers take them; the caller locks the
+// others it needs as usual, skipping the held ones.
+func (db *Database) begin(t *Table) *Tx {
+	tx := db.newTx()
+
+	db.Mu.RLock()
+	writes := make(map[*Table]bool)
+	tx.writes = writes
+	queue := []*Table{t}
+	for len(queue) > 0 {
+		x := queue[0]
+		queue = queue[1:]
+		triggers := db.tableTriggersLocked(x)
+		tx.triggers[x] = triggers
+		for _, tr := range triggers {
+			if tr.After == nil {
+				continue
+			}
+			writes[x] = true
+			for _, name := range tr.Writes {
+				target, ok := db.Tables[name]
+				if !ok || writes[target] {
+					continue
+				}
+				writes[target] = true
+				if _, seen := tx.triggers[target]; !seen {
+					queue = append(queue, target)
+				}
+			}
+		}
+	}
+	if len(writes) == 0 {
+		db.Mu.RUnlock()
+		return tx
+	}
+	tx.outgoing, tx.incoming = db.foreignKeyGraph()
+	db.Mu.RUnlock()
+
+	// Deletes cascade through children and writes check parents, so every
+	// table linked to a write is taken up front.
+	linked := make(map[*Table]bool, len(writes))
+	var tables []*Table
+	var link func(x *Table)
+	link = func(x *Table) {
+		if linked[x] {
+			return
+		}
+		linked[x] = true
+		tables = append(tables, x)
+		for _, fk := range tx.outgoing[x.Name] {
+			link(fk.parent)
+		}
+		for _, fk := range tx.incoming[x.Name] {
+			link(fk.child)
+		}
+	}
+	for x := range writes {
+		link(x)
+	}
+	depth := foreignKeyDepths(tx.outgoing)
+	lockOrder(tables, func(t *Table) int { return depth[t] })
+	tx.held = make(map[*Table]bool, len(tables))
+	for _, x := range tables {
+		x.Mu.Lock()
+		tx.held[x] = true
+	}
+	return tx
+}
+
+// newTx returns a transaction that fires no triggers.
+func (db *Database) newTx() *Tx {
+	return &Tx{db: db, triggers: make(map[*Table][]*Trigger), inserted: make(map[*Table]bool)}
+}
+
+// lock takes t's lock unless the transaction holds it already.
+func (tx *Tx) lock(t *Table) {
+	if !tx.held[t] {
+		t.Mu.Lock()
+	}
+}
+
+func (tx *Tx) unlock(t *Table) {
+	if !tx.held[t] {
+		t.Mu.Unlock()
+	}
+}
+
+// end commits the transaction when err is nil and rolls it back otherwise,
+// and returns err. The caller must still hold every lock.
+func (tx *Tx) end(err error) error {
+	if err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		tx.undo, tx.changes, tx.rewrite = nil, nil, false
+		return err
+	}
+	for _, c := range tx.changes {
+		c.table.publish(c.kind, c.befores, c.afters)
+	}
+	for t := range tx.inserted {
+		t.autoFlushLocked()
+	}
+	return nil
+}
+
+// close releases the held tables and rewrites the data file if a sealed
+// clump changed. The caller must have released its own locks.
+func (tx *Tx) close(err error) error {
+	for t := range tx.held {
+		t.Mu.Unlock()
+	}
+	if err != nil || !tx.rewrite {
+		return err
+	}
+	return tx.db.Rewrite()
+}
+
+// apply runs fn, which makes changes to t and reports whether a sealed
+// clump changed. If the transaction may roll back, the rows of t are kept
+// so they can be put back.
+func (tx *Tx) apply(t *Table, changes []change, fn func() bool) {
+	if len(tx.held) > 0 {
+		clumps := make([][]Row, len(t.SealedClumps))
+		for i, clump := range t.SealedClumps {
+			clumps[i] = clump.Rows
+		}
+		sealed, hot := t.SealedClumps, t.HotHeap.Rows
+		tx.undo = append(tx.undo, func() {
+			for _, c := range changes {
+				for _, row := range c.afters {
+					t.unindexRow(row)
+				}
+			}
+			t.SealedClumps, t.HotHeap.Rows = sealed, hot
+			for i, clump := range sealed {
+				clump.Rows = clumps[i]
+				clump.Metadata.RowCount = len(clumps[i])
+			}
+			for _, c := range changes {
+				for _, row := range c.befores {
+					t.indexRow(row)
+				}
+			}
+		})
+	}
+	if fn() {
+		tx.rewrite = true
+	}
+	for _, c := range changes {
+		if c.kind == ChangeInsert {
+			tx.inserted[t] = true
+		}
+	}
+	tx.changes = append(tx.changes, changes...)
+}
+
+// hasBefore reports whether any before trigger of t may fire for kind.
+func (tx *Tx) hasBefore(t *Table, kind ChangeKind) bool {
+	for _, tr := range tx.triggers[t] {
+		if tr.Before != nil && tr.fires(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// before runs the before triggers of t for ev.
+func (tx *Tx) before(t *Table, ev *HookEvent) error {
+	for _, tr := range tx.triggers[t] {
+		if tr.Before == nil || !tr.fires(ev.Kind) {
+			continue
+		}
+		if err := tr.Before(ev); err != nil {
+			return fmt.Errorf("trigger %s: %v", tr.Name, err)
+		}
+		if ev.After == nil && ev.Kind != ChangeDelete {
+			return fmt.Errorf("trigger %s: removed the row", tr.Name)
+		}
+	}
+	return nil
+}
+
+// after runs the after triggers of t for every row of changes, in order.
+func (tx *Tx) after(t *Table, changes []change) error {
+	tx.depth++
+	defer func() { tx.depth-- }()
+	for _, tr := range tx.triggers[t] {
+		if tr.After == nil {
+			continue
+		}
+		if tx.depth > maxTriggerDepth {
+			return fmt.Errorf("trigger %s: triggers nested too deeply", tr.Name)
+		}
+	}
+	for _, c := range changes {
+		n := max(len(c.befores), len(c.afters))
+		for i := 0; i < n; i++ {
+			ev := &HookEvent{Kind: c.kind, Table: t.Name}
+			if i < len(c.befores) {
+				ev.Before = c.befores[i]
+			}
+			if i < len(c.afters) {
+				ev.After = c.afters[i]
+			}
+			for _, tr := range tx.triggers[t] {
+				if tr.After == nil || !tr.fires(c.kind) {
+					continue
+				}
+				if err := tr.After(tx, ev); err != nil {
+					return fmt.Errorf("trigger %s: %v", tr.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// table returns a table the transaction holds, for the writes of a trigger.
+func (tx *Tx) table(name string) (*Table, error) {
+	for t := range tx.writes {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("table not declared in the trigger's writes: %s", name)
+}
+
+// Find returns copies of the rows of a table accepted by filter, or of every
+// row when filter is nil. Expired rows are left out.
+func (tx *Tx) Find(tableName string, filter func(Row) bool) ([]Row, error) {
+	rows, err := tx.find(tableName, filter)
+	for i, row := range rows {
+		rows[i] = withoutHidden(row)
+	}
+	return rows, err
+}
+
+// find returns the stored rows Find copies, ids included. They must not be
+// changed.
+func (tx *Tx) find(tableName string, filter func(Row) bool) ([]Row, error) {
+	t, err := tx.table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	live := t.Schema.live
+	var rows []Row
+	t.eachRowLocked(func(row Row) {
+		if live(row) && (filter == nil || filter(row)) {
+			rows = append(rows, row)
+		}
+	})
+	return rows, nil
+}
+
+// Insert inserts rows into a table, as BulkInsert does.
+func (tx *Tx) Insert(tableName string, rows ...Row) error {
+	t, err := tx.table(tableName)
+	if err != nil {
+		return err
+	}
+	outgoing := tx.outgoing[tableName]
+	release := lockParents(t, outgoing, tx.held)
+	defer release()
+	return t.insertLocked(tx, rows, outgoing, len(rows) > 1)
+}
+
+// Update applies update to the rows of a table accepted by filter, as
+// Table.UpdateWhere does, and returns how many it changed.
+func (tx *Tx) Update(tableName string, filter func(Row) bool, update Row) (int, error) {
+	t, err := tx.table(tableName)
+	if err != nil {
+		return 0, err
+	}
+	outgoing, incoming := tx.outgoing[tableName], tx.incoming[tableName]
+	release := lockParents(t, outgoing, tx.held)
+	unlockChildren := lockChildren(t, incoming, false, tx.held)
+	defer release()
+	defer unlockChildren()
+	return t.updateLocked(tx, filter, update, nil, outgoing, incoming)
+}
+
+// Delete removes the rows of a table accepted by filter, as
+// Table.DeleteWhere does, and returns how many it removed.
+func (tx *Tx) Delete(tableName string, filter func(Row) bool) (int, error) {
+	t, err := tx.table(tableName)
+	if err != nil {
+		return 0, err
+	}
+	plan := newDeletePlan(tx, t, tx.incoming)
+	defer plan.unlock(t)
+	return plan.run(t, filter, nil)
+}
@@ -0,0 +1,299 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// jsonKey is the index key used for values that are not hashable on their own
+// (maps and slices). It is a distinct type so it never collides with a string.
+type jsonKey string
+
+// IndexKey normalizes a value for use as a unique index key. Numbers inserted
+// from Go arrive as ints while rows loaded from disk or the bridge carry
+// float64, so every numeric type is folded onto float64.
+func IndexKey(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int8:
+		return float64(n)
+	case int16:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint:
+		return float64(n)
+	case uint8:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	case uint32:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	case map[string]interface{}, []interface{}, []float64, Row:
+		data, _ := json.Marshal(n)
+		return jsonKey(data)
+	case time.Time:
+		return timeKey(n.UTC().Format(time.RFC3339Nano))
+	case []byte:
+		return bytesKey(n)
+	}
+	return v
+}
+
+// timeKey and bytesKey stand in for timestamps, whose equality ignores the
+// zone, and byte slices, which are not hashable.
+type timeKey string
+type bytesKey string
+
+func newUniqueIndices(keys []uniqueKey) map[string]map[interface{}]Row {
+	indices := make(map[string]map[interface{}]Row)
+	for _, k := range keys {
+		indices[k.Name] = make(map[interface{}]Row)
+	}
+	return indices
+}
+
+// indexRow records the unique values, the text and the vectors of row. It
+// assumes the caller already checked for conflicts.
+func (t *Table) indexRow(row Row) {
+	for _, k := range t.Schema.uniqueKeys() {
+		t.UniqueIndices[k.Name][k.key(row)] = row
+	}
+	for _, x := range t.text {
+		x.add(row)
+	}
+	for _, x := range t.vectors {
+		x.add(row)
+	}
+}
+
+// unindexRow removes the unique values, the text and the vectors of row from
+// the indices. A unique value another row has taken over, as a new row may
+// from an expired one, is left alone.
+func (t *Table) unindexRow(row Row) {
+	for _, k := range t.Schema.uniqueKeys() {
+		key := k.key(row)
+		if owner, ok := t.UniqueIndices[k.Name][key]; ok && sameRow(owner, row) {
+			delete(t.UniqueIndices[k.Name], key)
+		}
+	}
+	for _, x := range t.text {
+		x.remove(row)
+	}
+	for _, x := range t.vectors {
+		x.remove(row)
+	}
+}
+
+// checkUnique reports the first unique index whose value in row is already
+// held by a row other than self. self may be nil for brand new rows. Expired
+// rows hold no values.
+func (t *Table) checkUnique(row Row, self Row) error {
+	live := t.Schema.live
+	for _, k := range t.Schema.uniqueKeys() {
+		if owner, exists := t.UniqueIndices[k.Name][k.key(row)]; exists && (self == nil || !sameRow(owner, self)) && live(owner) {
+			return errors.New("unique constraint violation: " + k.Name)
+		}
+	}
+	return nil
+}
+
+// countDuplicates returns how many rows would be dropped if k were enforced
+// on the current data, keeping the first row seen for each value.
+func (t *Table) countDuplicates(k uniqueKey) int {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+
+	seen := make(map[interface{}]struct{})
+	dups := 0
+	check := func(row Row) {
+		key := k.key(row)
+		if _, ok := seen[key]; ok {
+			dups++
+			return
+		}
+		seen[key] = struct{}{}
+	}
+	for _, clump := range t.SealedClumps {
+		for _, row := range clump.Rows {
+			check(row)
+		}
+	}
+	for _, row := range t.HotHeap.Rows {
+		check(row)
+	}
+	return dups
+}
+
+type IndexViolation struct {
+	Field string
+	Value interface{}
+	Count int
+}
+
+type VerifyReport struct {
+	Table      string
+	Rows       int
+	Violations []IndexViolation
+}
+
+// Verify rebuilds the unique indices of a table from its rows and reports any
+// value held by more than one row. The first row seen keeps the index entry.
+func (db *Database) Verify(tableName string) (*VerifyReport, error) {
+	db.Mu.RLock()
+	table, ok := db.Tables[tableName]
+	db.Mu.RUnlock()
+
+	if !ok {
+		return nil, errors.New("table not found: " + tableName)
+	}
+
+	table.Mu.Lock()
+	defer table.Mu.Unlock()
+
+	report := &VerifyReport{Table: tableName}
+	keys := table.Schema.uniqueKeys()
+	indices := newUniqueIndices(keys)
+	counts := make(map[string]map[interface{}]int)
+
+	check := func(row Row) {
+		report.Rows++
+		for _, k := range keys {
+			key := k.key(row)
+			if _, seen := indices[k.Name][key]; seen {
+				if counts[k.Name] == nil {
+					counts[k.Name] = make(map[interface{}]int)
+				}
+				counts[k.Name][key]++
+				continue
+			}
+			indices[k.Name][key] = row
+		}
+	}
+
+	for _, clump := range table.SealedClumps {
+		for _, row := range clump.Rows {
+			check(row)
+		}
+	}
+	for _, row := range table.HotHeap.Rows {
+		check(row)
+	}
+	table.UniqueIndices = indices
+
+	for _, k := range keys {
+		for key, dups := range counts[k.Name] {
+			report.Violations = append(report.Violations, IndexViolation{
+				Field: k.Name,
+				Value: k.value(indices[k.Name][key]),
+				Count: dups + 1,
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// HasUniqueIndex reports whether a unique index covers exactly fields.
+func (t *Table) HasUniqueIndex(fields ...string) bool {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+	_, ok := t.Schema.uniqueKeyFor(fields)
+	return ok
+}
+
+// LookupUnique finds the rows holding each of values in the unique index on
+// field, returning copies in the same order. Values held by no row, and
+// null values, give nil. It reports false when field has no unique index.
+func (t *Table) LookupUnique(field string, values []interface{}) ([]Row, bool) {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+
+	k, ok := t.Schema.uniqueKeyFor([]string{field})
+	if !ok {
+		return nil, false
+	}
+	index := t.UniqueIndices[k.Name]
+	out := make([]Row, len(values))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if row, found := index[k.key(Row{field: v})]; found && t.Schema.live(row) {
+			out[i] = withoutHidden(row)
+		}
+	}
+	return out, true
+}
+
+// UniqueIndexes returns the fields of every unique index of the table, keyed
+// by index name.
+func (t *Table) UniqueIndexes() map[string][]string {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+	out := make(map[string][]string)
+	for _, k := range t.Schema.uniqueKeys() {
+		out[k.Name] = append([]string(nil), k.Fields...)
+	}
+	return out
+}
+
+// LookupSnapshot probes the unique index covering fields with each of keys,
+// which hold one value per field in the same order, and returns the rows
+// found as a single-batch Snapshot taken at one moment. Values are read with
+// their field's type first, rows found by several keys appear once, and keys
+// with a null value find nothing. It reports false when no unique index
+// covers fields.
+func (t *Table) LookupSnapshot(fields []string, keys [][]interface{}) (*Snapshot, bool) {
+	t.syncView()
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+
+	k, ok := t.Schema.uniqueKeyFor(fields)
+	if !ok {
+		return nil, false
+	}
+	types := make(map[string]FieldType, len(t.Schema.Fields))
+	for _, f := range t.Schema.Fields {
+		types[f.Name] = f.Type
+	}
+	index := t.UniqueIndices[k.Name]
+	seen := make(map[int64]bool)
+	var rows []Row
+probe:
+	for _, key := range keys {
+		probe := make(Row, len(fields))
+		for i, f := range fields {
+			v := key[i]
+			if typ, ok := types[f]; ok {
+				if nv, err := normalizeValue(v, typ); err == nil {
+					v = nv
+				}
+			}
+			if v == nil {
+				continue probe
+			}
+			probe[f] = v
+		}
+		row, found := index[k.key(probe)]
+		if !found {
+			continue
+		}
+		if id, ok := RowID(row); ok {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		rows = append(rows, row)
+	}
+	return t.snapshotLocked([][]Row{rows}), true
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// FieldStats summarizes the values found under one field name.
+type FieldStats struct {
+	Name string
+	// Type is the dominant type of the non-null values.
+	Type FieldType
+	// Present counts rows with a non-null value, Mismatched the ones whose
+	// value is not of the dominant type.
+	Present    int
+	Mismatched int
+	Distinct   int
+	// Unique is set when every row holds a distinct value, making the field a
+	// candidate for a unique index.
+	Unique bool
+}
+
+// InferredSchema describes the rows of a table, or of orphaned clumps whose
+// table has no schema, and the schema they suggest.
+type InferredSchema struct {
+	Table    string
+	Orphan   bool
+	Clumps   int
+	Rows     int
+	Fields   []FieldStats
+	Proposed []Field
+}
+
+// InspectOrphans lists every table that has clumps on disk but no schema,
+// ordered by name.
+func (db *Database) InspectOrphans() []InferredSchema {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+
+	names := make([]string, 0, len(db.Orphans))
+	for name := range db.Orphans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]InferredSchema, 0, len(names))
+	for _, name := range names {
+		out = append(out, inferSchema(name, true, db.Orphans[name], nil))
+	}
+	return out
+}
+
+// InferSchema proposes a schema for the rows of a table, which may be an
+// orphan or a table with a schema already.
+func (db *Database) InferSchema(tableName string) (*InferredSchema, error) {
+	db.Mu.RLock()
+	defer db.Mu.RUnlock()
+
+	if clumps, ok := db.Orphans[tableName]; ok {
+		inferred := inferSchema(tableName, true, clumps, nil)
+		return &inferred, nil
+	}
+	table, ok := db.Tables[tableName]
+	if !ok {
+		return nil, errors.New("table not found: " + tableName)
+	}
+
+	table.Mu.RLock()
+	defer table.Mu.RUnlock()
+	inferred := inferSchema(tableName, false, table.SealedClumps, table.HotHeap.Rows)
+	return &inferred, nil
+}
+
+func inferSchema(tableName string, orphan bool, clumps []*SealedClump, extra []Row) InferredSchema {
+	type tally struct {
+		present int
+		types   map[FieldType]int
+		values  map[interface{}]bool
+	}
+	tallies := make(map[string]*tally)
+	rows := 0
+
+	count := func(row Row) {
+		rows++
+		for name, v := range row {
+			if hidden(name) || v == nil {
+				continue
+			}
+			t, ok := tallies[name]
+			if !ok {
+				t = &tally{types: make(map[FieldType]int), values: make(map[interface{}]bool)}
+				tallies[name] = t
+			}
+			t.present++
+			if typ, ok := valueType(v); ok {
+				t.types[typ]++
+			}
+			t.values[IndexKey(v)] = true
+		}
+	}
+	for _, clump := range clumps {
+		for _, row := range clump.Rows {
+			count(row)
+		}
+	}
+	for _, row := range extra {
+		count(row)
+	}
+
+	inferred := InferredSchema{Table: tableName, Orphan: orphan, Clumps: len(clumps), Rows: rows}
+	names := make([]string, 0, len(tallies))
+	for name := range tallies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := tallies[name]
+		typ := dominantType(t.types)
+		stats := FieldStats{
+			Name:       name,
+			Type:       typ,
+			Present:    t.present,
+			Mismatched: t.present - t.types[typ],
+			Distinct:   len(t.values),
+			Unique:     rows > 1 && t.present == rows && len(t.values) == rows,
+		}
+		// Whole numbers are counted as ints, so they fit a float field too.
+		if typ == FieldTypeFloat {
+			stats.Mismatched -= t.types[FieldTypeInt]
+		}
+		inferred.Fields = append(inferred.Fields, stats)
+		inferred.Proposed = append(inferred.Proposed, Field{Name: name, Type: typ, Unique: stats.Unique})
+	}
+	return inferred
+}
+
+// valueType returns the field type a stored value belongs to. Whole numbers
+// count as ints since every number comes back from disk as float64.
+func valueType(v interface{}) (FieldType, bool) {
+	switch x := v.(type) {
+	case bool:
+		return FieldTypeBool, true
+	case string:
+		// Timestamps read back from disk are RFC 3339 strings.
+		if _, err := time.Parse(time.RFC3339Nano, x); err == nil {
+			return FieldTypeTimestamp, true
+		}
+		return FieldTypeString, true
+	case time.Time:
+		return FieldTypeTimestamp, true
+	case []byte:
+		return FieldTypeBytes, true
+	case Decimal:
+		return FieldTypeDecimal, true
+	case map[string]interface{}:
+		return FieldTypeObject, true
+	case []interface{}:
+		return FieldTypeArray, true
+	}
+	if n, ok := toFloat(v); ok {
+		if n == math.Trunc(n) {
+			return FieldTypeInt, true
+		}
+		return FieldTypeFloat, true
+	}
+	return 0, false
+}
+
+// dominantType picks the most common type. Ints mixed with floats make a
+// float field.
+func dominantType(types map[FieldType]int) FieldType {
+	if types[FieldTypeFloat] > 0 {
+		merged := make(map[FieldType]int, len(types))
+		for typ, n := range types {
+			merged[typ] = n
+		}
+		merged[FieldTypeFloat] += merged[FieldTypeInt]
+		merged[FieldTypeInt] = 0
+		types = merged
+	}
+	best, bestCount := FieldTypeString, 0
+	for typ := FieldTypeInt; int(typ) < len(fieldTypeNames); typ++ {
+		if types[typ] > bestCount {
+			best, bestCount = typ, types[typ]
+		}
+	}
+	return best
+}
+
+// AdoptOrphans gives orphaned clumps a schema, making their rows visible
+// under tableName. When fields is nil the inferred schema is used. Rows that
+// break the schema are only dropped when force is set.
+func (db *Database) AdoptOrphans(tableName string, fields []Field, force bool, constraints ...Constraint) error {
+	db.Mu.Lock()
+	clumps, ok := db.Orphans[tableName]
+	if !ok {
+		db.Mu.Unlock()
+		return errors.New("no orphaned clumps for table: " + tableName)
+	}
+	if _, exists := db.Tables[tableName]; exists {
+		db.Mu.Unlock()
+		return errors.New("table already exists: " + tableName)
+	}
+	inferred := inferSchema(tableName, true, clumps, nil)
+	if fields == nil {
+		fields = inferred.Proposed
+	}
+	if err := validateFields(fields); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	if err := validateConstraints(fields, constraints); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	if err := db.validateForeignKeys(tableName, fields, constraints); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+
+	// Work on copies so a refused adoption leaves the orphans untouched.
+	table := &Table{
+		Db:      db,
+		Name:    tableName,
+		HotHeap: NewHotHeap(1000),
+	}
+	for _, clump := range clumps {
+		copied := *clump
+		copied.Rows = make([]Row, len(clump.Rows))
+		for i, row := range clump.Rows {
+			copied.Rows[i] = merged(row, nil)
+		}
+		table.SealedClumps = append(table.SealedClumps, &copied)
+	}
+	table.adoptIDsLocked()
+
+	change := fmt.Sprintf("TABLE_ADOPT: %d orphaned rows adopted", inferred.Rows)
+	schema := nextSchema(nil, fields, constraints, []string{change})
+	table.Schema = schema
+	table.decodeRowsLocked()
+	dropped := 0
+	db.applySchemaLocked(table, schema, func(Row, ConflictKind, string) { dropped++ })
+	if dropped > 0 && !force {
+		db.Mu.Unlock()
+		return fmt.Errorf("adopting %s would drop %d rows", tableName, dropped)
+	}
+
+	db.Schemas[tableName] = schema
+	db.Tables[tableName] = table
+	delete(db.Orphans, tableName)
+	db.Mu.Unlock()
+
+	if err := db.SaveSchemas(); err != nil {
+		return err
+	}
+	if dropped > 0 {
+		return db.Rewrite()
+	}
+	return nil
+}
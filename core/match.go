@@ -0,0 +1,206 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matcher compiles a match, as sent over the bridge, into a row filter. Keys
+// are field paths such as "address.city" or "tags[0]". A plain value must
+// equal the field. A map whose keys all start with "$" holds comparisons
+// instead: $eq, $ne, $gt, $gte, $lt, $lte, $in, $contains and $like (SQL
+// wildcards % and _). Values for top-level fields are normalized to the
+// field's type first, so a timestamp may be given as an RFC 3339 string.
+func (s *Schema) Matcher(match map[string]interface{}) (func(Row) bool, error) {
+	types := make(map[string]FieldType, len(s.Fields))
+	for _, f := range s.Fields {
+		types[f.Name] = f.Type
+	}
+	normalize := func(field string, v interface{}) (interface{}, error) {
+		typ, ok := types[field]
+		if !ok {
+			return v, nil
+		}
+		nv, err := normalizeValue(v, typ)
+		if err != nil {
+			return nil, fmt.Errorf("type mismatch: %s: %v", field, err)
+		}
+		return nv, nil
+	}
+
+	var preds []func(Row) bool
+	for field, want := range match {
+		path, err := ParsePath(field)
+		if err != nil {
+			return nil, err
+		}
+		get := func(r Row) interface{} {
+			v, _ := path.Get(r)
+			return v
+		}
+		ops, isOps := operators(want)
+		if !isOps {
+			v, err := normalize(field, want)
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, func(r Row) bool { return Equal(get(r), v) })
+			continue
+		}
+		for op, arg := range ops {
+			pred, err := comparison(field, get, op, arg, normalize)
+			if err != nil {
+				return nil, err
+			}
+			preds = append(preds, pred)
+		}
+	}
+
+	return func(r Row) bool {
+		for _, pred := range preds {
+			if !pred(r) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Matcher compiles match against the schema of a table. See Schema.Matcher.
+func (db *Database) Matcher(tableName string, match map[string]interface{}) (func(Row) bool, error) {
+	db.Mu.RLock()
+	schema, ok := db.Schemas[tableName]
+	db.Mu.RUnlock()
+	if !ok {
+		return nil, errors.New("table not found: " + tableName)
+	}
+	return schema.Matcher(match)
+}
+
+func operators(v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil, false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+func comparison(field string, get func(Row) interface{}, op string, arg interface{}, normalize func(string, interface{}) (interface{}, error)) (func(Row) bool, error) {
+	switch op {
+	case "$in":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s expects an array", op)
+		}
+		values := make([]interface{}, len(list))
+		for i, v := range list {
+			nv, err := normalize(field, v)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = nv
+		}
+		return func(r Row) bool {
+			for _, v := range values {
+				if Equal(get(r), v) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "$contains":
+		return func(r Row) bool { return Contains(get(r), arg) }, nil
+
+	case "$like":
+		pattern, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a string", op)
+		}
+		re := likePattern(pattern)
+		return func(r Row) bool {
+			s, ok := get(r).(string)
+			return ok && re.MatchString(s)
+		}, nil
+	}
+
+	v, err := normalize(field, arg)
+	if err != nil {
+		return nil, err
+	}
+	var test func(int) bool
+	switch op {
+	case "$eq":
+		test = func(c int) bool { return c == 0 }
+	case "$ne":
+		test = func(c int) bool { return c != 0 }
+	case "$gt":
+		test = func(c int) bool { return c > 0 }
+	case "$gte":
+		test = func(c int) bool { return c >= 0 }
+	case "$lt":
+		test = func(c int) bool { return c < 0 }
+	case "$lte":
+		test = func(c int) bool { return c <= 0 }
+	default:
+		return nil, fmt.Errorf("unknown match operator: %s", op)
+	}
+	if op == "$eq" || op == "$ne" {
+		return func(r Row) bool { return test(Compare(get(r), v)) }, nil
+	}
+	// Ordering only applies between values of the same kind, so null never
+	// matches a range.
+	return func(r Row) bool {
+		got := get(r)
+		return valueRank(got) == valueRank(v) && test(Compare(got, v))
+	}, nil
+}
+
+// likePattern compiles an SQL LIKE pattern: % matches any run of characters
+// and _ matches exactly one.
+func likePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, c := range pattern {
+		switch c {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// Contains reports whether a string holds a substring, an array holds an
+// element, or an object holds a key.
+func Contains(v, item interface{}) bool {
+	switch x := v.(type) {
+	case string:
+		s, ok := item.(string)
+		return ok && strings.Contains(x, s)
+	case []interface{}:
+		for _, e := range x {
+			if Equal(e, item) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		k, ok := item.(string)
+		if ok {
+			_, exists := x[k]
+			return exists
+		}
+	}
+	return false
+}
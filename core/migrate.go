@@ -0,0 +1,539 @@
+package core
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MigrationKind names one explicit step of a schema migration.
+type MigrationKind string
+
+const (
+	MigrateRenameField MigrationKind = "rename_field"
+	MigrateRenameTable MigrationKind = "rename_table"
+	MigrateCast        MigrationKind = "cast"
+	MigrateBackfill    MigrationKind = "backfill"
+)
+
+// CastFailure decides what happens to a value that cannot be converted.
+type CastFailure string
+
+const (
+	CastFail    CastFailure = "fail"
+	CastNull    CastFailure = "null"
+	CastDefault CastFailure = "default"
+	CastDrop    CastFailure = "drop"
+)
+
+// MigrationStep is one step run by Migrate. Field names refer to the table as
+// left by the previous step.
+//
+//   - rename_field renames Field to To.
+//   - rename_table renames the table to To.
+//   - cast converts Field to Type. Values that do not convert are handled by
+//     OnFailure; CastDefault substitutes Value.
+//   - backfill sets Field, of Type, on every row where it is null: to Value,
+//     to the value of From, or to the result of Derive. Values go through the
+//     same conversion as a cast.
+type MigrationStep struct {
+	Kind      MigrationKind
+	Field     string                `json:",omitempty"`
+	To        string                `json:",omitempty"`
+	Type      FieldType             `json:",omitempty"`
+	OnFailure CastFailure           `json:",omitempty"`
+	Value     interface{}           `json:",omitempty"`
+	From      string                `json:",omitempty"`
+	Derive    func(Row) interface{} `json:"-"`
+}
+
+func (s MigrationStep) onFailure() CastFailure {
+	if s.OnFailure == "" {
+		return CastFail
+	}
+	return s.OnFailure
+}
+
+// migrationPlan is the outcome of checking steps against a schema.
+type migrationPlan struct {
+	steps       []MigrationStep
+	name        string
+	fields      []Field
+	constraints []Constraint
+	renames     map[string]string // original field name to final name
+	changes     []string
+
+	// A dry run keeps going past values that fail to convert, reporting
+	// every row a step touches to observe instead.
+	dryRun  bool
+	observe func(step int, row Row, failed bool)
+}
+
+// planMigration validates steps against schema and works out the table name
+// and field list they lead to. Table names are checked by the caller.
+func planMigration(tableName string, schema *Schema, steps []MigrationStep) (*migrationPlan, error) {
+	plan := &migrationPlan{
+		steps:       append([]MigrationStep(nil), steps...),
+		name:        tableName,
+		fields:      append([]Field(nil), schema.Fields...),
+		constraints: append([]Constraint(nil), schema.Constraints...),
+		renames:     make(map[string]string),
+	}
+	for _, f := range schema.Fields {
+		plan.renames[f.Name] = f.Name
+	}
+	find := func(name string) int {
+		for i, f := range plan.fields {
+			if f.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for n, step := range steps {
+		switch step.Kind {
+		case MigrateRenameField:
+			i := find(step.Field)
+			if i < 0 {
+				return nil, fmt.Errorf("step %d: unknown field: %s", n, step.Field)
+			}
+			if step.To == "" || find(step.To) >= 0 {
+				return nil, fmt.Errorf("step %d: invalid new name for field %s: %q", n, step.Field, step.To)
+			}
+			plan.fields[i].Name = step.To
+			for c := range plan.constraints {
+				plan.constraints[c].Fields = renamed(plan.constraints[c].Fields, step.Field, step.To)
+				if plan.constraints[c].RefTable == plan.name {
+					plan.constraints[c].RefFields = renamed(plan.constraints[c].RefFields, step.Field, step.To)
+				}
+			}
+			for orig, cur := range plan.renames {
+				if cur == step.Field {
+					plan.renames[orig] = step.To
+				}
+			}
+			plan.changes = append(plan.changes, fmt.Sprintf("FIELD_RENAME: field '%s' renamed to '%s'", step.Field, step.To))
+
+		case MigrateRenameTable:
+			if step.To == "" {
+				return nil, fmt.Errorf("step %d: missing new table name", n)
+			}
+			for c := range plan.constraints {
+				if plan.constraints[c].RefTable == plan.name {
+					plan.constraints[c].RefTable = step.To
+				}
+			}
+			plan.changes = append(plan.changes, fmt.Sprintf("TABLE_RENAME: table '%s' renamed to '%s'", plan.name, step.To))
+			plan.name = step.To
+
+		case MigrateCast:
+			i := find(step.Field)
+			if i < 0 {
+				return nil, fmt.Errorf("step %d: unknown field: %s", n, step.Field)
+			}
+			if !canCast(plan.fields[i].Type, step.Type) {
+				return nil, fmt.Errorf("step %d: unsupported cast of field %s from %v to %v", n, step.Field, plan.fields[i].Type, step.Type)
+			}
+			if err := step.checkFailure(); err != nil {
+				return nil, fmt.Errorf("step %d: %v", n, err)
+			}
+			plan.changes = append(plan.changes, fmt.Sprintf("FIELD_CAST: field '%s' cast from %v to %v (on failure: %s)", step.Field, plan.fields[i].Type, step.Type, step.onFailure()))
+			plan.fields[i].Type = step.Type
+
+		case MigrateBackfill:
+			if step.Field == "" {
+				return nil, fmt.Errorf("step %d: missing field to backfill", n)
+			}
+			sources := 0
+			if step.Value != nil {
+				sources++
+			}
+			if step.From != "" {
+				if find(step.From) < 0 {
+					return nil, fmt.Errorf("step %d: unknown field: %s", n, step.From)
+				}
+				sources++
+			}
+			if step.Derive != nil {
+				sources++
+			}
+			if sources != 1 {
+				return nil, fmt.Errorf("step %d: backfill needs exactly one of a value, a source field or a derive function", n)
+			}
+			if err := step.checkFailure(); err != nil {
+				return nil, fmt.Errorf("step %d: %v", n, err)
+			}
+			if i := find(step.Field); i >= 0 {
+				// An existing field keeps its declared type.
+				plan.steps[n].Type = plan.fields[i].Type
+			} else {
+				plan.fields = append(plan.fields, Field{Name: step.Field, Type: step.Type})
+			}
+			plan.changes = append(plan.changes, fmt.Sprintf("FIELD_BACKFILL: field '%s' filled where null", step.Field))
+
+		default:
+			return nil, fmt.Errorf("step %d: unknown migration step: %q", n, step.Kind)
+		}
+	}
+	return plan, nil
+}
+
+func (s MigrationStep) checkFailure() error {
+	switch s.onFailure() {
+	case CastFail, CastNull, CastDrop:
+		return nil
+	case CastDefault:
+		if s.Value == nil || s.Kind == MigrateBackfill {
+			return errors.New("default failure policy needs a cast with a value")
+		}
+		if _, ok := convertValue(s.Value, s.Type); !ok {
+			return fmt.Errorf("default value %v does not convert to %v", s.Value, s.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown failure policy: %q", s.OnFailure)
+}
+
+func renamed(names []string, from, to string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = renamedPath(n, from, to)
+	}
+	return out
+}
+
+// canCast reports whether values of type from can be converted to type to.
+func canCast(from, to FieldType) bool {
+	if from == to {
+		return true
+	}
+	switch from {
+	case FieldTypeInt:
+		return to == FieldTypeFloat || to == FieldTypeString || to == FieldTypeDecimal || to == FieldTypeTimestamp
+	case FieldTypeFloat, FieldTypeDecimal:
+		return to == FieldTypeInt || to == FieldTypeFloat || to == FieldTypeString || to == FieldTypeDecimal
+	case FieldTypeString:
+		return to == FieldTypeInt || to == FieldTypeFloat || to == FieldTypeDecimal || to == FieldTypeTimestamp || to == FieldTypeBytes
+	case FieldTypeTimestamp, FieldTypeBytes:
+		return to == FieldTypeString
+	}
+	return false
+}
+
+// convertValue converts v to typ. Numbers are stored as float64, the way they
+// come back from disk. Floats only become ints when they have no fraction.
+func convertValue(v interface{}, typ FieldType) (interface{}, bool) {
+	if v == nil {
+		return nil, true
+	}
+	switch typ {
+	case FieldTypeInt, FieldTypeFloat:
+		n, ok := toFloat(v)
+		if !ok {
+			s, isString := v.(string)
+			if !isString {
+				return nil, false
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, false
+			}
+			n = parsed
+		}
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, false
+		}
+		if typ == FieldTypeInt && n != math.Trunc(n) {
+			return nil, false
+		}
+		return n, true
+	case FieldTypeString:
+		switch x := v.(type) {
+		case string:
+			return x, true
+		case Decimal:
+			return string(x), true
+		case time.Time:
+			return x.Format(time.RFC3339Nano), true
+		case []byte:
+			return base64.StdEncoding.EncodeToString(x), true
+		}
+		if n, ok := toFloat(v); ok {
+			return strconv.FormatFloat(n, 'f', -1, 64), true
+		}
+		return nil, false
+	case FieldTypeBool:
+		b, ok := v.(bool)
+		return b, ok
+	}
+	nv, err := normalizeValue(v, typ)
+	return nv, err == nil
+}
+
+// apply runs the row-level steps on a copy of row. It reports false when a
+// step's failure policy drops the row.
+func (p *migrationPlan) apply(row Row) (Row, bool, error) {
+	out := make(Row, len(row)+1)
+	for k, v := range row {
+		out[k] = v
+	}
+
+	for n, step := range p.steps {
+		switch step.Kind {
+		case MigrateRenameField:
+			if v, ok := out[step.Field]; ok {
+				out[step.To] = v
+				delete(out, step.Field)
+				p.note(n, out, false)
+			}
+		case MigrateCast, MigrateBackfill:
+			v := out[step.Field]
+			if step.Kind == MigrateBackfill {
+				if v != nil {
+					continue
+				}
+				switch {
+				case step.From != "":
+					v = out[step.From]
+				case step.Derive != nil:
+					v = step.Derive(out)
+				default:
+					v = step.Value
+				}
+			}
+			converted, ok := convertValue(v, step.Type)
+			if !ok {
+				p.note(n, out, true)
+				switch step.onFailure() {
+				case CastFail:
+					if !p.dryRun {
+						return nil, false, fmt.Errorf("cannot convert %v of field %s to %v", v, step.Field, step.Type)
+					}
+					converted = nil
+				case CastDrop:
+					return nil, false, nil
+				case CastNull:
+					converted = nil
+				case CastDefault:
+					converted, _ = convertValue(step.Value, step.Type)
+				}
+			} else if step.Kind == MigrateBackfill || IndexKey(converted) != IndexKey(v) {
+				p.note(n, out, false)
+			}
+			out[step.Field] = converted
+		}
+	}
+	return out, true, nil
+}
+
+func (p *migrationPlan) note(step int, row Row, failed bool) {
+	if p.observe != nil {
+		p.observe(step, row, failed)
+	}
+}
+
+// stage returns a detached copy of t with the steps of plan applied to every
+// row. The caller must hold the table's lock.
+func (t *Table) stage(plan *migrationPlan) (*Table, error) {
+	staged := &Table{
+		Db:      t.Db,
+		Name:    plan.name,
+		Schema:  &Schema{Version: t.Schema.Version, Fields: plan.fields, Constraints: plan.constraints},
+		HotHeap: &HotHeap{Rows: nil, MaxRows: t.HotHeap.MaxRows},
+	}
+	convert := func(rows []Row) ([]Row, error) {
+		var kept []Row
+		for _, row := range rows {
+			out, keep, err := plan.apply(row)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				kept = append(kept, out)
+			}
+		}
+		return kept, nil
+	}
+
+	for _, clump := range t.SealedClumps {
+		rows, err := convert(clump.Rows)
+		if err != nil {
+			return nil, err
+		}
+		copied := *clump
+		copied.Rows = rows
+		copied.Metadata.RowCount = len(rows)
+		staged.SealedClumps = append(staged.SealedClumps, &copied)
+	}
+	rows, err := convert(t.HotHeap.Rows)
+	if err != nil {
+		return nil, err
+	}
+	staged.HotHeap.Rows = rows
+
+	staged.UniqueIndices = newUniqueIndices(staged.Schema.uniqueKeys())
+	return staged, nil
+}
+
+// Migrate runs steps against a table and then syncs it to newFields and
+// constraints like SyncSchema. Rows are rewritten once, and the data file and
+// schemas are replaced together, so a crash leaves either the old or the new
+// database. After a rename_table step the table is known by its new name.
+func (db *Database) Migrate(tableName string, steps []MigrationStep, newFields []Field, force bool, constraints ...Constraint) error {
+	name, err := db.migrate(tableName, steps, newFields, force, constraints)
+	if err != nil {
+		return err
+	}
+	return db.refreshViewsOf(name)
+}
+
+// migrate is Migrate up to refreshing the views of the table, which it
+// returns the name of.
+func (db *Database) migrate(tableName string, steps []MigrationStep, newFields []Field, force bool, constraints []Constraint) (string, error) {
+	if err := validateFields(newFields); err != nil {
+		return "", err
+	}
+	if err := validateConstraints(newFields, constraints); err != nil {
+		return "", err
+	}
+
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+
+	table, ok := db.Tables[tableName]
+	if !ok {
+		return "", errors.New("table not found: " + tableName)
+	}
+
+	table.Mu.Lock()
+	table.upgradeLocked()
+	plan, err := planMigration(tableName, table.Schema, steps)
+	if err != nil {
+		table.Mu.Unlock()
+		return "", err
+	}
+	if _, exists := db.Tables[plan.name]; exists && plan.name != tableName {
+		table.Mu.Unlock()
+		return "", errors.New("table already exists: " + plan.name)
+	}
+	staged, err := table.stage(plan)
+	table.Mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	// Tables pointing at this one follow its renames.
+	schemas := make(map[string]*Schema, len(db.Schemas))
+	for name, schema := range db.Schemas {
+		if name == tableName {
+			continue
+		}
+		if retargeted, changed := plan.retarget(tableName, schema); changed {
+			schema = retargeted
+		}
+		if v := schema.View; v != nil && v.Table == tableName && plan.name != tableName {
+			// Views follow too.
+			renamed, view := *schema, *v
+			view.Table = plan.name
+			renamed.View = &view
+			schema = &renamed
+		}
+		if plan.name != tableName {
+			// So do rules writing to it.
+			schema = schema.renameRuleTable(tableName, plan.name)
+		}
+		schemas[name] = schema
+	}
+	if err := validateForeignKeysIn(schemas, plan.name, newFields, constraints); err != nil {
+		return "", err
+	}
+	if err := db.reshapeLocked(tableName, newFields); err != nil {
+		return "", err
+	}
+
+	report := db.diffLocked(plan.name, staged.Schema, staged, newFields, constraints)
+	if !report.Compatiable && !force {
+		return "", fmt.Errorf("incompatible schema change: %v", report.Conflicts)
+	}
+
+	table.Mu.Lock()
+	// Rows may have changed since staging.
+	if staged, err = table.stage(plan); err != nil {
+		table.Mu.Unlock()
+		return "", err
+	}
+	if plan.name != tableName {
+		delete(db.Tables, tableName)
+		delete(db.Schemas, tableName)
+		db.Tables[plan.name] = table
+		table.Name = plan.name
+		db.renameTriggersLocked(tableName, plan.name)
+	}
+	changes := append(plan.changes, report.Conflicts...)
+	schema := reviseSchema(table.Schema, newFields, constraints, changes)
+	if plan.name != tableName {
+		schema = schema.renameRuleTable(tableName, plan.name)
+	}
+	db.Schemas[plan.name] = schema
+	table.SealedClumps = staged.SealedClumps
+	table.HotHeap.Rows = staged.HotHeap.Rows
+	db.applySchemaLocked(table, schema, nil)
+	table.Mu.Unlock()
+
+	// The tables that follow are locked one at a time, as SetTTL does.
+	for name, schema := range schemas {
+		if schema != db.Schemas[name] {
+			other := db.Tables[name]
+			other.Mu.Lock()
+			other.Schema = schema
+			db.Schemas[name] = schema
+			other.Mu.Unlock()
+		}
+	}
+
+	return plan.name, db.commitLocked()
+}
+
+// renamed returns ref, a field or a path into one, with its root field
+// renamed as the plan renames it.
+func (p *migrationPlan) renamed(ref string) string {
+	path, err := ParsePath(ref)
+	if err != nil {
+		return ref
+	}
+	root := path.Root()
+	to, ok := p.renames[root]
+	if !ok {
+		return ref
+	}
+	return to + ref[len(root):]
+}
+
+// retarget rewrites the foreign keys of schema that point at the migrated
+// table. It returns a new schema revision when anything changed.
+func (p *migrationPlan) retarget(tableName string, schema *Schema) (*Schema, bool) {
+	constraints := append([]Constraint(nil), schema.Constraints...)
+	changed := false
+	for i, c := range constraints {
+		if c.Kind != ConstraintForeignKey || c.RefTable != tableName {
+			continue
+		}
+		refs := make([]string, len(c.RefFields))
+		for j, f := range c.RefFields {
+			refs[j] = p.renamed(f)
+		}
+		constraints[i].RefTable = p.name
+		constraints[i].RefFields = refs
+		changed = true
+	}
+	if !changed {
+		return schema, false
+	}
+	change := fmt.Sprintf("FOREIGN_KEY_RETARGET: references to '%s' follow its migration", tableName)
+	return nextSchema(schema, schema.Fields, constraints, []string{change}), true
+}
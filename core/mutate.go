@@ -0,0 +1,597 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// BackupFunc receives the original rows of a mutation before anything is
+// changed, once per affected table. Returning an error aborts the mutation.
+type BackupFunc func(tableName string, rows []Row) error
+
+// UpdateWhere applies update to every row matched by filter, keeping the
+// unique indices in step and enforcing foreign keys in both directions. It
+// returns the number of rows changed. Changing a row of a sealed clump
+// rewrites the database file.
+func (t *Table) UpdateWhere(filter func(Row) bool, update Row, backup BackupFunc) (int, error) {
+	outgoing, incoming := t.Db.foreignKeys(t.Name)
+
+	tx := t.Db.begin(t)
+	release := lockParents(t, outgoing, tx.held)
+	tx.lock(t)
+	unlockChildren := lockChildren(t, incoming, false, tx.held)
+	n, err := t.updateLocked(tx, filter, update, backup, outgoing, incoming)
+	err = tx.end(err)
+	unlockChildren()
+	tx.unlock(t)
+	release()
+
+	return n, tx.close(err)
+}
+
+func (t *Table) updateLocked(tx *Tx, filter func(Row) bool, update Row, backup BackupFunc, outgoing, incoming []foreignKey) (int, error) {
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
+	if _, ok := update[RowIDField]; ok {
+		return 0, errRowIDReadOnly
+	}
+	update = merged(update, nil)
+	if err := t.Schema.normalizeRow(update); err != nil {
+		return 0, err
+	}
+	// Expired rows are gone as far as updates are concerned.
+	if live := t.Schema.liveAt(time.Now()); live != nil {
+		match := filter
+		filter = func(row Row) bool { return live(row) && match(row) }
+	}
+	matched, sealed := t.matchLocked(filter)
+	if len(matched) == 0 {
+		return 0, nil
+	}
+
+	newRows := make([]Row, len(matched))
+	for i, row := range matched {
+		newRows[i] = merged(row, update)
+	}
+	// Fields set by before triggers are checked like those of update.
+	checked := update
+	hooked := tx.hasBefore(t, ChangeUpdate)
+	if hooked {
+		checked = merged(update, nil)
+		for i, row := range matched {
+			ev := &HookEvent{Kind: ChangeUpdate, Table: t.Name, Before: row, After: newRows[i]}
+			if err := tx.before(t, ev); err != nil {
+				return 0, err
+			}
+			if _, ok := ev.After[RowIDField]; !ok || !Equal(ev.After[RowIDField], row[RowIDField]) {
+				return 0, errRowIDReadOnly
+			}
+			if err := t.Schema.normalizeRow(ev.After); err != nil {
+				return 0, err
+			}
+			for k, v := range ev.After {
+				if _, ok := checked[k]; !ok && !Equal(v, row[k]) {
+					checked[k] = v
+				}
+			}
+			newRows[i] = ev.After
+		}
+	}
+	// Computed fields follow the fields they read, and are checked where
+	// they change.
+	computed := t.Schema.hasComputed()
+	if computed {
+		if !hooked {
+			checked = merged(update, nil)
+		}
+		for i, row := range newRows {
+			if err := t.Schema.computeRow(row); err != nil {
+				return 0, err
+			}
+			for _, f := range t.Schema.Fields {
+				if f.Expr != "" && !Equal(row[f.Name], matched[i][f.Name]) {
+					checked[f.Name] = row[f.Name]
+				}
+			}
+		}
+	}
+
+	if err := t.checkUniqueUpdate(matched, newRows, checked); err != nil {
+		return 0, err
+	}
+	rows := []Row{update}
+	if hooked || computed {
+		rows = newRows
+	}
+	for _, f := range t.Schema.Fields {
+		if _, ok := checked[f.Name]; !ok {
+			continue
+		}
+		for _, row := range rows {
+			if err := f.Check(row[f.Name]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, fk := range outgoing {
+		if !touches(checked, fk.Fields) {
+			continue
+		}
+		for _, row := range newRows {
+			if err := fk.check(row); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := checkReferencesKept(incoming, matched, newRows); err != nil {
+		return 0, err
+	}
+
+	if backup != nil {
+		if err := backup(t.Name, matched); err != nil {
+			return 0, err
+		}
+	}
+
+	changes := []change{{table: t, kind: ChangeUpdate, befores: matched, afters: newRows}}
+	tx.apply(t, changes, func() bool {
+		t.replaceLocked(matched, newRows)
+		return sealed
+	})
+
+	return len(matched), tx.after(t, changes)
+}
+
+// DeleteWhere removes every row matched by filter and releases their unique
+// values. Rows in other tables that reference a removed row are handled by
+// the OnDelete action of their foreign key. It returns the number of rows
+// removed from t.
+func (t *Table) DeleteWhere(filter func(Row) bool, backup BackupFunc) (int, error) {
+	return t.deleteWhere(filter, backup, true)
+}
+
+// deleteWhere is DeleteWhere, firing the table's triggers only if fire is
+// set.
+func (t *Table) deleteWhere(filter func(Row) bool, backup BackupFunc, fire bool) (int, error) {
+	t.Db.Mu.RLock()
+	_, incoming := t.Db.foreignKeyGraph()
+	t.Db.Mu.RUnlock()
+
+	tx := t.Db.newTx()
+	if fire {
+		tx = t.Db.begin(t)
+	}
+	tx.lock(t)
+	plan := newDeletePlan(tx, t, incoming)
+	n, err := plan.run(t, filter, backup)
+	err = tx.end(err)
+	plan.unlock(t)
+	tx.unlock(t)
+
+	return n, tx.close(err)
+}
+
+type nullOp struct {
+	row    Row
+	fields []string
+}
+
+// deletePlan collects every row a delete reaches through cascading foreign
+// keys, so restrict violations abort before anything has changed.
+type deletePlan struct {
+	tx       *Tx
+	incoming map[string][]foreignKey
+	locked   map[*Table]bool
+	removed  map[*Table][]Row
+	nulled   map[*Table][]nullOp
+	seen     map[*Table]rowSet
+}
+
+// newDeletePlan starts a delete from root, which the caller has locked. It
+// locks every table the delete may reach, in lockOrder, before any is read.
+func newDeletePlan(tx *Tx, root *Table, incoming map[string][]foreignKey) *deletePlan {
+	p := &deletePlan{
+		tx:       tx,
+		incoming: incoming,
+		locked:   map[*Table]bool{root: true},
+		removed:  make(map[*Table][]Row),
+		nulled:   make(map[*Table][]nullOp),
+		seen:     make(map[*Table]rowSet),
+	}
+	var reached []*Table
+	depths := make(map[*Table]int)
+	var reach func(t *Table)
+	reach = func(t *Table) {
+		for _, fk := range incoming[t.Name] {
+			child := fk.child
+			if _, seen := depths[child]; seen || p.locked[child] {
+				continue
+			}
+			depths[child] = fk.childDepth
+			if !tx.held[child] {
+				reached = append(reached, child)
+			}
+			reach(child)
+		}
+	}
+	reach(root)
+	lockOrder(reached, func(t *Table) int { return depths[t] })
+	for _, child := range reached {
+		child.Mu.Lock()
+		p.locked[child] = true
+	}
+	return p
+}
+
+func (p *deletePlan) run(t *Table, filter func(Row) bool, backup BackupFunc) (int, error) {
+	if err := t.writable(); err != nil {
+		return 0, err
+	}
+	matched, _ := t.matchLocked(filter)
+	if len(matched) == 0 {
+		return 0, nil
+	}
+	for _, row := range matched {
+		if err := p.tx.before(t, &HookEvent{Kind: ChangeDelete, Table: t.Name, Before: row}); err != nil {
+			return 0, err
+		}
+	}
+	p.remove(t, matched)
+	if err := p.collect(t, matched); err != nil {
+		return 0, err
+	}
+
+	if backup != nil {
+		for table, rows := range p.removed {
+			if err := backup(table.Name, rows); err != nil {
+				return 0, err
+			}
+		}
+		for table, ops := range p.nulled {
+			if err := backup(table.Name, opsRows(ops)); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	for table, rows := range p.removed {
+		p.tx.apply(table, []change{{table: table, kind: ChangeDelete, befores: rows}}, func() bool {
+			return table.removeLocked(rows)
+		})
+	}
+	for table, ops := range p.nulled {
+		// A row reached by several foreign keys gets all of its fields
+		// nulled in one new version.
+		nulls := make(map[uintptr]Row)
+		var olds, news []Row
+		for _, op := range ops {
+			if p.seen[table].has(op.row) {
+				continue
+			}
+			id := reflect.ValueOf(op.row).Pointer()
+			next, ok := nulls[id]
+			if !ok {
+				next = merged(op.row, nil)
+				nulls[id] = next
+				olds = append(olds, op.row)
+				news = append(news, next)
+			}
+			for _, f := range op.fields {
+				next[f] = nil
+			}
+		}
+		p.tx.apply(table, []change{{table: table, kind: ChangeUpdate, befores: olds, afters: news}}, func() bool {
+			return table.replaceLocked(olds, news)
+		})
+	}
+
+	return len(matched), p.tx.after(t, []change{{table: t, kind: ChangeDelete, befores: matched}})
+}
+
+func (p *deletePlan) remove(t *Table, rows []Row) []Row {
+	if p.seen[t] == nil {
+		p.seen[t] = make(rowSet)
+	}
+	var fresh []Row
+	for _, row := range rows {
+		if p.seen[t].add(row) {
+			fresh = append(fresh, row)
+		}
+	}
+	p.removed[t] = append(p.removed[t], fresh...)
+	return fresh
+}
+
+// collect follows the foreign keys pointing at t for the rows being removed.
+func (p *deletePlan) collect(t *Table, rows []Row) error {
+	for _, fk := range p.incoming[t.Name] {
+		keys := make(map[interface{}]bool, len(rows))
+		for _, row := range rows {
+			keys[fk.parentKey.key(row)] = true
+		}
+
+		child := fk.child
+		var refs []Row
+		child.eachRowLocked(func(row Row) {
+			if key, ok := fk.lookup(row); ok && keys[key] && !p.seen[child].has(row) {
+				refs = append(refs, row)
+			}
+		})
+		if len(refs) == 0 {
+			continue
+		}
+
+		switch fk.action() {
+		case ActionRestrict:
+			return fmt.Errorf("foreign key violation: %s.%s still references %s", child.Name, fk.IndexName(), t.Name)
+		case ActionCascade:
+			if fresh := p.remove(child, refs); len(fresh) > 0 {
+				if err := p.collect(child, fresh); err != nil {
+					return err
+				}
+			}
+		case ActionSetNull:
+			for _, row := range refs {
+				p.nulled[child] = append(p.nulled[child], nullOp{row: row, fields: fk.Fields})
+			}
+		}
+	}
+	return nil
+}
+
+// unlock releases the tables the plan locked.
+func (p *deletePlan) unlock(root *Table) {
+	for table := range p.locked {
+		if table != root {
+			table.Mu.Unlock()
+		}
+	}
+}
+
+// Restore puts a previously removed row back into the HotHeap, subject to the
+// same unique and foreign key constraints as an insert.
+func (t *Table) Restore(row Row) error {
+	outgoing, _ := t.Db.foreignKeys(t.Name)
+	release := lockParents(t, outgoing, nil)
+	defer release()
+
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+
+	if err := t.writable(); err != nil {
+		return err
+	}
+	if err := t.Schema.normalizeRow(row); err != nil {
+		return err
+	}
+	if err := t.Schema.computeRow(row); err != nil {
+		return err
+	}
+	if err := t.Schema.checkRow(row); err != nil {
+		return err
+	}
+	if err := t.checkUnique(row, nil); err != nil {
+		return err
+	}
+	if err := checkForeignKeys(outgoing, row); err != nil {
+		return err
+	}
+	// A restored row keeps its id unless another row has taken it since.
+	if id, ok := RowID(row); !ok || t.hasRowID(id) {
+		t.assignID(row)
+	}
+	t.indexRow(row)
+	t.HotHeap.Rows = append(t.HotHeap.Rows, row)
+	t.publish(ChangeInsert, nil, []Row{row})
+	return nil
+}
+
+// matchLocked returns the rows accepted by filter, and whether any of them
+// lives in a sealed clump.
+func (t *Table) matchLocked(filter func(Row) bool) ([]Row, bool) {
+	var matched []Row
+	sealed := false
+	for _, clump := range t.SealedClumps {
+		for _, row := range clump.Rows {
+			if filter(row) {
+				matched = append(matched, row)
+				sealed = true
+			}
+		}
+	}
+	for _, row := range t.HotHeap.Rows {
+		if filter(row) {
+			matched = append(matched, row)
+		}
+	}
+	return matched, sealed
+}
+
+// removeLocked drops rows from the table and its indices. It reports whether
+// a sealed clump changed.
+func (t *Table) removeLocked(rows []Row) bool {
+	set := make(rowSet, len(rows))
+	for _, row := range rows {
+		set.add(row)
+		t.unindexRow(row)
+	}
+
+	sealed := false
+	for _, clump := range t.SealedClumps {
+		kept := clump.Rows[:0:0]
+		for _, row := range clump.Rows {
+			if !set.has(row) {
+				kept = append(kept, row)
+			}
+		}
+		if len(kept) != len(clump.Rows) {
+			clump.Rows = kept
+			clump.Metadata.RowCount = len(kept)
+			sealed = true
+		}
+	}
+
+	var kept []Row
+	for _, row := range t.HotHeap.Rows {
+		if !set.has(row) {
+			kept = append(kept, row)
+		}
+	}
+	t.HotHeap.Rows = kept
+
+	return sealed
+}
+
+// replaceLocked swaps each row of olds for the row at the same position in
+// news. Rows are never changed in place: every batch holding a replaced row
+// is copied, so snapshots taken earlier keep seeing the old versions. It
+// reports whether a sealed clump changed.
+func (t *Table) replaceLocked(olds, news []Row) bool {
+	if len(olds) == 0 {
+		return false
+	}
+	next := make(map[uintptr]Row, len(olds))
+	for i, row := range olds {
+		next[reflect.ValueOf(row).Pointer()] = news[i]
+		t.unindexRow(row)
+	}
+	for _, row := range news {
+		t.indexRow(row)
+	}
+
+	swap := func(rows []Row) ([]Row, bool) {
+		var out []Row
+		for i, row := range rows {
+			repl, ok := next[reflect.ValueOf(row).Pointer()]
+			if !ok {
+				continue
+			}
+			if out == nil {
+				out = make([]Row, len(rows), cap(rows))
+				copy(out, rows)
+			}
+			out[i] = repl
+		}
+		if out == nil {
+			return rows, false
+		}
+		return out, true
+	}
+
+	sealed := false
+	for _, clump := range t.SealedClumps {
+		if rows, changed := swap(clump.Rows); changed {
+			clump.Rows = rows
+			sealed = true
+		}
+	}
+	t.HotHeap.Rows, _ = swap(t.HotHeap.Rows)
+	return sealed
+}
+
+func (t *Table) eachRowLocked(fn func(Row)) {
+	for _, clump := range t.SealedClumps {
+		for _, row := range clump.Rows {
+			fn(row)
+		}
+	}
+	for _, row := range t.HotHeap.Rows {
+		fn(row)
+	}
+}
+
+func opsRows(ops []nullOp) []Row {
+	rows := make([]Row, len(ops))
+	for i, op := range ops {
+		rows[i] = op.row
+	}
+	return rows
+}
+
+// lockChildren locks the tables whose foreign keys point at self, skipping
+// self and the tables held by a transaction.
+func lockChildren(self *Table, incoming []foreignKey, write bool, held map[*Table]bool) func() {
+	var children []*Table
+	depths := make(map[*Table]int)
+	for _, fk := range incoming {
+		if _, seen := depths[fk.child]; fk.child != self && !seen && !held[fk.child] {
+			depths[fk.child] = fk.childDepth
+			children = append(children, fk.child)
+		}
+	}
+	lockOrder(children, func(t *Table) int { return depths[t] })
+	for _, c := range children {
+		if write {
+			c.Mu.Lock()
+		} else {
+			c.Mu.RLock()
+		}
+	}
+	return func() {
+		for _, c := range children {
+			if write {
+				c.Mu.Unlock()
+			} else {
+				c.Mu.RUnlock()
+			}
+		}
+	}
+}
+
+// checkUniqueUpdate verifies that replacing every row in matched by the row
+// of newRows at its position, which differ in the fields of update, leaves
+// each unique index free of duplicates. A value may move between matched
+// rows, but it may not land on a row outside the set.
+func (t *Table) checkUniqueUpdate(matched, newRows []Row, update Row) error {
+	inSet := make(rowSet, len(matched))
+	for _, row := range matched {
+		inSet.add(row)
+	}
+	for _, k := range t.Schema.uniqueKeys() {
+		if !touches(update, k.Fields) {
+			continue
+		}
+		seen := make(map[interface{}]bool, len(matched))
+		for i := range matched {
+			key := k.key(newRows[i])
+			if seen[key] {
+				return errors.New("unique constraint violation: " + k.Name)
+			}
+			seen[key] = true
+			if owner, exists := t.UniqueIndices[k.Name][key]; exists && !inSet.has(owner) && t.Schema.live(owner) {
+				return errors.New("unique constraint violation: " + k.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// touches reports whether update sets any of fields, or the top-level field
+// a path among them starts from.
+func touches(update Row, fields []string) bool {
+	for _, f := range fields {
+		root := f
+		if p, err := ParsePath(f); err == nil {
+			root = p.Root()
+		}
+		if _, ok := update[root]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// merged returns a copy of row with the fields of update applied on top.
+func merged(row Row, update Row) Row {
+	out := make(Row, len(row)+len(update))
+	for k, v := range row {
+		out[k] = v
+	}
+	for k, v := range update {
+		out[k] = v
+	}
+	return out
+}
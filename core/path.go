@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Path addresses a value inside a row: a top-level field, a key of a nested
+// object ("address.city") or an element of an array ("tags[0]"). Steps can be
+// chained, as in "orders[2].items[0].sku".
+type Path struct {
+	raw   string
+	steps []pathStep
+}
+
+type pathStep struct {
+	key   string
+	index int
+	isIdx bool
+}
+
+// ParsePath parses a dot path. A plain field name is a valid path of one step.
+func ParsePath(s string) (Path, error) {
+	p := Path{raw: s}
+	if s == "" {
+		return p, fmt.Errorf("invalid field path: %q", s)
+	}
+	for _, segment := range strings.Split(s, ".") {
+		name := segment
+		if i := strings.IndexByte(segment, '['); i >= 0 {
+			name = segment[:i]
+		}
+		if name == "" {
+			return Path{}, fmt.Errorf("invalid field path: %q", s)
+		}
+		p.steps = append(p.steps, pathStep{key: name})
+		rest := segment[len(name):]
+		for rest != "" {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return Path{}, fmt.Errorf("invalid field path: %q", s)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return Path{}, fmt.Errorf("invalid field path: %q", s)
+			}
+			p.steps = append(p.steps, pathStep{index: n, isIdx: true})
+			rest = rest[end+1:]
+		}
+	}
+	return p, nil
+}
+
+// String returns the path as it was written.
+func (p Path) String() string {
+	return p.raw
+}
+
+// Root is the top-level field the path starts from.
+func (p Path) Root() string {
+	if len(p.steps) == 0 {
+		return ""
+	}
+	return p.steps[0].key
+}
+
+// Nested reports whether the path reaches below its root field.
+func (p Path) Nested() bool {
+	return len(p.steps) > 1
+}
+
+// Get returns the value the path points at. It reports false when a step is
+// missing, an index is out of range or a value is not the expected container.
+func (p Path) Get(row Row) (interface{}, bool) {
+	if v, ok := row[p.raw]; ok || !p.Nested() {
+		return v, ok
+	}
+	var cur interface{} = map[string]interface{}(row)
+	for _, step := range p.steps {
+		if step.isIdx {
+			arr, ok := cur.([]interface{})
+			if !ok || step.index >= len(arr) {
+				return nil, false
+			}
+			cur = arr[step.index]
+			continue
+		}
+		var v interface{}
+		var ok bool
+		switch m := cur.(type) {
+		case map[string]interface{}:
+			v, ok = m[step.key]
+		case Row:
+			v, ok = m[step.key]
+		}
+		if !ok {
+			return nil, false
+		}
+		cur = v
+	}
+	return cur, true
+}
+
+// Lookup resolves path against row. Invalid paths find nothing.
+func Lookup(row Row, path string) (interface{}, bool) {
+	if v, ok := row[path]; ok {
+		return v, true
+	}
+	p, err := ParsePath(path)
+	if err != nil {
+		return nil, false
+	}
+	return p.Get(row)
+}
+
+// fieldValue is Lookup without the found flag, for index keys and sorting.
+func fieldValue(row Row, path string) interface{} {
+	v, _ := Lookup(row, path)
+	return v
+}
+
+// checkPath verifies that path starts at a known field and only descends
+// into objects and arrays.
+func checkPath(types map[string]FieldType, path string) error {
+	p, err := ParsePath(path)
+	if err != nil {
+		return err
+	}
+	typ, ok := types[p.Root()]
+	if !ok {
+		return fmt.Errorf("unknown field: %s", path)
+	}
+	if p.Nested() && typ != FieldTypeObject && typ != FieldTypeArray {
+		return fmt.Errorf("invalid field path: %q: %s is a %v", path, p.Root(), typ)
+	}
+	return nil
+}
+
+// renamedPath moves path from root field from to root field to.
+func renamedPath(path, from, to string) string {
+	if path == from {
+		return to
+	}
+	if strings.HasPrefix(path, from+".") || strings.HasPrefix(path, from+"[") {
+		return to + path[len(from):]
+	}
+	return path
+}
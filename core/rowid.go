@@ -0,0 +1,85 @@
+package core
+
+import (
+	"errors"
+	"strings"
+)
+
+// RowIDField is the key holding the id the database gives every row. Field
+// names cannot contain NUL, so it never meets the data. It is not part of the
+// schema, cannot be updated, and is kept across migrations, so reports and
+// change feeds can point at individual rows, but it is left out of the rows
+// read back; see RowID.
+const RowIDField = "\x00id"
+
+// RowID returns the id of row. Ids come back from disk as float64.
+func RowID(row Row) (int64, bool) {
+	switch id := row[RowIDField].(type) {
+	case int64:
+		return id, true
+	case float64:
+		return int64(id), true
+	case int:
+		return int64(id), true
+	}
+	return 0, false
+}
+
+// assignID gives row the next id of the table. The caller must hold the
+// table's lock.
+func (t *Table) assignID(row Row) {
+	t.nextID++
+	row[RowIDField] = t.nextID
+}
+
+// adoptIDsLocked takes over the ids of rows loaded from disk and numbers the
+// rows written before ids existed, and any row whose id another row took
+// first.
+func (t *Table) adoptIDsLocked() {
+	var missing []Row
+	taken := make(map[int64]bool)
+	t.eachRowLocked(func(row Row) {
+		if id, ok := RowID(row); ok && !taken[id] {
+			taken[id] = true
+			if id > t.nextID {
+				t.nextID = id
+			}
+			return
+		}
+		missing = append(missing, row)
+	})
+	for _, row := range missing {
+		t.assignID(row)
+	}
+}
+
+// hasRowID reports whether a live row already carries id.
+func (t *Table) hasRowID(id int64) bool {
+	found := false
+	t.eachRowLocked(func(row Row) {
+		if rid, ok := RowID(row); ok && rid == id {
+			found = true
+		}
+	})
+	return found
+}
+
+// hidden reports whether key is kept apart from the fields of a row, like
+// RowIDField: field names cannot contain NUL.
+func hidden(key string) bool {
+	return strings.HasPrefix(key, "\x00")
+}
+
+// withoutHidden returns a copy of row for reading back, without its id or any
+// other hidden key.
+func withoutHidden(row Row) Row {
+	out := make(Row, len(row))
+	for k, v := range row {
+		if !hidden(k) {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+var errRowIDReadOnly = errors.New("field is read-only: " + RowIDField)
@@ -0,0 +1,381 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule is a trigger declared as data and kept with a table's schema, for
+// clients of the bridge. Its values may refer to the row it fires for:
+// "$new.<path>" is a value of the row written, "$old.<path>" one of the row
+// as it was, and "$now" the current time. A string that really starts with
+// "$" is written with two.
+type Rule struct {
+	Name string
+	// On lists the kinds of write the rule fires for; empty is all.
+	On []ChangeKind `json:",omitempty"`
+	// Set assigns fields of an inserted or updated row before it is checked.
+	Set map[string]interface{} `json:",omitempty"`
+	// Require is a match the row must pass, or the write is aborted with
+	// Message: the row written for inserts and updates, the row removed for
+	// deletes. It is tested after Set.
+	Require map[string]interface{} `json:",omitempty"`
+	Message string                 `json:",omitempty"`
+	// Then lists the writes made once each row is written.
+	Then []RuleWrite `json:",omitempty"`
+}
+
+// RuleWrite is a write made by a rule. Insert adds a row to Table. Otherwise
+// the rows of Table passing Match are deleted if Delete is set, or else get
+// the fields of Set, and the numbers of Inc added to theirs.
+type RuleWrite struct {
+	Table  string
+	Insert map[string]interface{} `json:",omitempty"`
+	Match  map[string]interface{} `json:",omitempty"`
+	Set    map[string]interface{} `json:",omitempty"`
+	Inc    map[string]float64     `json:",omitempty"`
+	Delete bool                   `json:",omitempty"`
+}
+
+// SetRules replaces the rules of a table. Like its TTL, they are kept with
+// the schema and carried over when the schema changes.
+func (db *Database) SetRules(tableName string, rules []Rule) error {
+	db.Mu.Lock()
+	table, ok := db.Tables[tableName]
+	if !ok {
+		db.Mu.Unlock()
+		return errors.New("table not found: " + tableName)
+	}
+	if err := db.notView(tableName); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	for _, r := range rules {
+		for _, w := range r.Then {
+			if _, ok := db.Tables[w.Table]; !ok {
+				db.Mu.Unlock()
+				return fmt.Errorf("rule %s: table not found: %s", r.Name, w.Table)
+			}
+			if err := db.notView(w.Table); err != nil {
+				db.Mu.Unlock()
+				return fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+	}
+	table.Mu.Lock()
+	schema := *table.Schema
+	schema.Rules = append([]Rule(nil), rules...)
+	if len(rules) == 0 {
+		schema.Rules = nil
+	}
+	triggers, err := compileRules(tableName, &schema)
+	if err != nil {
+		table.Mu.Unlock()
+		db.Mu.Unlock()
+		return err
+	}
+	table.Schema = &schema
+	table.rules.set(&schema, triggers)
+	db.Schemas[tableName] = &schema
+	table.Mu.Unlock()
+	db.Mu.Unlock()
+
+	return db.SaveSchemas()
+}
+
+// renameRuleTable returns the schema with the writes of its rules to from
+// going to to instead, or the schema itself if none write to from.
+func (s *Schema) renameRuleTable(from, to string) *Schema {
+	rules := make([]Rule, len(s.Rules))
+	changed := false
+	for i, r := range s.Rules {
+		then := make([]RuleWrite, len(r.Then))
+		for j, w := range r.Then {
+			if w.Table == from {
+				w.Table = to
+				changed = true
+			}
+			then[j] = w
+		}
+		r.Then = then
+		rules[i] = r
+	}
+	if !changed {
+		return s
+	}
+	renamed := *s
+	renamed.Rules = rules
+	return &renamed
+}
+
+// ruleCache keeps the triggers compiled from the rules of a table's schema.
+// Schemas are replaced, not changed, so a new schema compiles them afresh.
+type ruleCache struct {
+	mu       sync.Mutex
+	schema   *Schema
+	triggers []*Trigger
+}
+
+// get returns the triggers of the rules of schema, compiling them unless
+// they were compiled for it last.
+func (c *ruleCache) get(tableName string, schema *Schema) []*Trigger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.schema != schema {
+		// Rules were checked when they were set.
+		c.triggers, _ = compileRules(tableName, schema)
+		c.schema = schema
+	}
+	return c.triggers
+}
+
+func (c *ruleCache) set(schema *Schema, triggers []*Trigger) {
+	c.mu.Lock()
+	c.schema, c.triggers = schema, triggers
+	c.mu.Unlock()
+}
+
+// compileRules turns the rules of a schema into triggers.
+func compileRules(tableName string, schema *Schema) ([]*Trigger, error) {
+	names := make(map[string]bool)
+	var triggers []*Trigger
+	for i := range schema.Rules {
+		r := &schema.Rules[i]
+		if r.Name == "" {
+			return nil, errors.New("rule needs a name")
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule already exists: %s", r.Name)
+		}
+		names[r.Name] = true
+		tr, err := r.compile(tableName, schema)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", r.Name, err)
+		}
+		triggers = append(triggers, tr)
+	}
+	return triggers, nil
+}
+
+func (r *Rule) compile(tableName string, schema *Schema) (*Trigger, error) {
+	for _, k := range r.On {
+		if k != ChangeInsert && k != ChangeUpdate && k != ChangeDelete {
+			return nil, fmt.Errorf("unknown kind: %s", k)
+		}
+	}
+	// Values are checked by expanding them for an empty row.
+	blank := &HookEvent{}
+	if _, err := expandRule(r.Set, blank, time.Time{}); err != nil {
+		return nil, err
+	}
+	require, err := expandRule(r.Require, blank, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := schema.Matcher(require); err != nil {
+		return nil, err
+	}
+	for _, w := range r.Then {
+		if w.Table == "" {
+			return nil, errors.New("write needs a table")
+		}
+		if w.Insert != nil && (w.Match != nil || w.Set != nil || w.Inc != nil || w.Delete) {
+			return nil, errors.New("an insert takes no match, set, inc or delete")
+		}
+		if w.Delete && (w.Set != nil || w.Inc != nil) {
+			return nil, errors.New("a delete takes no set or inc")
+		}
+		if w.Insert == nil && !w.Delete && w.Set == nil && w.Inc == nil {
+			return nil, fmt.Errorf("write to %s does nothing", w.Table)
+		}
+		for _, m := range []map[string]interface{}{w.Insert, w.Match, w.Set} {
+			if _, err := expandRule(m, blank, time.Time{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	tr := &Trigger{Name: r.Name, Table: tableName, On: r.On}
+	if r.Set != nil || r.Require != nil {
+		tr.Before = r.before(schema)
+	}
+	if len(r.Then) > 0 {
+		tr.After = r.after
+		for _, w := range r.Then {
+			tr.Writes = append(tr.Writes, w.Table)
+		}
+	}
+	return tr, nil
+}
+
+func (r *Rule) before(schema *Schema) func(ev *HookEvent) error {
+	return func(ev *HookEvent) error {
+		now := time.Now()
+		if ev.Kind != ChangeDelete && r.Set != nil {
+			set, err := expandRule(r.Set, ev, now)
+			if err != nil {
+				return err
+			}
+			for k, v := range set {
+				ev.After[k] = v
+			}
+		}
+		if r.Require == nil {
+			return nil
+		}
+		require, err := expandRule(r.Require, ev, now)
+		if err != nil {
+			return err
+		}
+		matches, err := schema.Matcher(require)
+		if err != nil {
+			return err
+		}
+		row := ev.After
+		if ev.Kind == ChangeDelete {
+			row = ev.Before
+		}
+		// Set values are normalized later, so the row is normalized here
+		// the way it will be stored.
+		row = merged(row, nil)
+		if err := schema.normalizeRow(row); err != nil {
+			return err
+		}
+		if !matches(row) {
+			if r.Message != "" {
+				return errors.New(r.Message)
+			}
+			return errors.New("requirement not met")
+		}
+		return nil
+	}
+}
+
+func (r *Rule) after(tx *Tx, ev *HookEvent) error {
+	now := time.Now()
+	for _, w := range r.Then {
+		if w.Insert != nil {
+			row, err := expandRule(w.Insert, ev, now)
+			if err != nil {
+				return err
+			}
+			if err := tx.Insert(w.Table, Row(row)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		t, err := tx.table(w.Table)
+		if err != nil {
+			return err
+		}
+		match, err := expandRule(w.Match, ev, now)
+		if err != nil {
+			return err
+		}
+		filter, err := t.Schema.Matcher(match)
+		if err != nil {
+			return err
+		}
+		if w.Delete {
+			if _, err := tx.Delete(w.Table, filter); err != nil {
+				return err
+			}
+			continue
+		}
+		set, err := expandRule(w.Set, ev, now)
+		if err != nil {
+			return err
+		}
+		if len(w.Inc) == 0 {
+			if _, err := tx.Update(w.Table, filter, Row(set)); err != nil {
+				return err
+			}
+			continue
+		}
+		// Increments depend on each row's value, so rows are updated one
+		// by one.
+		rows, err := tx.find(w.Table, filter)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			update := merged(Row(set), nil)
+			for field, n := range w.Inc {
+				old, _ := toFloat(row[field])
+				update[field] = old + n
+			}
+			id, _ := RowID(row)
+			byID := func(r Row) bool {
+				rid, ok := RowID(r)
+				return ok && rid == id
+			}
+			if _, err := tx.Update(w.Table, byID, update); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandRule returns a copy of values with the references of a rule
+// replaced by what they refer to for ev.
+func expandRule(values map[string]interface{}, ev *HookEvent, now time.Time) (map[string]interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+	out := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		x, err := expandValue(v, ev, now)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = x
+	}
+	return out, nil
+}
+
+func expandValue(v interface{}, ev *HookEvent, now time.Time) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		if !strings.HasPrefix(x, "$") {
+			return x, nil
+		}
+		if strings.HasPrefix(x, "$$") {
+			return x[1:], nil
+		}
+		if x == "$now" {
+			return now, nil
+		}
+		row := ev.After
+		ref, ok := strings.CutPrefix(x, "$new.")
+		if !ok {
+			row = ev.Before
+			if ref, ok = strings.CutPrefix(x, "$old."); !ok {
+				return nil, fmt.Errorf("unknown reference: %s", x)
+			}
+		}
+		path, err := ParsePath(ref)
+		if err != nil {
+			return nil, err
+		}
+		val, _ := path.Get(row)
+		return val, nil
+	case map[string]interface{}:
+		return expandRule(x, ev, now)
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, item := range x {
+			y, err := expandValue(item, ev, now)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = y
+		}
+		return out, nil
+	}
+	return v, nil
+}
@@ -1,5 +1,11 @@
 package core
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type FieldType int
 
 const (
@@ -7,21 +13,198 @@ const (
 	FieldTypeString
 	FieldTypeFloat
 	FieldTypeBool
+	FieldTypeObject
+	FieldTypeArray
+	FieldTypeTimestamp
+	FieldTypeBytes
+	FieldTypeDecimal
+	FieldTypeVector
 )
 
+var fieldTypeNames = []string{"int", "string", "float", "bool", "object", "array", "timestamp", "bytes", "decimal", "vector"}
+
+func (t FieldType) String() string {
+	if int(t) >= 0 && int(t) < len(fieldTypeNames) {
+		return fieldTypeNames[t]
+	}
+	return fmt.Sprintf("FieldType(%d)", int(t))
+}
+
+// Field describes one column. Besides the type and uniqueness, a field may
+// carry value rules that every insert and update must satisfy.
 type Field struct {
-	Name   string
-	Type   FieldType
-	Unique bool
+	Name      string
+	Type      FieldType
+	Unique    bool
+	Min       *float64      `json:",omitempty"`
+	Max       *float64      `json:",omitempty"`
+	MinLength *int          `json:",omitempty"`
+	MaxLength *int          `json:",omitempty"`
+	Pattern   string        `json:",omitempty"`
+	Enum      []interface{} `json:",omitempty"`
+	NotEmpty  bool          `json:",omitempty"`
+	// FullText keeps an inverted index of a string field for Search.
+	FullText bool `json:",omitempty"`
+	// Dimensions is the length every value of a vector field must have.
+	Dimensions int `json:",omitempty"`
+	// VectorIndex keeps an approximate nearest-neighbour index of a vector
+	// field: "ivf", or empty for none. Lists is the number of clusters the
+	// index splits the vectors into; zero picks the square root of the row
+	// count when it is trained.
+	VectorIndex string `json:",omitempty"`
+	Lists       int    `json:",omitempty"`
+	// Expr makes the field computed: its value is derived from the other
+	// fields of the row, as in "price * qty" or "lower(email)", and any
+	// value written to it is replaced. A computed field is virtual, kept
+	// off disk and computed again when its rows are loaded, unless Stored
+	// is set. Either way it can be filtered, sorted and indexed like any
+	// other field. See expression for what Expr may hold.
+	Expr   string `json:",omitempty"`
+	Stored bool   `json:",omitempty"`
+}
+
+type ConstraintKind string
+
+const (
+	ConstraintUnique     ConstraintKind = "unique"
+	ConstraintForeignKey ConstraintKind = "foreign_key"
+)
+
+// Constraint is a table-level rule spanning one or more fields. Foreign keys
+// point Fields at RefFields of RefTable, which must form a unique key there.
+type Constraint struct {
+	Name      string
+	Kind      ConstraintKind
+	Fields    []string
+	RefTable  string            `json:",omitempty"`
+	RefFields []string          `json:",omitempty"`
+	OnDelete  ReferentialAction `json:",omitempty"`
+}
+
+// IndexName is the key of the constraint in Table.UniqueIndices. It defaults
+// to the field names joined by commas.
+func (c Constraint) IndexName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return strings.Join(c.Fields, ",")
 }
 
 type Schema struct {
-	Version int
-	Fields  []Field
+	Version     int
+	Fields      []Field
+	Constraints []Constraint
+	History     []SchemaRevision `json:",omitempty"`
+	// TTL, if set, expires the table's rows; see Database.SetTTL.
+	TTL *TTL `json:",omitempty"`
+	// Rules are the triggers kept with the table; see Database.SetRules.
+	Rules []Rule `json:",omitempty"`
+	// View, if set, makes the table a view; see Database.CreateView.
+	View *View `json:",omitempty"`
+	// Temporal, if set, keeps the past versions of the table's rows; see
+	// Database.SetTemporal.
+	Temporal *Temporal `json:",omitempty"`
 }
 
 type ConflictReport struct {
 	Compatiable bool
 	Conflicts   []string
 	Destructive bool
+	Details     []Conflict `json:",omitempty"`
+}
+
+// uniqueKey is one unique index of a table: either a single Unique field or a
+// composite unique constraint.
+type uniqueKey struct {
+	Name   string
+	Fields []string
+}
+
+// key returns the index key of row. Composite keys are folded into a single
+// comparable value.
+func (k uniqueKey) key(row Row) interface{} {
+	if len(k.Fields) == 1 {
+		return IndexKey(fieldValue(row, k.Fields[0]))
+	}
+	return IndexKey(k.value(row))
+}
+
+// value returns the fields of the key as they appear in row, for reporting.
+func (k uniqueKey) value(row Row) interface{} {
+	if len(k.Fields) == 1 {
+		return fieldValue(row, k.Fields[0])
+	}
+	vals := make([]interface{}, len(k.Fields))
+	for i, f := range k.Fields {
+		vals[i] = fieldValue(row, f)
+	}
+	return vals
+}
+
+func (s *Schema) uniqueKeys() []uniqueKey {
+	return uniqueKeysOf(s.Fields, s.Constraints)
+}
+
+func uniqueKeysOf(fields []Field, constraints []Constraint) []uniqueKey {
+	var keys []uniqueKey
+	for _, f := range fields {
+		if f.Unique {
+			keys = append(keys, uniqueKey{Name: f.Name, Fields: []string{f.Name}})
+		}
+	}
+	for _, c := range constraints {
+		if c.Kind == ConstraintUnique {
+			keys = append(keys, uniqueKey{Name: c.IndexName(), Fields: c.Fields})
+		}
+	}
+	return keys
+}
+
+func validateConstraints(fields []Field, constraints []Constraint) error {
+	types := make(map[string]FieldType, len(fields))
+	// Unique indexes share one namespace with unique fields; foreign keys
+	// have their own, so one may be named after the unique field it is on.
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, f := range fields {
+		types[f.Name] = f.Type
+		if f.Unique {
+			names[f.Name] = true
+		}
+	}
+	for _, c := range constraints {
+		if len(c.Fields) == 0 {
+			return errors.New("constraint has no fields: " + c.IndexName())
+		}
+		// Fields may be paths into object and array fields, such as
+		// "address.city".
+		for _, f := range c.Fields {
+			if err := checkPath(types, f); err != nil {
+				return fmt.Errorf("constraint %s references %v", c.IndexName(), err)
+			}
+		}
+		switch c.Kind {
+		case ConstraintUnique:
+		case ConstraintForeignKey:
+			if c.RefTable == "" || len(c.RefFields) != len(c.Fields) {
+				return errors.New("foreign key needs a table and one referenced field per field: " + c.IndexName())
+			}
+			switch c.OnDelete {
+			case "", ActionRestrict, ActionCascade, ActionSetNull:
+			default:
+				return fmt.Errorf("unknown delete action for %s: %s", c.IndexName(), c.OnDelete)
+			}
+		default:
+			return fmt.Errorf("unknown constraint kind: %s", c.Kind)
+		}
+		taken := names
+		if c.Kind == ConstraintForeignKey {
+			taken = keys
+		}
+		if taken[c.IndexName()] {
+			return errors.New("duplicate constraint name: " + c.IndexName())
+		}
+		taken[c.IndexName()] = true
+	}
+	return nil
 }
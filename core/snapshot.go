@@ -0,0 +1,161 @@
+package core
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Snapshot pins the rows a table holds at one moment, in the order unsorted
+// queries return them: the hot heap, unless empty, then the sealed clumps.
+// It keeps the schema the rows were read under. Reading a snapshot takes no
+// lock.
+//
+// This works because stored rows are never modified in place. Inserts append
+// past the end of the hot heap, deletes build new batches, and updates go
+// through replaceLocked, which copies any batch it touches. A snapshot
+// therefore keeps seeing the rows exactly as they were, while writers carry
+// on against the live table.
+type Snapshot struct {
+	Schema  *Schema
+	batches [][]Row
+	// live hides the rows that had expired when the snapshot was taken.
+	live func(Row) bool
+}
+
+// Snapshot captures the current batches of the table. It only holds the
+// table's read lock while copying the batch headers. The snapshot of a view
+// holds its rows: computed from its table, or for a materialized view, the
+// rows stored once the writes made so far reached it.
+func (t *Table) Snapshot() *Snapshot {
+	t.Mu.RLock()
+	schema := t.Schema
+	t.Mu.RUnlock()
+	if schema.View != nil {
+		if !schema.View.Materialized {
+			return t.viewSnapshot(schema)
+		}
+		t.Db.syncViews()
+	}
+
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+	return t.snapshotRLocked()
+}
+
+// snapshotRLocked is Snapshot for a table that is not a view, or for the
+// stored rows of a view. The caller must hold the table's read lock.
+func (t *Table) snapshotRLocked() *Snapshot {
+	batches := make([][]Row, 0, len(t.SealedClumps)+1)
+	// Full slice expression: appends after this point land beyond our view.
+	if rows := t.HotHeap.Rows; len(rows) > 0 {
+		batches = append(batches, rows[:len(rows):len(rows)])
+	}
+	for _, clump := range t.SealedClumps {
+		batches = append(batches, clump.Rows)
+	}
+	return t.snapshotLocked(batches)
+}
+
+// snapshotLocked wraps batches of the table's rows in a Snapshot that hides
+// the expired ones. The caller must hold the table's read lock.
+func (t *Table) snapshotLocked(batches [][]Row) *Snapshot {
+	return &Snapshot{Schema: t.Schema, batches: batches, live: t.Schema.liveAt(time.Now())}
+}
+
+// visible reports whether row is part of the snapshot rather than expired.
+func (s *Snapshot) visible(row Row) bool {
+	return s.live == nil || s.live(row)
+}
+
+// Batches is the number of batches in the snapshot.
+func (s *Snapshot) Batches() int {
+	return len(s.batches)
+}
+
+// Len is the number of rows in the snapshot, expired ones included.
+func (s *Snapshot) Len() int {
+	n := 0
+	for _, rows := range s.batches {
+		n += len(rows)
+	}
+	return n
+}
+
+// BatchLen is the number of rows in batch i.
+func (s *Snapshot) BatchLen(i int) int {
+	return len(s.batches[i])
+}
+
+// Scan returns copies of the rows of batch i that pass filter. A nil filter
+// keeps every row. The copies are the caller's to keep and modify.
+func (s *Snapshot) Scan(i int, filter func(Row) bool) []Row {
+	var out []Row
+	for _, row := range s.batches[i] {
+		if s.visible(row) && (filter == nil || filter(row)) {
+			out = append(out, s.output(row))
+		}
+	}
+	return out
+}
+
+// output returns the copy of row handed to readers, without its id and the
+// fields a materialized view keeps for its own upkeep, so that a view reads
+// the same whether it is materialized or not.
+func (s *Snapshot) output(row Row) Row {
+	out := withoutHidden(row)
+	if s.Schema.View != nil {
+		delete(out, ViewStateField)
+		delete(out, ViewSourceField)
+	}
+	return out
+}
+
+// each calls fn with every row of the snapshot. fn must not modify them.
+func (s *Snapshot) each(fn func(Row)) {
+	for _, rows := range s.batches {
+		for _, row := range rows {
+			if s.visible(row) {
+				fn(row)
+			}
+		}
+	}
+}
+
+// ScanWorkers is the number of clumps a scan may work on at once.
+func (db *Database) ScanWorkers() int {
+	if db.Config != nil && db.Config.ScanWorkers > 0 {
+		return db.Config.ScanWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// parallel calls fn for every index below n on at most workers goroutines
+// and waits for them all.
+func parallel(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
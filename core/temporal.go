@@ -0,0 +1,296 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/crypto"
+	"github.com/ikwerre-dev/EmojiDB/storage"
+)
+
+// RowValidFromField holds the time a row's version became current, in Unix
+// milliseconds, in the rows read from a table's history; see
+// Table.SnapshotAsOf. It cannot be used as a field name.
+const RowValidFromField = "_valid_from"
+
+// RowValidToField holds the time a past version was replaced or deleted, in
+// Unix milliseconds, in the rows read from a table's history. It cannot be
+// used as a field name.
+const RowValidToField = "_valid_to"
+
+// validFromKey and validToKey hold the times of RowValidFromField and
+// RowValidToField in the stored rows and versions. Like RowIDField they
+// never meet the data, are kept across migrations and are left out of the
+// rows read back.
+const (
+	validFromKey = "\x00valid_from"
+	validToKey   = "\x00valid_to"
+)
+
+// versionSegmentPrefix marks records of the data file that hold past
+// versions of a table's rows, under the table's name with this prefix.
+const versionSegmentPrefix = "\x00versions:"
+
+// Temporal keeps the past versions of a table's rows, so that queries can
+// read the table as it was at an earlier time; see Table.SnapshotAsOf.
+// Versions are kept in memory and written to the data file, encrypted like
+// the rows, when the table is flushed.
+type Temporal struct {
+	// Retain is how long a version is kept after it was replaced or
+	// deleted, as a Go duration such as "2160h". Empty keeps every version.
+	Retain string `json:",omitempty"`
+	// Since is when the table started keeping history. SetTemporal fills
+	// it in; the table cannot be read as of any earlier time.
+	Since time.Time
+}
+
+func (tp *Temporal) retain() (time.Duration, error) {
+	if tp.Retain == "" {
+		return 0, nil
+	}
+	retain, err := time.ParseDuration(tp.Retain)
+	if err != nil {
+		return 0, fmt.Errorf("temporal: %v", err)
+	}
+	if retain <= 0 {
+		return 0, errors.New("temporal: retain must be positive")
+	}
+	return retain, nil
+}
+
+// horizon returns the earliest time the history is complete from at now:
+// when it started, or the oldest time versions are still retained for.
+func (tp *Temporal) horizon(now time.Time) time.Time {
+	retain, err := tp.retain()
+	if err != nil || retain == 0 {
+		return tp.Since
+	}
+	if oldest := now.Add(-retain); oldest.After(tp.Since) {
+		return oldest
+	}
+	return tp.Since
+}
+
+// validFrom returns when the version row became current. Rows written
+// before the history started count from its start.
+func (tp *Temporal) validFrom(row Row) int64 {
+	if at, ok := toFloat(row[validFromKey]); ok {
+		return int64(at)
+	}
+	return tp.Since.UnixMilli()
+}
+
+// SetTemporal makes a table keep the past versions of its rows, or stops it
+// and drops the versions kept so far when temporal is nil. Calling it again
+// only changes the retention: the history keeps its start.
+func (db *Database) SetTemporal(tableName string, temporal *Temporal) error {
+	db.Mu.Lock()
+	table, ok := db.Tables[tableName]
+	if !ok {
+		db.Mu.Unlock()
+		return errors.New("table not found: " + tableName)
+	}
+	if err := db.notView(tableName); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	table.Mu.Lock()
+	rewrite := temporal == nil && table.versionsSaved > 0
+	if temporal != nil {
+		if _, err := temporal.retain(); err != nil {
+			table.Mu.Unlock()
+			db.Mu.Unlock()
+			return err
+		}
+		copied := *temporal
+		copied.Since = time.Now()
+		if prev := table.Schema.Temporal; prev != nil {
+			copied.Since = prev.Since
+		}
+		temporal = &copied
+	}
+	// Snapshots hold on to the old schema, so it is replaced, not changed.
+	schema := *table.Schema
+	schema.Temporal = temporal
+	table.Schema = &schema
+	db.Schemas[tableName] = &schema
+	if temporal == nil {
+		table.versions, table.versionsSaved = nil, 0
+	}
+	table.Mu.Unlock()
+	db.Mu.Unlock()
+
+	if err := db.SaveSchemas(); err != nil {
+		return err
+	}
+	if rewrite {
+		// The data file still holds the dropped versions.
+		return db.Rewrite()
+	}
+	return nil
+}
+
+// recordLocked stamps the rows of a change with the time they became
+// current and keeps the rows they replaced, when the table keeps history.
+// The caller must hold the table's lock.
+func (t *Table) recordLocked(befores, afters []Row) {
+	if t.Schema.Temporal == nil {
+		return
+	}
+	now := time.Now().UnixMilli()
+	for _, row := range afters {
+		row[validFromKey] = now
+	}
+	for _, row := range befores {
+		version := merged(row, nil)
+		version[validToKey] = now
+		t.versions = append(t.versions, version)
+	}
+}
+
+// SnapshotAsOf returns the rows of a table as they were at time at: the
+// versions that were current then, each with its RowValidFromField, and
+// with RowValidToField if it has been replaced or deleted since. The table
+// must keep history, and at must not be before its horizon.
+func (t *Table) SnapshotAsOf(at time.Time) (*Snapshot, error) {
+	return t.SnapshotBetween(at, at)
+}
+
+// SnapshotBetween returns every version of the rows of a table that was
+// current at some time from from to to, inclusive, as SnapshotAsOf does.
+func (t *Table) SnapshotBetween(from, to time.Time) (*Snapshot, error) {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+
+	tp := t.Schema.Temporal
+	if tp == nil {
+		return nil, errors.New("table keeps no history: " + t.Name)
+	}
+	if to.Before(from) {
+		return nil, errors.New("history: the period ends before it starts")
+	}
+	if start := tp.horizon(time.Now()); from.Before(start) {
+		return nil, fmt.Errorf("history of %s starts at %s", t.Name, start.Format(time.RFC3339))
+	}
+
+	first, last := from.UnixMilli(), to.UnixMilli()
+	var past, current []Row
+	for _, version := range t.versions {
+		end, _ := toFloat(version[validToKey])
+		if from := tp.validFrom(version); from <= last && int64(end) > first {
+			past = append(past, merged(version, Row{RowValidFromField: from, RowValidToField: int64(end)}))
+		}
+	}
+	t.eachRowLocked(func(row Row) {
+		if from := tp.validFrom(row); from <= last {
+			current = append(current, merged(row, Row{RowValidFromField: from}))
+		}
+	})
+	// Rows that had expired by the start of the period are left out.
+	return &Snapshot{Schema: t.Schema, batches: [][]Row{past, current}, live: t.Schema.liveAt(from)}, nil
+}
+
+// pruneVersionsLocked drops the versions older than the table's retention.
+// It reports whether any of them had been written to the data file. The
+// caller must hold the table's lock.
+func (t *Table) pruneVersionsLocked(now time.Time) bool {
+	tp := t.Schema.Temporal
+	if tp == nil {
+		return false
+	}
+	retain, err := tp.retain()
+	if err != nil || retain == 0 {
+		return false
+	}
+	cutoff := now.Add(-retain).UnixMilli()
+	kept := t.versions[:0:0]
+	saved := 0
+	for i, version := range t.versions {
+		if end, _ := toFloat(version[validToKey]); int64(end) >= cutoff {
+			kept = append(kept, version)
+		} else if i < t.versionsSaved {
+			saved++
+		}
+	}
+	if len(kept) == len(t.versions) {
+		return false
+	}
+	t.versions = kept
+	t.versionsSaved -= saved
+	return saved > 0
+}
+
+// saveVersions drops the versions of a table past its retention and writes
+// the new ones to the data file, as part of a flush.
+func (db *Database) saveVersions(tableName string) error {
+	table, err := db.Table(tableName)
+	if err != nil {
+		return err
+	}
+	table.Mu.Lock()
+	pruned := table.pruneVersionsLocked(time.Now())
+	pending := table.versions[table.versionsSaved:]
+	table.versionsSaved = len(table.versions)
+	table.Mu.Unlock()
+
+	if pruned {
+		// The data file still holds the dropped versions.
+		return db.Rewrite()
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	db.Mu.Lock()
+	defer db.Mu.Unlock()
+	if err := db.writeVersionsLocked(db.File, tableName, pending); err != nil {
+		return err
+	}
+	return db.File.Sync()
+}
+
+// savedVersions returns the versions of the table already written to the
+// data file, for writing it afresh. The caller must hold at least the
+// table's read lock.
+func (t *Table) savedVersions() []Row {
+	return t.versions[:t.versionsSaved]
+}
+
+// writeVersionsLocked appends versions of a table's rows to file. The caller
+// must hold db.Mu.
+func (db *Database) writeVersionsLocked(file *os.File, tableName string, versions []Row) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	return storage.InternalPersistClump(file, versionSegmentPrefix+tableName, versions, db.Key, crypto.Encrypt, crypto.EncodeToEmojis)
+}
+
+// loadVersions keeps versions read from the data file until their table is
+// set up. The caller must not hold db.Mu.
+func (db *Database) loadVersions(tableName string, data []byte) error {
+	var versions []Row
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return err
+	}
+	db.Mu.Lock()
+	if db.versionSegments == nil {
+		db.versionSegments = make(map[string][]Row)
+	}
+	db.versionSegments[tableName] = append(db.versionSegments[tableName], versions...)
+	db.Mu.Unlock()
+	return nil
+}
+
+// adoptVersionsLocked gives the table the versions loaded for it. They are
+// dropped if the table no longer keeps history. The caller must hold the
+// table's lock.
+func (t *Table) adoptVersionsLocked(versions []Row) {
+	if t.Schema.Temporal == nil {
+		return
+	}
+	t.Schema.decodeRows(versions)
+	t.versions = versions
+	t.versionsSaved = len(versions)
+}
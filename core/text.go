@@ -0,0 +1,405 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// textSegmentPrefix marks records of the data file that hold the full-text
+// postings of the clump written just before them, under the table's name
+// with this prefix. No table name can start with a NUL byte.
+const textSegmentPrefix = "\x00text:"
+
+// BM25 parameters.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// textPostings is an inverted index of one field: for every term, the rows
+// holding it and the positions it takes in each. Rows are identified by id.
+type textPostings struct {
+	Lengths map[int64]int
+	Terms   map[string]map[int64][]int
+}
+
+// textIndex is the live full-text index of a FullText field. It also keeps
+// the current version of every indexed row, so hits need no scan.
+type textIndex struct {
+	field string
+	textPostings
+	rows  map[int64]Row
+	total int
+}
+
+// textSegment holds the postings of the rows of one sealed clump, by field.
+// It is persisted after the clump so an index loads without re-tokenizing.
+type textSegment map[string]*textPostings
+
+func newTextPostings() textPostings {
+	return textPostings{Lengths: make(map[int64]int), Terms: make(map[string]map[int64][]int)}
+}
+
+// newTextIndexes returns empty full-text indexes for the FullText fields of
+// schema.
+func newTextIndexes(schema *Schema) map[string]*textIndex {
+	indexes := make(map[string]*textIndex)
+	for _, f := range schema.Fields {
+		if f.FullText {
+			indexes[f.Name] = &textIndex{field: f.Name, textPostings: newTextPostings(), rows: make(map[int64]Row)}
+		}
+	}
+	return indexes
+}
+
+// add indexes the text of row. Rows without an id or text are skipped.
+func (x *textIndex) add(row Row) {
+	id, ok := RowID(row)
+	if !ok {
+		return
+	}
+	x.addTokens(id, row, analyze(textOf(row, x.field)))
+}
+
+func (x *textIndex) addTokens(id int64, row Row, tokens []string) {
+	if len(tokens) == 0 {
+		return
+	}
+	x.Lengths[id] = len(tokens)
+	x.rows[id] = row
+	x.total += len(tokens)
+	for pos, term := range tokens {
+		docs := x.Terms[term]
+		if docs == nil {
+			docs = make(map[int64][]int)
+			x.Terms[term] = docs
+		}
+		docs[id] = append(docs[id], pos)
+	}
+}
+
+// remove drops row, as it was indexed, from the index.
+func (x *textIndex) remove(row Row) {
+	id, ok := RowID(row)
+	if !ok {
+		return
+	}
+	n, ok := x.Lengths[id]
+	if !ok {
+		return
+	}
+	for _, term := range analyze(textOf(row, x.field)) {
+		if docs := x.Terms[term]; docs != nil {
+			delete(docs, id)
+			if len(docs) == 0 {
+				delete(x.Terms, term)
+			}
+		}
+	}
+	delete(x.Lengths, id)
+	delete(x.rows, id)
+	x.total -= n
+}
+
+func textOf(row Row, field string) string {
+	s, _ := row[field].(string)
+	return s
+}
+
+// segment builds the persisted postings of rows, or nil when the table has
+// no full-text field. The caller must hold the table's lock.
+func (t *Table) segment(rows []Row) textSegment {
+	if len(t.text) == 0 {
+		return nil
+	}
+	seg := make(textSegment, len(t.text))
+	for name := range t.text {
+		x := &textIndex{field: name, textPostings: newTextPostings(), rows: make(map[int64]Row)}
+		for _, row := range rows {
+			x.add(row)
+		}
+		seg[name] = &x.textPostings
+	}
+	return seg
+}
+
+// adoptTextLocked loads the persisted segments of the table into its
+// full-text indexes and then indexes whatever rows they do not cover, such
+// as those of a file written before the field was indexed. Segments of rows
+// no longer in the table are dropped.
+func (t *Table) adoptTextLocked(segments []textSegment) {
+	if len(t.text) == 0 {
+		return
+	}
+	for name, x := range t.text {
+		for _, seg := range segments {
+			p := seg[name]
+			if p == nil {
+				continue
+			}
+			for id, n := range p.Lengths {
+				x.total += n - x.Lengths[id]
+				x.Lengths[id] = n
+			}
+			for term, docs := range p.Terms {
+				have := x.Terms[term]
+				if have == nil {
+					have = make(map[int64][]int, len(docs))
+					x.Terms[term] = have
+				}
+				for id, positions := range docs {
+					have[id] = positions
+				}
+			}
+		}
+
+		live := make(map[int64]bool)
+		t.eachRowLocked(func(row Row) {
+			id, ok := RowID(row)
+			if !ok {
+				return
+			}
+			live[id] = true
+			if _, ok := x.Lengths[id]; ok {
+				x.rows[id] = row
+				return
+			}
+			x.add(row)
+		})
+		dead := false
+		for id, n := range x.Lengths {
+			if !live[id] {
+				delete(x.Lengths, id)
+				x.total -= n
+				dead = true
+			}
+		}
+		if !dead {
+			continue
+		}
+		for term, docs := range x.Terms {
+			for id := range docs {
+				if !live[id] {
+					delete(docs, id)
+				}
+			}
+			if len(docs) == 0 {
+				delete(x.Terms, term)
+			}
+		}
+	}
+}
+
+// analyze splits text into terms: the words of fold, reduced to a common
+// stem.
+func analyze(text string) []string {
+	terms := fold(text)
+	for i, w := range terms {
+		terms[i] = stem(w)
+	}
+	return terms
+}
+
+// fold splits text into runs of letters and digits, in lower case.
+func fold(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, w := range words {
+		words[i] = strings.ToLower(w)
+	}
+	return words
+}
+
+// stem strips common English suffixes so that "refunds", "refunded" and
+// "refunding" share the term "refund". It is deliberately simple: plurals,
+// -ing, -ed and -ly, then a doubled final consonant or a silent e. Words
+// that are not plain ASCII letters are kept whole.
+func stem(w string) string {
+	for i := 0; i < len(w); i++ {
+		if w[i] < 'a' || w[i] > 'z' {
+			return w
+		}
+	}
+	if len(w) <= 3 {
+		return w
+	}
+	switch {
+	case strings.HasSuffix(w, "sses"):
+		w = w[:len(w)-2]
+	case strings.HasSuffix(w, "ies") && len(w) > 4:
+		w = w[:len(w)-3] + "y"
+	case strings.HasSuffix(w, "ss"), strings.HasSuffix(w, "us"), strings.HasSuffix(w, "is"):
+	case strings.HasSuffix(w, "s"):
+		w = w[:len(w)-1]
+	}
+	for _, suffix := range []string{"ing", "ed", "ly"} {
+		if rest := strings.TrimSuffix(w, suffix); rest != w && len(rest) >= 3 && strings.ContainsAny(rest, "aeiouy") {
+			w = rest
+			if n := len(w); w[n-1] == w[n-2] && !strings.ContainsRune("aeiouslz", rune(w[n-1])) {
+				w = w[:n-1]
+			}
+			break
+		}
+	}
+	if len(w) > 3 && strings.HasSuffix(w, "e") {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+// SearchHit is a row found by Search, with its BM25 score.
+type SearchHit struct {
+	Row   Row
+	Score float64
+}
+
+// searchClause is one part of a search: a term, a phrase of several terms,
+// or a prefix.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseSearch splits a search into clauses: bare words, "quoted phrases" and
+// prefixes ending in *.
+func parseSearch(text string) []searchClause {
+	var clauses []searchClause
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			if terms := analyze(part); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			if strings.HasSuffix(word, "*") {
+				// Prefixes are folded but not stemmed: "refun*" must still
+				// find "refund".
+				if words := fold(word); len(words) == 1 {
+					clauses = append(clauses, searchClause{terms: words, prefix: true})
+				}
+				continue
+			}
+			// A word the analyzer splits, like "e-mail", is a phrase.
+			if terms := analyze(word); len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+		}
+	}
+	return clauses
+}
+
+// Search ranks the rows of a table by how well field, which must be a
+// FullText field, matches text. A row matches if it holds any of the words,
+// "quoted phrases" or prefix* of text; rows are scored with BM25, and rarer
+// terms count for more. filter, which may be nil, narrows the hits, and
+// limit bounds them when positive. Hits come highest score first.
+func (db *Database) Search(tableName, field, text string, filter func(Row) bool, limit int) ([]SearchHit, error) {
+	table, err := db.Table(tableName)
+	if err != nil {
+		return nil, err
+	}
+	clauses := parseSearch(text)
+	if len(clauses) == 0 {
+		return nil, errors.New("empty search")
+	}
+
+	table.Mu.RLock()
+	defer table.Mu.RUnlock()
+
+	x, ok := table.text[field]
+	if !ok {
+		return nil, fmt.Errorf("field is not full-text indexed: %s", field)
+	}
+	n := float64(len(x.Lengths))
+	if n == 0 {
+		return nil, nil
+	}
+	avg := float64(x.total) / n
+	live := table.Schema.live
+
+	scores := make(map[int64]float64)
+	score := func(term string, id int64, tf int) {
+		df := float64(len(x.Terms[term]))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		norm := 1 - bm25B + bm25B*float64(x.Lengths[id])/avg
+		scores[id] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+	}
+	for _, c := range clauses {
+		switch {
+		case c.prefix:
+			for term, docs := range x.Terms {
+				if strings.HasPrefix(term, c.terms[0]) {
+					for id, positions := range docs {
+						score(term, id, len(positions))
+					}
+				}
+			}
+		case len(c.terms) == 1:
+			for id, positions := range x.Terms[c.terms[0]] {
+				score(c.terms[0], id, len(positions))
+			}
+		default:
+			for id, tf := range x.phrase(c.terms) {
+				for _, term := range c.terms {
+					score(term, id, tf)
+				}
+			}
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for id, s := range scores {
+		row := x.rows[id]
+		if !live(row) || filter != nil && !filter(row) {
+			continue
+		}
+		hits = append(hits, SearchHit{Row: row, Score: s})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		a, _ := RowID(hits[i].Row)
+		b, _ := RowID(hits[j].Row)
+		return a < b
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	for i := range hits {
+		hits[i].Row = withoutHidden(hits[i].Row)
+	}
+	return hits, nil
+}
+
+// phrase returns how often terms occur in sequence in each row holding them
+// all.
+func (x *textIndex) phrase(terms []string) map[int64]int {
+	counts := make(map[int64]int)
+	for id, starts := range x.Terms[terms[0]] {
+		for _, p := range starts {
+			found := true
+			for k, term := range terms[1:] {
+				if !containsInt(x.Terms[term][id], p+k+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				counts[id]++
+			}
+		}
+	}
+	return counts
+}
+
+func containsInt(sorted []int, v int) bool {
+	i := sort.SearchInts(sorted, v)
+	return i < len(sorted) && sorted[i] == v
+}
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RowInsertedField holds the time a row was inserted, in Unix milliseconds,
+// in tables whose TTL counts from insertion. Like RowIDField it never meets
+// the data, is not part of the schema, is kept across migrations and is left
+// out of the rows read back.
+const RowInsertedField = "\x00inserted"
+
+// TTL expires the rows of a table some time after a time of theirs. Expired
+// rows are left out of reads at once and removed for good when the table is
+// flushed, or by Expire.
+type TTL struct {
+	// Field is a timestamp field holding each row's time. Empty counts from
+	// the time the row was inserted; rows inserted before the TTL was set
+	// then never expire.
+	Field string `json:",omitempty"`
+	// After is how long after that time a row expires, as a Go duration
+	// such as "15m" or "720h". Empty means Field holds the expiry itself.
+	After string `json:",omitempty"`
+}
+
+// validate checks the TTL against the fields of its table.
+func (ttl *TTL) validate(fields []Field) error {
+	after, err := ttl.after()
+	if err != nil {
+		return err
+	}
+	if ttl.Field == "" {
+		if after <= 0 {
+			return errors.New("ttl: counting from insertion needs a positive after")
+		}
+		return nil
+	}
+	for _, f := range fields {
+		if f.Name == ttl.Field {
+			if f.Type != FieldTypeTimestamp {
+				return fmt.Errorf("ttl: %s is not a timestamp field", ttl.Field)
+			}
+			return nil
+		}
+	}
+	return errors.New("ttl: field not found: " + ttl.Field)
+}
+
+func (ttl *TTL) after() (time.Duration, error) {
+	if ttl.After == "" {
+		return 0, nil
+	}
+	after, err := time.ParseDuration(ttl.After)
+	if err != nil {
+		return 0, fmt.Errorf("ttl: %v", err)
+	}
+	if after < 0 {
+		return 0, errors.New("ttl: after is negative")
+	}
+	return after, nil
+}
+
+// liveAt returns a predicate telling which rows have not expired at now, or
+// nil when the schema has no TTL and every row is live.
+func (s *Schema) liveAt(now time.Time) func(Row) bool {
+	if s.TTL == nil {
+		return nil
+	}
+	after, err := s.TTL.after()
+	if err != nil {
+		return nil
+	}
+	cutoff := now.Add(-after)
+	if s.TTL.Field == "" {
+		ms := cutoff.UnixMilli()
+		return func(row Row) bool {
+			at, ok := toFloat(row[RowInsertedField])
+			return !ok || int64(at) > ms
+		}
+	}
+	field := s.TTL.Field
+	return func(row Row) bool {
+		at, ok := row[field].(time.Time)
+		return !ok || at.After(cutoff)
+	}
+}
+
+// live reports whether row has not expired now.
+func (s *Schema) live(row Row) bool {
+	if live := s.liveAt(time.Now()); live != nil {
+		return live(row)
+	}
+	return true
+}
+
+// stampInserted records the insert time of a new row when the table's TTL
+// counts from insertion.
+func (s *Schema) stampInserted(row Row) {
+	if s.TTL != nil && s.TTL.Field == "" {
+		row[RowInsertedField] = time.Now().UnixMilli()
+	}
+}
+
+// SetTTL sets the TTL of a table, or removes it when ttl is nil. Rows are
+// not rewritten: a new TTL applies to the rows already there as soon as it
+// is set.
+func (db *Database) SetTTL(tableName string, ttl *TTL) error {
+	db.Mu.Lock()
+	table, ok := db.Tables[tableName]
+	if !ok {
+		db.Mu.Unlock()
+		return errors.New("table not found: " + tableName)
+	}
+	if err := db.notView(tableName); err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	table.Mu.Lock()
+	if ttl != nil {
+		if err := ttl.validate(table.Schema.Fields); err != nil {
+			table.Mu.Unlock()
+			db.Mu.Unlock()
+			return err
+		}
+		copied := *ttl
+		ttl = &copied
+	}
+	// Snapshots hold on to the old schema, so it is replaced, not changed.
+	schema := *table.Schema
+	schema.TTL = ttl
+	table.Schema = &schema
+	db.Schemas[tableName] = &schema
+	table.Mu.Unlock()
+	db.Mu.Unlock()
+
+	return db.SaveSchemas()
+}
+
+// Expire removes the expired rows of a table for good, following the
+// OnDelete action of foreign keys pointing at them, and returns how many
+// were removed. Flush calls it after sealing the hot heap.
+func (db *Database) Expire(tableName string) (int, error) {
+	table, err := db.Table(tableName)
+	if err != nil {
+		return 0, err
+	}
+	table.Mu.RLock()
+	live := table.Schema.liveAt(time.Now())
+	table.Mu.RUnlock()
+	if live == nil {
+		return 0, nil
+	}
+	return table.deleteWhere(func(row Row) bool { return !live(row) }, nil, false)
+}
@@ -0,0 +1,261 @@
+package core
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Decimal is an exact decimal number kept in its shortest form, such as
+// "12.5" or "-0.001". It travels over the bridge and to disk as a JSON string.
+type Decimal string
+
+var decimalPattern = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?$`)
+
+// ParseDecimal parses s exactly, without going through float64.
+func ParseDecimal(s string) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	if !decimalPattern.MatchString(s) {
+		return "", fmt.Errorf("invalid decimal: %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return "", fmt.Errorf("invalid decimal: %q", s)
+	}
+	return decimalFromRat(r), nil
+}
+
+// decimalFromRat formats r, whose denominator only has the factors 2 and 5,
+// with exactly as many digits as it needs.
+func decimalFromRat(r *big.Rat) Decimal {
+	denom := new(big.Int).Set(r.Denom())
+	digits := 0
+	two, five, ten := big.NewInt(2), big.NewInt(5), big.NewInt(10)
+	for denom.Cmp(big.NewInt(1)) != 0 {
+		switch {
+		case new(big.Int).Mod(denom, ten).Sign() == 0:
+			denom.Div(denom, ten)
+		case new(big.Int).Mod(denom, two).Sign() == 0:
+			denom.Div(denom, two)
+		case new(big.Int).Mod(denom, five).Sign() == 0:
+			denom.Div(denom, five)
+		default:
+			// Not a finite decimal; keep plenty of digits.
+			return Decimal(strings.TrimRight(strings.TrimRight(r.FloatString(32), "0"), "."))
+		}
+		digits++
+	}
+	s := r.FloatString(digits)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return Decimal(s)
+}
+
+// Rat returns the exact value of d.
+func (d Decimal) Rat() *big.Rat {
+	r, ok := new(big.Rat).SetString(string(d))
+	if !ok {
+		return new(big.Rat)
+	}
+	return r
+}
+
+// timestampLayouts are the string forms accepted for timestamps. Layouts
+// without a zone are read as UTC.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseTimestamp reads an RFC 3339 string, or a date, into a UTC time.
+func ParseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp: %q", s)
+}
+
+// normalizeValue converts v to the form the database keeps for typ:
+//
+//   - timestamp: time.Time in UTC. Accepts time.Time, RFC 3339 strings and
+//     Unix milliseconds.
+//   - bytes: []byte. Accepts []byte, base64 strings and Node Buffer JSON.
+//   - decimal: Decimal. Accepts Decimal, numeric strings and numbers.
+//   - object: map[string]interface{}.
+//   - array: []interface{}. Any Go slice is accepted.
+//   - vector: []float64. Accepts any Go slice of finite numbers.
+//
+// Values of the original scalar types pass through unchecked.
+func normalizeValue(v interface{}, typ FieldType) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch typ {
+	case FieldTypeTimestamp:
+		switch x := v.(type) {
+		case time.Time:
+			return x.UTC().Round(0), nil
+		case string:
+			return ParseTimestamp(x)
+		}
+		if n, ok := toFloat(v); ok {
+			return time.UnixMilli(int64(n)).UTC(), nil
+		}
+
+	case FieldTypeBytes:
+		switch x := v.(type) {
+		case []byte:
+			return append([]byte(nil), x...), nil
+		case string:
+			return base64.StdEncoding.DecodeString(x)
+		case map[string]interface{}:
+			// JSON.stringify(Buffer) gives {type: 'Buffer', data: [...]}.
+			if x["type"] == "Buffer" {
+				if data, ok := x["data"].([]interface{}); ok {
+					out := make([]byte, len(data))
+					for i, b := range data {
+						n, ok := toFloat(b)
+						if !ok || n < 0 || n > 255 {
+							return nil, errors.New("invalid buffer data")
+						}
+						out[i] = byte(n)
+					}
+					return out, nil
+				}
+			}
+		}
+
+	case FieldTypeDecimal:
+		switch x := v.(type) {
+		case Decimal:
+			return x, nil
+		case string:
+			return ParseDecimal(x)
+		}
+		if n, ok := toFloat(v); ok {
+			return ParseDecimal(strconv.FormatFloat(n, 'f', -1, 64))
+		}
+
+	case FieldTypeObject:
+		switch x := v.(type) {
+		case map[string]interface{}:
+			return x, nil
+		case Row:
+			return map[string]interface{}(x), nil
+		}
+
+	case FieldTypeArray:
+		if x, ok := v.([]interface{}); ok {
+			return x, nil
+		}
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+			out := make([]interface{}, rv.Len())
+			for i := range out {
+				out[i] = rv.Index(i).Interface()
+			}
+			return out, nil
+		}
+
+	case FieldTypeVector:
+		var out []float64
+		switch x := v.(type) {
+		case []float64:
+			out = append([]float64(nil), x...)
+		case []float32:
+			out = make([]float64, len(x))
+			for i, n := range x {
+				out[i] = float64(n)
+			}
+		default:
+			rv := reflect.ValueOf(v)
+			if rv.Kind() != reflect.Slice {
+				break
+			}
+			out = make([]float64, rv.Len())
+			for i := range out {
+				n, ok := toFloat(rv.Index(i).Interface())
+				if !ok {
+					return nil, fmt.Errorf("vector element %d is not a number", i)
+				}
+				out[i] = n
+			}
+		}
+		if out == nil {
+			break
+		}
+		for i, n := range out {
+			if math.IsNaN(n) || math.IsInf(n, 0) {
+				return nil, fmt.Errorf("vector element %d is not finite", i)
+			}
+		}
+		return out, nil
+
+	default:
+		return v, nil
+	}
+	return nil, fmt.Errorf("cannot use %T as %v", v, typ)
+}
+
+// normalizeRow converts the values of row to their stored form in place.
+func (s *Schema) normalizeRow(row Row) error {
+	for _, f := range s.Fields {
+		v, ok := row[f.Name]
+		if !ok || v == nil {
+			continue
+		}
+		nv, err := normalizeValue(v, f.Type)
+		if err != nil {
+			return fmt.Errorf("type mismatch: %s: %v", f.Name, err)
+		}
+		if vec, ok := nv.([]float64); ok && f.Type == FieldTypeVector && len(vec) != f.Dimensions {
+			return fmt.Errorf("type mismatch: %s: expected %d dimensions, got %d", f.Name, f.Dimensions, len(vec))
+		}
+		row[f.Name] = nv
+	}
+	return nil
+}
+
+// decodeRowsLocked turns values read back from JSON, such as timestamp
+// strings, into their stored form. Values that do not decode are kept as
+// they are.
+func (t *Table) decodeRowsLocked() {
+	for _, clump := range t.SealedClumps {
+		t.Schema.decodeRows(clump.Rows)
+	}
+}
+
+// decodeRows is decodeRowsLocked for rows outside the table's clumps.
+func (s *Schema) decodeRows(rows []Row) {
+	var typed []Field
+	for _, f := range s.Fields {
+		if f.Type >= FieldTypeObject {
+			typed = append(typed, f)
+		}
+	}
+	if len(typed) == 0 {
+		return
+	}
+	for _, row := range rows {
+		for _, f := range typed {
+			if v, ok := row[f.Name]; ok {
+				if nv, err := normalizeValue(v, f.Type); err == nil {
+					row[f.Name] = nv
+				}
+			}
+		}
+	}
+}
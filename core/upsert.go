@@ -0,0 +1,251 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// UpsertMode decides what happens when a row collides with an existing one on
+// the conflict target.
+type UpsertMode int
+
+const (
+	// UpsertMerge overwrites the fields present in the new row and keeps the rest.
+	UpsertMerge UpsertMode = iota
+	// UpsertReplace swaps the existing row for the new one.
+	UpsertReplace
+	// UpsertIgnore keeps the existing row and drops the new one.
+	UpsertIgnore
+)
+
+func ParseUpsertMode(s string) (UpsertMode, error) {
+	switch s {
+	case "", "merge":
+		return UpsertMerge, nil
+	case "replace":
+		return UpsertReplace, nil
+	case "ignore":
+		return UpsertIgnore, nil
+	}
+	return 0, errors.New("unknown upsert mode: " + s)
+}
+
+type UpsertResult struct {
+	Inserted int
+	Updated  int
+	Ignored  int
+}
+
+// upsertOp is the staged outcome for one record of an upsert batch.
+type upsertOp struct {
+	existing Row
+	newRow   Row
+}
+
+func (db *Database) Upsert(tableName string, record Row, conflictFields []string, mode UpsertMode) (UpsertResult, error) {
+	return db.BulkUpsert(tableName, []Row{record}, conflictFields, mode)
+}
+
+// BulkUpsert inserts records, resolving collisions on conflictFields according
+// to mode. The whole batch is validated before anything is applied, so either
+// every record lands or none does.
+func (db *Database) BulkUpsert(tableName string, records []Row, conflictFields []string, mode UpsertMode) (UpsertResult, error) {
+	db.Mu.RLock()
+	table, ok := db.Tables[tableName]
+	db.Mu.RUnlock()
+
+	if !ok {
+		return UpsertResult{}, errors.New("table not found: " + tableName)
+	}
+
+	outgoing, incoming := db.foreignKeys(tableName)
+	tx := db.begin(table)
+	release := lockParents(table, outgoing, tx.held)
+	tx.lock(table)
+	unlockChildren := lockChildren(table, incoming, false, tx.held)
+	result, err := table.upsertLocked(tx, records, conflictFields, mode, outgoing, incoming)
+	if err = tx.end(err); err != nil {
+		result = UpsertResult{}
+	}
+	unlockChildren()
+	tx.unlock(table)
+	release()
+
+	// Sealed clumps are append-only on disk, so changing one of their rows
+	// means rewriting the file.
+	return result, tx.close(err)
+}
+
+func (t *Table) upsertLocked(tx *Tx, records []Row, conflictFields []string, mode UpsertMode, outgoing, incoming []foreignKey) (UpsertResult, error) {
+	var result UpsertResult
+	if err := t.writable(); err != nil {
+		return result, err
+	}
+
+	target, err := t.conflictTarget(conflictFields)
+	if err != nil {
+		return result, err
+	}
+
+	live := t.Schema.live
+	// The caller's maps are left alone.
+	records = append([]Row(nil), records...)
+	// 1. Validation Phase (All or Nothing)
+	ops := make([]upsertOp, len(records))
+	for i, record := range records {
+		record = merged(record, nil)
+		records[i] = record
+		if err := t.Schema.normalizeRow(record); err != nil {
+			return result, fmt.Errorf("row %d: %v", i, err)
+		}
+		// The conflict target may be computed; a merged row is computed
+		// again below.
+		if err := t.Schema.computeRow(record); err != nil {
+			return result, fmt.Errorf("row %d: %v", i, err)
+		}
+		for _, f := range target.Fields {
+			if _, ok := record[f]; !ok {
+				return result, fmt.Errorf("row %d: missing field: %s", i, f)
+			}
+		}
+		key := target.key(record)
+		for j := 0; j < i; j++ {
+			if target.key(records[j]) == key {
+				return result, fmt.Errorf("row %d: duplicate value in batch for field: %s", i, target.Name)
+			}
+		}
+
+		existing, found := t.UniqueIndices[target.Name][key]
+		if found && !live(existing) {
+			// An expired row is as good as gone: the record is inserted
+			// afresh and takes over the key.
+			existing, found = nil, false
+		}
+		if found && mode == UpsertIgnore {
+			continue
+		}
+
+		newRow := record
+		if found {
+			// The existing row keeps its id and insert time whichever way
+			// it is rewritten.
+			kept := Row{RowIDField: existing[RowIDField]}
+			if at, ok := existing[RowInsertedField]; ok {
+				kept[RowInsertedField] = at
+			}
+			newRow = merged(record, kept)
+			if mode == UpsertMerge {
+				newRow = merged(existing, newRow)
+			}
+		}
+		ev := &HookEvent{Kind: ChangeInsert, Table: t.Name, After: newRow}
+		if found {
+			ev.Kind, ev.Before = ChangeUpdate, existing
+		}
+		if tx.hasBefore(t, ev.Kind) {
+			if err := tx.before(t, ev); err != nil {
+				return result, fmt.Errorf("row %d: %v", i, err)
+			}
+			newRow = ev.After
+			if err := t.Schema.normalizeRow(newRow); err != nil {
+				return result, fmt.Errorf("row %d: %v", i, err)
+			}
+			if target.key(newRow) != key {
+				return result, fmt.Errorf("row %d: a trigger changed the conflict key: %s", i, target.Name)
+			}
+			if found && !Equal(newRow[RowIDField], existing[RowIDField]) {
+				return result, fmt.Errorf("row %d: %v", i, errRowIDReadOnly)
+			}
+		}
+
+		if err := t.Schema.computeRow(newRow); err != nil {
+			return result, fmt.Errorf("row %d: %v", i, err)
+		}
+		if target.key(newRow) != key {
+			return result, fmt.Errorf("row %d: the merged row computes another conflict key: %s", i, target.Name)
+		}
+		for _, field := range t.Schema.Fields {
+			if _, ok := newRow[field.Name]; !ok {
+				return result, fmt.Errorf("row %d: missing field: %s", i, field.Name)
+			}
+		}
+		for _, k := range t.Schema.uniqueKeys() {
+			if k.Name == target.Name {
+				continue
+			}
+			otherKey := k.key(newRow)
+			// The row being replaced may keep its own values.
+			if owner, exists := t.UniqueIndices[k.Name][otherKey]; exists && live(owner) && target.key(owner) != key {
+				return result, fmt.Errorf("row %d: unique constraint violation: %s", i, k.Name)
+			}
+			for j := 0; j < i; j++ {
+				if ops[j].newRow != nil && k.key(ops[j].newRow) == otherKey {
+					return result, fmt.Errorf("row %d: duplicate value in batch for field: %s", i, k.Name)
+				}
+			}
+		}
+
+		if err := t.Schema.checkRow(newRow); err != nil {
+			return result, fmt.Errorf("row %d: %v", i, err)
+		}
+		if err := checkForeignKeys(outgoing, newRow); err != nil {
+			return result, fmt.Errorf("row %d: %v", i, err)
+		}
+		if found {
+			if err := checkReferencesKept(incoming, []Row{existing}, []Row{newRow}); err != nil {
+				return result, fmt.Errorf("row %d: %v", i, err)
+			}
+		}
+
+		ops[i] = upsertOp{existing: existing, newRow: newRow}
+	}
+
+	// 2. Application Phase
+	var olds, news []Row
+	var changes []change
+	for _, op := range ops {
+		switch {
+		case op.newRow == nil:
+			result.Ignored++
+		case op.existing == nil:
+			changes = append(changes, change{table: t, kind: ChangeInsert, afters: []Row{op.newRow}})
+			result.Inserted++
+		default:
+			// The new version takes the old row's position in the HotHeap
+			// or its sealed clump.
+			olds = append(olds, op.existing)
+			news = append(news, op.newRow)
+			changes = append(changes, change{table: t, kind: ChangeUpdate, befores: []Row{op.existing}, afters: []Row{op.newRow}})
+			result.Updated++
+		}
+	}
+	tx.apply(t, changes, func() bool {
+		for _, op := range ops {
+			if op.newRow != nil && op.existing == nil {
+				t.assignID(op.newRow)
+				t.Schema.stampInserted(op.newRow)
+				t.indexRow(op.newRow)
+				t.HotHeap.Rows = append(t.HotHeap.Rows, op.newRow)
+			}
+		}
+		return t.replaceLocked(olds, news)
+	})
+
+	return result, tx.after(t, changes)
+}
+
+// conflictTarget resolves the fields of an upsert to the unique index that
+// arbitrates collisions. Field order does not matter.
+func (t *Table) conflictTarget(conflictFields []string) (uniqueKey, error) {
+	if k, ok := t.Schema.uniqueKeyFor(conflictFields); ok {
+		return k, nil
+	}
+	return uniqueKey{}, errors.New("upsert conflict target is not unique: " + strings.Join(conflictFields, ","))
+}
+
+// sameRow reports whether a and b are the same map, not merely equal maps.
+func sameRow(a, b Row) bool {
+	return reflect.ValueOf(a).UnsafePointer() == reflect.ValueOf(b).UnsafePointer()
+}
@@ -0,0 +1,374 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// vectorSegmentPrefix marks records of the data file that hold the vector
+// index lists of the clump written just before them, under the table's name
+// with this prefix.
+const vectorSegmentPrefix = "\x00vector:"
+
+// VectorIndexIVF is the inverted file index: vectors are clustered around
+// centroids, and a search only reads the clusters nearest the query.
+const VectorIndexIVF = "ivf"
+
+// vectorTrainMin is the row count at which vector indexes are trained.
+// Smaller tables are searched exhaustively, which is about as fast.
+const vectorTrainMin = 256
+
+// kmeansRounds bounds the refinement of the centroids when training.
+const kmeansRounds = 10
+
+// Metric is how a nearest-neighbour search measures vectors.
+type Metric string
+
+const (
+	// Cosine compares directions; the distance is 1 minus the cosine.
+	Cosine Metric = "cosine"
+	// Dot compares inner products; the distance is the negated product.
+	Dot Metric = "dot"
+	// L2 is the Euclidean distance.
+	L2 Metric = "l2"
+)
+
+// ParseMetric checks a metric name. The empty name is Cosine.
+func ParseMetric(name string) (Metric, error) {
+	switch m := Metric(strings.ToLower(name)); m {
+	case "":
+		return Cosine, nil
+	case Cosine, Dot, L2:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown metric: %s", name)
+}
+
+// Distance measures how far apart a and b, of the same length, are under m;
+// smaller is nearer. A zero vector is at distance 1 from everything under
+// Cosine.
+func Distance(m Metric, a, b []float64) float64 {
+	switch m {
+	case Dot:
+		return -dot(a, b)
+	case L2:
+		return math.Sqrt(squaredL2(a, b))
+	}
+	na, nb := math.Sqrt(dot(a, a)), math.Sqrt(dot(b, b))
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot(a, b)/(na*nb)
+}
+
+func dot(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
+
+func squaredL2(a, b []float64) float64 {
+	s := 0.0
+	for i := range a {
+		d := a[i] - b[i]
+		s += d * d
+	}
+	return s
+}
+
+// nearestCentroid returns the index of the centroid closest to vec.
+func nearestCentroid(centroids [][]float64, vec []float64) int {
+	best, bestD := 0, math.Inf(1)
+	for c, centroid := range centroids {
+		if d := squaredL2(vec, centroid); d < bestD {
+			best, bestD = c, d
+		}
+	}
+	return best
+}
+
+// vectorIndex is the IVF index of a vector field: centroids that split the
+// vectors into lists, and the rows of each list. It holds nothing until it
+// is trained, and searches scan the table until then.
+type vectorIndex struct {
+	field     string
+	dims      int
+	lists     int
+	centroids [][]float64
+	list      map[int64]int
+	members   []map[int64]Row
+	// saved reports whether the centroids are in the data file. Segments
+	// are built under the table's read lock, so it is atomic.
+	saved atomic.Bool
+}
+
+// vectorSegment holds the list of every row of one sealed clump, by field,
+// and the centroids of indexes whose centroids are not in the file yet. It
+// is persisted after the clump so an index loads without clustering again.
+type vectorSegment map[string]*vectorLists
+
+type vectorLists struct {
+	Centroids [][]float64 `json:",omitempty"`
+	Lists     map[int64]int
+}
+
+// newVectorIndexes returns untrained indexes for the vector fields of schema
+// that ask for one.
+func newVectorIndexes(schema *Schema) map[string]*vectorIndex {
+	indexes := make(map[string]*vectorIndex)
+	for _, f := range schema.Fields {
+		if f.VectorIndex != "" {
+			indexes[f.Name] = &vectorIndex{field: f.Name, dims: f.Dimensions, lists: f.Lists}
+		}
+	}
+	return indexes
+}
+
+func (x *vectorIndex) trained() bool {
+	return x.centroids != nil
+}
+
+// add puts row in the list of its nearest centroid.
+func (x *vectorIndex) add(row Row) {
+	vec, ok := row[x.field].([]float64)
+	if !ok || !x.trained() {
+		return
+	}
+	if id, ok := RowID(row); ok {
+		x.put(id, nearestCentroid(x.centroids, vec), row)
+	}
+}
+
+func (x *vectorIndex) put(id int64, c int, row Row) {
+	x.list[id] = c
+	x.members[c][id] = row
+}
+
+// remove drops row from its list.
+func (x *vectorIndex) remove(row Row) {
+	id, ok := RowID(row)
+	if !ok {
+		return
+	}
+	if c, ok := x.list[id]; ok {
+		delete(x.list, id)
+		delete(x.members[c], id)
+	}
+}
+
+// reset empties the index and splits it by centroids.
+func (x *vectorIndex) reset(centroids [][]float64) {
+	x.centroids = centroids
+	x.list = make(map[int64]int)
+	x.members = make([]map[int64]Row, len(centroids))
+	for c := range x.members {
+		x.members[c] = make(map[int64]Row)
+	}
+	x.saved.Store(false)
+}
+
+// train clusters the vectors of rows and indexes rows. It does nothing when
+// rows hold fewer than vectorTrainMin vectors.
+func (x *vectorIndex) train(rows []Row) {
+	var vecs [][]float64
+	for _, row := range rows {
+		if vec, ok := row[x.field].([]float64); ok {
+			vecs = append(vecs, vec)
+		}
+	}
+	if len(vecs) < vectorTrainMin {
+		return
+	}
+	k := x.lists
+	if k <= 0 {
+		k = int(math.Sqrt(float64(len(vecs))))
+	}
+	x.reset(kmeans(vecs, min(k, len(vecs))))
+	for _, row := range rows {
+		x.add(row)
+	}
+}
+
+// kmeans clusters vecs around k centroids. It starts from evenly spaced
+// vectors, so training the same rows gives the same index.
+func kmeans(vecs [][]float64, k int) [][]float64 {
+	centroids := make([][]float64, k)
+	for c := range centroids {
+		centroids[c] = append([]float64(nil), vecs[c*len(vecs)/k]...)
+	}
+	assign := make([]int, len(vecs))
+	for round := 0; round < kmeansRounds; round++ {
+		moved := round == 0
+		for i, vec := range vecs {
+			c := nearestCentroid(centroids, vec)
+			moved = moved || c != assign[i]
+			assign[i] = c
+		}
+		if !moved {
+			break
+		}
+		sums := make([][]float64, k)
+		counts := make([]int, k)
+		for i, vec := range vecs {
+			c := assign[i]
+			if sums[c] == nil {
+				sums[c] = make([]float64, len(vec))
+			}
+			for d, v := range vec {
+				sums[c][d] += v
+			}
+			counts[c]++
+		}
+		// A centroid left without vectors stays where it was.
+		for c, sum := range sums {
+			if counts[c] == 0 {
+				continue
+			}
+			for d := range sum {
+				sum[d] /= float64(counts[c])
+			}
+			centroids[c] = sum
+		}
+	}
+	return centroids
+}
+
+// trainVectorsLocked trains the untrained vector indexes once the table
+// holds vectorTrainMin rows. The caller must hold the table's lock.
+func (t *Table) trainVectorsLocked() {
+	var rows []Row
+	for _, x := range t.vectors {
+		if x.trained() {
+			continue
+		}
+		if rows == nil {
+			n := len(t.HotHeap.Rows)
+			for _, clump := range t.SealedClumps {
+				n += len(clump.Rows)
+			}
+			if n < vectorTrainMin {
+				return
+			}
+			t.eachRowLocked(func(row Row) {
+				rows = append(rows, row)
+			})
+		}
+		x.train(rows)
+	}
+}
+
+// vectorSegment builds the persisted lists of rows, or nil when no vector
+// index is trained. Indexes whose centroids are not in the file yet add
+// them. The caller must hold at least the table's read lock.
+func (t *Table) vectorSegment(rows []Row) vectorSegment {
+	var seg vectorSegment
+	for name, x := range t.vectors {
+		if !x.trained() {
+			continue
+		}
+		p := &vectorLists{Lists: make(map[int64]int)}
+		if !x.saved.Swap(true) {
+			p.Centroids = x.centroids
+		}
+		for _, row := range rows {
+			if id, ok := RowID(row); ok {
+				if c, ok := x.list[id]; ok {
+					p.Lists[id] = c
+				}
+			}
+		}
+		if seg == nil {
+			seg = make(vectorSegment)
+		}
+		seg[name] = p
+	}
+	return seg
+}
+
+// unsaveVectors notes that the data file is being written afresh, so the
+// next segment of each index carries its centroids again. The caller must
+// hold at least the table's read lock.
+func (t *Table) unsaveVectors() {
+	for _, x := range t.vectors {
+		x.saved.Store(false)
+	}
+}
+
+// adoptVectorsLocked loads the persisted segments of the table into its
+// vector indexes. Rows the segments do not place go to their nearest list,
+// and indexes with no centroids in the file are trained afresh.
+func (t *Table) adoptVectorsLocked(segments []vectorSegment) {
+	for name, x := range t.vectors {
+		var centroids [][]float64
+		lists := make(map[int64]int)
+		for _, seg := range segments {
+			p := seg[name]
+			if p == nil {
+				continue
+			}
+			if p.Centroids != nil {
+				// Lists written before these centroids refer to older ones.
+				centroids = p.Centroids
+				lists = make(map[int64]int)
+			}
+			for id, c := range p.Lists {
+				lists[id] = c
+			}
+		}
+		if len(centroids) == 0 || len(centroids[0]) != x.dims {
+			continue
+		}
+		x.reset(centroids)
+		x.saved.Store(true)
+		t.eachRowLocked(func(row Row) {
+			id, ok := RowID(row)
+			vec, isVector := row[name].([]float64)
+			if !ok || !isVector {
+				return
+			}
+			c, ok := lists[id]
+			if !ok || c < 0 || c >= len(centroids) {
+				c = nearestCentroid(centroids, vec)
+			}
+			x.put(id, c, row)
+		})
+	}
+	t.trainVectorsLocked()
+}
+
+// NearestSnapshot returns the rows of field's vector index, one batch per
+// list, starting with the list whose centroid is nearest vec under m. It
+// reports false when the field has no trained index.
+func (t *Table) NearestSnapshot(field string, vec []float64, m Metric) (*Snapshot, bool) {
+	t.Mu.RLock()
+	defer t.Mu.RUnlock()
+
+	x, ok := t.vectors[field]
+	if !ok || !x.trained() || len(vec) != x.dims {
+		return nil, false
+	}
+	order := make([]int, len(x.centroids))
+	dist := make([]float64, len(x.centroids))
+	for c, centroid := range x.centroids {
+		order[c] = c
+		dist[c] = Distance(m, vec, centroid)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return dist[order[i]] < dist[order[j]]
+	})
+
+	batches := make([][]Row, len(order))
+	for i, c := range order {
+		rows := make([]Row, 0, len(x.members[c]))
+		for _, row := range x.members[c] {
+			rows = append(rows, row)
+		}
+		batches[i] = rows
+	}
+	return t.snapshotLocked(batches), true
+}
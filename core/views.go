@@ -0,0 +1,944 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ViewStateField holds, in each row of a grouped materialized view, what
+// the view needs to carry on updating the row as its table changes. Like
+// RowIDField it is not part of the schema.
+const ViewStateField = "_view"
+
+// ViewSourceField holds, in each row of a materialized view that is not
+// grouped, the row id of the row of the table it shows.
+const ViewSourceField = "_source"
+
+// View is a saved query over a table, kept with the schema and read by name
+// like a table: through Table, query.Query and Count. It cannot be written
+// to. A view shows the rows of Table passing Match, cut down to Columns;
+// when it has GroupBy fields or Aggregates it shows one row per group
+// instead, holding the GroupBy fields and the results of the aggregates.
+// Aggregates without GroupBy make a single group, even over no rows.
+//
+// A view is computed whenever it is read, unless it is Materialized: then
+// its rows are stored like a table's and brought up to date from the change
+// feed after every write to Table, a group or row at a time. Reading a
+// materialized view waits for the writes made before the read.
+type View struct {
+	// Table is the table the view reads. It cannot be a view.
+	Table string
+	// Match keeps the rows passing it, as in Count; empty keeps every row.
+	Match map[string]interface{} `json:",omitempty"`
+	// Columns are the fields of Table a view that is not grouped shows;
+	// empty shows them all.
+	Columns    []string        `json:",omitempty"`
+	GroupBy    []string        `json:",omitempty"`
+	Aggregates []ViewAggregate `json:",omitempty"`
+	// Materialized stores the rows of the view; see RefreshView.
+	Materialized bool `json:",omitempty"`
+}
+
+// ViewAggregate is one aggregate column of a grouped view. Values that are
+// null, or not finite numbers for a sum or average, are left out.
+type ViewAggregate struct {
+	// Func is count, sum, avg, min or max.
+	Func string
+	// Field is the field aggregated. A count without one counts rows.
+	Field string `json:",omitempty"`
+	// As names the column holding the result.
+	As string
+}
+
+// grouped reports whether the view shows groups rather than rows.
+func (v *View) grouped() bool {
+	return len(v.GroupBy) > 0 || len(v.Aggregates) > 0
+}
+
+// fields checks the view against the schema of its table and returns the
+// fields and constraints of its rows.
+func (v *View) fields(source *Schema) ([]Field, []Constraint, error) {
+	if _, err := source.Matcher(v.Match); err != nil {
+		return nil, nil, err
+	}
+	known := make(map[string]Field, len(source.Fields))
+	for _, f := range source.Fields {
+		known[f.Name] = f
+	}
+	// Only the type of a field carries over; its rules and indexes stay
+	// with the table.
+	column := func(name string) (Field, error) {
+		f, ok := known[name]
+		if !ok {
+			return Field{}, errors.New("unknown field: " + name)
+		}
+		return Field{Name: f.Name, Type: f.Type, Dimensions: f.Dimensions}, nil
+	}
+	taken := map[string]bool{RowIDField: true, ViewStateField: true, ViewSourceField: true}
+	var fields []Field
+	add := func(f Field) error {
+		if taken[f.Name] {
+			return errors.New("duplicate or reserved view column: " + f.Name)
+		}
+		taken[f.Name] = true
+		fields = append(fields, f)
+		return nil
+	}
+
+	if !v.grouped() {
+		columns := v.Columns
+		if len(columns) == 0 {
+			for _, f := range source.Fields {
+				columns = append(columns, f.Name)
+			}
+		}
+		for _, name := range columns {
+			f, err := column(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := add(f); err != nil {
+				return nil, nil, err
+			}
+		}
+		if v.Materialized {
+			fields = append(fields, Field{Name: ViewSourceField, Type: FieldTypeInt, Unique: true})
+		}
+		return fields, nil, nil
+	}
+
+	if len(v.Columns) > 0 {
+		return nil, nil, errors.New("a grouped view shows its groups and cannot select columns")
+	}
+	for _, name := range v.GroupBy {
+		f, err := column(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := add(f); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, a := range v.Aggregates {
+		if a.As == "" {
+			return nil, nil, fmt.Errorf("%s(%s) needs a column name", a.Func, a.Field)
+		}
+		out := Field{Name: a.As, Type: FieldTypeInt}
+		var in Field
+		if a.Field != "" {
+			var err error
+			if in, err = column(a.Field); err != nil {
+				return nil, nil, err
+			}
+		}
+		switch a.Func {
+		case AggCount:
+		case AggSum, AggAvg:
+			if a.Field == "" || in.Type != FieldTypeInt && in.Type != FieldTypeFloat && in.Type != FieldTypeDecimal {
+				return nil, nil, fmt.Errorf("%s needs a number field: %s", a.Func, a.As)
+			}
+			out.Type = in.Type
+			if a.Func == AggAvg && in.Type == FieldTypeInt {
+				out.Type = FieldTypeFloat
+			}
+		case AggMin, AggMax:
+			if a.Field == "" {
+				return nil, nil, fmt.Errorf("%s needs a field: %s", a.Func, a.As)
+			}
+			out.Type, out.Dimensions = in.Type, in.Dimensions
+		default:
+			return nil, nil, fmt.Errorf("unknown aggregate: %s", a.Func)
+		}
+		if err := add(out); err != nil {
+			return nil, nil, err
+		}
+	}
+	var constraints []Constraint
+	if v.Materialized && len(v.GroupBy) > 0 {
+		// Groups are found through the index of their fields.
+		constraints = []Constraint{{Kind: ConstraintUnique, Fields: append([]string(nil), v.GroupBy...)}}
+	}
+	return fields, constraints, nil
+}
+
+// project returns the columns of row shown by a view that is not grouped.
+// A computed view keeps the row's id; a materialized one has ids of its own
+// and points at the row through ViewSourceField.
+func (v *View) project(schema *Schema, row Row) Row {
+	out := make(Row, len(schema.Fields)+1)
+	for _, f := range schema.Fields {
+		if f.Name != ViewSourceField {
+			out[f.Name] = row[f.Name]
+		}
+	}
+	if id, ok := RowID(row); ok {
+		if v.Materialized {
+			out[ViewSourceField] = id
+		} else {
+			out[RowIDField] = id
+		}
+	}
+	return out
+}
+
+// viewGroup accumulates the rows of one group of a view.
+type viewGroup struct {
+	values []interface{}
+	rows   int
+	accs   []*Accumulator
+	// stored is the view's row for the group, for materialized views.
+	stored Row
+}
+
+func (v *View) newGroup(values []interface{}) *viewGroup {
+	g := &viewGroup{values: values, accs: make([]*Accumulator, len(v.Aggregates))}
+	for i, a := range v.Aggregates {
+		g.accs[i] = NewAccumulator(a.Func)
+	}
+	return g
+}
+
+// groupOf returns the group values of row.
+func (v *View) groupOf(row Row) []interface{} {
+	values := make([]interface{}, len(v.GroupBy))
+	for i, f := range v.GroupBy {
+		values[i] = row[f]
+	}
+	return values
+}
+
+// groupKey folds group values into a comparable key.
+func groupKey(values []interface{}) interface{} {
+	keys := make([]interface{}, len(values))
+	for i, v := range values {
+		keys[i] = IndexKey(v)
+	}
+	return IndexKey(keys)
+}
+
+// value is what aggregate a takes from row: the field, or any non-null
+// value when counting rows.
+func (a ViewAggregate) value(row Row) interface{} {
+	if a.Field == "" {
+		return true
+	}
+	return row[a.Field]
+}
+
+func (g *viewGroup) add(v *View, row Row) {
+	g.rows++
+	for i, a := range v.Aggregates {
+		g.accs[i].Add(a.value(row))
+	}
+}
+
+func (g *viewGroup) remove(v *View, row Row) {
+	g.rows--
+	for i, a := range v.Aggregates {
+		g.accs[i].Remove(a.value(row))
+	}
+}
+
+// row returns the view's row for the group. A materialized view's row also
+// keeps the state of the group.
+func (g *viewGroup) row(v *View) Row {
+	out := make(Row, len(g.values)+len(g.accs)+1)
+	for i, f := range v.GroupBy {
+		out[f] = g.values[i]
+	}
+	for i, a := range v.Aggregates {
+		out[a.As] = g.accs[i].Result()
+	}
+	if v.Materialized {
+		states := make([]interface{}, len(g.accs))
+		for i, acc := range g.accs {
+			states[i] = acc.state()
+		}
+		out[ViewStateField] = map[string]interface{}{"rows": g.rows, "aggregates": states}
+	}
+	return out
+}
+
+// storedGroup reads back the group of a materialized view's row.
+func (v *View) storedGroup(schema *Schema, stored Row) (*viewGroup, error) {
+	g := v.newGroup(v.groupOf(stored))
+	g.stored = stored
+	state, _ := stored[ViewStateField].(map[string]interface{})
+	rows, ok := toFloat(state["rows"])
+	states, _ := state["aggregates"].([]interface{})
+	if !ok || len(states) != len(v.Aggregates) {
+		return nil, errors.New("invalid view state")
+	}
+	g.rows = int(rows)
+	types := make(map[string]FieldType, len(schema.Fields))
+	for _, f := range schema.Fields {
+		types[f.Name] = f.Type
+	}
+	for i, a := range v.Aggregates {
+		s, _ := states[i].(map[string]interface{})
+		acc, err := accumulatorFrom(a.Func, s, types[a.As])
+		if err != nil {
+			return nil, err
+		}
+		g.accs[i] = acc
+	}
+	return g, nil
+}
+
+// evaluate computes the rows of the view over snap, a snapshot of its table,
+// giving them the schema of the view.
+func (v *View) evaluate(schema *Schema, snap *Snapshot) []Row {
+	matches, err := snap.Schema.Matcher(v.Match)
+	if err != nil {
+		// The table changed under the view; RefreshView reports why.
+		return nil
+	}
+	var rows []Row
+	if !v.grouped() {
+		snap.each(func(row Row) {
+			if matches(row) {
+				rows = append(rows, v.project(schema, row))
+			}
+		})
+		return rows
+	}
+
+	// Groups come out in the order they were first seen.
+	groups := make(map[interface{}]*viewGroup)
+	var order []*viewGroup
+	snap.each(func(row Row) {
+		if !matches(row) {
+			return
+		}
+		values := v.groupOf(row)
+		key := groupKey(values)
+		g := groups[key]
+		if g == nil {
+			g = v.newGroup(values)
+			groups[key] = g
+			order = append(order, g)
+		}
+		g.add(v, row)
+	})
+	if len(order) == 0 && len(v.GroupBy) == 0 {
+		order = append(order, v.newGroup(nil))
+	}
+	for _, g := range order {
+		rows = append(rows, g.row(v))
+	}
+	return rows
+}
+
+// CreateView saves view under name. A materialized view is filled from its
+// table straight away.
+func (db *Database) CreateView(name string, view View) error {
+	db.Mu.Lock()
+	if _, exists := db.Tables[name]; exists {
+		db.Mu.Unlock()
+		return errors.New("table already exists: " + name)
+	}
+	source, ok := db.Tables[view.Table]
+	if !ok {
+		db.Mu.Unlock()
+		return errors.New("table not found: " + view.Table)
+	}
+	if source.Schema.View != nil {
+		db.Mu.Unlock()
+		return errors.New("a view cannot read a view: " + view.Table)
+	}
+	fields, constraints, err := view.fields(source.Schema)
+	if err != nil {
+		db.Mu.Unlock()
+		return err
+	}
+	schema := nextSchema(nil, fields, constraints, []string{"VIEW_NEW: view defined over " + view.Table})
+	copied := view
+	schema.View = &copied
+
+	table := &Table{
+		Db:            db,
+		Name:          name,
+		Schema:        schema,
+		HotHeap:       NewHotHeap(1000),
+		SealedClumps:  make([]*SealedClump, 0),
+		UniqueIndices: newUniqueIndices(schema.uniqueKeys()),
+		text:          newTextIndexes(schema),
+		vectors:       newVectorIndexes(schema),
+		upgraded:      schema.Version,
+	}
+	db.Schemas[name] = schema
+	db.Tables[name] = table
+	// The view is locked before anyone can see it, so the change feed
+	// reaches it only once it is filled.
+	table.Mu.Lock()
+	db.Mu.Unlock()
+	if view.Materialized {
+		db.rebuildViewLocked(table, source)
+	}
+	table.Mu.Unlock()
+
+	return db.SaveSchemas()
+}
+
+// RefreshView rebuilds a view from its table: its columns take the current
+// types of the table's fields, and a materialized view's rows are computed
+// again. Views are refreshed on their own when their table's schema
+// changes.
+func (db *Database) RefreshView(name string) error {
+	db.Mu.Lock()
+	table, ok := db.Tables[name]
+	if !ok {
+		db.Mu.Unlock()
+		return errors.New("table not found: " + name)
+	}
+	rewrite, err := db.refreshViewLocked(table)
+	if err != nil {
+		return err
+	}
+	if err := db.SaveSchemas(); err != nil {
+		return err
+	}
+	if rewrite {
+		return db.Rewrite()
+	}
+	return nil
+}
+
+// refreshViewLocked is RefreshView for a view the caller found under db.Mu,
+// which it releases. It reports whether sealed rows were dropped, so the
+// data file must be rewritten.
+func (db *Database) refreshViewLocked(table *Table) (bool, error) {
+	table.Mu.Lock()
+	view := table.Schema.View
+	if view == nil {
+		table.Mu.Unlock()
+		db.Mu.Unlock()
+		return false, errors.New("not a view: " + table.Name)
+	}
+	source, ok := db.Tables[view.Table]
+	if !ok {
+		table.Mu.Unlock()
+		db.Mu.Unlock()
+		return false, fmt.Errorf("view %s: table not found: %s", table.Name, view.Table)
+	}
+	fields, constraints, err := view.fields(source.Schema)
+	if err != nil {
+		table.Mu.Unlock()
+		db.Mu.Unlock()
+		return false, fmt.Errorf("view %s: %v", table.Name, err)
+	}
+	schema := nextSchema(table.Schema, fields, constraints, []string{"VIEW_REFRESH: view rebuilt from " + view.Table})
+	if schema != table.Schema {
+		table.Schema = schema
+		table.UniqueIndices = newUniqueIndices(schema.uniqueKeys())
+		table.text = newTextIndexes(schema)
+		table.vectors = newVectorIndexes(schema)
+		table.upgraded = schema.Version
+		db.Schemas[table.Name] = schema
+	}
+	// The table is read without db.Mu, which writers may want while
+	// holding its lock.
+	db.Mu.Unlock()
+	rewrite := false
+	if view.Materialized {
+		rewrite = db.rebuildViewLocked(table, source)
+	}
+	table.Mu.Unlock()
+	return rewrite, nil
+}
+
+// rebuildViewLocked fills a materialized view with its rows computed from
+// source, and records the change they reflect so that earlier ones are not
+// applied again. It reports whether sealed rows were dropped. The caller
+// must hold the view's lock.
+func (db *Database) rebuildViewLocked(t *Table, source *Table) bool {
+	source.Mu.RLock()
+	snap := source.snapshotRLocked()
+	// Writes to source are published under its lock, so the snapshot
+	// holds exactly the changes up to here.
+	pos := db.changes.head()
+	source.Mu.RUnlock()
+
+	rows := t.Schema.View.evaluate(t.Schema, snap)
+	rewrite := len(t.SealedClumps) > 0
+	t.SealedClumps = make([]*SealedClump, 0)
+	t.HotHeap = NewHotHeap(1000)
+	t.UniqueIndices = newUniqueIndices(t.Schema.uniqueKeys())
+	t.text = newTextIndexes(t.Schema)
+	t.vectors = newVectorIndexes(t.Schema)
+	for _, row := range rows {
+		t.assignID(row)
+		t.indexRow(row)
+		t.HotHeap.Rows = append(t.HotHeap.Rows, row)
+	}
+	t.autoFlushLocked()
+	db.views.rebuilt(t, pos)
+	return rewrite
+}
+
+// viewSnapshot computes the rows of a view that is not materialized.
+func (t *Table) viewSnapshot(schema *Schema) *Snapshot {
+	t.Db.Mu.RLock()
+	source, ok := t.Db.Tables[schema.View.Table]
+	t.Db.Mu.RUnlock()
+	var rows []Row
+	if ok {
+		rows = schema.View.evaluate(schema, source.Snapshot())
+	}
+	return &Snapshot{Schema: schema, batches: [][]Row{rows}}
+}
+
+// writable refuses writes to a view, whose rows only come from its table.
+// The caller must hold the table's lock.
+func (t *Table) writable() error {
+	if t.Schema.View != nil {
+		return errors.New("cannot write to view: " + t.Name)
+	}
+	return nil
+}
+
+// notView refuses a change to the schema or rules of a view. The caller
+// must hold db.Mu.
+func (db *Database) notView(tableName string) error {
+	if schema, ok := db.Schemas[tableName]; ok && schema.View != nil {
+		return errors.New("cannot change a view: " + tableName)
+	}
+	return nil
+}
+
+// viewsOfLocked returns the views reading a table, by name. The caller must
+// hold db.Mu.
+func (db *Database) viewsOfLocked(tableName string) []*Table {
+	var views []*Table
+	for _, t := range db.Tables {
+		if v := t.Schema.View; v != nil && v.Table == tableName {
+			views = append(views, t)
+		}
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// reshapeLocked checks that a table may take fields as its schema: it is not
+// a view, and every view reading it still works with them. The caller must
+// hold db.Mu.
+func (db *Database) reshapeLocked(tableName string, fields []Field) error {
+	if err := db.notView(tableName); err != nil {
+		return err
+	}
+	for _, t := range db.viewsOfLocked(tableName) {
+		if _, _, err := t.Schema.View.fields(&Schema{Fields: fields}); err != nil {
+			return fmt.Errorf("view %s: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// refreshViewsOf refreshes the views of a table after its schema changed.
+func (db *Database) refreshViewsOf(tableName string) error {
+	db.Mu.RLock()
+	views := db.viewsOfLocked(tableName)
+	db.Mu.RUnlock()
+	for _, t := range views {
+		if err := db.RefreshView(t.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// viewMaintainer brings the materialized views up to date from the change
+// feed. It runs on a goroutine of its own, so writers never wait for views
+// and only lock the tables they write; readers of a view wait for it to
+// catch up instead.
+type viewMaintainer struct {
+	mu     sync.Mutex
+	caught *sync.Cond
+	// applied is the number of the last change applied.
+	applied uint64
+	// from holds, for the views rebuilt since the maintainer started, the
+	// last change their rows reflect.
+	from map[*Table]uint64
+	// groups does the same for single groups of grouped views, computed
+	// again from their table after losing a minimum or maximum.
+	groups  map[*Table]map[interface{}]uint64
+	running bool
+	stopped chan struct{}
+}
+
+// startViews starts keeping the materialized views up to date with the
+// changes made from now on.
+func (db *Database) startViews() {
+	m := &db.views
+	m.caught = sync.NewCond(&m.mu)
+	m.from = make(map[*Table]uint64)
+	m.groups = make(map[*Table]map[interface{}]uint64)
+	m.applied = db.changes.head()
+	m.running = true
+	m.stopped = make(chan struct{})
+	go db.maintainViews(m.applied + 1)
+}
+
+// stopViews waits for the maintainer to finish once the feed is closed.
+func (db *Database) stopViews() {
+	if db.views.stopped != nil {
+		<-db.views.stopped
+	}
+}
+
+// head returns the number of the latest change.
+func (f *changeFeed) head() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.next() - 1
+}
+
+func (m *viewMaintainer) rebuilt(t *Table, pos uint64) {
+	m.mu.Lock()
+	if m.from != nil {
+		m.from[t] = pos
+		delete(m.groups, t)
+	}
+	m.mu.Unlock()
+}
+
+// syncViews waits until every change made so far reached the views.
+func (db *Database) syncViews() {
+	target := db.changes.head()
+	m := &db.views
+	m.mu.Lock()
+	for m.running && m.applied < target {
+		m.caught.Wait()
+	}
+	m.mu.Unlock()
+}
+
+// syncView waits for the writes made so far to reach t if it is a
+// materialized view.
+func (t *Table) syncView() {
+	t.Mu.RLock()
+	view := t.Schema.View
+	t.Mu.RUnlock()
+	if view != nil && view.Materialized {
+		t.Db.syncViews()
+	}
+}
+
+func (db *Database) maintainViews(next uint64) {
+	m := &db.views
+	f := &db.changes
+	defer func() {
+		m.mu.Lock()
+		m.running = false
+		m.caught.Broadcast()
+		m.mu.Unlock()
+		close(m.stopped)
+	}()
+	for {
+		f.mu.Lock()
+		for next >= f.next() && !f.closed {
+			f.wake.Wait()
+		}
+		if next >= f.next() {
+			f.mu.Unlock()
+			return
+		}
+		start, behind := next, next < f.first
+		var batch []Change
+		if !behind {
+			batch = append([]Change(nil), f.log[next-f.first:]...)
+		}
+		next = f.next()
+		f.mu.Unlock()
+
+		if behind {
+			// The changes were dropped before they were read: every
+			// materialized view is computed again.
+			db.refreshMaterialized()
+		} else {
+			db.applyViews(start, batch)
+		}
+		m.mu.Lock()
+		m.applied = next - 1
+		m.caught.Broadcast()
+		m.mu.Unlock()
+	}
+}
+
+// refreshMaterialized rebuilds every materialized view.
+func (db *Database) refreshMaterialized() {
+	db.Mu.RLock()
+	var views []string
+	for name, t := range db.Tables {
+		t.Mu.RLock()
+		if t.Schema.View != nil && t.Schema.View.Materialized {
+			views = append(views, name)
+		}
+		t.Mu.RUnlock()
+	}
+	db.Mu.RUnlock()
+	for _, name := range views {
+		db.RefreshView(name)
+	}
+}
+
+// applyViews applies a batch of changes, the first numbered start, to the
+// materialized views of the tables they changed.
+func (db *Database) applyViews(start uint64, batch []Change) {
+	written := make(map[string]bool)
+	for _, c := range batch {
+		written[c.Table] = true
+	}
+	type job struct {
+		view, source *Table
+	}
+	var jobs []job
+	db.Mu.RLock()
+	for name := range written {
+		source, ok := db.Tables[name]
+		if !ok {
+			continue
+		}
+		for _, t := range db.viewsOfLocked(name) {
+			if t.Schema.View.Materialized {
+				jobs = append(jobs, job{t, source})
+			}
+		}
+	}
+	db.Mu.RUnlock()
+
+	for _, j := range jobs {
+		rewrite, err := db.applyView(j.view, j.source, start, batch)
+		if err != nil {
+			// A row of the view could not be read back; computing the
+			// view again puts it right.
+			rewrite = true
+			db.Mu.Lock()
+			if _, err := db.refreshViewLocked(j.view); err != nil {
+				continue
+			}
+		}
+		if rewrite {
+			db.Rewrite()
+		}
+	}
+}
+
+// applyView applies the changes of batch to its table to a materialized
+// view, in one write. It reports whether a sealed clump changed.
+func (db *Database) applyView(t, source *Table, start uint64, batch []Change) (bool, error) {
+	t.Mu.Lock()
+	defer t.Mu.Unlock()
+	view, schema := t.Schema.View, t.Schema
+	if view == nil || view.Table != source.Name {
+		return false, nil
+	}
+	db.views.mu.Lock()
+	from := db.views.from[t]
+	recomputed := db.views.groups[t]
+	db.views.mu.Unlock()
+
+	var changes []Change
+	var positions []uint64
+	for i, c := range batch {
+		if c.Table == view.Table && start+uint64(i) > from {
+			changes = append(changes, c)
+			positions = append(positions, start+uint64(i))
+		}
+	}
+	if len(changes) == 0 {
+		return false, nil
+	}
+	source.Mu.RLock()
+	matches, err := source.Schema.Matcher(view.Match)
+	source.Mu.RUnlock()
+	if err != nil {
+		return false, err
+	}
+
+	// wanted holds the row the view should have for each key touched, in
+	// the order first touched; stored the row it has.
+	var keys []interface{}
+	stored := make(map[interface{}]Row)
+	wanted := make(map[interface{}]Row)
+	lookup := func(fields []string, probe Row) Row {
+		k, ok := schema.uniqueKeyFor(fields)
+		if !ok {
+			return nil
+		}
+		return t.UniqueIndices[k.Name][k.key(probe)]
+	}
+
+	if !view.grouped() {
+		for _, c := range changes {
+			key := IndexKey(c.RowID)
+			if _, seen := stored[key]; !seen {
+				keys = append(keys, key)
+				stored[key] = lookup([]string{ViewSourceField}, Row{ViewSourceField: c.RowID})
+			}
+			wanted[key] = nil
+			if c.After != nil && matches(c.After) {
+				wanted[key] = view.project(schema, c.After)
+			}
+		}
+	} else {
+		groups := make(map[interface{}]*viewGroup)
+		group := func(values []interface{}) (*viewGroup, error) {
+			key := groupKey(values)
+			if g, ok := groups[key]; ok {
+				return g, nil
+			}
+			var row Row
+			if len(view.GroupBy) == 0 {
+				t.eachRowLocked(func(r Row) { row = r })
+			} else {
+				probe := make(Row, len(values))
+				for i, f := range view.GroupBy {
+					probe[f] = values[i]
+				}
+				row = lookup(view.GroupBy, probe)
+			}
+			g := view.newGroup(values)
+			if row != nil {
+				var err error
+				if g, err = view.storedGroup(schema, row); err != nil {
+					return nil, err
+				}
+			}
+			groups[key] = g
+			keys = append(keys, key)
+			stored[key] = row
+			return g, nil
+		}
+		// A group computed again already reflects the changes up to the
+		// position it was computed at.
+		apply := func(row Row, pos uint64, fn func(*viewGroup)) error {
+			if row == nil || !matches(row) {
+				return nil
+			}
+			values := view.groupOf(row)
+			if pos <= recomputed[groupKey(values)] {
+				return nil
+			}
+			g, err := group(values)
+			if err == nil {
+				fn(g)
+			}
+			return err
+		}
+		for i, c := range changes {
+			if err := apply(c.Before, positions[i], func(g *viewGroup) { g.remove(view, c.Before) }); err != nil {
+				return false, err
+			}
+			if err := apply(c.After, positions[i], func(g *viewGroup) { g.add(view, c.After) }); err != nil {
+				return false, err
+			}
+		}
+
+		// A group that lost its minimum or maximum is computed again from
+		// the table. The maintainer runs behind the writers, so the table
+		// may hold changes of later batches already: the group is read at
+		// a known position, and those changes are skipped when they come.
+		stale := make(map[interface{}]bool)
+		for key, g := range groups {
+			for _, acc := range g.accs {
+				if acc.Stale() {
+					stale[key] = true
+				}
+			}
+		}
+		if len(stale) > 0 {
+			source.Mu.RLock()
+			snap := source.snapshotRLocked()
+			// Writes to source are published under its lock.
+			pos := db.changes.head()
+			source.Mu.RUnlock()
+			for key := range stale {
+				fresh := view.newGroup(groups[key].values)
+				fresh.stored = groups[key].stored
+				groups[key] = fresh
+			}
+			snap.each(func(row Row) {
+				if !matches(row) {
+					return
+				}
+				if key := groupKey(view.groupOf(row)); stale[key] {
+					groups[key].add(view, row)
+				}
+			})
+			db.views.mu.Lock()
+			if db.views.groups[t] == nil {
+				db.views.groups[t] = make(map[interface{}]uint64)
+			}
+			for key := range stale {
+				db.views.groups[t][key] = pos
+			}
+			db.views.mu.Unlock()
+		}
+		for key, g := range groups {
+			if g.rows > 0 || len(view.GroupBy) == 0 {
+				wanted[key] = g.row(view)
+			}
+		}
+	}
+
+	var inserts, olds, news, deletes []Row
+	for _, key := range keys {
+		old, row := stored[key], wanted[key]
+		switch {
+		case old == nil && row != nil:
+			inserts = append(inserts, row)
+		case old != nil && row == nil:
+			deletes = append(deletes, old)
+		case old != nil && !sameValues(old, row):
+			row[RowIDField] = old[RowIDField]
+			olds = append(olds, old)
+			news = append(news, row)
+		}
+	}
+
+	// Later batches come after this one, so groups computed up to it are
+	// current again.
+	end := start + uint64(len(batch)) - 1
+	db.views.mu.Lock()
+	for key, pos := range db.views.groups[t] {
+		if pos <= end {
+			delete(db.views.groups[t], key)
+		}
+	}
+	db.views.mu.Unlock()
+
+	tx := db.newTx()
+	changed := []change{
+		{table: t, kind: ChangeInsert, afters: inserts},
+		{table: t, kind: ChangeUpdate, befores: olds, afters: news},
+		{table: t, kind: ChangeDelete, befores: deletes},
+	}
+	tx.apply(t, changed, func() bool {
+		sealed := t.replaceLocked(olds, news)
+		if t.removeLocked(deletes) {
+			sealed = true
+		}
+		for _, row := range inserts {
+			t.assignID(row)
+			t.indexRow(row)
+			t.HotHeap.Rows = append(t.HotHeap.Rows, row)
+		}
+		return sealed
+	})
+	tx.end(nil)
+	return tx.rewrite, nil
+}
+
+// sameValues reports whether the fields of row hold the values they hold in
+// stored, so that rewriting stored would change nothing.
+func sameValues(stored, row Row) bool {
+	for k, v := range row {
+		if k != RowIDField && !Equal(stored[k], v) {
+			return false
+		}
+	}
+	return true
+}
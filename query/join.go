@@ -0,0 +1,313 @@
+package query
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+type JoinKind string
+
+const (
+	InnerJoin JoinKind = "inner"
+	LeftJoin  JoinKind = "left"
+)
+
+// Join matches rows of Table whose Right field equals the Left field of the
+// rows joined so far. Left may be qualified with the name of the base table
+// or an earlier join ("orders.product_id"); unqualified fields belong to the
+// base table. As names the joined table in results, which lets a table be
+// joined to itself.
+type Join struct {
+	Kind  JoinKind
+	Table string
+	Left  string
+	Right string
+	As    string `json:",omitempty"`
+}
+
+// Name is the prefix of the joined table's columns.
+func (j Join) Name() string {
+	if j.As != "" {
+		return j.As
+	}
+	return j.Table
+}
+
+// Join adds an inner join: rows without a match in table are dropped.
+//
+// Once a query has joins, each result has its columns prefixed by table,
+// as in {"orders.id": 1, "products.name": "pen"}, and filters, sort keys and
+// selected columns address fields the same way. Filters added with Filter
+// see a row holding one object per table, keyed by table name.
+func (q *Query) Join(table, left, right string) *Query {
+	q.Joins = append(q.Joins, Join{Kind: InnerJoin, Table: table, Left: left, Right: right})
+	return q
+}
+
+// LeftJoin adds a left join: rows without a match in table are kept, with
+// null for every column of table.
+func (q *Query) LeftJoin(table, left, right string) *Query {
+	q.Joins = append(q.Joins, Join{Kind: LeftJoin, Table: table, Left: left, Right: right})
+	return q
+}
+
+// AddJoin adds a join spelled out in full, such as an aliased self join.
+func (q *Query) AddJoin(j Join) *Query {
+	q.Joins = append(q.Joins, j)
+	return q
+}
+
+// Where adds a match in the form used by the bridge (see core.Schema.Matcher)
+// and checks it against the schemas of the query's tables. Keys prefixed
+// with a joined table's name are tested after joining; every other key
+// belongs to the base table and is tested before joining, so fewer rows are
+// joined. Add joins before calling Where.
+//
+// Equality on the fields of a unique index of the base table lets the
+// planner look rows up in the index instead of scanning (see Plan).
+func (q *Query) Where(match map[string]interface{}) error {
+	parts, raw, err := q.splitMatch(match)
+	if err != nil {
+		return err
+	}
+	if base, ok := parts[q.TableName]; ok {
+		q.pushed = append(q.pushed, base)
+		q.equal = append(q.equal, raw[q.TableName])
+		delete(parts, q.TableName)
+	}
+	for _, f := range parts {
+		q.Filters = append(q.Filters, f)
+	}
+	return nil
+}
+
+// Predicate compiles a match like Where, but returns it as a single filter
+// over the rows Filter sees instead of adding it, so that callers can
+// combine several with their own logic.
+func (q *Query) Predicate(match map[string]interface{}) (FilterFunc, error) {
+	parts, _, err := q.splitMatch(match)
+	if err != nil {
+		return nil, err
+	}
+	var filters []FilterFunc
+	for name, f := range parts {
+		if name == q.TableName && len(q.Joins) > 0 {
+			filters = append(filters, within(name, f))
+			continue
+		}
+		filters = append(filters, f)
+	}
+	return func(r core.Row) bool {
+		for _, f := range filters {
+			if !f(r) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// ColumnName is the key a selected path has in results: with joins, fields
+// of the base table are prefixed by its name.
+func (q *Query) ColumnName(path string) string {
+	return q.qualify(path)
+}
+
+// within applies f to one table's part of a joined row.
+func within(name string, f FilterFunc) FilterFunc {
+	return func(r core.Row) bool {
+		sub, _ := r[name].(core.Row)
+		return f(sub)
+	}
+}
+
+// splitMatch compiles match per table, also returning each table's part of
+// match keyed by unqualified field. The base table's filter applies to base
+// rows; the others already expect joined rows.
+func (q *Query) splitMatch(match map[string]interface{}) (map[string]FilterFunc, map[string]map[string]interface{}, error) {
+	parts := map[string]map[string]interface{}{}
+	for key, want := range match {
+		name, field := q.TableName, key
+		if len(q.Joins) > 0 {
+			if root, rest, ok := strings.Cut(key, "."); ok && q.joined(root) != nil {
+				name, field = root, rest
+			} else if ok && root == q.TableName {
+				field = rest
+			}
+		}
+		if parts[name] == nil {
+			parts[name] = map[string]interface{}{}
+		}
+		parts[name][field] = want
+	}
+
+	filters := make(map[string]FilterFunc, len(parts))
+	for name, part := range parts {
+		table := q.TableName
+		if j := q.joined(name); j != nil {
+			table = j.Table
+		}
+		matches, err := q.Db.Matcher(table, part)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name == q.TableName {
+			filters[name] = matches
+			continue
+		}
+		filters[name] = within(name, matches)
+	}
+	return filters, parts, nil
+}
+
+// joined returns the join named name, or nil.
+func (q *Query) joined(name string) *Join {
+	for i := range q.Joins {
+		if q.Joins[i].Name() == name {
+			return &q.Joins[i]
+		}
+	}
+	return nil
+}
+
+// qualify prefixes a field of the base table with its name when the query
+// has joins.
+func (q *Query) qualify(path string) string {
+	if len(q.Joins) == 0 {
+		return path
+	}
+	root, _, _ := strings.Cut(path, ".")
+	if root == q.TableName || q.joined(root) != nil {
+		return path
+	}
+	return q.TableName + "." + path
+}
+
+// joinPlan is a join resolved against the live tables when a query starts.
+type joinPlan struct {
+	Join
+	name   string
+	left   string
+	fields []string
+	table  *core.Table
+	// Without a unique index on Right, the joined table is read once from a
+	// snapshot into a hash table keyed by core.IndexKey.
+	hash map[interface{}][]core.Row
+}
+
+func (q *Query) planJoins() ([]*joinPlan, error) {
+	names := map[string]bool{q.TableName: true}
+	plans := make([]*joinPlan, 0, len(q.Joins))
+	for _, j := range q.Joins {
+		if j.Kind == "" {
+			j.Kind = InnerJoin
+		}
+		if j.Kind != InnerJoin && j.Kind != LeftJoin {
+			return nil, fmt.Errorf("unknown join kind: %s", j.Kind)
+		}
+		if names[j.Name()] {
+			return nil, fmt.Errorf("duplicate table in join: %s", j.Name())
+		}
+		names[j.Name()] = true
+
+		table, err := q.Db.Table(j.Table)
+		if err != nil {
+			return nil, err
+		}
+		p := &joinPlan{Join: j, name: j.Name(), left: q.qualify(j.Left), table: table}
+		snap := table.Snapshot()
+		for _, f := range snap.Schema.Fields {
+			p.fields = append(p.fields, f.Name)
+		}
+		if !table.HasUniqueIndex(j.Right) {
+			p.hash = make(map[interface{}][]core.Row)
+			for i := 0; i < snap.Batches(); i++ {
+				for _, row := range snap.Scan(i, nil) {
+					if v, ok := core.Lookup(row, j.Right); ok && v != nil {
+						key := core.IndexKey(v)
+						p.hash[key] = append(p.hash[key], row)
+					}
+				}
+			}
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// apply joins rows, which hold one object per table joined so far, with the
+// plan's table.
+func (p *joinPlan) apply(rows []core.Row) []core.Row {
+	keys := make([]interface{}, len(rows))
+	for i, row := range rows {
+		keys[i], _ = core.Lookup(row, p.left)
+	}
+
+	var found []core.Row
+	if p.hash == nil {
+		found, _ = p.table.LookupUnique(p.Right, keys)
+	}
+
+	var out []core.Row
+	for i, row := range rows {
+		var matches []core.Row
+		switch {
+		case p.hash == nil:
+			if found[i] != nil {
+				matches = found[i : i+1]
+			}
+		case keys[i] != nil:
+			matches = p.hash[core.IndexKey(keys[i])]
+		}
+
+		if len(matches) == 0 {
+			if p.Kind == LeftJoin {
+				out = append(out, with(row, p.name, nil))
+			}
+			continue
+		}
+		for _, m := range matches {
+			out = append(out, with(row, p.name, m))
+		}
+	}
+	return out
+}
+
+// with returns a copy of a joined row with one more table.
+func with(row core.Row, name string, sub core.Row) core.Row {
+	out := make(core.Row, len(row)+1)
+	for k, v := range row {
+		out[k] = v
+	}
+	if sub == nil {
+		out[name] = nil
+	} else {
+		out[name] = sub
+	}
+	return out
+}
+
+// flatten turns a joined row into columns prefixed by table. Tables left
+// unmatched by a left join give a null for each of their fields.
+func flatten(row core.Row, base string, plans []*joinPlan) core.Row {
+	out := make(core.Row)
+	add := func(name string, sub core.Row) {
+		for k, v := range sub {
+			out[name+"."+k] = v
+		}
+	}
+	sub, _ := row[base].(core.Row)
+	add(base, sub)
+	for _, p := range plans {
+		if sub, ok := row[p.name].(core.Row); ok {
+			add(p.name, sub)
+			continue
+		}
+		for _, f := range p.fields {
+			out[p.name+"."+f] = nil
+		}
+	}
+	return out
+}
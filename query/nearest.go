@@ -0,0 +1,103 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+// DistanceField is the column a Nearest query adds to each result: how far
+// its vector is from the query's under the metric, as core.Distance puts it.
+// With joins it is qualified by the base table, like the base columns.
+const DistanceField = "_distance"
+
+// Nearest asks for the K rows whose vector Field is nearest Vector under
+// Metric, which defaults to cosine. Probes is how many lists of an IVF index
+// to read at first; zero reads a quarter of them.
+type Nearest struct {
+	Field  string
+	Vector []float64
+	K      int
+	Metric core.Metric `json:",omitempty"`
+	Probes int         `json:",omitempty"`
+}
+
+// Nearest keeps the k rows passing the query's filters whose vector field
+// is nearest vector under metric, nearest first, and adds DistanceField to
+// each. OrderBy, if given, reorders those k rows.
+//
+// When field has a trained IVF index, only the lists nearest the vector are
+// read, and more are read until k rows pass the filters or none are left,
+// so the results are approximate. Otherwise every row is compared.
+func (q *Query) Nearest(field string, vector []float64, k int, metric core.Metric) *Query {
+	q.Near = &Nearest{Field: field, Vector: vector, K: k, Metric: metric}
+	return q
+}
+
+// check validates n against the base table's schema and returns a copy with
+// the defaults filled in.
+func (n *Nearest) check(table string, schema *core.Schema) (*Nearest, error) {
+	out := *n
+	out.Field = strings.TrimPrefix(n.Field, table+".")
+	metric, err := core.ParseMetric(string(n.Metric))
+	if err != nil {
+		return nil, err
+	}
+	out.Metric = metric
+	if out.K <= 0 {
+		return nil, fmt.Errorf("nearest needs a positive k, got %d", out.K)
+	}
+	for _, f := range schema.Fields {
+		if f.Name != out.Field {
+			continue
+		}
+		if f.Type != core.FieldTypeVector {
+			return nil, fmt.Errorf("field is not a vector: %s", out.Field)
+		}
+		if len(out.Vector) != f.Dimensions {
+			return nil, fmt.Errorf("type mismatch: %s: expected %d dimensions, got %d", out.Field, f.Dimensions, len(out.Vector))
+		}
+		return &out, nil
+	}
+	return nil, fmt.Errorf("field not found: %s", out.Field)
+}
+
+// base returns the row of the base table within a result row.
+func (r *Rows) base(row core.Row) core.Row {
+	if len(r.plans) == 0 {
+		return row
+	}
+	sub, _ := row[r.q.TableName].(core.Row)
+	return sub
+}
+
+// nearest keeps the K rows nearest the query vector, nearest first and ties
+// in the order they were read, and records their distance. Rows without a
+// vector are dropped.
+func (r *Rows) nearest(rows []core.Row) []core.Row {
+	type ranked struct {
+		row  core.Row
+		dist float64
+	}
+	var all []ranked
+	for _, row := range rows {
+		base := r.base(row)
+		vec, ok := base[r.near.Field].([]float64)
+		if !ok {
+			continue
+		}
+		all = append(all, ranked{row, core.Distance(r.near.Metric, r.near.Vector, vec)})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].dist < all[j].dist })
+	if len(all) > r.near.K {
+		all = all[:r.near.K]
+	}
+	out := make([]core.Row, len(all))
+	for i, x := range all {
+		r.base(x.row)[DistanceField] = x.dist
+		out[i] = x.row
+	}
+	return out
+}
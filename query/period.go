@@ -0,0 +1,28 @@
+package query
+
+import "time"
+
+// Period reads the versions of the rows that were current at some time from
+// From to To, inclusive, instead of the rows the table holds now. The table
+// must keep history; see core.Database.SetTemporal. Each result carries
+// core.RowValidFromField, and core.RowValidToField when it has since been
+// replaced or deleted.
+type Period struct {
+	From time.Time
+	To   time.Time
+}
+
+// AsOf reads the table as it was at time at: each row as it stood then, and
+// none of the rows inserted since or deleted before.
+func (q *Query) AsOf(at time.Time) *Query {
+	q.Period = &Period{From: at, To: at}
+	return q
+}
+
+// Between reads every version of the rows that was current at some time
+// from from to to, inclusive, so a row updated in between comes back once
+// per version.
+func (q *Query) Between(from, to time.Time) *Query {
+	q.Period = &Period{From: from, To: to}
+	return q
+}
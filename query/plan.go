@@ -0,0 +1,290 @@
+package query
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+type AccessPath string
+
+const (
+	// FullScan reads every clump of the table.
+	FullScan AccessPath = "full_scan"
+	// IndexLookup probes a unique index and reads only the rows it finds.
+	IndexLookup AccessPath = "index_lookup"
+	// VectorIndex reads the lists of an IVF index nearest a Nearest
+	// query's vector.
+	VectorIndex AccessPath = "vector_index"
+	// HistoryScan reads the versions of the rows current during the
+	// query's Period.
+	HistoryScan AccessPath = "history_scan"
+)
+
+type JoinStrategy string
+
+const (
+	// IndexJoin probes the joined table's unique index once per row.
+	IndexJoin JoinStrategy = "index_nested_loop"
+	// HashJoin reads the joined table once into a hash table.
+	HashJoin JoinStrategy = "hash"
+)
+
+// Plan is how a query runs, chosen when it starts.
+//
+// The planner looks for a unique index of the base table whose every field
+// the query's Where matches compare for equality ($eq, a plain value or
+// $in). When probing it would examine no more rows than the table holds, the
+// query reads just the rows found and skips every clump; the full filter
+// still runs on them. Otherwise a Nearest query reads the nearest lists of
+// its field's IVF index when it has a trained one, and any other query scans
+// the table. Indexes only hold the current rows, so a query with a Period
+// scans the versions of its period instead.
+type Plan struct {
+	Table  string
+	Access AccessPath
+	// Index names the unique index an IndexLookup probes, and Keys is the
+	// number of values probed.
+	Index string `json:",omitempty"`
+	Keys  int    `json:",omitempty"`
+	// Lists is the number of lists of the IVF index a VectorIndex plan
+	// reads from, and Probes how many of them it read.
+	Lists  int `json:",omitempty"`
+	Probes int `json:",omitempty"`
+	// EstimatedRows is the number of base rows the access path is expected
+	// to examine: the table's size for a scan, the number of keys for a
+	// lookup, the size of the first lists probed for a vector index.
+	EstimatedRows int
+	// Clumps counts the table's sealed clumps, and its hot heap when it
+	// holds rows.
+	Clumps  int
+	Joins   []JoinStep `json:",omitempty"`
+	Workers int
+}
+
+// JoinStep is how one join of a plan runs.
+type JoinStep struct {
+	Table    string
+	Strategy JoinStrategy
+}
+
+// Stats reports what a stream of rows has done so far.
+type Stats struct {
+	// RowsExamined counts the base rows the query's filters ran on.
+	RowsExamined  int
+	RowsReturned  int
+	ClumpsScanned int
+	ClumpsSkipped int
+	// Stages lists the time spent in each stage the query has. Stages that
+	// run on several workers report the sum of their time.
+	Stages []Stage
+	// Total is the time from the start of the query to the end of the
+	// stream, or to now if it has not ended.
+	Total time.Duration
+}
+
+type Stage struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Explanation is a plan together with what running it cost.
+type Explanation struct {
+	Plan  *Plan
+	Stats Stats
+}
+
+// Explain runs the query to completion, discarding the rows, and reports
+// the plan it used and its statistics.
+func (q *Query) Explain() (*Explanation, error) {
+	return q.ExplainContext(context.Background())
+}
+
+// ExplainContext is Explain with cancellation.
+func (q *Query) ExplainContext(ctx context.Context) (*Explanation, error) {
+	rows, err := q.Rows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &Explanation{Plan: rows.Plan(), Stats: rows.Stats()}, nil
+}
+
+// stage indexes the timers of a stream.
+type stage int
+
+const (
+	stagePlan stage = iota
+	stageLookup
+	stageScan
+	stageJoin
+	stageFilter
+	stageSort
+	stageProject
+	numStages
+)
+
+var stageNames = [numStages]string{"plan", "index_lookup", "scan", "join", "filter", "sort", "project"}
+
+// counters are updated by scan workers and read by Stats at any time.
+type counters struct {
+	examined atomic.Int64
+	scanned  atomic.Int64
+	stages   [numStages]atomic.Int64
+}
+
+func (c *counters) since(s stage, start time.Time) {
+	c.stages[s].Add(int64(time.Since(start)))
+}
+
+// plan chooses the access path of the query over table and returns the
+// snapshot to read: the whole table, the rows found in a unique index, the
+// lists of a vector index, nearest first, or the versions of a period.
+func (q *Query) plan(table *core.Table, near *Nearest, c *counters) (*Plan, *core.Snapshot, error) {
+	if q.Period != nil {
+		snap, err := table.SnapshotBetween(q.Period.From, q.Period.To)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &Plan{Table: q.TableName, Access: HistoryScan, EstimatedRows: snap.Len(), Clumps: snap.Batches()}, snap, nil
+	}
+	snap := table.Snapshot()
+	p := &Plan{Table: q.TableName, Access: FullScan, EstimatedRows: snap.Len(), Clumps: snap.Batches()}
+	if found, ok := q.planLookup(table, p, c); ok {
+		return p, found, nil
+	}
+	if near == nil {
+		return p, snap, nil
+	}
+
+	start := time.Now()
+	found, ok := table.NearestSnapshot(near.Field, near.Vector, near.Metric)
+	c.since(stageLookup, start)
+	if !ok {
+		return p, snap, nil
+	}
+	p.Access, p.Index, p.Lists = VectorIndex, near.Field, found.Batches()
+	p.Probes = near.Probes
+	if p.Probes <= 0 {
+		p.Probes = (p.Lists + 3) / 4
+	}
+	p.Probes = min(p.Probes, p.Lists)
+	p.EstimatedRows = 0
+	for i := 0; i < p.Probes; i++ {
+		p.EstimatedRows += found.BatchLen(i)
+	}
+	return p, found, nil
+}
+
+// planLookup returns the rows of the unique index lookup the query can use,
+// filling in p, or false when there is none.
+func (q *Query) planLookup(table *core.Table, p *Plan, c *counters) (*core.Snapshot, bool) {
+	eq := make(map[string][]interface{})
+	for _, match := range q.equal {
+		for field, vals := range equalities(match) {
+			if _, ok := eq[field]; !ok {
+				eq[field] = vals
+			}
+		}
+	}
+	if len(eq) == 0 {
+		return nil, false
+	}
+
+	// The cheapest index is the one needing the fewest probes.
+	indexes := table.UniqueIndexes()
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, probes := "", -1
+	for _, name := range names {
+		n := 1
+		for _, f := range indexes[name] {
+			vals, ok := eq[f]
+			if !ok || n > p.EstimatedRows {
+				n = -1
+				break
+			}
+			n *= len(vals)
+		}
+		if n >= 0 && (probes < 0 || n < probes) {
+			best, probes = name, n
+		}
+	}
+	if probes < 0 || probes > p.EstimatedRows {
+		return nil, false
+	}
+
+	start := time.Now()
+	fields := indexes[best]
+	keys := [][]interface{}{{}}
+	for _, f := range fields {
+		var next [][]interface{}
+		for _, key := range keys {
+			for _, v := range eq[f] {
+				next = append(next, append(key[:len(key):len(key)], v))
+			}
+		}
+		keys = next
+	}
+	found, ok := table.LookupSnapshot(fields, keys)
+	c.since(stageLookup, start)
+	if !ok {
+		// The index went away since UniqueIndexes.
+		return nil, false
+	}
+	p.Access, p.Index, p.Keys, p.EstimatedRows = IndexLookup, best, len(keys), len(keys)
+	return found, true
+}
+
+// equalities returns the values each field of match must equal one of.
+// Fields compared in other ways, or with null, are left out, since probing
+// an index with null finds nothing.
+func equalities(match map[string]interface{}) map[string][]interface{} {
+	out := make(map[string][]interface{})
+	for field, want := range match {
+		vals := []interface{}{want}
+		if ops, ok := want.(map[string]interface{}); ok && isOperators(ops) {
+			if v, ok := ops["$eq"]; ok {
+				vals = []interface{}{v}
+			} else if in, ok := ops["$in"].([]interface{}); ok {
+				vals = in
+			} else {
+				continue
+			}
+		}
+		usable := true
+		for _, v := range vals {
+			usable = usable && v != nil
+		}
+		if usable {
+			out[field] = vals
+		}
+	}
+	return out
+}
+
+// isOperators reports whether a match value is a map of comparisons rather
+// than an object to compare with, as core.Schema.Matcher decides.
+func isOperators(m map[string]interface{}) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
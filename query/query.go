@@ -1,7 +1,7 @@
 package query
 
 import (
-	"errors"
+	"context"
 
 	"github.com/ikwerre-dev/EmojiDB/core"
 )
@@ -11,6 +11,24 @@ type Query struct {
 	TableName string
 	Filters   []FilterFunc
 	Columns   []string
+	Order     []SortKey
+	Max       int
+	Workers   int
+	Joins     []Join
+	// Near, if set, ranks the results by vector distance; see Nearest.
+	Near *Nearest
+	// Period, if set, reads past versions of the rows; see AsOf.
+	Period *Period
+	// pushed holds base table filters from Where, run before joining, and
+	// equal the matches they were compiled from, for the planner.
+	pushed []FilterFunc
+	equal  []map[string]interface{}
+}
+
+// SortKey orders results by one field, using core.Compare.
+type SortKey struct {
+	Field string
+	Desc  bool
 }
 
 type FilterFunc func(core.Row) bool
@@ -22,44 +40,98 @@ func NewQuery(db *core.Database, tableName string) *Query {
 	}
 }
 
+// Filter adds a condition rows must pass. Filters may be called from several
+// goroutines at once; see Parallel.
 func (q *Query) Filter(f FilterFunc) *Query {
 	q.Filters = append(q.Filters, f)
 	return q
 }
 
+// Eq keeps rows whose value at path equals value. Paths may reach into
+// nested objects and arrays, as in "address.city" or "tags[0]".
+func Eq(path string, value interface{}) FilterFunc {
+	return func(r core.Row) bool {
+		v, _ := core.Lookup(r, path)
+		return core.Equal(v, value)
+	}
+}
+
+// Contains keeps rows whose value at path is an array holding item, a string
+// holding item as a substring, or an object with item as a key.
+func Contains(path string, item interface{}) FilterFunc {
+	return func(r core.Row) bool {
+		v, _ := core.Lookup(r, path)
+		return core.Contains(v, item)
+	}
+}
+
+// Select projects the results onto columns. A column may be a nested path;
+// its value is returned under the path itself, e.g. "address.city".
 func (q *Query) Select(columns ...string) *Query {
 	q.Columns = columns
 	return q
 }
 
+// OrderBy sorts the results by field, which may be a nested path. Later
+// calls break ties of earlier ones.
+func (q *Query) OrderBy(field string, desc bool) *Query {
+	q.Order = append(q.Order, SortKey{Field: field, Desc: desc})
+	return q
+}
+
+// Parallel sets how many clumps are scanned at once. Zero uses
+// core.Database.ScanWorkers. With more than one worker, filters run on
+// several goroutines and must be safe for concurrent use.
+func (q *Query) Parallel(workers int) *Query {
+	q.Workers = workers
+	return q
+}
+
+// Limit caps the number of results; zero means no limit.
+func (q *Query) Limit(n int) *Query {
+	q.Max = n
+	return q
+}
+
+// Execute runs the query and collects every result.
 func (q *Query) Execute() ([]core.Row, error) {
-	q.Db.Mu.RLock()
-	table, ok := q.Db.Tables[q.TableName]
-	q.Db.Mu.RUnlock()
+	return q.ExecuteContext(context.Background())
+}
 
-	if !ok {
-		return nil, errors.New("table not found: " + q.TableName)
+// ExecuteContext is Execute with cancellation. It streams through Rows, so
+// the table lock is released between clumps.
+func (q *Query) ExecuteContext(ctx context.Context) ([]core.Row, error) {
+	rows, err := q.Rows(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
 	var results []core.Row
-
-	table.Mu.RLock()
-	for _, row := range table.HotHeap.Rows {
-		if q.Matches(row) {
-			results = append(results, q.Project(row))
-		}
+	for rows.Next() {
+		results = append(results, rows.Row())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
+	return results, nil
+}
 
-	for _, clump := range table.SealedClumps {
-		for _, row := range clump.Rows {
-			if q.Matches(row) {
-				results = append(results, q.Project(row))
-			}
+func (q *Query) less(a, b core.Row) bool {
+	for _, key := range q.Order {
+		field := q.qualify(key.Field)
+		x, _ := core.Lookup(a, field)
+		y, _ := core.Lookup(b, field)
+		c := core.Compare(x, y)
+		if c == 0 {
+			continue
 		}
+		if key.Desc {
+			return c > 0
+		}
+		return c < 0
 	}
-	table.Mu.RUnlock()
-
-	return results, nil
+	return false
 }
 
 func (q *Query) Matches(row core.Row) bool {
@@ -78,9 +150,19 @@ func (q *Query) Project(row core.Row) core.Row {
 
 	projected := make(core.Row)
 	for _, col := range q.Columns {
-		if val, ok := row[col]; ok {
+		col = q.qualify(col)
+		if val, ok := core.Lookup(row, col); ok || len(q.Joins) > 0 {
 			projected[col] = val
 		}
 	}
 	return projected
 }
+
+func (q *Query) matchesPushed(row core.Row) bool {
+	for _, filter := range q.pushed {
+		if !filter(row) {
+			return false
+		}
+	}
+	return true
+}
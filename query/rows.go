@@ -0,0 +1,362 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sort"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+// Rows streams the results of a query one clump at a time. It reads from a
+// snapshot taken when the query starts and holds no lock while it runs, so
+// writers are never blocked and rows written after the start are not seen.
+//
+//	rows, err := q.Rows(ctx)
+//	if err != nil { ... }
+//	defer rows.Close()
+//	for rows.Next() {
+//		use(rows.Row())
+//	}
+//	if err := rows.Err(); err != nil { ... }
+//
+// Up to Workers clumps are filtered and projected ahead of the reader on
+// separate goroutines. Their results are handed out in clump order, so the
+// output is the same as a sequential scan.
+//
+// A sorted or Nearest query has to see every match before it can yield the
+// first, so it reads the whole snapshot on the first call to Next.
+//
+// Rows follows the query's Plan, which may read rows from an index instead
+// of the snapshot; Stats reports its progress.
+type Rows struct {
+	ctx     context.Context
+	q       *Query
+	plan    *Plan
+	snap    *core.Snapshot
+	plans   []*joinPlan
+	near    *Nearest
+	workers int
+	start   time.Time
+	end     time.Time
+	count   *counters
+	next    int
+	pending []chan []core.Row
+	sorted  bool
+	buf     []core.Row
+	cur     core.Row
+	sent    int
+	err     error
+	closed  bool
+}
+
+// Rows starts streaming the query. Cancelling ctx stops the stream at the
+// next clump boundary, and Err then returns the context's error.
+func (q *Query) Rows(ctx context.Context) (*Rows, error) {
+	start := time.Now()
+	table, err := q.Db.Table(q.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if q.Period != nil && len(q.Joins) > 0 {
+		return nil, errors.New("a query of past versions cannot join tables")
+	}
+	plans, err := q.planJoins()
+	if err != nil {
+		return nil, err
+	}
+	workers := q.Workers
+	if workers <= 0 {
+		workers = q.Db.ScanWorkers()
+	}
+	var near *Nearest
+	if q.Near != nil {
+		if near, err = q.Near.check(q.TableName, table.Snapshot().Schema); err != nil {
+			return nil, err
+		}
+	}
+	count := &counters{}
+	plan, snap, err := q.plan(table, near, count)
+	if err != nil {
+		return nil, err
+	}
+	plan.Workers = workers
+	for _, p := range plans {
+		step := JoinStep{Table: p.name, Strategy: HashJoin}
+		if p.hash == nil {
+			step.Strategy = IndexJoin
+		}
+		plan.Joins = append(plan.Joins, step)
+	}
+	// The index lookup is a stage of its own.
+	count.stages[stagePlan].Add(int64(time.Since(start)) - count.stages[stageLookup].Load())
+	return &Rows{ctx: ctx, q: q, plan: plan, snap: snap, plans: plans, near: near, workers: workers, start: start, count: count}, nil
+}
+
+// Next advances to the next row. It returns false when the results are
+// exhausted, the limit is reached, the context is done or Close was called.
+func (r *Rows) Next() bool {
+	if !r.advance() {
+		if r.end.IsZero() {
+			r.end = time.Now()
+		}
+		return false
+	}
+	return true
+}
+
+func (r *Rows) advance() bool {
+	if r.closed || (r.q.Max > 0 && r.sent >= r.q.Max) {
+		return false
+	}
+	if (len(r.q.Order) > 0 || r.near != nil) && !r.sorted {
+		r.sorted = true
+		if !r.sortAll() {
+			return false
+		}
+	}
+	for len(r.buf) == 0 {
+		if !r.fill() {
+			return false
+		}
+	}
+	r.cur = r.buf[0]
+	r.buf = r.buf[1:]
+	r.sent++
+	return true
+}
+
+// fill moves the results of the next clump into buf, first starting scans
+// of the clumps after it up to the worker limit. It reports false when no
+// clump is left or the context is done.
+func (r *Rows) fill() bool {
+	if err := r.ctx.Err(); err != nil {
+		r.err = err
+		return false
+	}
+	for len(r.pending) < r.workers && r.next < r.batches() {
+		i := r.next
+		r.next++
+		// Buffered, so a scan finishes even if the stream is abandoned.
+		done := make(chan []core.Row, 1)
+		if r.workers == 1 {
+			done <- r.scan(i)
+		} else {
+			go func() { done <- r.scan(i) }()
+		}
+		r.pending = append(r.pending, done)
+	}
+	if len(r.pending) == 0 {
+		return false
+	}
+	r.buf = <-r.pending[0]
+	r.pending = r.pending[1:]
+	return true
+}
+
+// batches is the number of batches of the snapshot to read: those of the
+// lists probed so far when reading a vector index.
+func (r *Rows) batches() int {
+	if r.plan.Access == VectorIndex {
+		return r.plan.Probes
+	}
+	return r.snap.Batches()
+}
+
+// scan filters and joins one clump and, unless the query is sorted,
+// projects it.
+func (r *Rows) scan(i int) []core.Row {
+	var rows []core.Row
+	examined := 0
+	start := time.Now()
+	if len(r.plans) == 0 {
+		rows = r.snap.Scan(i, func(row core.Row) bool {
+			examined++
+			return r.q.matchesPushed(row) && r.q.Matches(row)
+		})
+		r.count.since(stageScan, start)
+	} else {
+		for _, row := range r.snap.Scan(i, func(row core.Row) bool {
+			examined++
+			return r.q.matchesPushed(row)
+		}) {
+			rows = append(rows, core.Row{r.q.TableName: row})
+		}
+		r.count.since(stageScan, start)
+
+		start = time.Now()
+		for _, p := range r.plans {
+			rows = p.apply(rows)
+		}
+		r.count.since(stageJoin, start)
+
+		start = time.Now()
+		kept := rows[:0]
+		for _, row := range rows {
+			if r.q.Matches(row) {
+				kept = append(kept, row)
+			}
+		}
+		rows = kept
+		r.count.since(stageFilter, start)
+	}
+	r.count.examined.Add(int64(examined))
+	if r.plan.Access == FullScan {
+		r.count.scanned.Add(1)
+	}
+	if !r.sorted {
+		r.projectAll(rows)
+	}
+	return rows
+}
+
+// projectAll projects rows in place.
+func (r *Rows) projectAll(rows []core.Row) {
+	start := time.Now()
+	for j, row := range rows {
+		rows[j] = r.project(row)
+	}
+	r.count.since(stageProject, start)
+}
+
+// project applies the query's columns, or flattens a joined row into
+// columns prefixed by table when none were selected.
+func (r *Rows) project(row core.Row) core.Row {
+	if len(r.plans) > 0 && len(r.q.Columns) == 0 {
+		return flatten(row, r.q.TableName, r.plans)
+	}
+	return r.q.Project(row)
+}
+
+// sortAll reads the rest of the snapshot into buf, ranks it by distance for
+// a Nearest query and sorts it. Sorting needs every field, so only the rows
+// within the limit are then projected.
+func (r *Rows) sortAll() bool {
+	var all []core.Row
+	for {
+		for r.fill() {
+			all = append(all, r.buf...)
+		}
+		if r.err != nil {
+			r.buf = nil
+			return false
+		}
+		// Too few rows of the probed lists passed the filters: read twice
+		// as many lists.
+		if r.plan.Access != VectorIndex || len(all) >= r.near.K || r.plan.Probes == r.plan.Lists {
+			break
+		}
+		r.plan.Probes = min(2*r.plan.Probes, r.plan.Lists)
+	}
+	start := time.Now()
+	if r.near != nil {
+		all = r.nearest(all)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return r.q.less(all[i], all[j])
+	})
+	r.count.since(stageSort, start)
+	if r.q.Max > 0 && len(all) > r.q.Max-r.sent {
+		all = all[:r.q.Max-r.sent]
+	}
+	var dist []interface{}
+	if r.near != nil {
+		for _, row := range all {
+			dist = append(dist, r.base(row)[DistanceField])
+		}
+	}
+	r.projectAll(all)
+	// The distance is kept even when the columns leave it out.
+	for i, d := range dist {
+		all[i][r.q.qualify(DistanceField)] = d
+	}
+	r.buf = all
+	return true
+}
+
+// Plan returns the plan the stream follows.
+func (r *Rows) Plan() *Plan {
+	return r.plan
+}
+
+// Stats reports the work done so far. It may be called between calls to
+// Next as well as after the stream ends.
+func (r *Rows) Stats() Stats {
+	s := Stats{
+		RowsExamined:  int(r.count.examined.Load()),
+		RowsReturned:  r.sent,
+		ClumpsScanned: int(r.count.scanned.Load()),
+	}
+	s.ClumpsSkipped = r.plan.Clumps - s.ClumpsScanned
+	for st := stage(0); st < numStages; st++ {
+		switch {
+		case st == stageLookup && r.plan.Access == FullScan,
+			(st == stageJoin || st == stageFilter) && len(r.plans) == 0,
+			st == stageSort && len(r.q.Order) == 0 && r.near == nil:
+			continue
+		}
+		s.Stages = append(s.Stages, Stage{Name: stageNames[st], Duration: time.Duration(r.count.stages[st].Load())})
+	}
+	end := r.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s.Total = end.Sub(r.start)
+	return s
+}
+
+// Row returns the current row. It is a copy the caller may keep.
+func (r *Rows) Row() core.Row {
+	return r.cur
+}
+
+// Err returns the error that ended the stream early, if any.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close stops the stream and drops its buffered rows. It is safe to call
+// more than once.
+func (r *Rows) Close() error {
+	r.closed = true
+	r.pending = nil
+	r.buf = nil
+	r.cur = nil
+	return nil
+}
+
+// All yields the remaining rows and closes the stream when the loop ends.
+// Check Err afterwards.
+func (r *Rows) All() iter.Seq[core.Row] {
+	return func(yield func(core.Row) bool) {
+		defer r.Close()
+		for r.Next() {
+			if !yield(r.Row()) {
+				return
+			}
+		}
+	}
+}
+
+// Iter runs the query and yields its rows. If the query fails or ctx is
+// cancelled, the last pair carries the error and a nil row.
+func (q *Query) Iter(ctx context.Context) iter.Seq2[core.Row, error] {
+	return func(yield func(core.Row, error) bool) {
+		rows, err := q.Rows(ctx)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if !yield(rows.Row(), nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package query
+
+import (
+	"errors"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+// View turns the query into a view definition for core.Database.CreateView:
+// its Where matches and Select columns, or, with groupBy fields or
+// aggregates, one row per group. A view is kept with the schema, so only
+// what can be saved carries over; a query with Go filters, joins, an order,
+// a limit or a nearest search cannot become one.
+func (q *Query) View(groupBy []string, aggregates ...core.ViewAggregate) (core.View, error) {
+	switch {
+	case len(q.Filters) > 0:
+		return core.View{}, errors.New("a view cannot keep Go filters; use Where")
+	case len(q.Joins) > 0:
+		return core.View{}, errors.New("a view cannot join tables")
+	case len(q.Order) > 0 || q.Max > 0 || q.Near != nil:
+		return core.View{}, errors.New("a view cannot order or limit its rows")
+	case q.Period != nil:
+		return core.View{}, errors.New("a view cannot read past versions")
+	}
+	var match map[string]interface{}
+	for _, m := range q.equal {
+		for k, v := range m {
+			if match == nil {
+				match = make(map[string]interface{})
+			}
+			if _, dup := match[k]; dup {
+				return core.View{}, errors.New("a view matches each key once: " + k)
+			}
+			match[k] = v
+		}
+	}
+	return core.View{
+		Table:      q.TableName,
+		Match:      match,
+		Columns:    q.Columns,
+		GroupBy:    groupBy,
+		Aggregates: aggregates,
+	}, nil
+}
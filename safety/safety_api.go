@@ -22,30 +22,10 @@ func Update(db *core.Database, tableName string, filter FilterFunc, update core.
 		return errors.New("table not found")
 	}
 
-	table.Mu.Lock()
-	defer table.Mu.Unlock()
-
-	var toBackup []core.Row
-	var indices []int
-	for i, row := range table.HotHeap.Rows {
-		if filter(row) {
-			toBackup = append(toBackup, row)
-			indices = append(indices, i)
-		}
-	}
-
-	if len(toBackup) > 0 {
-		if err := BatchBackupForSafety(db, tableName, toBackup); err != nil {
-			return err
-		}
-		for _, idx := range indices {
-			for k, v := range update {
-				table.HotHeap.Rows[idx][k] = v
-			}
-		}
-	}
-
-	return nil
+	_, err := table.UpdateWhere(filter, update, func(name string, rows []core.Row) error {
+		return BatchBackupForSafety(db, name, rows)
+	})
+	return err
 }
 
 func Delete(db *core.Database, tableName string, filter FilterFunc) error {
@@ -57,40 +37,41 @@ func Delete(db *core.Database, tableName string, filter FilterFunc) error {
 		return errors.New("table not found")
 	}
 
-	table.Mu.Lock()
-	defer table.Mu.Unlock()
+	_, err := table.DeleteWhere(filter, func(name string, rows []core.Row) error {
+		return BatchBackupForSafety(db, name, rows)
+	})
+	return err
+}
 
-	var toBackup []core.Row
-	var newRows []core.Row
-	for _, row := range table.HotHeap.Rows {
-		if filter(row) {
-			toBackup = append(toBackup, row)
-		} else {
-			newRows = append(newRows, row)
-		}
+func Restore(db *core.Database, timestamp time.Time, accepted bool) error {
+	if !accepted {
+		return errors.New("recovery aborted")
 	}
 
-	if len(toBackup) > 0 {
-		if err := BatchBackupForSafety(db, tableName, toBackup); err != nil {
-			return err
-		}
+	backup, err := findBackup(db, timestamp)
+	if err != nil {
+		return err
 	}
 
-	table.HotHeap.Rows = newRows
-	return nil
-}
+	db.Mu.RLock()
+	table, ok := db.Tables[backup.TableName]
+	db.Mu.RUnlock()
 
-func Restore(db *core.Database, timestamp time.Time, accepted bool) error {
-	if !accepted {
-		return errors.New("recovery aborted")
+	if !ok {
+		return errors.New("recovery point not found")
 	}
+	// The table checks unique and foreign keys itself, so the database lock
+	// must be released first.
+	return table.Restore(backup.Data)
+}
 
+func findBackup(db *core.Database, timestamp time.Time) (*SafetyBackup, error) {
 	db.Mu.Lock()
 	defer db.Mu.Unlock()
 
 	_, err := db.SafetyFile.Seek(0, io.SeekStart)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	br := bufio.NewReader(db.SafetyFile)
@@ -100,14 +81,14 @@ func Restore(db *core.Database, timestamp time.Time, accepted bool) error {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return err
+			return nil, err
 		}
 
 		payload := make([]byte, size)
 		for i := 0; i < int(size); i++ {
 			b, err := crypto.DecodeOne(br)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			payload[i] = b
 		}
@@ -123,14 +104,11 @@ func Restore(db *core.Database, timestamp time.Time, accepted bool) error {
 		}
 
 		if backup.Timestamp.Truncate(time.Second).Equal(timestamp.Truncate(time.Second)) {
-			if table, ok := db.Tables[backup.TableName]; ok {
-				table.Mu.Lock()
-				table.HotHeap.Rows = append(table.HotHeap.Rows, backup.Data)
-				table.Mu.Unlock()
-				return nil
+			if _, ok := db.Tables[backup.TableName]; ok {
+				return &backup, nil
 			}
 		}
 	}
 
-	return errors.New("recovery point not found")
+	return nil, errors.New("recovery point not found")
 }
@@ -9,13 +9,327 @@ export interface ConnectionStatus {
 
 export interface Field {
     Name: string;
-    Type: number; // 0 for int, 1 for string, etc.
+    /** 0 int, 1 string, 2 float, 3 bool, 4 object, 5 array, 6 timestamp, 7 bytes, 8 decimal, 9 vector. */
+    Type: number;
     Unique: boolean;
+    /** Numeric bounds, inclusive. */
+    Min?: number;
+    Max?: number;
+    /** String length bounds in characters, inclusive. */
+    MinLength?: number;
+    MaxLength?: number;
+    /** Regular expression (Go RE2 syntax) that string values must match. */
+    Pattern?: string;
+    /** The only values the field may take. */
+    Enum?: any[];
+    /** Rejects null, blank strings and empty arrays or objects. */
+    NotEmpty?: boolean;
+    /** Keeps a full-text index of a string field for `search`. */
+    FullText?: boolean;
+    /** Length every value of a vector field must have. */
+    Dimensions?: number;
+    /** 'ivf' keeps an approximate nearest-neighbour index of a vector field. */
+    VectorIndex?: 'ivf';
+    /** Clusters of the IVF index; defaults to the square root of the row count. */
+    Lists?: number;
+    /**
+     * Computes the field from the others in the row, e.g. 'price * qty',
+     * 'lower(email)' or "first || ' ' || last". Values written to it are replaced.
+     */
+    Expr?: string;
+    /** Writes a computed field to disk instead of computing it as rows load. */
+    Stored?: boolean;
+}
+
+/**
+ * Match keys are field paths: 'age', 'address.city' or 'tags[0]'.
+ * A plain value matches by equality. An operator object such as
+ * { $gte: 18, $lt: 65 } compares instead; operands use the field's type.
+ */
+export type MatchValue = any | {
+    $eq?: any; $ne?: any; $gt?: any; $gte?: any; $lt?: any; $lte?: any;
+    $in?: any[];
+    /** Substring, array element or object key. */
+    $contains?: any;
+};
+
+export type Match = Record<string, MatchValue>;
+
+export interface SortKey {
+    field: string;
+    desc?: boolean;
+}
+
+export interface QueryOptions {
+    /** Field names or sort keys, applied in order. */
+    sort?: string | SortKey | (string | SortKey)[];
+    /** Maximum number of rows to return. */
+    limit?: number;
+    /** Fields or nested paths to return; a path's value comes back under the path itself. */
+    select?: string[];
+    /** Tables to join. Results then carry columns prefixed by table, e.g. 'products.name'. */
+    joins?: Join[];
+    /** Keeps the k rows nearest a vector, nearest first, each with a `_distance`. */
+    nearest?: Nearest;
+    /** Reads the table as it was at a past time. The table must keep history; see `setTemporal`. */
+    asOf?: Date | string;
+    /** Reads every version of the rows current at some time in the period, inclusive. */
+    between?: { from: Date | string; to: Date | string };
+}
+
+export interface Nearest {
+    /** A vector field of the queried table. */
+    field: string;
+    vector: number[];
+    k: number;
+    /** Distances are 1 - cosine, the negated dot product or the Euclidean distance. Defaults to 'cosine'. */
+    metric?: 'cosine' | 'dot' | 'l2';
+    /** IVF lists to read at first; more are read while fewer than k rows match. Defaults to a quarter. */
+    probes?: number;
+}
+
+export interface Join {
+    /** 'inner' (default) drops unmatched rows; 'left' keeps them with null columns. */
+    kind?: 'inner' | 'left';
+    table: string;
+    /** Field of the rows joined so far, e.g. 'product_id' or 'orders.product_id'. */
+    left: string;
+    /** Field of the joined table that must equal left. */
+    right: string;
+    /** Name for the joined table's columns, needed to join a table to itself. */
+    as?: string;
+}
+
+export interface Explanation {
+    Plan: {
+        Table: string;
+        /**
+         * 'index_lookup' when a unique index answers the match's equality, 'vector_index' when
+         * a nearest query reads an IVF index, 'history_scan' for asOf and between, else 'full_scan'.
+         */
+        Access: 'full_scan' | 'index_lookup' | 'vector_index' | 'history_scan';
+        Index?: string;
+        Keys?: number;
+        /** IVF lists of the index and how many were read. */
+        Lists?: number;
+        Probes?: number;
+        EstimatedRows: number;
+        Clumps: number;
+        Joins?: { Table: string; Strategy: 'index_nested_loop' | 'hash' }[];
+        Workers: number;
+    };
+    Stats: {
+        RowsExamined: number;
+        RowsReturned: number;
+        ClumpsScanned: number;
+        ClumpsSkipped: number;
+        /** Durations are in nanoseconds; stages run by several workers add up their time. */
+        Stages: { Name: string; Duration: number }[];
+        Total: number;
+    };
+}
+
+export interface SearchOptions {
+    /** Only rows also matching this are returned. */
+    match?: Match;
+    /** Maximum number of hits to return. */
+    limit?: number;
+}
+
+export interface SearchHit {
+    Row: Record<string, any>;
+    /** BM25 relevance; higher is better. */
+    Score: number;
+}
+
+export type ChangeKind = 'insert' | 'update' | 'delete';
+
+export interface Change {
+    /** Pass as `from` to resume after this change. */
+    Position: string;
+    Kind: ChangeKind;
+    Table: string;
+    RowID: number;
+    /** The row before an update or delete. */
+    Before?: Record<string, any>;
+    /** The row after an insert or update. */
+    After?: Record<string, any>;
+    Time: string;
+}
+
+export interface SubscribeOptions {
+    /** Only changes to this table. */
+    table?: string;
+    /** Only changes of these kinds. */
+    kinds?: ChangeKind[];
+    /** Only rows matching this, after an insert or update and before a delete. Needs `table`. */
+    match?: Match;
+    /** Position of the last change seen; changes after it are sent first. */
+    from?: string;
+    /** Called when the engine ends the subscription, e.g. when it fell too far behind. */
+    onError?: (err: Error) => void;
+}
+
+export interface Subscription {
+    id: string;
+    unsubscribe(): Promise<string>;
+}
+
+export interface TTL {
+    /** Timestamp field holding each row's time; omit to count from insertion. */
+    Field?: string;
+    /** Go duration after that time at which a row expires, e.g. "15m"; omit when Field holds the expiry itself. */
+    After?: string;
+}
+
+export interface Temporal {
+    /** Go duration a version is kept after it was replaced or deleted, e.g. "2160h"; omit to keep every version. */
+    Retain?: string;
+    /** When the table started keeping history; filled in by the database. */
+    Since?: string;
+}
+
+/**
+ * A trigger kept with a table's schema. Values may use "$new.<path>" for the
+ * row written, "$old.<path>" for the row as it was and "$now" for the current
+ * time; a string starting with "$" is written with "$$".
+ */
+export interface Rule {
+    Name: string;
+    /** Kinds of write the rule fires for; omit for all. */
+    On?: ChangeKind[];
+    /** Fields assigned to an inserted or updated row before it is checked. */
+    Set?: Record<string, any>;
+    /** Match the row must pass, or the write fails with Message. */
+    Require?: Record<string, any>;
+    Message?: string;
+    /** Writes made once each row is written; they fail or succeed with it. */
+    Then?: RuleWrite[];
+}
+
+/**
+ * A write made by a rule: Insert adds a row, otherwise the rows passing Match
+ * are deleted, or given Set and have Inc added to their numbers.
+ */
+export interface RuleWrite {
+    Table: string;
+    Insert?: Record<string, any>;
+    Match?: Record<string, any>;
+    Set?: Record<string, any>;
+    Inc?: Record<string, number>;
+    Delete?: boolean;
+}
+
+/**
+ * A view: the rows of table passing match, cut down to select, or with
+ * groupBy or aggregates, one row per group.
+ */
+export interface View {
+    table: string;
+    match?: Record<string, any>;
+    select?: string[];
+    groupBy?: string[];
+    aggregates?: ViewAggregate[];
+    /** Stores the rows and updates them as the table changes. */
+    materialized?: boolean;
+}
+
+/** An aggregate column of a grouped view; a count without Field counts rows. */
+export interface ViewAggregate {
+    Func: 'count' | 'sum' | 'avg' | 'min' | 'max';
+    Field?: string;
+    As: string;
+}
+
+export interface SqlResult {
+    /** Selected columns in order; absent for SELECT * and for statements other than SELECT. */
+    columns?: string[];
+    rows?: Record<string, any>[];
+    /** Rows inserted, updated or deleted. */
+    rowsAffected: number;
+}
+
+export type UpsertMode = 'merge' | 'replace' | 'ignore';
+
+export interface UpsertResult {
+    Inserted: number;
+    Updated: number;
+    Ignored: number;
+}
+
+export interface VerifyReport {
+    Table: string;
+    Rows: number;
+    Violations: { Field: string; Value: any; Count: number }[] | null;
+}
+
+export interface Constraint {
+    Name?: string;
+    Kind: 'unique' | 'foreign_key';
+    Fields: string[];
+    /** Foreign keys only: the referenced table and its unique fields. */
+    RefTable?: string;
+    RefFields?: string[];
+    /** Foreign keys only: what happens to referencing rows on delete. Defaults to 'restrict'. */
+    OnDelete?: 'restrict' | 'cascade' | 'set_null';
+}
+
+export type MigrationStep =
+    | { Kind: 'rename_field'; Field: string; To: string }
+    | { Kind: 'rename_table'; To: string }
+    | { Kind: 'cast'; Field: string; Type: number; OnFailure?: 'fail' | 'null' | 'default' | 'drop'; Value?: any }
+    | { Kind: 'backfill'; Field: string; Type?: number; Value?: any; From?: string; OnFailure?: 'fail' | 'null' | 'drop' };
+
+export interface Conflict {
+    Kind: string;
+    Table: string;
+    /** Field, unique index or foreign key the conflict is about. */
+    Field?: string;
+    Dropped: number;
+    Altered: number;
+    /** Up to five of the affected rows. */
+    Sample?: Record<string, any>[];
+}
+
+export interface ConflictReport {
+    Compatiable: boolean;
+    Conflicts: string[] | null;
+    Destructive: boolean;
+    Details?: Conflict[];
+}
+
+export interface FieldStats {
+    Name: string;
+    /** Dominant type of the non-null values. */
+    Type: number;
+    Present: number;
+    Mismatched: number;
+    Distinct: number;
+    /** Every row holds a distinct value. */
+    Unique: boolean;
+}
+
+export interface InferredSchema {
+    Table: string;
+    Orphan: boolean;
+    Clumps: number;
+    Rows: number;
+    Fields: FieldStats[] | null;
+    Proposed: Field[] | null;
+}
+
+export interface SchemaRevision {
+    Version: number;
+    Fields: Field[];
+    Constraints?: Constraint[];
+    Changes?: string[];
+    ChangedAt: string;
 }
 
 export interface Schema {
     table: string;
     fields: Field[];
+    constraints?: Constraint[];
 }
 
 export default class EmojiDB {
@@ -43,8 +357,9 @@ export default class EmojiDB {
      * Defines a schema for a table.
      * @param table Name of the table.
      * @param fields Array of field definitions.
+     * @param constraints (Optional) Table-level constraints such as composite unique keys.
      */
-    defineSchema(table: string, fields: Field[]): Promise<string>;
+    defineSchema(table: string, fields: Field[], constraints?: Constraint[]): Promise<string>;
 
     /**
      * Inserts a row into a table.
@@ -60,13 +375,23 @@ export default class EmojiDB {
      */
     batchInsert(table: string, rows: Record<string, any>[]): Promise<string>;
 
+    /**
+     * Inserts rows, resolving collisions on a unique field atomically.
+     * @param table Name of the table.
+     * @param rowOrRows A row object or an array of rows (applied all-or-nothing).
+     * @param conflict The unique field that decides whether a row already exists.
+     * @param mode 'merge' updates the given fields, 'replace' swaps the whole row, 'ignore' keeps the existing row.
+     */
+    upsert(table: string, rowOrRows: Record<string, any> | Record<string, any>[], conflict: string | string[], mode?: UpsertMode): Promise<UpsertResult>;
+
     /**
      * Applies schema changes to the database (Migration).
      * @param table Name of the table.
      * @param fields New field definitions.
      * @param force If true, forcefully rewrites the table, discarding rows that violate the new schema.
+     * @param constraints (Optional) Table-level constraints for the new schema.
      */
-    migrate(table: string, fields: Field[], force?: boolean): Promise<string>;
+    migrate(table: string, fields: Field[], force?: boolean, constraints?: Constraint[]): Promise<string>;
 
     /**
      * Applies schema changes to the database (Migration) using the local schema file.
@@ -75,6 +400,26 @@ export default class EmojiDB {
      */
     migrate(table: string, force?: boolean): Promise<string>;
 
+    /**
+     * Runs explicit migration steps (renames, casts, backfills) and then syncs the table to the new fields.
+     * The whole migration is written in one crash-safe rewrite.
+     * @param table Name of the table before the migration.
+     * @param steps Steps to run in order. Field names refer to the table as left by the previous step.
+     * @param fields Field definitions after the migration.
+     * @param force If true, rows that violate the new schema are dropped instead of failing the migration.
+     * @param constraints (Optional) Table-level constraints after the migration.
+     */
+    migrateSchema(table: string, steps: MigrationStep[], fields: Field[], force?: boolean, constraints?: Constraint[]): Promise<string>;
+
+    /**
+     * Reports what a forced migration would do without changing any data.
+     * @param table Name of the table.
+     * @param fields Field definitions after the migration.
+     * @param constraints (Optional) Table-level constraints after the migration.
+     * @param steps (Optional) Migration steps, as for migrateSchema.
+     */
+    dryRun(table: string, fields: Field[], constraints?: Constraint[], steps?: MigrationStep[]): Promise<ConflictReport>;
+
     /**
      * Applies schema changes for ALL tables in the local schema file.
      */
@@ -85,7 +430,7 @@ export default class EmojiDB {
      * @param table Name of the table.
      * @param match Filter conditions (e.g. { active: true }).
      */
-    count(table: string, match?: Record<string, any>): Promise<number>;
+    count(table: string, match?: Match): Promise<number>;
 
     /**
      * destructively drops a table and all its data.
@@ -93,6 +438,53 @@ export default class EmojiDB {
      */
     dropTable(table: string): Promise<string>;
 
+    /**
+     * Calls onChange for every row inserted, updated or deleted from now on,
+     * in order.
+     * @param onChange Receives each change.
+     * @param options (Optional) Filters and a position to resume from.
+     */
+    subscribe(onChange: (change: Change) => void, options?: SubscribeOptions): Promise<Subscription>;
+
+    /**
+     * Expires the rows of a table. Expired rows are hidden from queries and
+     * counts at once, and removed from disk on the next flush.
+     * @param table Name of the table.
+     * @param ttl (Optional) The expiry policy; null stops expiring rows.
+     */
+    setTTL(table: string, ttl?: TTL | null): Promise<string>;
+
+    /**
+     * Makes a table keep every past version of its rows, with `_valid_from`
+     * and `_valid_to` times, so it can be queried with `asOf` and `between`.
+     * @param table Name of the table.
+     * @param temporal (Optional) The retention of past versions; null stops keeping history and drops them.
+     */
+    setTemporal(table: string, temporal?: Temporal | null): Promise<string>;
+
+    /**
+     * Replaces the rules of a table. Rules are kept with the schema.
+     * @param table Name of the table.
+     * @param rules (Optional) The rules; empty removes them.
+     */
+    setRules(table: string, rules?: Rule[]): Promise<string>;
+
+    /**
+     * Saves a query over a table as a view, read by name like a table but
+     * never written to. A materialized view stores its rows and keeps them up
+     * to date as the table changes.
+     * @param name Name of the view.
+     * @param view The table, match and columns or groups of the view.
+     */
+    createView(name: string, view: View): Promise<string>;
+
+    /**
+     * Rebuilds a view from its table. Views are refreshed on their own when
+     * their table's schema changes.
+     * @param name Name of the view.
+     */
+    refreshView(name: string): Promise<string>;
+
     /**
      * Manually flushes in-memory data (Hot Heap) to the disk-based Sealed Clump.
      * Use this to ensure data persistence before stopping the application.
@@ -100,6 +492,32 @@ export default class EmojiDB {
      */
     flush(table: string): Promise<string>;
 
+    /**
+     * Lists tables that have data on disk but no schema, with row counts and a proposed schema.
+     */
+    inspectOrphans(): Promise<InferredSchema[]>;
+
+    /**
+     * Proposes a schema from the rows of a table or of orphaned data.
+     * @param table Name of the table.
+     */
+    inferSchema(table: string): Promise<InferredSchema>;
+
+    /**
+     * Gives orphaned data a schema so its rows become visible.
+     * @param table Name of the orphaned table.
+     * @param fields (Optional) Field definitions. Defaults to the inferred schema.
+     * @param force If true, rows that violate the schema are dropped instead of failing.
+     * @param constraints (Optional) Table-level constraints.
+     */
+    adoptOrphans(table: string, fields?: Field[] | null, force?: boolean, constraints?: Constraint[]): Promise<string>;
+
+    /**
+     * Lists every recorded revision of a table's schema, oldest first.
+     * @param table Name of the table.
+     */
+    schemaHistory(table: string): Promise<SchemaRevision[]>;
+
     /**
      * Forces the engine to regenerate the local schema file based on the database content (Pull).
      */
@@ -114,8 +532,27 @@ export default class EmojiDB {
      * Queries a table for rows matching the criteria.
      * @param table Name of the table.
      * @param match (Optional) Filter object to match rows.
+     * @param options (Optional) Sorting and limit.
+     */
+    query(table: string, match?: Match, options?: QueryOptions): Promise<any[]>;
+
+    /**
+     * Runs a query like `query`, discarding its rows, and reports how it ran.
      */
-    query(table: string, match?: Record<string, any>): Promise<any[]>;
+    explain(table: string, match?: Match, options?: QueryOptions): Promise<Explanation>;
+
+    /**
+     * Ranks rows by how well a FullText field matches a search, best first.
+     * @param query Words, "quoted phrases" and prefix* terms; a row matching any of them is a hit.
+     */
+    search(table: string, field: string, query: string, options?: SearchOptions): Promise<SearchHit[]>;
+
+    /**
+     * Runs one SQL statement: SELECT, INSERT, UPDATE, DELETE, CREATE TABLE or DROP TABLE.
+     * @param query The statement, with ? or $1, $2... placeholders.
+     * @param params (Optional) Values for the placeholders, in order.
+     */
+    sql(query: string, params?: any[]): Promise<SqlResult>;
 
     /**
      * Updates rows in a table that match the criteria.
@@ -123,14 +560,20 @@ export default class EmojiDB {
      * @param match Filter object to select rows to update.
      * @param updateData Object containing the new values.
      */
-    update(table: string, match: Record<string, any>, updateData: Record<string, any>): Promise<string>;
+    update(table: string, match: Match, updateData: Record<string, any>): Promise<string>;
 
     /**
      * Deletes rows from a table that match the criteria.
      * @param table Name of the table.
      * @param match Filter object to select rows to delete.
      */
-    delete(table: string, match: Record<string, any>): Promise<string>;
+    delete(table: string, match: Match): Promise<string>;
+
+    /**
+     * Rebuilds unique indices from stored rows and reports values held by more than one row.
+     * @param table (Optional) Table to verify. Verifies every table when omitted.
+     */
+    verify(table?: string): Promise<VerifyReport[]>;
 
     /**
      * Secures the database by generating a one-time master key.
@@ -25,6 +25,10 @@ export class EmojiDBError extends Error {
         } else if (message.includes('unique constraint violation:')) {
             this.code = 'UNIQUE_CONSTRAINT';
             this.details = { field: message.split(': ')[1] };
+        } else if (message.includes('check constraint violation:')) {
+            this.code = 'CHECK_CONSTRAINT';
+            const parts = message.split(': ');
+            this.details = { field: parts[1], rule: parts.slice(2).join(': ') };
         } else if (message.includes('type mismatch')) {
             this.code = 'TYPE_MISMATCH';
             const parts = message.split(': ');
@@ -126,6 +130,7 @@ class EmojiDB {
         this.process = null;
         this.rl = null;
         this.pending = new Map();
+        this.subscriptions = new Map();
     }
 
     async connect() {
@@ -144,6 +149,10 @@ class EmojiDB {
             this.rl.on('line', (line) => {
                 try {
                     const res = JSON.parse(line);
+                    if (res.subscription) {
+                        this.dispatch(res);
+                        return;
+                    }
                     const p = this.pending.get(res.id);
                     if (p) {
                         if (res.error) {
@@ -179,8 +188,18 @@ class EmojiDB {
         return { status: 'disconnected' };
     }
 
-    async send(method, params = {}) {
-        const id = Math.random().toString(36).substring(7);
+    dispatch(res) {
+        const s = this.subscriptions.get(res.subscription);
+        if (!s) return;
+        if (res.error) {
+            this.subscriptions.delete(res.subscription);
+            if (s.onError) s.onError(new EmojiDBError(res.error));
+            return;
+        }
+        s.onChange(res.event);
+    }
+
+    async send(method, params = {}, id = Math.random().toString(36).substring(7)) {
         const stackContainer = {};
         Error.captureStackTrace(stackContainer);
 
@@ -199,8 +218,8 @@ class EmojiDB {
         return this.send('open', { path: dbPath, key });
     }
 
-    async defineSchema(table, fields) {
-        return this.send('define_schema', { table, fields });
+    async defineSchema(table, fields, constraints = []) {
+        return this.send('define_schema', { table, fields, constraints });
     }
 
     async insert(table, row) {
@@ -211,11 +230,57 @@ class EmojiDB {
         return this.send('batch_insert', { table, records: rows });
     }
 
-    async query(table, match = {}) {
-        return this.send('query', { table, match });
+    async upsert(table, rowOrRows, conflict, mode = 'merge') {
+        const conflictFields = Array.isArray(conflict) ? conflict : [conflict];
+        if (Array.isArray(rowOrRows)) {
+            return this.send('upsert', { table, records: rowOrRows, conflict: conflictFields, mode });
+        }
+        return this.send('upsert', { table, row: rowOrRows, conflict: conflictFields, mode });
+    }
+
+    queryParams(table, match, options) {
+        const params = { table, match };
+        if (options.sort) {
+            const keys = Array.isArray(options.sort) ? options.sort : [options.sort];
+            params.sort = keys.map(k => typeof k === 'string' ? { field: k, desc: false } : k);
+        }
+        if (options.limit) params.limit = options.limit;
+        if (options.select) params.select = options.select;
+        if (options.joins) params.joins = options.joins;
+        if (options.nearest) params.nearest = options.nearest;
+        if (options.asOf) params.asOf = options.asOf;
+        if (options.between) params.between = options.between;
+        return params;
     }
 
-    async migrate(table, fieldsOrForce, forceArg = false) {
+    async query(table, match = {}, options = {}) {
+        return this.send('query', this.queryParams(table, match, options));
+    }
+
+    async explain(table, match = {}, options = {}) {
+        return this.send('explain', this.queryParams(table, match, options));
+    }
+
+    async search(table, field, query, options = {}) {
+        const params = { table, field, query };
+        if (options.match) params.match = options.match;
+        if (options.limit) params.limit = options.limit;
+        return this.send('search', params);
+    }
+
+    async sql(query, params = []) {
+        return this.send('sql', { query, params });
+    }
+
+    async migrateSchema(table, steps, fields, force = false, constraints = []) {
+        return this.send('migrate_schema', { table, steps, fields, force, constraints });
+    }
+
+    async dryRun(table, fields, constraints = [], steps = []) {
+        return this.send('dry_run', { table, fields, constraints, steps });
+    }
+
+    async migrate(table, fieldsOrForce, forceArg = false, constraints = []) {
         let fields = null;
         let force = forceArg;
 
@@ -226,7 +291,7 @@ class EmojiDB {
         }
 
         if (table && fields) {
-            return this.send('sync_schema', { table, fields, force });
+            return this.send('sync_schema', { table, fields, constraints, force });
         }
 
         if (!this.dbPath) {
@@ -252,7 +317,7 @@ class EmojiDB {
             if (!schema[table]) {
                 throw new Error(`Table '${table}' not defined in schema file.`);
             }
-            return this.send('sync_schema', { table, fields: schema[table].Fields, force });
+            return this.send('sync_schema', { table, fields: schema[table].Fields, constraints: schema[table].Constraints || [], force });
         }
         const schemaTables = Object.keys(schema);
         if (schemaTables.length === 0) return "No tables to migrate.";
@@ -274,7 +339,13 @@ class EmojiDB {
         const results = [];
         for (const t of schemaTables) {
             // We run them sequentially to be safe
-            await this.send('sync_schema', { table: t, fields: schema[t].Fields, force });
+            await this.send('sync_schema', { table: t, fields: schema[t].Fields, constraints: schema[t].Constraints || [], force });
+            const history = await this.schemaHistory(t);
+            const latest = history[history.length - 1];
+            if (latest && latest.Changes && latest.Changes.length > 0) {
+                console.log(`📜 EmojiDB: '${t}' is at v${latest.Version} (${latest.ChangedAt}): ${latest.Changes.join('; ')}`);
+            }
+            results.push(`${t}@v${latest ? latest.Version : 1}`);
         }
 
         let msg = `Migrated ${results.length} tables: ${results.join(', ')}`;
@@ -284,6 +355,22 @@ class EmojiDB {
         return msg;
     }
 
+    async inspectOrphans() {
+        return this.send('inspect_orphans', {});
+    }
+
+    async inferSchema(table) {
+        return this.send('infer_schema', { table });
+    }
+
+    async adoptOrphans(table, fields = null, force = false, constraints = []) {
+        return this.send('adopt_orphans', { table, fields, force, constraints });
+    }
+
+    async schemaHistory(table) {
+        return this.send('schema_history', { table });
+    }
+
     async pull() {
         return this.send('pull_schema');
     }
@@ -300,6 +387,49 @@ class EmojiDB {
         return this.send('drop_table', { table });
     }
 
+    async subscribe(onChange, options = {}) {
+        const id = Math.random().toString(36).substring(7);
+        const params = {};
+        if (options.table) params.table = options.table;
+        if (options.kinds) params.kinds = options.kinds;
+        if (options.match) params.match = options.match;
+        if (options.from) params.from = options.from;
+        this.subscriptions.set(id, { onChange, onError: options.onError });
+        try {
+            await this.send('subscribe', params, id);
+        } catch (err) {
+            this.subscriptions.delete(id);
+            throw err;
+        }
+        return {
+            id,
+            unsubscribe: async () => {
+                this.subscriptions.delete(id);
+                return this.send('unsubscribe', { subscription: id });
+            }
+        };
+    }
+
+    async setTTL(table, ttl = null) {
+        return this.send('set_ttl', { table, ttl });
+    }
+
+    async setTemporal(table, temporal = null) {
+        return this.send('set_temporal', { table, temporal });
+    }
+
+    async setRules(table, rules = []) {
+        return this.send('set_rules', { table, rules });
+    }
+
+    async createView(name, view) {
+        return this.send('create_view', { name, ...view });
+    }
+
+    async refreshView(name) {
+        return this.send('refresh_view', { name });
+    }
+
     async flush(table) {
         console.log(`💾 EmojiDB: Persisting '${table}' to disk...`);
         const res = await this.send('flush', { table });
@@ -315,6 +445,10 @@ class EmojiDB {
         return this.send('delete', { table, match });
     }
 
+    async verify(table) {
+        return this.send('verify', table ? { table } : {});
+    }
+
     async secure() {
         return this.send('secure');
     }
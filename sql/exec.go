@@ -0,0 +1,551 @@
+// Package sql runs a small SQL dialect against a database. Statements are
+// parsed once, compiled into a plan over query.Query and the table mutations
+// of core, and run with parameters bound by position:
+//
+//	res, err := sql.Exec(ctx, db, "SELECT name, price FROM products WHERE price < ? ORDER BY price", 10)
+//
+// The dialect covers SELECT with joins, WHERE, GROUP BY, ORDER BY and LIMIT;
+// INSERT, UPDATE and DELETE; and CREATE TABLE and DROP TABLE.
+package sql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+// Result is the outcome of a statement. A SELECT fills Columns, in the
+// order selected (empty for SELECT *), and Rows; other statements report
+// how many rows they changed.
+type Result struct {
+	Columns      []string   `json:"columns,omitempty"`
+	Rows         []core.Row `json:"rows,omitempty"`
+	RowsAffected int        `json:"rowsAffected"`
+}
+
+// Plan is a statement compiled against a database with its parameters bound.
+type Plan interface {
+	Run(ctx context.Context) (*Result, error)
+}
+
+type planFunc func(ctx context.Context) (*Result, error)
+
+func (f planFunc) Run(ctx context.Context) (*Result, error) {
+	return f(ctx)
+}
+
+// Stmt is a parsed statement. It holds no database state and may be
+// compiled any number of times.
+type Stmt struct {
+	node   interface{}
+	params int
+}
+
+// Parse parses one statement. Keywords are not case sensitive; names are.
+func Parse(text string) (*Stmt, error) {
+	node, params, err := parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Stmt{node: node, params: params}, nil
+}
+
+// NumParams is the number of parameters the statement takes.
+func (s *Stmt) NumParams() int {
+	return s.params
+}
+
+// Compile binds args to the statement's parameters and plans it against db.
+// Tables, and the types of values compared in WHERE, are checked now;
+// constraints are checked when the plan runs.
+func (s *Stmt) Compile(db *core.Database, args ...interface{}) (Plan, error) {
+	if len(args) != s.params {
+		return nil, fmt.Errorf("statement takes %d parameters, got %d", s.params, len(args))
+	}
+	c := &compiler{db: db, args: args}
+	switch n := s.node.(type) {
+	case *selectStmt:
+		return c.selectPlan(n)
+	case *insertStmt:
+		return c.insertPlan(n)
+	case *updateStmt:
+		return c.updatePlan(n)
+	case *deleteStmt:
+		return c.deletePlan(n)
+	case *createStmt:
+		return c.createPlan(n), nil
+	case *dropStmt:
+		return c.dropPlan(n), nil
+	}
+	return nil, fmt.Errorf("unsupported statement: %T", s.node)
+}
+
+// Exec parses, compiles and runs a statement.
+func Exec(ctx context.Context, db *core.Database, text string, args ...interface{}) (*Result, error) {
+	stmt, err := Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := stmt.Compile(db, args...)
+	if err != nil {
+		return nil, err
+	}
+	return plan.Run(ctx)
+}
+
+type compiler struct {
+	db   *core.Database
+	args []interface{}
+}
+
+func (c *compiler) bind(v value) interface{} {
+	if v.param > 0 {
+		return c.args[v.param-1]
+	}
+	return v.lit
+}
+
+// where adds a WHERE clause to q. A plain AND of comparisons goes through
+// Query.Where, so the base table's part is tested before joining; anything
+// else becomes a single filter.
+func (c *compiler) where(q *query.Query, e expr) error {
+	if e == nil {
+		return nil
+	}
+	match := map[string]interface{}{}
+	if c.conjunction(e, match) {
+		return q.Where(match)
+	}
+	f, err := c.filter(q, e)
+	if err != nil {
+		return err
+	}
+	q.Filter(f)
+	return nil
+}
+
+// conjunction collects an AND of comparisons into match. It reports false
+// for anything else, or if a column is tested twice with one operator.
+func (c *compiler) conjunction(e expr, match map[string]interface{}) bool {
+	switch e := e.(type) {
+	case logic:
+		return e.and && c.conjunction(e.left, match) && c.conjunction(e.right, match)
+	case cond:
+		ops, _ := match[e.field].(map[string]interface{})
+		if ops == nil {
+			ops = map[string]interface{}{}
+			match[e.field] = ops
+		}
+		if _, dup := ops[e.op]; dup {
+			return false
+		}
+		ops[e.op] = c.operand(e)
+		return true
+	}
+	return false
+}
+
+func (c *compiler) operand(e cond) interface{} {
+	if e.op != "$in" {
+		return c.bind(e.values[0])
+	}
+	in := make([]interface{}, len(e.values))
+	for i, v := range e.values {
+		in[i] = c.bind(v)
+	}
+	return in
+}
+
+func (c *compiler) filter(q *query.Query, e expr) (query.FilterFunc, error) {
+	switch e := e.(type) {
+	case cond:
+		return q.Predicate(map[string]interface{}{
+			e.field: map[string]interface{}{e.op: c.operand(e)},
+		})
+	case not:
+		f, err := c.filter(q, e.x)
+		if err != nil {
+			return nil, err
+		}
+		return func(r core.Row) bool { return !f(r) }, nil
+	case logic:
+		left, err := c.filter(q, e.left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.filter(q, e.right)
+		if err != nil {
+			return nil, err
+		}
+		if e.and {
+			return func(r core.Row) bool { return left(r) && right(r) }, nil
+		}
+		return func(r core.Row) bool { return left(r) || right(r) }, nil
+	}
+	return nil, fmt.Errorf("unsupported condition: %T", e)
+}
+
+func (c *compiler) limit(v *value) (int, error) {
+	if v == nil {
+		return 0, nil
+	}
+	switch n := c.bind(*v).(type) {
+	case int64:
+		if n >= 0 {
+			return int(n), nil
+		}
+	case int:
+		if n >= 0 {
+			return n, nil
+		}
+	case float64:
+		if n >= 0 && n == float64(int(n)) {
+			return int(n), nil
+		}
+	}
+	return 0, fmt.Errorf("LIMIT must be a whole number of at least 0")
+}
+
+func (c *compiler) selectPlan(s *selectStmt) (Plan, error) {
+	q := query.NewQuery(c.db, s.table)
+	for _, j := range s.joins {
+		q.AddJoin(j)
+	}
+	if err := c.where(q, s.where); err != nil {
+		return nil, err
+	}
+	max, err := c.limit(s.limit)
+	if err != nil {
+		return nil, err
+	}
+	// LIMIT 0 returns nothing rather than everything.
+	empty := s.limit != nil && max == 0
+
+	grouped := len(s.groupBy) > 0
+	for _, it := range s.items {
+		grouped = grouped || it.fn != ""
+	}
+	if grouped {
+		return c.groupPlan(q, s, max, empty)
+	}
+
+	// Projection and sorting happen in the query; aliases are applied last.
+	aliases := map[string]string{}
+	var fields, columns []string
+	for _, it := range s.items {
+		fields = append(fields, it.field)
+		name := q.ColumnName(it.field)
+		if it.alias != "" {
+			aliases[name] = it.alias
+			name = it.alias
+		}
+		columns = append(columns, name)
+	}
+	if len(fields) > 0 {
+		q.Select(fields...)
+	}
+	for _, key := range s.orderBy {
+		for _, it := range s.items {
+			if it.alias == key.Field {
+				key.Field = it.field
+				break
+			}
+		}
+		q.OrderBy(key.Field, key.Desc)
+	}
+	q.Limit(max)
+
+	return planFunc(func(ctx context.Context) (*Result, error) {
+		res := &Result{Columns: columns}
+		if empty {
+			return res, nil
+		}
+		rows, err := q.ExecuteContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			for from, to := range aliases {
+				if v, ok := row[from]; ok {
+					delete(row, from)
+					row[to] = v
+				}
+			}
+		}
+		res.Rows = rows
+		return res, nil
+	}), nil
+}
+
+// groupPlan runs a query with GROUP BY or aggregates. Every matching row is
+// streamed through one accumulator per group; groups come out in the order
+// they were first seen unless ORDER BY says otherwise.
+func (c *compiler) groupPlan(q *query.Query, s *selectStmt, max int, empty bool) (Plan, error) {
+	if len(s.items) == 0 {
+		return nil, fmt.Errorf("SELECT * cannot be grouped")
+	}
+	grouped := map[string]bool{}
+	for _, field := range s.groupBy {
+		grouped[q.ColumnName(field)] = true
+	}
+	columns := make([]string, len(s.items))
+	for i, it := range s.items {
+		if it.fn == "" && !grouped[q.ColumnName(it.field)] {
+			return nil, fmt.Errorf("column %s must appear in GROUP BY or an aggregate", it.field)
+		}
+		if it.fn != "" && it.fn != "count" && it.field == "*" {
+			return nil, fmt.Errorf("%s(*) is not supported", it.fn)
+		}
+		columns[i] = it.name()
+	}
+
+	// ORDER BY may name an output column or a selected field.
+	var order []query.SortKey
+	for _, key := range s.orderBy {
+		name := ""
+		for _, it := range s.items {
+			if it.name() == key.Field || it.fn == "" && q.ColumnName(it.field) == q.ColumnName(key.Field) {
+				name = it.name()
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("ORDER BY %s must be a selected column", key.Field)
+		}
+		order = append(order, query.SortKey{Field: name, Desc: key.Desc})
+	}
+
+	return planFunc(func(ctx context.Context) (*Result, error) {
+		res := &Result{Columns: columns}
+		if empty {
+			return res, nil
+		}
+		type group struct {
+			first core.Row
+			aggs  []*aggregate
+		}
+		groups := map[interface{}]*group{}
+		var keys []interface{}
+		for row, err := range q.Iter(ctx) {
+			if err != nil {
+				return nil, err
+			}
+			vals := make([]interface{}, len(s.groupBy))
+			for i, field := range s.groupBy {
+				v, _ := core.Lookup(row, q.ColumnName(field))
+				vals[i] = core.IndexKey(v)
+			}
+			key := core.IndexKey(vals)
+			g := groups[key]
+			if g == nil {
+				g = &group{first: row, aggs: newAggregates(s.items)}
+				groups[key] = g
+				keys = append(keys, key)
+			}
+			for i, it := range s.items {
+				if g.aggs[i] == nil {
+					continue
+				}
+				field := it.field
+				if field != "*" {
+					field = q.ColumnName(field)
+				}
+				if err := g.aggs[i].add(row, field); err != nil {
+					return nil, err
+				}
+			}
+		}
+		// Aggregates over no rows at all still give one row, as COUNT(*) = 0.
+		if len(keys) == 0 && len(s.groupBy) == 0 {
+			groups[nil] = &group{aggs: newAggregates(s.items)}
+			keys = append(keys, nil)
+		}
+
+		for _, key := range keys {
+			g := groups[key]
+			out := make(core.Row, len(s.items))
+			for i, it := range s.items {
+				if g.aggs[i] != nil {
+					out[columns[i]] = g.aggs[i].result()
+					continue
+				}
+				out[columns[i]], _ = core.Lookup(g.first, q.ColumnName(it.field))
+			}
+			res.Rows = append(res.Rows, out)
+		}
+		sort.SliceStable(res.Rows, func(i, j int) bool {
+			for _, key := range order {
+				cmp := core.Compare(res.Rows[i][key.Field], res.Rows[j][key.Field])
+				if cmp == 0 {
+					continue
+				}
+				if key.Desc {
+					return cmp > 0
+				}
+				return cmp < 0
+			}
+			return false
+		})
+		if max > 0 && len(res.Rows) > max {
+			res.Rows = res.Rows[:max]
+		}
+		return res, nil
+	}), nil
+}
+
+// aggregate accumulates one aggregate function of a select item over a
+// group.
+type aggregate struct {
+	acc *core.Accumulator
+}
+
+func newAggregates(items []selectItem) []*aggregate {
+	aggs := make([]*aggregate, len(items))
+	for i, it := range items {
+		if it.fn != "" {
+			aggs[i] = &aggregate{acc: core.NewAccumulator(it.fn)}
+		}
+	}
+	return aggs
+}
+
+func (a *aggregate) add(row core.Row, field string) error {
+	if a.acc.Func == core.AggCount && field == "*" {
+		return a.acc.Add(true)
+	}
+	v, _ := core.Lookup(row, field)
+	if err := a.acc.Add(v); err != nil {
+		return fmt.Errorf("%s(%s): %v", a.acc.Func, field, err)
+	}
+	return nil
+}
+
+func (a *aggregate) result() interface{} {
+	return a.acc.Result()
+}
+
+func (c *compiler) insertPlan(s *insertStmt) (Plan, error) {
+	table, err := c.db.Table(s.table)
+	if err != nil {
+		return nil, err
+	}
+	columns := s.columns
+	if len(columns) == 0 {
+		for _, f := range table.Snapshot().Schema.Fields {
+			columns = append(columns, f.Name)
+		}
+	}
+	records := make([]core.Row, len(s.rows))
+	for i, vals := range s.rows {
+		if len(vals) != len(columns) {
+			return nil, fmt.Errorf("row %d: expected %d values, got %d", i, len(columns), len(vals))
+		}
+		row := make(core.Row, len(columns))
+		for j, col := range columns {
+			row[col] = c.bind(vals[j])
+		}
+		records[i] = row
+	}
+
+	return planFunc(func(ctx context.Context) (*Result, error) {
+		var err error
+		if len(records) == 1 {
+			err = c.db.Insert(s.table, records[0])
+		} else {
+			err = c.db.BulkInsert(s.table, records)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Result{RowsAffected: len(records)}, nil
+	}), nil
+}
+
+// backup saves the rows an UPDATE or DELETE is about to change, as the
+// bridge's update and delete do.
+func (c *compiler) backup(name string, rows []core.Row) error {
+	return safety.BatchBackupForSafety(c.db, name, rows)
+}
+
+// matcher compiles the WHERE clause of an UPDATE or DELETE. Without one,
+// every row matches.
+func (c *compiler) matcher(tableName string, where expr) (*core.Table, query.FilterFunc, error) {
+	table, err := c.db.Table(tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if where == nil {
+		return table, func(core.Row) bool { return true }, nil
+	}
+	f, err := c.filter(query.NewQuery(c.db, tableName), where)
+	if err != nil {
+		return nil, nil, err
+	}
+	return table, f, nil
+}
+
+func (c *compiler) updatePlan(s *updateStmt) (Plan, error) {
+	table, filter, err := c.matcher(s.table, s.where)
+	if err != nil {
+		return nil, err
+	}
+	update := make(core.Row, len(s.set))
+	for _, a := range s.set {
+		update[a.field] = c.bind(a.value)
+	}
+	return planFunc(func(ctx context.Context) (*Result, error) {
+		n, err := table.UpdateWhere(filter, update, c.backup)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{RowsAffected: n}, nil
+	}), nil
+}
+
+func (c *compiler) deletePlan(s *deleteStmt) (Plan, error) {
+	table, filter, err := c.matcher(s.table, s.where)
+	if err != nil {
+		return nil, err
+	}
+	return planFunc(func(ctx context.Context) (*Result, error) {
+		n, err := table.DeleteWhere(filter, c.backup)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{RowsAffected: n}, nil
+	}), nil
+}
+
+func (c *compiler) createPlan(s *createStmt) Plan {
+	return planFunc(func(ctx context.Context) (*Result, error) {
+		if _, err := c.db.Table(s.table); err == nil {
+			if s.ifNotExists {
+				return &Result{}, nil
+			}
+			return nil, fmt.Errorf("table already exists: %s", s.table)
+		}
+		if err := c.db.DefineSchema(s.table, s.fields, s.constraints...); err != nil {
+			return nil, err
+		}
+		return &Result{}, nil
+	})
+}
+
+func (c *compiler) dropPlan(s *dropStmt) Plan {
+	return planFunc(func(ctx context.Context) (*Result, error) {
+		if _, err := c.db.Table(s.table); err != nil {
+			if s.ifExists {
+				return &Result{}, nil
+			}
+			return nil, err
+		}
+		if err := c.db.DropTable(s.table); err != nil {
+			return nil, err
+		}
+		return &Result{}, nil
+	})
+}
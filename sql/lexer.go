@@ -0,0 +1,142 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokQuoted // a "quoted" or `quoted` identifier, never a keyword
+	tokNumber
+	tokString
+	tokParam
+	tokSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex splits a statement into tokens. Keywords come out as identifiers; the
+// parser matches them without regard to case.
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '-' && strings.HasPrefix(src[i:], "--"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && isIdentPart(rune(src[i])) {
+				i++
+			}
+			toks = append(toks, token{tokIdent, src[start:i], start})
+
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			toks = append(toks, token{tokNumber, src[start:i], start})
+
+		case c == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated string at offset %d", start)
+				}
+				if src[i] == '\'' {
+					// '' is an escaped quote
+					if i+1 < len(src) && src[i+1] == '\'' {
+						b.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteByte(src[i])
+				i++
+			}
+			toks = append(toks, token{tokString, b.String(), start})
+
+		case c == '"' || c == '`':
+			start := i
+			end := strings.IndexByte(src[i+1:], src[i])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated identifier at offset %d", start)
+			}
+			toks = append(toks, token{tokQuoted, src[i+1 : i+1+end], start})
+			i += end + 2
+
+		case c == '?':
+			toks = append(toks, token{tokParam, "?", i})
+			i++
+
+		case c == '$' && i+1 < len(src) && isDigit(src[i+1]):
+			start := i
+			i++
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			toks = append(toks, token{tokParam, src[start:i], start})
+
+		default:
+			start := i
+			for _, op := range []string{"<=", ">=", "<>", "!="} {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, token{tokSymbol, op, start})
+					i += 2
+					break
+				}
+			}
+			if i > start {
+				continue
+			}
+			if !strings.ContainsRune("(),*;.[]=<>-", c) {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+			toks = append(toks, token{tokSymbol, string(c), start})
+			i++
+		}
+	}
+	return append(toks, token{tokEOF, "", len(src)}), nil
+}
+
+// Bare identifiers are ASCII; anything else can be written "quoted".
+func isIdentStart(c rune) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentPart(c rune) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,913 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+// The statements the dialect understands. Column names anywhere may be
+// paths into nested fields ("address.city", "tags[0]") and, with joins, may
+// be qualified by table ("orders.id").
+
+type selectStmt struct {
+	items   []selectItem // empty for SELECT *
+	table   string
+	joins   []query.Join
+	where   expr
+	groupBy []string
+	orderBy []query.SortKey
+	limit   *value
+}
+
+// selectItem is a column, or an aggregate when fn is set. COUNT(*) has
+// field "*".
+type selectItem struct {
+	fn    string
+	field string
+	alias string
+}
+
+// name is the column the item produces in results.
+func (it selectItem) name() string {
+	switch {
+	case it.alias != "":
+		return it.alias
+	case it.fn != "":
+		return it.fn + "(" + it.field + ")"
+	}
+	return it.field
+}
+
+type insertStmt struct {
+	table   string
+	columns []string
+	rows    [][]value
+}
+
+type assignment struct {
+	field string
+	value value
+}
+
+type updateStmt struct {
+	table string
+	set   []assignment
+	where expr
+}
+
+type deleteStmt struct {
+	table string
+	where expr
+}
+
+type createStmt struct {
+	table       string
+	ifNotExists bool
+	fields      []core.Field
+	constraints []core.Constraint
+}
+
+type dropStmt struct {
+	table    string
+	ifExists bool
+}
+
+// value is a literal or a reference to a bound parameter, counted from 1.
+type value struct {
+	lit   interface{}
+	param int
+}
+
+// expr is a WHERE clause: a logic, a not or a cond.
+type expr interface{}
+
+type logic struct {
+	and         bool
+	left, right expr
+}
+
+type not struct {
+	x expr
+}
+
+// cond compares a column using one of core.Schema.Matcher's operators.
+type cond struct {
+	field  string
+	op     string
+	values []value
+}
+
+type parser struct {
+	toks   []token
+	i      int
+	params int
+}
+
+func parse(src string) (interface{}, int, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := &parser{toks: toks}
+	var stmt interface{}
+	switch {
+	case p.acceptKeyword("SELECT"):
+		stmt, err = p.selectStmt()
+	case p.acceptKeyword("INSERT"):
+		stmt, err = p.insertStmt()
+	case p.acceptKeyword("UPDATE"):
+		stmt, err = p.updateStmt()
+	case p.acceptKeyword("DELETE"):
+		stmt, err = p.deleteStmt()
+	case p.acceptKeyword("CREATE"):
+		stmt, err = p.createStmt()
+	case p.acceptKeyword("DROP"):
+		stmt, err = p.dropStmt()
+	default:
+		err = p.errorf("expected SELECT, INSERT, UPDATE, DELETE, CREATE or DROP")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	p.acceptSymbol(";")
+	if p.peek().kind != tokEOF {
+		return nil, 0, p.errorf("unexpected input after statement")
+	}
+	return stmt, p.params, nil
+}
+
+func (p *parser) selectStmt() (*selectStmt, error) {
+	s := &selectStmt{}
+	if !p.acceptSymbol("*") {
+		for {
+			item, err := p.selectItem()
+			if err != nil {
+				return nil, err
+			}
+			s.items = append(s.items, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s.table = table
+
+	for {
+		kind := query.InnerJoin
+		switch {
+		case p.acceptKeyword("LEFT"):
+			p.acceptKeyword("OUTER")
+			kind = query.LeftJoin
+		case p.acceptKeyword("INNER"):
+		case p.peekKeyword("JOIN"):
+		default:
+			kind = ""
+		}
+		if kind == "" {
+			break
+		}
+		j, err := p.join(kind)
+		if err != nil {
+			return nil, err
+		}
+		s.joins = append(s.joins, j)
+	}
+
+	if p.acceptKeyword("WHERE") {
+		if s.where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			field, err := p.path()
+			if err != nil {
+				return nil, err
+			}
+			s.groupBy = append(s.groupBy, field)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			key, err := p.orderKey()
+			if err != nil {
+				return nil, err
+			}
+			s.orderBy = append(s.orderBy, key)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		s.limit = &v
+	}
+	return s, nil
+}
+
+var aggregates = map[string]bool{"count": true, "sum": true, "avg": true, "min": true, "max": true}
+
+func (p *parser) selectItem() (selectItem, error) {
+	var item selectItem
+	tok := p.peek()
+	if tok.kind == tokIdent && aggregates[strings.ToLower(tok.text)] && p.peekAt(1).text == "(" {
+		p.i += 2
+		item.fn = strings.ToLower(tok.text)
+		if item.fn == "count" && p.acceptSymbol("*") {
+			item.field = "*"
+		} else {
+			field, err := p.path()
+			if err != nil {
+				return item, err
+			}
+			item.field = field
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return item, err
+		}
+	} else {
+		field, err := p.path()
+		if err != nil {
+			return item, err
+		}
+		item.field = field
+	}
+	if p.acceptKeyword("AS") {
+		alias, err := p.ident()
+		if err != nil {
+			return item, err
+		}
+		item.alias = alias
+	}
+	return item, nil
+}
+
+// join parses the rest of "[LEFT] JOIN table [AS name] ON a = b". Either
+// side of ON may name the joined table.
+func (p *parser) join(kind query.JoinKind) (query.Join, error) {
+	j := query.Join{Kind: kind}
+	if err := p.expectKeyword("JOIN"); err != nil {
+		return j, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return j, err
+	}
+	j.Table = table
+	if p.acceptKeyword("AS") {
+		if j.As, err = p.ident(); err != nil {
+			return j, err
+		}
+	}
+	if err := p.expectKeyword("ON"); err != nil {
+		return j, err
+	}
+	a, err := p.path()
+	if err != nil {
+		return j, err
+	}
+	if err := p.expectSymbol("="); err != nil {
+		return j, err
+	}
+	b, err := p.path()
+	if err != nil {
+		return j, err
+	}
+	prefix := j.Name() + "."
+	switch {
+	case strings.HasPrefix(b, prefix):
+		j.Left, j.Right = a, strings.TrimPrefix(b, prefix)
+	case strings.HasPrefix(a, prefix):
+		j.Left, j.Right = b, strings.TrimPrefix(a, prefix)
+	default:
+		return j, p.errorf("ON must compare a column of %s", j.Name())
+	}
+	return j, nil
+}
+
+func (p *parser) orderKey() (query.SortKey, error) {
+	field, err := p.path()
+	if err != nil {
+		return query.SortKey{}, err
+	}
+	key := query.SortKey{Field: field}
+	if p.acceptKeyword("DESC") {
+		key.Desc = true
+	} else {
+		p.acceptKeyword("ASC")
+	}
+	return key, nil
+}
+
+func (p *parser) insertStmt() (*insertStmt, error) {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s := &insertStmt{table: table}
+	if p.acceptSymbol("(") {
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			s.columns = append(s.columns, col)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var row []value
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, v)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		s.rows = append(s.rows, row)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) updateStmt() (*updateStmt, error) {
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s := &updateStmt{table: table}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		s.set = append(s.set, assignment{field: field, value: v})
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if p.acceptKeyword("WHERE") {
+		if s.where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (p *parser) deleteStmt() (*deleteStmt, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s := &deleteStmt{table: table}
+	if p.acceptKeyword("WHERE") {
+		if s.where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// fieldTypes maps SQL type names onto field types.
+var fieldTypes = map[string]core.FieldType{
+	"int": core.FieldTypeInt, "integer": core.FieldTypeInt, "bigint": core.FieldTypeInt,
+	"string": core.FieldTypeString, "text": core.FieldTypeString, "varchar": core.FieldTypeString,
+	"float": core.FieldTypeFloat, "real": core.FieldTypeFloat, "double": core.FieldTypeFloat,
+	"bool": core.FieldTypeBool, "boolean": core.FieldTypeBool,
+	"object": core.FieldTypeObject, "json": core.FieldTypeObject, "map": core.FieldTypeObject, "array": core.FieldTypeArray,
+	"timestamp": core.FieldTypeTimestamp, "datetime": core.FieldTypeTimestamp,
+	"bytes": core.FieldTypeBytes, "blob": core.FieldTypeBytes,
+	"decimal": core.FieldTypeDecimal, "numeric": core.FieldTypeDecimal,
+}
+
+func (p *parser) createStmt() (*createStmt, error) {
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	s := &createStmt{}
+	if p.acceptKeyword("IF") {
+		if err := p.expectKeyword("NOT"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		s.ifNotExists = true
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s.table = table
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		if p.acceptKeyword("UNIQUE") {
+			cols, err := p.columnList()
+			if err != nil {
+				return nil, err
+			}
+			s.constraints = append(s.constraints, core.Constraint{Kind: core.ConstraintUnique, Fields: cols})
+		} else if err := p.columnDef(s); err != nil {
+			return nil, err
+		}
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// columnDef parses "name type [(n)] [UNIQUE | PRIMARY KEY | NOT EMPTY |
+// FULLTEXT | REFERENCES table (column) [ON DELETE action]]...". VARCHAR(n)
+// limits the length of the string.
+func (p *parser) columnDef(s *createStmt) error {
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	tok := p.next()
+	typ, ok := fieldTypes[strings.ToLower(tok.text)]
+	if tok.kind != tokIdent || !ok {
+		p.i--
+		return p.errorf("unknown column type")
+	}
+	f := core.Field{Name: name, Type: typ}
+	if p.acceptSymbol("(") {
+		n, err := p.number()
+		if err != nil {
+			return err
+		}
+		if typ == core.FieldTypeString {
+			max := int(n)
+			f.MaxLength = &max
+		}
+		// Precision and scale of DECIMAL(p, s) are accepted and ignored:
+		// decimals are exact at any length.
+		if p.acceptSymbol(",") {
+			if _, err := p.number(); err != nil {
+				return err
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return err
+		}
+	}
+
+	for {
+		switch {
+		case p.acceptKeyword("UNIQUE"):
+			f.Unique = true
+		case p.acceptKeyword("PRIMARY"):
+			if err := p.expectKeyword("KEY"); err != nil {
+				return err
+			}
+			f.Unique = true
+		case p.acceptKeyword("NOT"):
+			if err := p.expectKeyword("EMPTY"); err != nil {
+				return err
+			}
+			f.NotEmpty = true
+		case p.acceptKeyword("FULLTEXT"):
+			f.FullText = true
+		case p.acceptKeyword("REFERENCES"):
+			c := core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{name}}
+			if c.RefTable, err = p.ident(); err != nil {
+				return err
+			}
+			if c.RefFields, err = p.columnList(); err != nil {
+				return err
+			}
+			if p.acceptKeyword("ON") {
+				if err := p.expectKeyword("DELETE"); err != nil {
+					return err
+				}
+				switch {
+				case p.acceptKeyword("CASCADE"):
+					c.OnDelete = core.ActionCascade
+				case p.acceptKeyword("RESTRICT"):
+					c.OnDelete = core.ActionRestrict
+				case p.acceptKeyword("SET"):
+					if err := p.expectKeyword("NULL"); err != nil {
+						return err
+					}
+					c.OnDelete = core.ActionSetNull
+				default:
+					return p.errorf("expected CASCADE, RESTRICT or SET NULL")
+				}
+			}
+			s.constraints = append(s.constraints, c)
+		default:
+			s.fields = append(s.fields, f)
+			return nil
+		}
+	}
+}
+
+func (p *parser) columnList() ([]string, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var cols []string
+	for {
+		col, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return cols, p.expectSymbol(")")
+}
+
+func (p *parser) dropStmt() (*dropStmt, error) {
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	s := &dropStmt{}
+	if p.acceptKeyword("IF") {
+		if err := p.expectKeyword("EXISTS"); err != nil {
+			return nil, err
+		}
+		s.ifExists = true
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s.table = table
+	return s, nil
+}
+
+// or, and and unary parse a WHERE clause, binding NOT tighter than AND and
+// AND tighter than OR.
+func (p *parser) or() (expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logic{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = logic{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (expr, error) {
+	if p.acceptKeyword("NOT") {
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{x}, nil
+	}
+	if p.acceptSymbol("(") {
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expectSymbol(")")
+	}
+	return p.cond()
+}
+
+var comparisons = map[string]string{
+	"=": "$eq", "!=": "$ne", "<>": "$ne", "<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte",
+}
+
+func (p *parser) cond() (expr, error) {
+	field, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if op, ok := comparisons[tok.text]; ok && tok.kind == tokSymbol {
+		p.i++
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return cond{field: field, op: op, values: []value{v}}, nil
+	}
+
+	negate := p.acceptKeyword("NOT")
+	var c expr
+	switch {
+	case p.acceptKeyword("IN"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		in := cond{field: field, op: "$in"}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			in.values = append(in.values, v)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		c = in
+	case p.acceptKeyword("LIKE"):
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		c = cond{field: field, op: "$like", values: []value{v}}
+	case p.acceptKeyword("CONTAINS"):
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		c = cond{field: field, op: "$contains", values: []value{v}}
+	case p.acceptKeyword("BETWEEN"):
+		lo, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		hi, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		c = logic{and: true,
+			left:  cond{field: field, op: "$gte", values: []value{lo}},
+			right: cond{field: field, op: "$lte", values: []value{hi}},
+		}
+	case !negate && p.acceptKeyword("IS"):
+		op := "$eq"
+		if p.acceptKeyword("NOT") {
+			op = "$ne"
+		}
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return cond{field: field, op: op, values: []value{{}}}, nil
+	default:
+		return nil, p.errorf("expected a comparison")
+	}
+	if negate {
+		return not{c}, nil
+	}
+	return c, nil
+}
+
+// value parses a literal or a parameter: ? takes the next parameter and $n
+// names one explicitly.
+func (p *parser) value() (value, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokParam:
+		if tok.text == "?" {
+			p.params++
+			return value{param: p.params}, nil
+		}
+		n, _ := strconv.Atoi(tok.text[1:])
+		if n < 1 {
+			return value{}, p.errorAt(tok, "parameters are numbered from $1")
+		}
+		if n > p.params {
+			p.params = n
+		}
+		return value{param: n}, nil
+	case tokString:
+		return value{lit: tok.text}, nil
+	case tokNumber:
+		n, err := parseNumber(tok.text)
+		if err != nil {
+			return value{}, p.errorAt(tok, "invalid number")
+		}
+		return value{lit: n}, nil
+	case tokSymbol:
+		if tok.text == "-" && p.peek().kind == tokNumber {
+			n, err := parseNumber("-" + p.next().text)
+			if err != nil {
+				return value{}, p.errorAt(tok, "invalid number")
+			}
+			return value{lit: n}, nil
+		}
+	case tokIdent:
+		switch strings.ToUpper(tok.text) {
+		case "NULL":
+			return value{}, nil
+		case "TRUE":
+			return value{lit: true}, nil
+		case "FALSE":
+			return value{lit: false}, nil
+		}
+	}
+	return value{}, p.errorAt(tok, "expected a value")
+}
+
+// parseNumber keeps whole numbers as int64 so they compare and store like
+// inserted Go ints.
+func parseNumber(s string) (interface{}, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func (p *parser) number() (int64, error) {
+	tok := p.next()
+	n, err := strconv.ParseInt(tok.text, 10, 64)
+	if tok.kind != tokNumber || err != nil {
+		return 0, p.errorAt(tok, "expected a whole number")
+	}
+	return n, nil
+}
+
+// ident returns a table or column name.
+func (p *parser) ident() (string, error) {
+	tok := p.next()
+	if tok.kind != tokIdent && tok.kind != tokQuoted {
+		return "", p.errorAt(tok, "expected a name")
+	}
+	return tok.text, nil
+}
+
+// path returns a column, possibly qualified or nested: a.b[0].c.
+func (p *parser) path() (string, error) {
+	name, err := p.ident()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	for {
+		switch {
+		case p.acceptSymbol("."):
+			part, err := p.ident()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString("." + part)
+		case p.acceptSymbol("["):
+			n, err := p.number()
+			if err != nil {
+				return "", err
+			}
+			if err := p.expectSymbol("]"); err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "[%d]", n)
+		default:
+			return b.String(), nil
+		}
+	}
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) peekAt(n int) token {
+	if p.i+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.i+n]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *parser) peekKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.kind == tokIdent && strings.EqualFold(tok.text, kw)
+}
+
+func (p *parser) acceptKeyword(kw string) bool {
+	if p.peekKeyword(kw) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.acceptKeyword(kw) {
+		return p.errorf("expected %s", kw)
+	}
+	return nil
+}
+
+func (p *parser) acceptSymbol(s string) bool {
+	tok := p.peek()
+	if tok.kind == tokSymbol && tok.text == s {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(s string) error {
+	if !p.acceptSymbol(s) {
+		return p.errorf("expected %q", s)
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.peek(), fmt.Sprintf(format, args...))
+}
+
+func (p *parser) errorAt(tok token, msg string) error {
+	if tok.kind == tokEOF {
+		return fmt.Errorf("syntax error at end of statement: %s", msg)
+	}
+	return fmt.Errorf("syntax error at offset %d near %q: %s", tok.pos, tok.text, msg)
+}
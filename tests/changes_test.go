@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestChangeFeed(t *testing.T) {
+	dbPath := "test_changes.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "status", Type: core.FieldTypeString},
+	})
+	db.DefineSchema("logs", []core.Field{{Name: "msg", Type: core.FieldTypeString}})
+
+	all, err := db.Subscribe("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	orders, _ := db.Subscribe("", func(c core.Change) bool { return c.Table == "orders" })
+	defer orders.Close()
+
+	next := func(sub *core.Subscription) core.Change {
+		t.Helper()
+		select {
+		case c, ok := <-sub.C:
+			if !ok {
+				t.Fatalf("subscription ended: %v", sub.Err())
+			}
+			return c
+		case <-time.After(time.Second):
+			t.Fatal("no change arrived")
+		}
+		return core.Change{}
+	}
+
+	db.Insert("orders", core.Row{"id": 1, "status": "new"})
+	db.Insert("logs", core.Row{"msg": "hello"})
+	db.BulkInsert("orders", []core.Row{{"id": 2, "status": "new"}, {"id": 3, "status": "new"}})
+	safety.Update(db, "orders", func(r core.Row) bool { return core.Equal(r["id"], 1) }, core.Row{"status": "paid"})
+	db.Upsert("orders", core.Row{"id": 2, "status": "paid"}, []string{"id"}, core.UpsertMerge)
+	safety.Delete(db, "orders", func(r core.Row) bool { return core.Equal(r["id"], 3) })
+
+	want := []struct {
+		kind  core.ChangeKind
+		table string
+		id    int
+	}{
+		{core.ChangeInsert, "orders", 1},
+		{core.ChangeInsert, "logs", 0},
+		{core.ChangeInsert, "orders", 2},
+		{core.ChangeInsert, "orders", 3},
+		{core.ChangeUpdate, "orders", 1},
+		{core.ChangeUpdate, "orders", 2},
+		{core.ChangeDelete, "orders", 3},
+	}
+	var seen []core.Change
+	for _, w := range want {
+		c := next(all)
+		seen = append(seen, c)
+		if c.Kind != w.kind || c.Table != w.table || w.id != 0 && !core.Equal(c.After["id"], w.id) && !core.Equal(c.Before["id"], w.id) {
+			t.Fatalf("expected %s of %s %d, got %+v", w.kind, w.table, w.id, c)
+		}
+		if c.RowID == 0 {
+			t.Errorf("expected a row id, got %+v", c)
+		}
+	}
+	if up := seen[4]; up.Before["status"] != "new" || up.After["status"] != "paid" {
+		t.Errorf("expected the update's before and after, got %+v", up)
+	}
+	if del := seen[6]; del.Before == nil || del.After != nil {
+		t.Errorf("expected a delete with only before, got %+v", del)
+	}
+
+	// The filter leaves out the log.
+	for i := 0; i < 6; i++ {
+		if c := next(orders); c.Table != "orders" {
+			t.Errorf("expected only orders, got %+v", c)
+		}
+	}
+
+	// Resuming after the second change delivers the rest again.
+	resumed, err := db.Subscribe(seen[1].Position, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range seen[2:] {
+		if got := next(resumed); got.Position != c.Position {
+			t.Errorf("expected %s on resuming, got %s", c.Position, got.Position)
+		}
+	}
+	resumed.Close()
+	for range resumed.C {
+	}
+	if resumed.Err() != nil {
+		t.Errorf("expected no error after closing, got %v", resumed.Err())
+	}
+
+	if _, err := db.Subscribe("garbage", nil); err == nil {
+		t.Error("expected a bad position to be rejected")
+	}
+
+	// A position the log no longer holds cannot be resumed from.
+	db.Config.ChangeLogSize = 5
+	for i := 0; i < 10; i++ {
+		db.Insert("logs", core.Row{"msg": "spam"})
+	}
+	if _, err := db.Subscribe(seen[1].Position, nil); err == nil {
+		t.Error("expected an expired position to be rejected")
+	}
+	head := db.ChangePosition()
+	tail, _ := db.Subscribe(head, nil)
+	db.Insert("logs", core.Row{"msg": "last"})
+	if c := next(tail); c.After["msg"] != "last" {
+		t.Errorf("expected only the change after the head, got %+v", c)
+	}
+	tail.Close()
+}
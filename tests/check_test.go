@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestCheckRules(t *testing.T) {
+	dbPath := "test_check.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	minAge, maxAge := 13.0, 120.0
+	minLen, maxLen := 3, 10
+	fields := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "age", Type: core.FieldTypeInt, Min: &minAge, Max: &maxAge},
+		{Name: "handle", Type: core.FieldTypeString, MinLength: &minLen, MaxLength: &maxLen, Pattern: "^[a-z_]+$"},
+		{Name: "plan", Type: core.FieldTypeString, Enum: []interface{}{"free", "pro"}, NotEmpty: true},
+	}
+	if err := db.DefineSchema("accounts", fields); err != nil {
+		t.Fatalf("define failed: %v", err)
+	}
+
+	if err := db.Insert("accounts", core.Row{"id": 1, "age": 30, "handle": "alice", "plan": "pro"}); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+
+	cases := []struct {
+		row  core.Row
+		rule string
+	}{
+		{core.Row{"id": 2, "age": 5, "handle": "bob", "plan": "free"}, "age: min"},
+		{core.Row{"id": 2, "age": 30, "handle": "bo", "plan": "free"}, "handle: min_length"},
+		{core.Row{"id": 2, "age": 30, "handle": "Bob", "plan": "free"}, "handle: pattern"},
+		{core.Row{"id": 2, "age": 30, "handle": "bob", "plan": "gold"}, "plan: enum"},
+		{core.Row{"id": 2, "age": 30, "handle": "bob", "plan": nil}, "plan: not_empty"},
+	}
+	for _, c := range cases {
+		err := db.Insert("accounts", c.row)
+		if err == nil || !strings.Contains(err.Error(), c.rule) {
+			t.Errorf("expected %q violation, got %v", c.rule, err)
+		}
+	}
+
+	err = safety.Update(db, "accounts", func(r core.Row) bool { return true }, core.Row{"age": float64(200)})
+	if err == nil || !strings.Contains(err.Error(), "age: max") {
+		t.Errorf("expected max violation on update, got %v", err)
+	}
+
+	// Tightening a rule reports the rows that no longer comply
+	db.Insert("accounts", core.Row{"id": 3, "age": 15, "handle": "carol", "plan": "free"})
+	stricter := 18.0
+	tightened := append([]core.Field(nil), fields...)
+	tightened[1].Min = &stricter
+	report := db.DiffSchema("accounts", tightened)
+	found := false
+	for _, c := range report.Conflicts {
+		if strings.HasPrefix(c, "CHECK_VIOLATION: 1 rows") {
+			found = true
+		}
+	}
+	if !found || report.Compatiable {
+		t.Errorf("expected one row to violate the tightened rule: %v", report.Conflicts)
+	}
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestComputedFields(t *testing.T) {
+	dbPath := "test_computed.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	bad := [][]core.Field{
+		{{Name: "a", Type: core.FieldTypeInt, Expr: "b * 2"}},
+		{{Name: "a", Type: core.FieldTypeInt}, {Name: "b", Type: core.FieldTypeInt, Expr: "a + "}},
+		{{Name: "a", Type: core.FieldTypeInt}, {Name: "b", Type: core.FieldTypeInt, Expr: "a"}, {Name: "c", Type: core.FieldTypeInt, Expr: "b"}},
+		{{Name: "a", Type: core.FieldTypeInt, Stored: true}},
+		{{Name: "a", Type: core.FieldTypeString, Expr: "shout(a)"}},
+	}
+	for _, fields := range bad {
+		if err := db.DefineSchema("bad", fields); err == nil {
+			t.Errorf("expected %+v to be rejected", fields)
+		}
+	}
+
+	fields := []core.Field{
+		{Name: "sku", Type: core.FieldTypeString},
+		{Name: "price", Type: core.FieldTypeDecimal},
+		{Name: "qty", Type: core.FieldTypeInt},
+		{Name: "first", Type: core.FieldTypeString},
+		{Name: "last", Type: core.FieldTypeString},
+		{Name: "total", Type: core.FieldTypeDecimal, Expr: "price * qty", Stored: true},
+		{Name: "sku_key", Type: core.FieldTypeString, Expr: "lower(trim(sku))", Unique: true},
+		{Name: "buyer", Type: core.FieldTypeString, Expr: "first || ' ' || coalesce(last, '?')"},
+	}
+	if err := db.DefineSchema("lines", fields); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.BulkInsert("lines", []core.Row{
+		{"sku": " AB-1", "price": "2.50", "qty": 4, "first": "Ada", "last": "Lovelace"},
+		{"sku": "cd-2", "price": "0.10", "qty": 3, "first": "Alan", "last": nil, "total": "999"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := query.NewQuery(db, "lines").OrderBy("total", true).Execute()
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	if !core.Equal(rows[0]["total"], core.Decimal("10")) || rows[0]["sku_key"] != "ab-1" || rows[0]["buyer"] != "Ada Lovelace" {
+		t.Errorf("expected the first row computed, got %v", rows[0])
+	}
+	if !core.Equal(rows[1]["total"], core.Decimal("0.3")) || rows[1]["buyer"] != "Alan ?" {
+		t.Errorf("expected the written total to be replaced, got %v", rows[1])
+	}
+
+	// Computed fields take part in matches and unique indexes.
+	if n, _ := db.Count("lines", map[string]interface{}{"total": map[string]interface{}{"$gt": "1"}}); n != 1 {
+		t.Errorf("expected 1 line over 1, got %d", n)
+	}
+	if err := db.Insert("lines", core.Row{"sku": "ab-1 ", "price": "1", "qty": 1, "first": "Grace", "last": "Hopper"}); err == nil {
+		t.Error("expected a sku differing only in case to collide")
+	}
+	res, err := db.Upsert("lines", core.Row{"sku": "AB-1", "price": "3", "qty": 1, "first": "Ada", "last": "King"}, []string{"sku_key"}, core.UpsertMerge)
+	if err != nil || res.Updated != 1 {
+		t.Fatalf("expected the upsert to find the row by its computed key, got %+v, %v", res, err)
+	}
+
+	// Updates recompute the fields that read what they change.
+	if err := safety.Update(db, "lines", func(r core.Row) bool { return r["sku_key"] == "cd-2" }, core.Row{"qty": 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := safety.Update(db, "lines", func(r core.Row) bool { return r["sku_key"] == "cd-2" }, core.Row{"sku": "AB-1"}); err == nil {
+		t.Error("expected an update colliding on a computed key to fail")
+	}
+	db.Flush("lines")
+	db.Close()
+
+	// Virtual fields are computed again as the table loads.
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	rows, _ = query.NewQuery(db, "lines").OrderBy("sku_key", false).Execute()
+	if len(rows) != 2 || !core.Equal(rows[0]["total"], core.Decimal("3")) || rows[0]["buyer"] != "Ada King" {
+		t.Fatalf("expected the upserted row after reopening, got %v", rows)
+	}
+	if !core.Equal(rows[1]["total"], core.Decimal("1")) {
+		t.Errorf("expected the updated total after reopening, got %v", rows[1]["total"])
+	}
+	if n, _ := db.Count("lines", map[string]interface{}{"sku_key": "cd-2"}); n != 1 {
+		t.Errorf("expected the computed key to be indexed after reopening, got %d", n)
+	}
+
+	// A diff reports computed fields whose expression or inputs change.
+	changed := append([]core.Field(nil), fields...)
+	changed[7].Expr = "upper(first)"
+	report := db.DiffSchema("lines", changed)
+	if !report.Compatiable || !strings.Contains(strings.Join(report.Conflicts, "\n"), "COMPUTE_CHANGE: field 'buyer'") {
+		t.Errorf("expected the buyer to be recomputed, got %v", report.Conflicts)
+	}
+	changed[7].Expr = "first * 2"
+	report = db.DiffSchema("lines", changed)
+	if report.Compatiable || !strings.Contains(strings.Join(report.Conflicts, "\n"), "COMPUTE_FAILURE: 2 rows fail to compute field 'buyer'") {
+		t.Errorf("expected every row to fail, got %v", report.Conflicts)
+	}
+	changed[7].Expr = "upper(first)"
+	if err := db.SyncSchema("lines", changed, false); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.Count("lines", map[string]interface{}{"buyer": "ADA"}); n != 1 {
+		t.Errorf("expected the rows to be recomputed by the sync, got %d", n)
+	}
+}
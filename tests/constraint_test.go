@@ -0,0 +1,294 @@
+package tests
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestCompositeUnique(t *testing.T) {
+	dbPath := "test_composite.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	fields := []core.Field{
+		{Name: "tenant_id", Type: core.FieldTypeInt},
+		{Name: "email", Type: core.FieldTypeString},
+		{Name: "name", Type: core.FieldTypeString},
+	}
+	tenantEmail := core.Constraint{Name: "tenant_email", Kind: core.ConstraintUnique, Fields: []string{"tenant_id", "email"}}
+	if err := db.DefineSchema("members", fields, tenantEmail); err != nil {
+		t.Fatalf("define failed: %v", err)
+	}
+
+	if err := db.Insert("members", core.Row{"tenant_id": 1, "email": "a@x", "name": "a"}); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if err := db.Insert("members", core.Row{"tenant_id": 2, "email": "a@x", "name": "a"}); err != nil {
+		t.Fatalf("same email in another tenant should be allowed: %v", err)
+	}
+	if err := db.Insert("members", core.Row{"tenant_id": float64(1), "email": "a@x", "name": "b"}); err == nil {
+		t.Error("expected composite unique violation")
+	}
+	err = db.BulkInsert("members", []core.Row{
+		{"tenant_id": 3, "email": "c@x", "name": "c"},
+		{"tenant_id": 3, "email": "c@x", "name": "d"},
+	})
+	if err == nil {
+		t.Error("expected duplicate in batch")
+	}
+
+	res, err := db.Upsert("members", core.Row{"email": "a@x", "tenant_id": 1, "name": "renamed"}, []string{"email", "tenant_id"}, core.UpsertMerge)
+	if err != nil || res.Updated != 1 {
+		t.Fatalf("upsert on composite target failed: %+v %v", res, err)
+	}
+
+	// Drop the constraint, add a collision, then try to reintroduce it
+	if err := db.SyncSchema("members", fields, false); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	db.Insert("members", core.Row{"tenant_id": 1, "email": "a@x", "name": "dup"})
+
+	report := db.DiffSchema("members", fields, tenantEmail)
+	if report.Compatiable || !report.Destructive {
+		t.Errorf("expected incompatible destructive report, got %+v", report)
+	}
+	if err := db.SyncSchema("members", fields, false, tenantEmail); err == nil {
+		t.Error("expected sync without force to refuse")
+	}
+	if err := db.SyncSchema("members", fields, true, tenantEmail); err != nil {
+		t.Fatalf("forced sync failed: %v", err)
+	}
+	count, _ := db.Count("members", nil)
+	if count != 2 {
+		t.Errorf("expected duplicate to be pruned, got %d rows", count)
+	}
+	if len(db.Schemas["members"].Constraints) != 1 {
+		t.Error("constraint not stored in schema")
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	dbPath := "test_foreign_keys.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("products", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "name", Type: core.FieldTypeString},
+	})
+	orderFields := []core.Field{
+		{Name: "order_id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "product_id", Type: core.FieldTypeInt},
+	}
+	orderProduct := core.Constraint{
+		Name: "order_product", Kind: core.ConstraintForeignKey,
+		Fields: []string{"product_id"}, RefTable: "products", RefFields: []string{"id"},
+	}
+	if err := db.DefineSchema("orders", orderFields, orderProduct); err != nil {
+		t.Fatalf("define failed: %v", err)
+	}
+
+	// A one-to-one key sits on a unique field of the same name.
+	if err := db.DefineSchema("details", []core.Field{
+		{Name: "product_id", Type: core.FieldTypeInt, Unique: true},
+	}, core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{"product_id"}, RefTable: "products", RefFields: []string{"id"}}); err != nil {
+		t.Errorf("expected a foreign key on a unique field: %v", err)
+	}
+
+	bad := core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{"product_id"}, RefTable: "products", RefFields: []string{"name"}}
+	if err := db.DefineSchema("bad", orderFields, bad); err == nil {
+		t.Error("expected error for non-unique referenced field")
+	}
+
+	db.Insert("products", core.Row{"id": 1, "name": "pen"})
+	db.Insert("products", core.Row{"id": 2, "name": "ink"})
+	if err := db.Insert("orders", core.Row{"order_id": 10, "product_id": 1}); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	if err := db.Insert("orders", core.Row{"order_id": 11, "product_id": 99}); err == nil {
+		t.Error("expected foreign key violation on insert")
+	}
+	if err := safety.Update(db, "orders", func(r core.Row) bool { return r["order_id"] == 10 }, core.Row{"product_id": 99}); err == nil {
+		t.Error("expected foreign key violation on update")
+	}
+
+	// Restrict
+	byID := func(id int) safety.FilterFunc { return func(r core.Row) bool { return r["id"] == id } }
+	if err := safety.Delete(db, "products", byID(1)); err == nil {
+		t.Error("expected restrict to block delete")
+	}
+	if err := db.DropTable("products"); err == nil {
+		t.Error("expected drop of referenced table to fail")
+	}
+
+	// Cascade
+	orderProduct.OnDelete = core.ActionCascade
+	if err := db.SyncSchema("orders", orderFields, false, orderProduct); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if err := safety.Delete(db, "products", byID(1)); err != nil {
+		t.Fatalf("cascade delete failed: %v", err)
+	}
+	if n, _ := db.Count("orders", nil); n != 0 {
+		t.Errorf("expected cascaded order to be gone, got %d", n)
+	}
+
+	// Set null
+	orderProduct.OnDelete = core.ActionSetNull
+	uniqueProduct := []core.Field{orderFields[0], {Name: "product_id", Type: core.FieldTypeInt, Unique: true}}
+	if err := db.DefineSchema("bad", uniqueProduct, orderProduct); err == nil {
+		t.Error("expected set_null on a unique field to be rejected")
+	}
+	db.SyncSchema("orders", orderFields, false, orderProduct)
+	db.Insert("orders", core.Row{"order_id": 12, "product_id": 2})
+	if err := safety.Delete(db, "products", byID(2)); err != nil {
+		t.Fatalf("set null delete failed: %v", err)
+	}
+	if n, _ := db.Count("orders", map[string]interface{}{"product_id": nil}); n != 1 {
+		t.Errorf("expected product_id to be nulled, got %d rows", n)
+	}
+
+	// Adding a key over orphaned data is reported and pruned on force
+	db.SyncSchema("orders", orderFields, false)
+	db.Insert("orders", core.Row{"order_id": 13, "product_id": 42})
+	report := db.DiffSchema("orders", orderFields, orderProduct)
+	if report.Compatiable {
+		t.Errorf("expected orphans to make the change incompatible: %v", report.Conflicts)
+	}
+	if err := db.SyncSchema("orders", orderFields, true, orderProduct); err != nil {
+		t.Fatalf("forced sync failed: %v", err)
+	}
+	if n, _ := db.Count("orders", nil); n != 1 {
+		t.Errorf("expected orphan to be pruned, got %d rows", n)
+	}
+}
+
+func TestForeignKeyCycles(t *testing.T) {
+	dbPath := "test_fk_cycles.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	fields := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "ref", Type: core.FieldTypeInt},
+	}
+	ref := func(table string) core.Constraint {
+		return core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{"ref"}, RefTable: table, RefFields: []string{"id"}}
+	}
+
+	// A table may reference itself.
+	if err := db.DefineSchema("c", fields, ref("c")); err != nil {
+		t.Fatalf("expected a self reference to be allowed: %v", err)
+	}
+	if err := db.DefineSchema("b", fields, ref("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DefineSchema("a", fields, ref("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DefineSchema("c", fields, ref("c"), ref("a")); err == nil {
+		t.Error("expected a -> b -> c -> a to be rejected")
+	}
+	if err := db.SyncSchema("b", fields, false, ref("a")); err == nil {
+		t.Error("expected a -> b -> a to be rejected")
+	}
+	if err := db.Insert("c", core.Row{"id": 1, "ref": nil}); err != nil {
+		t.Fatalf("expected c to keep its definition: %v", err)
+	}
+}
+
+func TestForeignKeyLockOrder(t *testing.T) {
+	dbPath := "test_fk_lock_order.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	// Names sort children before parents: addresses < orders < users.
+	ref := func(field, table string) core.Constraint {
+		return core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{field}, RefTable: table, RefFields: []string{"id"}, OnDelete: core.ActionCascade}
+	}
+	db.DefineSchema("users", []core.Field{{Name: "id", Type: core.FieldTypeInt, Unique: true}})
+	db.DefineSchema("addresses", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "user", Type: core.FieldTypeInt},
+	}, ref("user", "users"))
+	db.DefineSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "user", Type: core.FieldTypeInt},
+		{Name: "address", Type: core.FieldTypeInt},
+	}, ref("user", "users"), ref("address", "addresses"))
+	db.Insert("users", core.Row{"id": 0})
+	db.Insert("addresses", core.Row{"id": 0, "user": 0})
+	// Inserts yield while they hold their parents, so that deletes get
+	// between them.
+	db.AddTrigger(core.Trigger{Name: "yield", Table: "orders", Before: func(*core.HookEvent) error {
+		runtime.Gosched()
+		return nil
+	}})
+
+	const n, writers = 200, 4
+	var wg sync.WaitGroup
+	wg.Add(writers + 1)
+	for w := 0; w < writers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= n; i++ {
+				db.Insert("orders", core.Row{"id": w*n + i, "user": 0, "address": 0})
+			}
+		}()
+	}
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= n; i++ {
+			db.Insert("users", core.Row{"id": i})
+			db.Insert("addresses", core.Row{"id": i, "user": i})
+			safety.Delete(db, "users", func(r core.Row) bool { return core.Equal(r["id"], i) })
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		// Closing would wait for the locks too.
+		t.Fatal("concurrent order inserts and cascading user deletes deadlocked")
+	}
+	defer db.Close()
+
+	if got, _ := db.Count("orders", nil); got != writers*n {
+		t.Errorf("expected %d orders, got %d", writers*n, got)
+	}
+	if got, _ := db.Count("addresses", nil); got != 1 {
+		t.Errorf("expected the cascaded addresses to be gone, got %d", got)
+	}
+}
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestDryRun(t *testing.T) {
+	dbPath := "test_dryrun.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("users", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "email", Type: core.FieldTypeString},
+		{Name: "age", Type: core.FieldTypeString},
+	})
+	db.DefineSchema("orders", []core.Field{
+		{Name: "user", Type: core.FieldTypeInt},
+	}, core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{"user"}, RefTable: "users", RefFields: []string{"id"}})
+
+	db.Insert("users", core.Row{"id": 1, "email": "a@x", "age": "20"})
+	db.Insert("users", core.Row{"id": 2, "email": "a@x", "age": "old"})
+	db.Insert("users", core.Row{"id": 3, "email": "c@x", "age": "30"})
+	db.Insert("orders", core.Row{"user": 2})
+
+	fields := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "email", Type: core.FieldTypeString, Unique: true},
+		{Name: "age", Type: core.FieldTypeInt},
+	}
+	steps := []core.MigrationStep{{Kind: core.MigrateCast, Field: "age", Type: core.FieldTypeInt, OnFailure: core.CastNull}}
+
+	report, err := db.DryRun("users", steps, fields)
+	if err != nil {
+		t.Fatalf("dry run failed: %v", err)
+	}
+	if !report.Destructive {
+		t.Error("expected dry run to be destructive")
+	}
+
+	details := make(map[core.ConflictKind]core.Conflict)
+	for _, c := range report.Details {
+		details[c.Kind] = c
+	}
+	if c := details[core.ConflictUniqueViolation]; c.Dropped != 1 || c.Field != "email" || len(c.Sample) != 1 || !core.Equal(c.Sample[0]["id"], 2) {
+		t.Errorf("unexpected unique violation: %+v", c)
+	}
+	if c := details[core.ConflictCastFailure]; c.Altered != 1 || c.Field != "age" {
+		t.Errorf("unexpected cast failure: %+v", c)
+	}
+	if c := details[core.ConflictFieldCast]; c.Altered != 2 {
+		t.Errorf("unexpected cast count: %+v", c)
+	}
+	if c := details[core.ConflictForeignKeyOrphan]; c.Table != "orders" || c.Altered != 1 || len(c.Sample) != 1 || !core.Equal(c.Sample[0]["user"], 2) {
+		t.Errorf("expected dangling order to be reported: %+v", c)
+	}
+
+	// Nothing was changed
+	if count, _ := db.Count("users", nil); count != 3 {
+		t.Errorf("dry run changed the data: %d rows", count)
+	}
+	if db.Schemas["users"].Version != 1 {
+		t.Error("dry run changed the schema")
+	}
+	if db.Tables["users"].HotHeap.Rows[0]["age"] != "20" {
+		t.Error("dry run changed a row")
+	}
+
+	// Ids are kept through a real migration
+	if err := db.SyncSchema("users", fields[:2], true); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	for _, row := range db.Tables["users"].HotHeap.Rows {
+		if _, ok := core.RowID(row); !ok {
+			t.Errorf("row lost its id: %v", row)
+		}
+	}
+}
+
+func TestRowIDsStayApart(t *testing.T) {
+	dbPath := "test_rowids.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	// A field may be called _id; the database keeps its own ids elsewhere.
+	if err := db.DefineSchema("docs", []core.Field{
+		{Name: "_id", Type: core.FieldTypeString, Unique: true},
+		{Name: "n", Type: core.FieldTypeInt},
+	}); err != nil {
+		t.Fatalf("expected _id to be a valid field name: %v", err)
+	}
+	if err := db.DefineSchema("bad", []core.Field{{Name: core.RowIDField, Type: core.FieldTypeInt}}); err == nil {
+		t.Error("expected the row id key to be refused as a field name")
+	}
+	doc := core.Row{"_id": "a", "n": 1}
+	if err := db.Insert("docs", doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc) != 2 {
+		t.Errorf("expected the caller's row to be left alone, got %v", doc)
+	}
+	db.Upsert("docs", core.Row{"_id": "b", "n": 2}, []string{"_id"}, core.UpsertMerge)
+	if err := safety.Update(db, "docs", func(r core.Row) bool { return r["_id"] == "b" }, core.Row{"_id": "c"}); err != nil {
+		t.Fatalf("expected _id to be updatable like any field: %v", err)
+	}
+	db.Flush("docs")
+	db.Close()
+
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	rows, err := query.NewQuery(db, "docs").OrderBy("_id", false).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["_id"] != "a" || rows[1]["_id"] != "c" {
+		t.Fatalf("expected the stored _id values, got %v", rows)
+	}
+	for _, r := range rows {
+		if _, ok := r[core.RowIDField]; ok || len(r) != 2 {
+			t.Errorf("expected only the fields of the row, got %v", r)
+		}
+	}
+	ids := make(map[int64]bool)
+	for _, clump := range db.Tables["docs"].SealedClumps {
+		for _, row := range clump.Rows {
+			id, ok := core.RowID(row)
+			if !ok || ids[id] {
+				t.Errorf("expected a distinct row id, got %v", row)
+			}
+			ids[id] = true
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected 2 row ids, got %v", ids)
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+func TestExplain(t *testing.T) {
+	dbPath := "test_explain.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("users", []core.Field{
+		{Name: "email", Type: core.FieldTypeString, Unique: true},
+		{Name: "age", Type: core.FieldTypeInt},
+	})
+	for i := 0; i < 30; i++ {
+		db.Insert("users", core.Row{"email": fmt.Sprintf("u%d@x", i), "age": i})
+		if i%10 == 9 {
+			db.Flush("users")
+		}
+	}
+
+	q := query.NewQuery(db, "users")
+	if err := q.Where(map[string]interface{}{"email": map[string]interface{}{"$in": []interface{}{"u3@x", "u25@x", "nope"}}, "age": map[string]interface{}{"$gt": 5}}); err != nil {
+		t.Fatal(err)
+	}
+	ex, err := q.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Plan.Access != query.IndexLookup || ex.Plan.Index != "email" || ex.Plan.EstimatedRows != 3 {
+		t.Errorf("expected an index lookup of 3 keys, got %+v", ex.Plan)
+	}
+	if ex.Stats.RowsExamined != 2 || ex.Stats.RowsReturned != 1 {
+		t.Errorf("expected 2 examined and 1 returned, got %+v", ex.Stats)
+	}
+	if ex.Stats.ClumpsScanned != 0 || ex.Stats.ClumpsSkipped != ex.Plan.Clumps || ex.Plan.Clumps < 3 {
+		t.Errorf("expected every clump skipped, got %+v / %+v", ex.Plan, ex.Stats)
+	}
+	stages := map[string]bool{}
+	for _, s := range ex.Stats.Stages {
+		stages[s.Name] = true
+	}
+	if !stages["index_lookup"] || stages["sort"] {
+		t.Errorf("unexpected stages: %+v", ex.Stats.Stages)
+	}
+
+	// The lookup must give the same rows as a scan would.
+	rows, _ := q.Execute()
+	if len(rows) != 1 || rows[0]["email"] != "u25@x" {
+		t.Errorf("unexpected lookup result: %v", rows)
+	}
+
+	q = query.NewQuery(db, "users").OrderBy("age", true).Limit(2)
+	q.Where(map[string]interface{}{"age": map[string]interface{}{"$gte": 10}})
+	ex, err = q.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Plan.Access != query.FullScan || ex.Plan.EstimatedRows != 30 {
+		t.Errorf("expected a full scan of 30 rows, got %+v", ex.Plan)
+	}
+	if ex.Stats.RowsExamined != 30 || ex.Stats.RowsReturned != 2 || ex.Stats.ClumpsSkipped != 0 {
+		t.Errorf("unexpected scan stats: %+v", ex.Stats)
+	}
+	if ex.Stats.Total <= 0 {
+		t.Error("expected a total time")
+	}
+
+	// A limit without sorting stops scanning early.
+	ex, _ = query.NewQuery(db, "users").Parallel(1).Limit(1).Explain()
+	if ex.Stats.ClumpsScanned != 1 || ex.Stats.ClumpsSkipped != ex.Plan.Clumps-1 {
+		t.Errorf("expected the limit to skip clumps, got %+v", ex.Stats)
+	}
+}
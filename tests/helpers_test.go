@@ -0,0 +1,17 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// resetDB removes every file core.Open creates for name so a test starts from
+// an empty database.
+func resetDB(name string) {
+	base := filepath.Join("emojidb", name)
+	os.Remove(base)
+	os.Remove(base + ".safety")
+	os.Remove(base + ".schema.json")
+	os.Remove(base + ".migrate")
+	os.Remove(base + ".schema.json.migrate")
+}
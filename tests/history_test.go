@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+func TestSchemaHistory(t *testing.T) {
+	dbPath := "test_history.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	v1 := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "name", Type: core.FieldTypeString},
+		{Name: "legacy", Type: core.FieldTypeString},
+	}
+	db.DefineSchema("users", v1)
+	db.Insert("users", core.Row{"id": 1, "name": "alice", "legacy": "x"})
+	db.Flush("users")
+
+	v2 := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "name", Type: core.FieldTypeString},
+		{Name: "age", Type: core.FieldTypeInt},
+	}
+	if err := db.SyncSchema("users", v2, false); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	// Syncing the same definition again must not bump the version
+	if err := db.SyncSchema("users", v2, false); err != nil {
+		t.Fatalf("identical sync failed: %v", err)
+	}
+
+	history, err := db.SchemaHistory("users")
+	if err != nil {
+		t.Fatalf("history failed: %v", err)
+	}
+	if len(history) != 2 || history[1].Version != 2 || db.Schemas["users"].Version != 2 {
+		t.Fatalf("expected two revisions ending at v2, got %+v", history)
+	}
+	if len(history[1].Changes) == 0 {
+		t.Error("expected v2 to record its changes")
+	}
+	if _, err := db.SchemaHistory("missing"); err == nil {
+		t.Error("expected error for unknown table")
+	}
+	db.Close()
+
+	// History survives a reopen and old clumps are upgraded on read
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+
+	history, _ = db.SchemaHistory("users")
+	if len(history) != 2 {
+		t.Errorf("expected history to persist, got %d revisions", len(history))
+	}
+
+	table, err := db.Table("users")
+	if err != nil {
+		t.Fatalf("table failed: %v", err)
+	}
+	for _, clump := range table.SealedClumps {
+		if clump.Metadata.SchemaVersion != 2 {
+			t.Errorf("expected clump upgraded to v2, got v%d", clump.Metadata.SchemaVersion)
+		}
+		for _, row := range clump.Rows {
+			if _, ok := row["legacy"]; ok {
+				t.Errorf("expected removed field to be dropped: %v", row)
+			}
+		}
+	}
+}
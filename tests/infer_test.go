@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+func TestAdoptOrphans(t *testing.T) {
+	dbPath := "test_orphans.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	db.DefineSchema("logs", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt},
+		{Name: "level", Type: core.FieldTypeString},
+		{Name: "took", Type: core.FieldTypeFloat},
+	})
+	db.Insert("logs", core.Row{"id": 1, "level": "info", "took": 1.5})
+	db.Insert("logs", core.Row{"id": 2, "level": "info", "took": 2})
+	db.Insert("logs", core.Row{"id": 3, "level": "warn", "took": 0.25})
+	db.Flush("logs")
+	db.Close()
+
+	// Losing the schema file leaves the clumps orphaned
+	os.Remove(filepath.Join("emojidb", dbPath+".schema.json"))
+
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+
+	orphans := db.InspectOrphans()
+	if len(orphans) != 1 || orphans[0].Table != "logs" || orphans[0].Rows != 3 {
+		t.Fatalf("unexpected orphans: %+v", orphans)
+	}
+	proposed := make(map[string]core.Field)
+	for _, f := range orphans[0].Proposed {
+		proposed[f.Name] = f
+	}
+	if f := proposed["id"]; f.Type != core.FieldTypeInt || !f.Unique {
+		t.Errorf("expected id to be a unique int, got %+v", f)
+	}
+	if f := proposed["level"]; f.Type != core.FieldTypeString || f.Unique {
+		t.Errorf("expected level to be a non-unique string, got %+v", f)
+	}
+	if f := proposed["took"]; f.Type != core.FieldTypeFloat {
+		t.Errorf("expected took to be a float, got %+v", f)
+	}
+
+	// A unique level would drop a row, so it needs force
+	strict := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt},
+		{Name: "level", Type: core.FieldTypeString, Unique: true},
+	}
+	if err := db.AdoptOrphans("logs", strict, false); err == nil {
+		t.Error("expected adoption to refuse dropping rows")
+	}
+	if len(db.InspectOrphans()) != 1 {
+		t.Error("refused adoption must keep the orphans")
+	}
+
+	if err := db.AdoptOrphans("logs", nil, false); err != nil {
+		t.Fatalf("adopt failed: %v", err)
+	}
+	if count, _ := db.Count("logs", nil); count != 3 {
+		t.Errorf("expected 3 adopted rows, got %d", count)
+	}
+	if len(db.InspectOrphans()) != 0 {
+		t.Error("expected no orphans after adoption")
+	}
+	if err := db.Insert("logs", core.Row{"id": 1, "level": "x", "took": 1}); err == nil {
+		t.Error("expected the inferred unique id to be enforced")
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+func TestJoins(t *testing.T) {
+	dbPath := "test_joins.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("products", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "name", Type: core.FieldTypeString},
+	})
+	db.DefineSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt},
+		{Name: "product_id", Type: core.FieldTypeInt},
+		{Name: "buyer", Type: core.FieldTypeString},
+	})
+	db.DefineSchema("users", []core.Field{
+		{Name: "username", Type: core.FieldTypeString},
+		{Name: "city", Type: core.FieldTypeString},
+	})
+	db.Insert("products", core.Row{"id": 1, "name": "pen"})
+	db.Insert("products", core.Row{"id": 2, "name": "ink"})
+	db.Flush("products")
+	db.Insert("orders", core.Row{"id": 10, "product_id": 1, "buyer": "ada"})
+	db.Insert("orders", core.Row{"id": 11, "product_id": 2, "buyer": "bola"})
+	db.Insert("orders", core.Row{"id": 12, "product_id": 3, "buyer": "ada"})
+	db.Insert("users", core.Row{"username": "ada", "city": "Lagos"})
+	db.Insert("users", core.Row{"username": "ada", "city": "Kano"})
+
+	// products.id is unique, so this probes the index
+	rows, err := query.NewQuery(db, "orders").Join("products", "product_id", "id").OrderBy("id", false).Execute()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("expected 2 inner rows, got %v (%v)", rows, err)
+	}
+	if rows[0]["orders.id"] != 10 || rows[0]["products.name"] != "pen" || rows[0]["products.id"] != 1 {
+		t.Errorf("unexpected joined row: %v", rows[0])
+	}
+	if _, ok := rows[0]["id"]; ok {
+		t.Error("joined columns must be prefixed by table")
+	}
+
+	// users.username is not unique, so this hash joins and fans out
+	rows, _ = query.NewQuery(db, "orders").
+		LeftJoin("users", "buyer", "username").
+		Select("id", "users.city").
+		OrderBy("id", false).OrderBy("users.city", false).
+		Execute()
+	want := []core.Row{
+		{"orders.id": 10, "users.city": "Kano"},
+		{"orders.id": 10, "users.city": "Lagos"},
+		{"orders.id": 11, "users.city": nil},
+		{"orders.id": 12, "users.city": "Kano"},
+		{"orders.id": 12, "users.city": "Lagos"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d left rows, got %v", len(want), rows)
+	}
+	for i := range want {
+		if rows[i]["orders.id"] != want[i]["orders.id"] || rows[i]["users.city"] != want[i]["users.city"] {
+			t.Errorf("row %d: expected %v, got %v", i, want[i], rows[i])
+		}
+	}
+
+	// Match keys split between the base table and joined tables
+	q := query.NewQuery(db, "orders").Join("products", "product_id", "id").LeftJoin("users", "orders.buyer", "username")
+	if err := q.Where(map[string]interface{}{"buyer": "ada", "users.city": "Lagos", "products.name": "pen"}); err != nil {
+		t.Fatalf("where failed: %v", err)
+	}
+	rows, _ = q.Execute()
+	if len(rows) != 1 || rows[0]["users.city"] != "Lagos" || rows[0]["products.name"] != "pen" {
+		t.Errorf("unexpected filtered join: %v", rows)
+	}
+
+	// Self join with an alias
+	rows, _ = query.NewQuery(db, "orders").Select("id", "same.id").AddJoin(query.Join{Table: "orders", As: "same", Left: "buyer", Right: "buyer"}).Execute()
+	if len(rows) != 5 {
+		t.Errorf("expected 5 self-joined rows, got %d", len(rows))
+	}
+	if _, err := query.NewQuery(db, "orders").Join("orders", "id", "id").Execute(); err == nil {
+		t.Error("expected joining a table to itself without an alias to fail")
+	}
+	if _, err := query.NewQuery(db, "orders").Join("missing", "id", "id").Execute(); err == nil {
+		t.Error("expected a missing joined table to fail")
+	}
+}
@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+func TestMigrate(t *testing.T) {
+	dbPath := "test_migrate.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	db.DefineSchema("people", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "fullname", Type: core.FieldTypeString},
+		{Name: "age", Type: core.FieldTypeString},
+	})
+	db.DefineSchema("pets", []core.Field{
+		{Name: "name", Type: core.FieldTypeString},
+		{Name: "owner", Type: core.FieldTypeInt},
+	}, core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{"owner"}, RefTable: "people", RefFields: []string{"id"}})
+
+	db.Insert("people", core.Row{"id": 1, "fullname": "alice", "age": "31"})
+	db.Insert("people", core.Row{"id": 2, "fullname": "bob", "age": "unknown"})
+	db.Flush("people")
+	db.Insert("people", core.Row{"id": 3, "fullname": "carol", "age": " 40 "})
+	db.Insert("pets", core.Row{"name": "rex", "owner": 1})
+
+	target := []core.Field{
+		{Name: "key", Type: core.FieldTypeInt, Unique: true},
+		{Name: "name", Type: core.FieldTypeString},
+		{Name: "age", Type: core.FieldTypeInt},
+		{Name: "country", Type: core.FieldTypeString},
+		{Name: "label", Type: core.FieldTypeString},
+	}
+	steps := []core.MigrationStep{
+		{Kind: core.MigrateRenameField, Field: "fullname", To: "name"},
+		{Kind: core.MigrateRenameField, Field: "id", To: "key"},
+		{Kind: core.MigrateCast, Field: "age", Type: core.FieldTypeInt},
+		{Kind: core.MigrateBackfill, Field: "country", Type: core.FieldTypeString, Value: "NG"},
+		{Kind: core.MigrateBackfill, Field: "label", Type: core.FieldTypeString, From: "key"},
+		{Kind: core.MigrateRenameTable, To: "users"},
+	}
+
+	// "unknown" does not parse, so the default policy aborts without changes
+	if err := db.Migrate("people", steps, target, false); err == nil {
+		t.Fatal("expected cast failure to abort the migration")
+	}
+	if _, ok := db.Tables["people"]; !ok {
+		t.Fatal("expected failed migration to leave the table alone")
+	}
+
+	// Triggers and rules follow the table to its new name.
+	fired := 0
+	db.AddTrigger(core.Trigger{Name: "count", Table: "people", Before: func(*core.HookEvent) error {
+		fired++
+		return nil
+	}})
+	db.SetRules("pets", []core.Rule{{Name: "adopt", On: []core.ChangeKind{core.ChangeInsert}, Then: []core.RuleWrite{
+		{Table: "people", Match: map[string]interface{}{"key": "$new.owner"}, Set: map[string]interface{}{"label": "owner"}},
+	}}})
+
+	steps[2].OnFailure = core.CastNull
+	if err := db.Migrate("people", steps, target, false); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if err := db.Insert("users", core.Row{"key": 4, "name": "dave", "age": 20, "country": "NG", "label": "4"}); err != nil {
+		t.Fatal(err)
+	}
+	if fired != 1 {
+		t.Errorf("expected the trigger to fire on the renamed table, fired %d times", fired)
+	}
+	if err := db.Insert("pets", core.Row{"name": "kit", "owner": 4}); err != nil {
+		t.Fatalf("expected the rule to write to the renamed table: %v", err)
+	}
+	if n, _ := db.Count("users", map[string]interface{}{"label": "owner"}); n != 1 {
+		t.Errorf("expected the rule to label the owner, got %d", n)
+	}
+	db.Flush("users")
+	db.Close()
+
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+
+	if _, ok := db.Tables["people"]; ok {
+		t.Error("expected old table name to be gone")
+	}
+	users, err := db.Table("users")
+	if err != nil {
+		t.Fatalf("renamed table missing: %v", err)
+	}
+	ages := make(map[float64]interface{})
+	for _, clump := range users.SealedClumps {
+		for _, row := range clump.Rows {
+			if row["country"] != "NG" || row["label"] == nil || row["name"] == nil {
+				t.Errorf("unexpected migrated row: %v", row)
+			}
+			ages[row["key"].(float64)] = row["age"]
+		}
+	}
+	if ages[1] != float64(31) || ages[2] != nil || ages[3] != float64(40) {
+		t.Errorf("unexpected cast results: %v", ages)
+	}
+
+	// The foreign key of pets follows the rename
+	fk := db.Schemas["pets"].Constraints[0]
+	if fk.RefTable != "users" || fk.RefFields[0] != "key" {
+		t.Errorf("expected foreign key to be retargeted, got %+v", fk)
+	}
+	if err := db.Insert("pets", core.Row{"name": "tom", "owner": 9}); err == nil {
+		t.Error("expected retargeted foreign key to be enforced")
+	}
+	if w := db.Schemas["pets"].Rules[0].Then[0]; w.Table != "users" {
+		t.Errorf("expected the rule to write to users after reopening, got %s", w.Table)
+	}
+
+	history, _ := db.SchemaHistory("users")
+	if len(history) != 2 || len(history[1].Changes) == 0 {
+		t.Errorf("expected migration to add a revision, got %+v", history)
+	}
+}
+
+func TestMigrateRecovery(t *testing.T) {
+	dbPath := "test_migrate_recovery.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, _ := core.Open(dbPath, "secret")
+	db.DefineSchema("items", []core.Field{{Name: "id", Type: core.FieldTypeInt}})
+	db.Close()
+
+	// A crash after the data file was swapped leaves only the new schema
+	// pending; opening must finish the commit.
+	full := filepath.Join("emojidb", dbPath)
+	pending := `{"renamed": {"Version": 2, "Fields": [{"Name": "id", "Type": 0, "Unique": false}], "Constraints": null}}`
+	os.WriteFile(full+".schema.json.migrate", []byte(pending), 0600)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if _, ok := db.Schemas["renamed"]; !ok {
+		t.Errorf("expected pending schema to be committed, got %v", db.ListTables())
+	}
+	db.Close()
+
+	// A crash before the swap leaves the old files in charge
+	os.WriteFile(full+".migrate", []byte("partial"), 0600)
+	os.WriteFile(full+".schema.json.migrate", []byte("{}"), 0600)
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	if _, ok := db.Schemas["renamed"]; !ok {
+		t.Error("expected interrupted commit to be discarded")
+	}
+	if _, err := os.Stat(full + ".migrate"); !os.IsNotExist(err) {
+		t.Error("expected pending data file to be removed")
+	}
+}
+
+func TestMigrateRetargetsPaths(t *testing.T) {
+	dbPath := "test_migrate_paths.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	fields := []core.Field{{Name: "addr", Type: core.FieldTypeObject}}
+	db.DefineSchema("places", fields, core.Constraint{Kind: core.ConstraintUnique, Fields: []string{"addr.id"}})
+	if err := db.DefineSchema("visits", []core.Field{{Name: "place", Type: core.FieldTypeInt}},
+		core.Constraint{Kind: core.ConstraintForeignKey, Fields: []string{"place"}, RefTable: "places", RefFields: []string{"addr.id"}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Insert("places", core.Row{"addr": map[string]interface{}{"id": 1}})
+
+	target := []core.Field{{Name: "address", Type: core.FieldTypeObject}}
+	steps := []core.MigrationStep{{Kind: core.MigrateRenameField, Field: "addr", To: "address"}}
+	if err := db.Migrate("places", steps, target, false, core.Constraint{Kind: core.ConstraintUnique, Fields: []string{"address.id"}}); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if fk := db.Schemas["visits"].Constraints[0]; fk.RefFields[0] != "address.id" {
+		t.Errorf("expected the path to follow its renamed root, got %+v", fk)
+	}
+	if err := db.Insert("visits", core.Row{"place": 1}); err != nil {
+		t.Errorf("expected the retargeted key to find the place: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+func TestParallelScan(t *testing.T) {
+	dbPath := "test_parallel.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("points", []core.Field{
+		{Name: "n", Type: core.FieldTypeInt},
+		{Name: "odd", Type: core.FieldTypeBool},
+	})
+	// Twenty clumps of 25 rows
+	for i := 0; i < 500; i++ {
+		db.Insert("points", core.Row{"n": i, "odd": i%2 == 1})
+		if i%25 == 24 {
+			db.Flush("points")
+		}
+	}
+
+	odd := func(r core.Row) bool { return r["odd"] == true }
+	sequential, err := query.NewQuery(db, "points").Filter(odd).Select("n").Parallel(1).Execute()
+	if err != nil {
+		t.Fatalf("sequential scan failed: %v", err)
+	}
+	if len(sequential) != 250 || sequential[0]["n"] != 1 || sequential[249]["n"] != 499 {
+		t.Fatalf("unexpected sequential results: %d rows", len(sequential))
+	}
+	for _, workers := range []int{2, 8, 64} {
+		got, err := query.NewQuery(db, "points").Filter(odd).Select("n").Parallel(workers).Execute()
+		if err != nil || !reflect.DeepEqual(got, sequential) {
+			t.Errorf("%d workers: results differ from a sequential scan (%v)", workers, err)
+		}
+	}
+
+	limited, _ := query.NewQuery(db, "points").Filter(odd).Parallel(8).Limit(5).Execute()
+	if len(limited) != 5 || limited[4]["n"] != 9 {
+		t.Errorf("expected the first 5 odd rows, got %v", limited)
+	}
+	sorted, _ := query.NewQuery(db, "points").Select("n").OrderBy("odd", false).OrderBy("n", true).Parallel(8).Limit(1).Execute()
+	if len(sorted) != 1 || sorted[0]["n"] != 498 {
+		t.Errorf("expected the largest even n, got %v", sorted)
+	}
+
+	for _, workers := range []int{1, 4} {
+		db.Config.ScanWorkers = workers
+		if count, err := db.Count("points", map[string]interface{}{"odd": false}); err != nil || count != 250 {
+			t.Errorf("%d workers: expected 250 even rows, got %d (%v)", workers, count, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestNestedPaths(t *testing.T) {
+	dbPath := "test_paths.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	fields := []core.Field{
+		{Name: "name", Type: core.FieldTypeString},
+		{Name: "address", Type: core.FieldTypeObject},
+		{Name: "tags", Type: core.FieldTypeArray},
+	}
+	// One user of each name per city
+	if err := db.DefineSchema("users", fields, core.Constraint{Kind: core.ConstraintUnique, Fields: []string{"name", "address.city"}}); err != nil {
+		t.Fatalf("define failed: %v", err)
+	}
+	if err := db.DefineSchema("bad", fields, core.Constraint{Kind: core.ConstraintUnique, Fields: []string{"name.first"}}); err == nil {
+		t.Error("expected a path into a string field to be rejected")
+	}
+
+	address := func(city string, zip float64) map[string]interface{} {
+		return map[string]interface{}{"city": city, "zip": zip}
+	}
+	db.Insert("users", core.Row{"name": "ada", "address": address("Lagos", 3), "tags": []interface{}{"staff", "admin"}})
+	db.Insert("users", core.Row{"name": "bola", "address": address("Abuja", 1), "tags": []interface{}{"staff"}})
+	db.Insert("users", core.Row{"name": "chi", "address": address("Lagos", 2), "tags": []interface{}{"guest"}})
+	db.Insert("users", core.Row{"name": "dan", "address": nil, "tags": nil})
+
+	if err := db.Insert("users", core.Row{"name": "ada", "address": address("Lagos", 9), "tags": nil}); err == nil {
+		t.Error("expected the nested unique index to reject a second ada in Lagos")
+	}
+	if err := db.Insert("users", core.Row{"name": "ada", "address": address("Kano", 9), "tags": nil}); err != nil {
+		t.Errorf("ada in Kano should be allowed: %v", err)
+	}
+	inKano := func(r core.Row) bool { v, _ := core.Lookup(r, "address.city"); return v == "Kano" }
+	if err := safety.Update(db, "users", inKano, core.Row{"address": address("Lagos", 9)}); err == nil {
+		t.Error("expected replacing the address to be checked against the nested unique index")
+	}
+
+	count, err := db.Count("users", map[string]interface{}{"address.city": "Lagos"})
+	if err != nil || count != 2 {
+		t.Errorf("expected 2 users in Lagos, got %d (%v)", count, err)
+	}
+	count, _ = db.Count("users", map[string]interface{}{"tags[0]": "staff"})
+	if count != 2 {
+		t.Errorf("expected 2 users tagged staff first, got %d", count)
+	}
+	count, _ = db.Count("users", map[string]interface{}{"tags": map[string]interface{}{"$contains": "admin"}})
+	if count != 1 {
+		t.Errorf("expected 1 admin, got %d", count)
+	}
+	if _, err := db.Count("users", map[string]interface{}{"tags[x]": 1}); err == nil {
+		t.Error("expected an invalid path to be rejected")
+	}
+
+	rows, err := query.NewQuery(db, "users").
+		Filter(query.Eq("address.city", "Lagos")).
+		Select("name", "address.zip").
+		OrderBy("address.zip", false).
+		Execute()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %v (%v)", rows, err)
+	}
+	if rows[0]["name"] != "chi" || rows[0]["address.zip"] != 2.0 {
+		t.Errorf("unexpected first row: %v", rows[0])
+	}
+
+	rows, _ = query.NewQuery(db, "users").Filter(query.Contains("tags", "staff")).Execute()
+	if len(rows) != 2 {
+		t.Errorf("expected 2 staff rows, got %d", len(rows))
+	}
+}
@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+func TestStreamingRows(t *testing.T) {
+	dbPath := "test_rows.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("events", []core.Field{
+		{Name: "n", Type: core.FieldTypeInt},
+	})
+	// Three clumps of three rows, plus one row in the hot heap
+	for i := 1; i <= 10; i++ {
+		db.Insert("events", core.Row{"n": i})
+		if i%3 == 0 {
+			db.Flush("events")
+		}
+	}
+
+	rows, err := query.NewQuery(db, "events").Rows(context.Background())
+	if err != nil {
+		t.Fatalf("rows failed: %v", err)
+	}
+	seen := 0
+	for rows.Next() {
+		seen++
+		if seen == 1 {
+			// The lock is free between clumps, and new rows stay out of
+			// the snapshot
+			if err := db.Insert("events", core.Row{"n": 99}); err != nil {
+				t.Fatalf("insert during scan failed: %v", err)
+			}
+		}
+		rows.Row()["n"] = -1 // rows are copies
+	}
+	if rows.Err() != nil || seen != 10 {
+		t.Errorf("expected 10 rows from the snapshot, got %d (%v)", seen, rows.Err())
+	}
+	if count, _ := db.Count("events", map[string]interface{}{"n": -1}); count != 0 {
+		t.Error("modifying a streamed row must not change the table")
+	}
+
+	// iter.Seq with a filter and a limit
+	var got []interface{}
+	stream, _ := query.NewQuery(db, "events").Filter(func(r core.Row) bool {
+		n, _ := r["n"].(int)
+		return n%2 == 0
+	}).Limit(3).Rows(context.Background())
+	for row := range stream.All() {
+		got = append(got, row["n"])
+	}
+	// The hot heap comes first, as Execute has always returned it
+	if len(got) != 3 || got[0] != 10 || got[1] != 2 || got[2] != 4 {
+		t.Errorf("unexpected limited stream: %v", got)
+	}
+
+	// Sorted streams read everything first
+	var last interface{}
+	for row, err := range query.NewQuery(db, "events").OrderBy("n", true).Limit(1).Iter(context.Background()) {
+		if err != nil {
+			t.Fatalf("iter failed: %v", err)
+		}
+		last = row["n"]
+	}
+	if last != 99 {
+		t.Errorf("expected the largest n first, got %v", last)
+	}
+
+	// Cancelling stops at the next clump; the first is the hot heap
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, _ = query.NewQuery(db, "events").Rows(ctx)
+	n := 0
+	for stream.Next() {
+		n++
+		cancel()
+	}
+	if !errors.Is(stream.Err(), context.Canceled) || n != 2 {
+		t.Errorf("expected cancellation after the hot heap, got %d rows (%v)", n, stream.Err())
+	}
+	if _, err := query.NewQuery(db, "events").ExecuteContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected ExecuteContext to honour cancellation, got %v", err)
+	}
+	if _, err := query.NewQuery(db, "missing").Rows(context.Background()); err == nil {
+		t.Error("expected an error for a missing table")
+	}
+}
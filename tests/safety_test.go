@@ -74,3 +74,65 @@ func TestSafetyEngine(t *testing.T) {
 		t.Errorf("expected 1 restored, got %d", len(results))
 	}
 }
+
+func TestSafetyUniqueIndices(t *testing.T) {
+	dbPath := "test_safety_unique.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	fields := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "username", Type: core.FieldTypeString, Unique: true},
+	}
+	db.DefineSchema("users", fields)
+	db.Insert("users", core.Row{"id": 1, "username": "alice"})
+	db.Insert("users", core.Row{"id": 2, "username": "bob"})
+
+	byID := func(id int) safety.FilterFunc {
+		return func(r core.Row) bool { return r["id"] == id }
+	}
+
+	err = safety.Update(db, "users", byID(2), core.Row{"username": "alice"})
+	if err == nil {
+		t.Fatal("expected unique violation on update")
+	}
+
+	if err := safety.Update(db, "users", byID(2), core.Row{"username": "bobby"}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if err := db.Insert("users", core.Row{"id": 3, "username": "bob"}); err != nil {
+		t.Fatalf("old value was not released by update: %v", err)
+	}
+
+	if err := safety.Delete(db, "users", byID(1)); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := db.Insert("users", core.Row{"id": 4, "username": "alice"}); err != nil {
+		t.Fatalf("deleted value was not released: %v", err)
+	}
+
+	points, _ := safety.ListRecoveryPoints(db)
+	if len(points) == 0 {
+		t.Fatal("expected recovery point")
+	}
+	if err := safety.Restore(db, points[len(points)-1], true); err == nil {
+		t.Error("expected restore to fail on reused username")
+	}
+
+	// Corrupt the heap behind the index's back and let Verify find it
+	table := db.Tables["users"]
+	table.HotHeap.Rows = append(table.HotHeap.Rows, core.Row{"id": 5, "username": "alice"})
+	report, err := db.Verify("users")
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if len(report.Violations) != 1 || report.Violations[0].Field != "username" || report.Violations[0].Count != 2 {
+		t.Errorf("unexpected violations: %+v", report.Violations)
+	}
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestFullTextSearch(t *testing.T) {
+	dbPath := "test_search.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	if err := db.DefineSchema("bad", []core.Field{{Name: "n", Type: core.FieldTypeInt, FullText: true}}); err == nil {
+		t.Error("expected full text on an int field to be rejected")
+	}
+	db.DefineSchema("tickets", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "body", Type: core.FieldTypeString, FullText: true},
+		{Name: "status", Type: core.FieldTypeString},
+	})
+	tickets := []string{
+		"My card was declined when paying",
+		"Refund requested: the card declined twice",
+		"Refunding takes too long, still waiting on refunds",
+		"Declined card? The CARD was fine yesterday",
+		"Shipping address changed",
+	}
+	for i, body := range tickets {
+		db.Insert("tickets", core.Row{"id": i + 1, "body": body, "status": "open"})
+	}
+	db.Flush("tickets")
+
+	ids := func(hits []core.SearchHit) []interface{} {
+		var out []interface{}
+		for _, h := range hits {
+			out = append(out, h.Row["id"])
+		}
+		return out
+	}
+
+	// Stems join refund, refunding and refunds; the third ticket says it twice.
+	hits, err := db.Search("tickets", "body", "refunded", nil, 0)
+	if err != nil || len(hits) != 2 || !core.Equal(hits[0].Row["id"], 3) || hits[0].Score <= hits[1].Score {
+		t.Fatalf("unexpected refund hits: %v (%v)", ids(hits), err)
+	}
+
+	// The phrase must appear in order: ticket 4 has "declined card" and
+	// "card was", not "card declined".
+	hits, _ = db.Search("tickets", "body", `"Card Declined"`, nil, 0)
+	if len(hits) != 1 || !core.Equal(hits[0].Row["id"], 2) {
+		t.Errorf("unexpected phrase hits: %v", ids(hits))
+	}
+
+	hits, _ = db.Search("tickets", "body", "ship* yesterday", nil, 0)
+	if len(hits) != 2 {
+		t.Errorf("expected a prefix and a word hit, got %v", ids(hits))
+	}
+
+	hits, _ = db.Search("tickets", "body", "card", func(r core.Row) bool { return !core.Equal(r["id"], 1) }, 1)
+	if len(hits) != 1 || core.Equal(hits[0].Row["id"], 1) {
+		t.Errorf("expected one filtered hit, got %v", ids(hits))
+	}
+
+	if _, err := db.Search("tickets", "status", "open", nil, 0); err == nil {
+		t.Error("expected an error for a field without full text")
+	}
+
+	// Updates and deletes keep the index in step.
+	safety.Update(db, "tickets", func(r core.Row) bool { return core.Equal(r["id"], 5) }, core.Row{"body": "Refund the shipping"})
+	safety.Delete(db, "tickets", func(r core.Row) bool { return core.Equal(r["id"], 3) })
+	hits, _ = db.Search("tickets", "body", "refund", nil, 0)
+	if got := ids(hits); len(got) != 2 || !core.Equal(got[0], 5) && !core.Equal(got[1], 5) {
+		t.Errorf("expected tickets 2 and 5 after the update, got %v", got)
+	}
+	if hits, _ := db.Search("tickets", "body", "address", nil, 0); len(hits) != 0 {
+		t.Errorf("expected the old text to be gone, got %v", ids(hits))
+	}
+	db.Close()
+
+	// The index comes back from the data file.
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	hits, _ = db.Search("tickets", "body", "refund card", nil, 0)
+	if len(hits) != 4 {
+		t.Errorf("expected 4 hits after reopening, got %v", ids(hits))
+	}
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	dbPath := "test_snapshot.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("stock", []core.Field{
+		{Name: "sku", Type: core.FieldTypeString, Unique: true},
+		{Name: "qty", Type: core.FieldTypeInt},
+	})
+	for _, sku := range []string{"a", "b", "c", "d"} {
+		db.Insert("stock", core.Row{"sku": sku, "qty": 1})
+		if sku == "b" {
+			db.Flush("stock")
+		}
+	}
+
+	table, _ := db.Table("stock")
+	rows, err := query.NewQuery(db, "stock").Rows(context.Background())
+	if err != nil {
+		t.Fatalf("rows failed: %v", err)
+	}
+	snap := table.Snapshot()
+
+	// Writes after the snapshot touch both the clump and the hot heap
+	if _, err := table.UpdateWhere(func(r core.Row) bool { return true }, core.Row{"qty": 2}, nil); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if _, err := table.DeleteWhere(func(r core.Row) bool { return r["sku"] == "d" }, nil); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	db.Upsert("stock", core.Row{"sku": "a", "qty": 3}, []string{"sku"}, core.UpsertMerge)
+	db.Insert("stock", core.Row{"sku": "e", "qty": 2})
+
+	n := 0
+	for rows.Next() {
+		n++
+		if rows.Row()["qty"] != 1 {
+			t.Errorf("snapshot saw a later write: %v", rows.Row())
+		}
+	}
+	if n != 4 || snap.Len() != 4 {
+		t.Errorf("expected the snapshot to keep 4 rows, got %d and %d", n, snap.Len())
+	}
+
+	if count, _ := db.Count("stock", map[string]interface{}{"qty": 2}); count != 3 {
+		t.Errorf("expected 3 live rows with qty 2, got %d", count)
+	}
+	if count, _ := db.Count("stock", map[string]interface{}{"sku": "a", "qty": 3}); count != 1 {
+		t.Error("expected the upsert to reach the live table")
+	}
+	if err := db.Insert("stock", core.Row{"sku": "a", "qty": 0}); err == nil {
+		t.Error("expected the replaced row to stay indexed")
+	}
+}
+
+// Run with -race: readers and writers share a table without blocking.
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	dbPath := "test_snapshot_race.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("ticks", []core.Field{
+		{Name: "n", Type: core.FieldTypeInt},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		table, _ := db.Table("ticks")
+		for i := 0; i < 200; i++ {
+			db.Insert("ticks", core.Row{"n": i})
+			if i%50 == 0 {
+				table.UpdateWhere(func(r core.Row) bool { return r["n"] == 0 }, core.Row{"n": -1}, nil)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			query.NewQuery(db, "ticks").Execute()
+			db.Count("ticks", nil)
+			db.DumpAsJSON("ticks")
+		}
+	}()
+	wg.Wait()
+
+	if count, _ := db.Count("ticks", nil); count != 200 {
+		t.Errorf("expected 200 rows, got %d", count)
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/sql"
+)
+
+func TestSQL(t *testing.T) {
+	dbPath := "test_sql.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	exec := func(text string, args ...interface{}) *sql.Result {
+		t.Helper()
+		res, err := sql.Exec(ctx, db, text, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		return res
+	}
+
+	exec("CREATE TABLE makers (id INT PRIMARY KEY, name VARCHAR(20) NOT EMPTY)")
+	exec(`CREATE TABLE products (
+		id INT PRIMARY KEY, name TEXT, price DECIMAL(10, 2), tags ARRAY,
+		maker INT REFERENCES makers (id) ON DELETE CASCADE)`)
+	exec("create table if not exists makers (id int)")
+	if _, err := sql.Exec(ctx, db, "CREATE TABLE makers (id INT)"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected an exists error, got %v", err)
+	}
+
+	exec("INSERT INTO makers VALUES (1, 'Acme'), (2, 'Bic')")
+	res := exec("INSERT INTO products (id, name, price, tags, maker) VALUES (?, ?, ?, ?, $5), (2, 'ink', 1.25, NULL, 2), (3, 'pad', '4.00', NULL, 1)",
+		1, "pen", "2.50", []interface{}{"office"}, 1)
+	if res.RowsAffected != 3 {
+		t.Errorf("expected 3 inserted, got %d", res.RowsAffected)
+	}
+
+	res = exec("SELECT name, price AS cost FROM products WHERE price >= ? AND name != 'pad' ORDER BY cost DESC", 1)
+	if len(res.Rows) != 2 || res.Rows[0]["name"] != "pen" || !core.Equal(res.Rows[0]["cost"], core.Decimal("2.5")) {
+		t.Fatalf("unexpected rows: %v", res.Rows)
+	}
+	if strings.Join(res.Columns, ",") != "name,cost" {
+		t.Errorf("unexpected columns: %v", res.Columns)
+	}
+
+	res = exec("SELECT id FROM products WHERE name LIKE 'p%' AND NOT (id = 3 OR tags CONTAINS 'x') ORDER BY id")
+	if len(res.Rows) != 1 || !core.Equal(res.Rows[0]["id"], 1) {
+		t.Errorf("expected pen only, got %v", res.Rows)
+	}
+	res = exec("SELECT id FROM products WHERE tags IS NULL AND price BETWEEN 1 AND 2")
+	if len(res.Rows) != 1 || !core.Equal(res.Rows[0]["id"], 2) {
+		t.Errorf("expected ink only, got %v", res.Rows)
+	}
+
+	res = exec(`SELECT makers.name, COUNT(*) AS n, SUM(price) AS total, MIN(products.name) AS first
+		FROM products JOIN makers ON products.maker = makers.id
+		GROUP BY makers.name ORDER BY n DESC`)
+	if len(res.Rows) != 2 {
+		t.Fatalf("expected 2 groups, got %v", res.Rows)
+	}
+	acme := res.Rows[0]
+	if acme["makers.name"] != "Acme" || acme["n"] != int64(2) || !core.Equal(acme["total"], core.Decimal("6.5")) || acme["first"] != "pad" {
+		t.Errorf("unexpected group: %v", acme)
+	}
+	res = exec("SELECT COUNT(*) FROM products WHERE id > 10")
+	if len(res.Rows) != 1 || res.Rows[0]["count(*)"] != int64(0) {
+		t.Errorf("expected a zero count, got %v", res.Rows)
+	}
+	if _, err := sql.Exec(ctx, db, "SELECT name, COUNT(*) FROM products"); err == nil {
+		t.Error("expected an error for an ungrouped column")
+	}
+
+	res = exec("UPDATE products SET price = ? WHERE id IN (1, 2)", "3.00")
+	if res.RowsAffected != 2 {
+		t.Errorf("expected 2 updated, got %d", res.RowsAffected)
+	}
+	res = exec("DELETE FROM makers WHERE id = 1")
+	if res.RowsAffected != 1 {
+		t.Errorf("expected 1 deleted, got %d", res.RowsAffected)
+	}
+	res = exec("SELECT * FROM products")
+	if len(res.Rows) != 1 || !core.Equal(res.Rows[0]["price"], core.Decimal("3")) {
+		t.Errorf("expected the cascade to leave ink at 3, got %v", res.Rows)
+	}
+
+	stmt, err := sql.Parse("SELECT id FROM products WHERE id = $2 OR id = $1 LIMIT 5")
+	if err != nil || stmt.NumParams() != 2 {
+		t.Fatalf("expected 2 params, got %v", err)
+	}
+	if _, err := stmt.Compile(db, 1); err == nil {
+		t.Error("expected a parameter count error")
+	}
+	for _, bad := range []string{
+		"SELECT FROM products",
+		"SELECT * FROM products WHERE name = 'unterminated",
+		"UPDATE products SET price = 1 WHERE",
+		"SELECT * FROM products LIMIT 1 extra",
+	} {
+		if _, err := sql.Parse(bad); err == nil {
+			t.Errorf("expected a syntax error for %q", bad)
+		}
+	}
+	if _, err := sql.Exec(ctx, db, "SELECT * FROM products WHERE price = 'abc'"); err == nil {
+		t.Error("expected a type mismatch")
+	}
+
+	exec("DROP TABLE products")
+	exec("DROP TABLE IF EXISTS products")
+	if _, err := db.Table("products"); err == nil {
+		t.Error("expected products to be dropped")
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+// tick waits long enough for the next write to get a later timestamp, and
+// returns a time between the writes.
+func tick() time.Time {
+	time.Sleep(5 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	return at
+}
+
+// balancesAt reads the balance of each account as of at.
+func balancesAt(t *testing.T, db *core.Database, at time.Time) map[interface{}]interface{} {
+	t.Helper()
+	rows, err := query.NewQuery(db, "accounts").AsOf(at).Execute()
+	if err != nil {
+		t.Fatalf("failed to read as of %v: %v", at, err)
+	}
+	out := make(map[interface{}]interface{})
+	for _, r := range rows {
+		out[r["owner"]] = r["balance"]
+	}
+	return out
+}
+
+func TestTemporalTables(t *testing.T) {
+	dbPath := "test_temporal.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	db.DefineSchema("accounts", []core.Field{
+		{Name: "owner", Type: core.FieldTypeString, Unique: true},
+		{Name: "balance", Type: core.FieldTypeInt},
+	})
+	if err := db.DefineSchema("periods", []core.Field{{Name: core.RowValidFromField, Type: core.FieldTypeInt}}); err == nil {
+		t.Error("expected a field named like the history fields to be rejected")
+	}
+	db.Insert("accounts", core.Row{"owner": "ada", "balance": 10})
+	if _, err := query.NewQuery(db, "accounts").AsOf(time.Now()).Execute(); err == nil {
+		t.Error("expected a table without history to refuse AsOf")
+	}
+	before := tick()
+	if err := db.SetTemporal("accounts", &core.Temporal{Retain: "soon"}); err == nil {
+		t.Error("expected an invalid retention to be rejected")
+	}
+	if err := db.SetTemporal("accounts", &core.Temporal{}); err != nil {
+		t.Fatal(err)
+	}
+
+	at10 := tick()
+	byOwner := func(owner string) func(core.Row) bool {
+		return func(r core.Row) bool { return r["owner"] == owner }
+	}
+	safety.Update(db, "accounts", byOwner("ada"), core.Row{"balance": 20})
+	at20 := tick()
+	db.Insert("accounts", core.Row{"owner": "alan", "balance": 5})
+	safety.Update(db, "accounts", byOwner("ada"), core.Row{"balance": 30})
+	at30 := tick()
+	safety.Delete(db, "accounts", byOwner("ada"))
+	after := tick()
+
+	if _, err := query.NewQuery(db, "accounts").AsOf(before).Execute(); err == nil {
+		t.Error("expected a read from before the history started to fail")
+	}
+	check := func(label string) {
+		t.Helper()
+		if got := balancesAt(t, db, at10); len(got) != 1 || !core.Equal(got["ada"], 10) {
+			t.Errorf("%s: expected ada at 10 only, got %v", label, got)
+		}
+		if got := balancesAt(t, db, at20); len(got) != 1 || !core.Equal(got["ada"], 20) {
+			t.Errorf("%s: expected ada at 20 only, got %v", label, got)
+		}
+		if got := balancesAt(t, db, at30); len(got) != 2 || !core.Equal(got["ada"], 30) || !core.Equal(got["alan"], 5) {
+			t.Errorf("%s: expected ada at 30 and alan at 5, got %v", label, got)
+		}
+		if got := balancesAt(t, db, after); len(got) != 1 || got["ada"] != nil {
+			t.Errorf("%s: expected ada gone, got %v", label, got)
+		}
+
+		q := query.NewQuery(db, "accounts").Between(at10, at30).OrderBy(core.RowValidFromField, false)
+		if err := q.Where(map[string]interface{}{"owner": "ada"}); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := q.Execute()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 3 || !core.Equal(rows[0]["balance"], 10) || !core.Equal(rows[2]["balance"], 30) {
+			t.Fatalf("%s: expected ada's three versions in order, got %v", label, rows)
+		}
+		for _, r := range rows {
+			if r[core.RowValidToField] == nil {
+				t.Errorf("%s: expected every version of ada to have ended, got %v", label, r)
+			}
+		}
+
+		// Only reads from the history carry the times of their versions.
+		rows, _ = query.NewQuery(db, "accounts").Execute()
+		if len(rows) != 1 || len(rows[0]) != 2 {
+			t.Errorf("%s: expected alan without history fields, got %v", label, rows)
+		}
+	}
+	check("live")
+
+	exp, err := query.NewQuery(db, "accounts").AsOf(at20).Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.Plan.Access != query.HistoryScan {
+		t.Errorf("expected a history scan, got %s", exp.Plan.Access)
+	}
+	db.Close()
+
+	// The history is kept in the data file.
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	check("reopened")
+
+	// Versions past the retention go when the table is flushed, and reads
+	// from before it fail.
+	if err := db.SetTemporal("accounts", &core.Temporal{Retain: "5ms"}); err != nil {
+		t.Fatal(err)
+	}
+	tick()
+	db.Flush("accounts")
+	if _, err := query.NewQuery(db, "accounts").AsOf(at20).Execute(); err == nil {
+		t.Error("expected a read from past the retention to fail")
+	}
+	db.SetTemporal("accounts", &core.Temporal{})
+	if got := balancesAt(t, db, at20); len(got) != 0 {
+		t.Errorf("expected the pruned versions to be gone, got %v", got)
+	}
+	db.Close()
+
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	if got := balancesAt(t, db, at20); len(got) != 0 {
+		t.Errorf("expected the pruned versions to stay gone, got %v", got)
+	}
+	if got := balancesAt(t, db, time.Now()); len(got) != 1 || !core.Equal(got["alan"], 5) {
+		t.Errorf("expected alan to be current, got %v", got)
+	}
+}
@@ -0,0 +1,324 @@
+package tests
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestTriggers(t *testing.T) {
+	dbPath := "test_triggers.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("customers", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "orders", Type: core.FieldTypeInt},
+	})
+	db.DefineSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "customer_id", Type: core.FieldTypeInt},
+		{Name: "total", Type: core.FieldTypeFloat},
+		{Name: "updated_at", Type: core.FieldTypeTimestamp},
+	})
+	db.DefineSchema("audit", []core.Field{
+		{Name: "order", Type: core.FieldTypeInt},
+		{Name: "kind", Type: core.FieldTypeString},
+	})
+	db.Insert("customers", core.Row{"id": 1, "orders": 0})
+
+	// Before: stamp every written order, and refuse empty ones.
+	err = db.AddTrigger(core.Trigger{
+		Name: "stamp", Table: "orders", On: []core.ChangeKind{core.ChangeInsert, core.ChangeUpdate},
+		Before: func(ev *core.HookEvent) error {
+			if total, _ := ev.After["total"].(float64); total <= 0 {
+				return errors.New("empty order")
+			}
+			ev.After["updated_at"] = time.Now()
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After: count the customer's orders and keep an audit trail.
+	err = db.AddTrigger(core.Trigger{
+		Name: "count", Table: "orders", Writes: []string{"customers", "audit"},
+		After: func(tx *core.Tx, ev *core.HookEvent) error {
+			row, inc := ev.After, 1
+			if ev.Kind == core.ChangeDelete {
+				row, inc = ev.Before, -1
+			}
+			if ev.Kind != core.ChangeUpdate {
+				customers, err := tx.Find("customers", func(r core.Row) bool { return core.Equal(r["id"], row["customer_id"]) })
+				if err != nil || len(customers) != 1 {
+					return errors.New("no such customer")
+				}
+				n, _ := customers[0]["orders"].(int)
+				// Found rows are copies: changing one changes nothing stored.
+				customers[0]["id"] = -1
+				byID := func(r core.Row) bool { return core.Equal(r["id"], row["customer_id"]) }
+				if _, err := tx.Update("customers", byID, core.Row{"orders": n + inc}); err != nil {
+					return err
+				}
+			}
+			return tx.Insert("audit", core.Row{"order": row["id"], "kind": string(ev.Kind)})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countOf := func() int {
+		rows, _ := query.NewQuery(db, "customers").Execute()
+		var n int
+		for _, r := range rows {
+			n, _ = r["orders"].(int)
+		}
+		return n
+	}
+
+	if err := db.Insert("orders", core.Row{"id": 1, "customer_id": 1, "total": 9.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BulkInsert("orders", []core.Row{
+		{"id": 2, "customer_id": 1, "total": 3.0},
+		{"id": 3, "customer_id": 1, "total": 4.0},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countOf(); n != 3 {
+		t.Errorf("expected 3 orders counted, got %d", n)
+	}
+	if n, _ := db.Count("audit", nil); n != 3 {
+		t.Errorf("expected 3 audit rows, got %d", n)
+	}
+	rows, _ := query.NewQuery(db, "orders").Execute()
+	for _, r := range rows {
+		if _, ok := r["updated_at"].(time.Time); !ok {
+			t.Errorf("expected the order to be stamped, got %v", r)
+		}
+	}
+
+	// A before trigger aborts the whole bulk insert.
+	err = db.BulkInsert("orders", []core.Row{
+		{"id": 4, "customer_id": 1, "total": 1.0},
+		{"id": 5, "customer_id": 1, "total": 0.0},
+	})
+	if err == nil {
+		t.Error("expected the empty order to be refused")
+	}
+	if n, _ := db.Count("orders", nil); n != 3 {
+		t.Errorf("expected no order of the refused insert, got %d", n)
+	}
+
+	// A failing after trigger undoes the write that fired it and its own.
+	sub, _ := db.Subscribe("", nil)
+	defer sub.Close()
+	if err := db.Insert("orders", core.Row{"id": 6, "customer_id": 42, "total": 1.0}); err == nil {
+		t.Error("expected an order of an unknown customer to fail")
+	}
+	if n, _ := db.Count("orders", nil); n != 3 {
+		t.Errorf("expected the failed order to be undone, got %d orders", n)
+	}
+	if n, _ := db.Count("audit", nil); n != 3 {
+		t.Errorf("expected no audit row of the failed order, got %d", n)
+	}
+
+	// Updates and deletes fire too, and their writes are published with them.
+	if err := safety.Update(db, "orders", func(r core.Row) bool { return core.Equal(r["id"], 1) }, core.Row{"total": 12.0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := safety.Delete(db, "orders", func(r core.Row) bool { return core.Equal(r["id"], 2) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := countOf(); n != 2 {
+		t.Errorf("expected 2 orders counted after the delete, got %d", n)
+	}
+	var tables []string
+	for len(tables) < 4 {
+		select {
+		case c := <-sub.C:
+			tables = append(tables, c.Table+" "+string(c.Kind))
+		case <-time.After(time.Second):
+			t.Fatalf("expected 4 changes, got %v", tables)
+		}
+	}
+	want := []string{"orders update", "audit insert", "orders delete", "customers update"}
+	for i, w := range want {
+		if tables[i] != w {
+			t.Errorf("expected changes %v, got %v", want, tables)
+			break
+		}
+	}
+
+	// Writes to a table not declared fail.
+	db.AddTrigger(core.Trigger{
+		Name: "stray", Table: "audit", On: []core.ChangeKind{core.ChangeInsert},
+		After: func(tx *core.Tx, ev *core.HookEvent) error {
+			return tx.Insert("customers", core.Row{"id": 99, "orders": 0})
+		},
+	})
+	if err := db.Insert("audit", core.Row{"order": 0, "kind": "manual"}); err == nil {
+		t.Error("expected a write to an undeclared table to fail")
+	}
+	db.DropTrigger("audit", "stray")
+	if err := db.Insert("audit", core.Row{"order": 0, "kind": "manual"}); err != nil {
+		t.Errorf("expected the insert to work without the trigger: %v", err)
+	}
+}
+
+func TestRules(t *testing.T) {
+	dbPath := "test_rules.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	db.DefineSchema("products", []core.Field{
+		{Name: "sku", Type: core.FieldTypeString, Unique: true},
+		{Name: "sold", Type: core.FieldTypeInt},
+	})
+	db.DefineSchema("sales", []core.Field{
+		{Name: "sku", Type: core.FieldTypeString},
+		{Name: "qty", Type: core.FieldTypeInt},
+		{Name: "at", Type: core.FieldTypeTimestamp},
+	})
+	db.Insert("products", core.Row{"sku": "A", "sold": 0})
+
+	if err := db.SetRules("sales", []core.Rule{{Name: "bad", Set: map[string]interface{}{"at": "$later"}}}); err == nil {
+		t.Error("expected an unknown reference to be rejected")
+	}
+	if err := db.SetRules("sales", []core.Rule{{Name: "bad", Then: []core.RuleWrite{{Table: "nowhere", Insert: map[string]interface{}{}}}}}); err == nil {
+		t.Error("expected a write to an unknown table to be rejected")
+	}
+
+	rules := []core.Rule{
+		{Name: "stamp", On: []core.ChangeKind{core.ChangeInsert}, Set: map[string]interface{}{"at": "$now"}},
+		{Name: "positive", Require: map[string]interface{}{"qty": map[string]interface{}{"$gt": 0}}, Message: "qty must be positive"},
+		{Name: "tally", On: []core.ChangeKind{core.ChangeInsert}, Then: []core.RuleWrite{
+			{Table: "products", Match: map[string]interface{}{"sku": "$new.sku"}, Inc: map[string]float64{"sold": 1}},
+		}},
+	}
+	if err := db.SetRules("sales", rules); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Rules are kept with the schema.
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	if got := db.Schemas["sales"].Rules; len(got) != 3 {
+		t.Fatalf("expected 3 rules after reopening, got %+v", got)
+	}
+
+	if err := db.Insert("sales", core.Row{"sku": "A", "qty": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert("sales", core.Row{"sku": "A", "qty": 0}); err == nil || err.Error() != "trigger positive: qty must be positive" {
+		t.Errorf("expected the rule's message, got %v", err)
+	}
+	rows, _ := query.NewQuery(db, "sales").Execute()
+	for _, r := range rows {
+		if _, ok := r["at"].(time.Time); !ok {
+			t.Errorf("expected the sale to be stamped, got %v", r)
+		}
+	}
+	rows, _ = query.NewQuery(db, "products").Execute()
+	for _, r := range rows {
+		if !core.Equal(r["sold"], 1) {
+			t.Errorf("expected 1 sold, got %v", r["sold"])
+		}
+	}
+
+	db.SetRules("sales", nil)
+	if err := db.Insert("sales", core.Row{"sku": "A", "qty": 0, "at": time.Now()}); err != nil {
+		t.Errorf("expected the insert to work without rules: %v", err)
+	}
+}
+
+func TestTriggersWithForeignKeys(t *testing.T) {
+	dbPath := "test_trigger_keys.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	db.DefineSchema("products", []core.Field{{Name: "id", Type: core.FieldTypeInt, Unique: true}})
+	db.DefineSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "product_id", Type: core.FieldTypeInt},
+	}, core.Constraint{
+		Kind: core.ConstraintForeignKey, Fields: []string{"product_id"}, RefTable: "products", RefFields: []string{"id"},
+		OnDelete: core.ActionCascade,
+	})
+	db.DefineSchema("audit", []core.Field{{Name: "order", Type: core.FieldTypeInt}})
+	db.AddTrigger(core.Trigger{
+		Name: "log", Table: "orders", On: []core.ChangeKind{core.ChangeInsert}, Writes: []string{"audit"},
+		After: func(tx *core.Tx, ev *core.HookEvent) error {
+			return tx.Insert("audit", core.Row{"order": ev.After["id"]})
+		},
+	})
+	if err := db.Insert("products", core.Row{"id": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Orders lock their product, and deleting a product locks its orders:
+	// both must take the tables in the same order.
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= n; i++ {
+			db.Insert("orders", core.Row{"id": i, "product_id": 0})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= n; i++ {
+			db.Insert("products", core.Row{"id": i})
+			safety.Delete(db, "products", func(r core.Row) bool { return core.Equal(r["id"], i) })
+		}
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		// Closing would wait for the locks too.
+		t.Fatal("concurrent order inserts and product deletes deadlocked")
+	}
+	defer db.Close()
+
+	if err := db.Insert("orders", core.Row{"id": n + 1, "product_id": 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.Count("audit", map[string]interface{}{"order": n + 1}); got != 1 {
+		t.Errorf("expected the trigger to log the order, got %d", got)
+	}
+}
@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+func TestTTL(t *testing.T) {
+	dbPath := "test_ttl.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	db.DefineSchema("otp", []core.Field{
+		{Name: "phone", Type: core.FieldTypeString, Unique: true},
+		{Name: "code", Type: core.FieldTypeString},
+		{Name: "created_at", Type: core.FieldTypeTimestamp},
+	})
+	if err := db.SetTTL("otp", &core.TTL{Field: "code"}); err == nil {
+		t.Error("expected a ttl on a string field to be rejected")
+	}
+	if err := db.SetTTL("otp", &core.TTL{After: "soon"}); err == nil {
+		t.Error("expected a bad duration to be rejected")
+	}
+	if err := db.SetTTL("otp", &core.TTL{}); err == nil {
+		t.Error("expected a ttl from insertion without after to be rejected")
+	}
+	if err := db.SetTTL("otp", &core.TTL{Field: "created_at", After: "5m"}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	db.Insert("otp", core.Row{"phone": "+1", "code": "111", "created_at": now.Add(-10 * time.Minute)})
+	db.Insert("otp", core.Row{"phone": "+2", "code": "222", "created_at": now})
+
+	// The old code is gone from reads at once.
+	if n, _ := db.Count("otp", nil); n != 1 {
+		t.Errorf("expected 1 live row, got %d", n)
+	}
+	rows, _ := query.NewQuery(db, "otp").Execute()
+	for _, r := range rows {
+		if r["phone"] == "+1" {
+			t.Errorf("expected the expired code to be hidden, got %v", rows)
+		}
+	}
+	byPhone := func(phone string) []core.Row {
+		q := query.NewQuery(db, "otp")
+		q.Where(map[string]interface{}{"phone": phone})
+		rows, _ := q.Execute()
+		return rows
+	}
+	if rows := byPhone("+1"); len(rows) != 0 {
+		t.Errorf("expected no lookup of an expired row, got %v", rows)
+	}
+
+	// Its unique value is free again.
+	if err := db.Insert("otp", core.Row{"phone": "+1", "code": "444", "created_at": now}); err != nil {
+		t.Fatalf("expected the expired phone to be reusable: %v", err)
+	}
+	rows = byPhone("+1")
+	if len(rows) != 1 || rows[0]["code"] != "444" {
+		t.Errorf("expected the new code, got %v", rows)
+	}
+
+	// Flushing removes the expired row for good.
+	if err := db.Flush("otp"); err != nil {
+		t.Fatal(err)
+	}
+	table, _ := db.Table("otp")
+	if n := table.Snapshot().Len(); n != 2 {
+		t.Errorf("expected 2 stored rows after the sweep, got %d", n)
+	}
+
+	// Per-row expiry: the field holds the time itself.
+	db.DefineSchema("invites", []core.Field{
+		{Name: "email", Type: core.FieldTypeString},
+		{Name: "expires_at", Type: core.FieldTypeTimestamp},
+	})
+	db.SetTTL("invites", &core.TTL{Field: "expires_at"})
+	db.Insert("invites", core.Row{"email": "a@x.io", "expires_at": now.Add(-time.Second)})
+	db.Insert("invites", core.Row{"email": "b@x.io", "expires_at": now.Add(time.Hour)})
+	if n, _ := db.Count("invites", nil); n != 1 {
+		t.Errorf("expected 1 live invite, got %d", n)
+	}
+
+	// Counting from insertion.
+	db.DefineSchema("sessions", []core.Field{
+		{Name: "token", Type: core.FieldTypeString},
+		{Name: "_inserted", Type: core.FieldTypeString},
+	})
+	db.Insert("sessions", core.Row{"token": "before", "_inserted": "mine"})
+	db.SetTTL("sessions", &core.TTL{After: "50ms"})
+	db.Insert("sessions", core.Row{"token": "after", "_inserted": "mine"})
+	if n, _ := db.Count("sessions", nil); n != 2 {
+		t.Errorf("expected 2 sessions, got %d", n)
+	}
+	// The insertion time is kept apart from the fields and not read back.
+	rows, _ = query.NewQuery(db, "sessions").Filter(func(r core.Row) bool { return r["token"] == "after" }).Execute()
+	if len(rows) != 1 || len(rows[0]) != 2 || rows[0]["_inserted"] != "mine" {
+		t.Errorf("expected the session as written, got %v", rows)
+	}
+	time.Sleep(80 * time.Millisecond)
+	if n, _ := db.Count("sessions", nil); n != 1 {
+		t.Errorf("expected the session from before the ttl to stay, got %d", n)
+	}
+	if n, err := db.Expire("sessions"); err != nil || n != 1 {
+		t.Errorf("expected 1 session expired, got %d (%v)", n, err)
+	}
+	db.Close()
+
+	// The policy is kept with the schema, and closing swept the expired invite.
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	schema := db.Schemas["invites"]
+	if schema == nil || schema.TTL == nil || schema.TTL.Field != "expires_at" {
+		t.Fatalf("expected the ttl to be kept, got %+v", schema)
+	}
+	invites, _ := db.Table("invites")
+	if n := invites.Snapshot().Len(); n != 1 {
+		t.Errorf("expected 1 stored invite after reopening, got %d", n)
+	}
+
+	// Removing the policy brings back expired rows not yet swept.
+	db.Insert("invites", core.Row{"email": "c@x.io", "expires_at": now.Add(-time.Hour)})
+	if n, _ := db.Count("invites", nil); n != 1 {
+		t.Errorf("expected 1 live invite, got %d", n)
+	}
+	db.SetTTL("invites", nil)
+	if n, _ := db.Count("invites", nil); n != 2 {
+		t.Errorf("expected both invites without a ttl, got %d", n)
+	}
+}
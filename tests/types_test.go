@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+)
+
+func TestRichFieldTypes(t *testing.T) {
+	dbPath := "test_types.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	fields := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt},
+		{Name: "placed", Type: core.FieldTypeTimestamp},
+		{Name: "blob", Type: core.FieldTypeBytes},
+		{Name: "total", Type: core.FieldTypeDecimal},
+		{Name: "meta", Type: core.FieldTypeObject},
+		{Name: "tags", Type: core.FieldTypeArray},
+	}
+	if err := db.DefineSchema("orders", fields); err != nil {
+		t.Fatalf("define failed: %v", err)
+	}
+
+	// The same instant in two zones must be stored identically
+	db.Insert("orders", core.Row{"id": 1, "placed": "2024-05-01T14:00:00+02:00", "blob": "aGVsbG8=", "total": "19.990", "meta": map[string]interface{}{"a": 1.0}, "tags": []string{"x", "y"}})
+	db.Insert("orders", core.Row{"id": 2, "placed": time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC), "blob": []byte{1, 2}, "total": 5, "meta": nil, "tags": []interface{}{}})
+	db.Insert("orders", core.Row{"id": 3, "placed": int64(1714564800000), "blob": nil, "total": "100.5", "meta": nil, "tags": nil})
+
+	if err := db.Insert("orders", core.Row{"id": 4, "placed": "yesterday", "blob": nil, "total": "1", "meta": nil, "tags": nil}); err == nil || !strings.Contains(err.Error(), "type mismatch: placed") {
+		t.Errorf("expected a type mismatch on placed, got %v", err)
+	}
+	if err := db.Insert("orders", core.Row{"id": 4, "placed": nil, "blob": nil, "total": "abc", "meta": nil, "tags": nil}); err == nil || !strings.Contains(err.Error(), "type mismatch: total") {
+		t.Errorf("expected a type mismatch on total, got %v", err)
+	}
+
+	db.Flush("orders")
+	db.Close()
+
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := query.NewQuery(db, "orders").OrderBy("id", false).Execute()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d (%v)", len(rows), err)
+	}
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if placed, ok := rows[0]["placed"].(time.Time); !ok || !placed.Equal(want) || placed.Location() != time.UTC {
+		t.Errorf("expected placed to round-trip as %v UTC, got %#v", want, rows[0]["placed"])
+	}
+	if b, ok := rows[0]["blob"].([]byte); !ok || !bytes.Equal(b, []byte("hello")) {
+		t.Errorf("expected blob to round-trip, got %#v", rows[0]["blob"])
+	}
+	if d, ok := rows[0]["total"].(core.Decimal); !ok || d != "19.99" {
+		t.Errorf("expected total 19.99, got %#v", rows[0]["total"])
+	}
+	if tags, ok := rows[0]["tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Errorf("expected tags to round-trip, got %#v", rows[0]["tags"])
+	}
+
+	// Decimals order by value, not as strings
+	byTotal, _ := query.NewQuery(db, "orders").OrderBy("total", true).Limit(2).Execute()
+	if len(byTotal) != 2 || !core.Equal(byTotal[0]["id"], 3) || !core.Equal(byTotal[1]["id"], 1) {
+		t.Errorf("unexpected order by total: %v", byTotal)
+	}
+
+	count, err := db.Count("orders", map[string]interface{}{"placed": map[string]interface{}{"$gt": "2024-05-01T11:30:00Z"}})
+	if err != nil || count != 2 {
+		t.Errorf("expected 2 orders after 11:30, got %d (%v)", count, err)
+	}
+	count, _ = db.Count("orders", map[string]interface{}{"total": map[string]interface{}{"$gte": 19.99}})
+	if count != 2 {
+		t.Errorf("expected 2 orders of at least 19.99, got %d", count)
+	}
+	count, _ = db.Count("orders", map[string]interface{}{"tags": map[string]interface{}{"$contains": "y"}})
+	if count != 1 {
+		t.Errorf("expected 1 order tagged y, got %d", count)
+	}
+}
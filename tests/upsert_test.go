@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+)
+
+func TestUpsert(t *testing.T) {
+	dbPath := "test_upsert.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	fields := []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "name", Type: core.FieldTypeString},
+		{Name: "email", Type: core.FieldTypeString, Unique: true},
+	}
+	db.DefineSchema("users", fields)
+	db.Insert("users", core.Row{"id": 1, "name": "alice", "email": "a@x"})
+
+	// Merge: id arrives as float64 like it would from the bridge
+	res, err := db.Upsert("users", core.Row{"id": float64(1), "name": "alice2"}, []string{"id"}, core.UpsertMerge)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if res.Updated != 1 {
+		t.Errorf("expected 1 updated, got %+v", res)
+	}
+	row := db.Tables["users"].HotHeap.Rows[0]
+	if row["name"] != "alice2" || row["email"] != "a@x" {
+		t.Errorf("merge did not keep existing fields: %v", row)
+	}
+
+	// Ignore
+	res, _ = db.Upsert("users", core.Row{"id": 1, "name": "x", "email": "x@x"}, []string{"id"}, core.UpsertIgnore)
+	if res.Ignored != 1 {
+		t.Errorf("expected 1 ignored, got %+v", res)
+	}
+
+	// Replace must still honour other unique fields
+	db.Insert("users", core.Row{"id": 2, "name": "bob", "email": "b@x"})
+	_, err = db.Upsert("users", core.Row{"id": 1, "name": "alice", "email": "b@x"}, []string{"id"}, core.UpsertReplace)
+	if err == nil {
+		t.Error("expected unique constraint violation on email")
+	}
+
+	// Batch is all or nothing
+	_, err = db.BulkUpsert("users", []core.Row{
+		{"id": 3, "name": "carol", "email": "c@x"},
+		{"id": 3, "name": "carol", "email": "c2@x"},
+	}, []string{"id"}, core.UpsertMerge)
+	if err == nil {
+		t.Error("expected duplicate in batch error")
+	}
+	res, err = db.BulkUpsert("users", []core.Row{
+		{"id": 2, "name": "bobby"},
+		{"id": 3, "name": "carol", "email": "c@x"},
+	}, []string{"id"}, core.UpsertMerge)
+	if err != nil {
+		t.Fatalf("batch failed: %v", err)
+	}
+	if res.Inserted != 1 || res.Updated != 1 {
+		t.Errorf("unexpected batch result: %+v", res)
+	}
+
+	count, _ := db.Count("users", nil)
+	if count != 3 {
+		t.Errorf("expected 3 rows, got %d", count)
+	}
+
+	if _, err := db.Upsert("users", core.Row{"id": 4}, []string{"name"}, core.UpsertMerge); err == nil {
+		t.Error("expected error for non-unique conflict target")
+	}
+}
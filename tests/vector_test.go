@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+func TestVectorSearch(t *testing.T) {
+	dbPath := "test_vector.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	if err := db.DefineSchema("bad", []core.Field{{Name: "v", Type: core.FieldTypeVector}}); err == nil {
+		t.Error("expected a vector without dimensions to be rejected")
+	}
+	if err := db.DefineSchema("bad", []core.Field{{Name: "n", Type: core.FieldTypeInt, VectorIndex: "ivf"}}); err == nil {
+		t.Error("expected a vector index on an int field to be rejected")
+	}
+	db.DefineSchema("items", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "cat", Type: core.FieldTypeString},
+		{Name: "emb", Type: core.FieldTypeVector, Dimensions: 3, VectorIndex: "ivf", Lists: 8},
+		{Name: "raw", Type: core.FieldTypeVector, Dimensions: 3},
+	})
+	if err := db.Insert("items", core.Row{"id": -1, "emb": []float64{1, 2}}); err == nil {
+		t.Error("expected a short vector to be rejected")
+	}
+	if err := db.Insert("items", core.Row{"id": -1, "emb": []interface{}{1, "x", 3}}); err == nil {
+		t.Error("expected a vector of strings to be rejected")
+	}
+
+	vec := func(i int) []float64 {
+		return []float64{float64(i % 20), float64(i / 20), 1}
+	}
+	cat := func(i int) string {
+		return []string{"a", "b"}[i%2]
+	}
+	for i := 0; i < 400; i++ {
+		// Vectors arrive from the bridge as JSON arrays.
+		v := vec(i)
+		if err := db.Insert("items", core.Row{"id": i, "cat": cat(i), "emb": []interface{}{v[0], v[1], v[2]}, "raw": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Flush("items")
+
+	// exact ranks every row by brute force.
+	exact := func(target []float64, metric core.Metric, keep func(int) bool, k int) []int {
+		var ids []int
+		for i := 0; i < 400; i++ {
+			if keep(i) {
+				ids = append(ids, i)
+			}
+		}
+		sort.SliceStable(ids, func(a, b int) bool {
+			return core.Distance(metric, target, vec(ids[a])) < core.Distance(metric, target, vec(ids[b]))
+		})
+		if len(ids) > k {
+			ids = ids[:k]
+		}
+		return ids
+	}
+	ids := func(rows []core.Row) []int {
+		var out []int
+		for _, r := range rows {
+			switch n := r["id"].(type) {
+			case int:
+				out = append(out, n)
+			case float64:
+				out = append(out, int(n))
+			}
+		}
+		return out
+	}
+	same := func(a, b []int) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// With the index, the row whose vector is the target is found first.
+	q := query.NewQuery(db, "items").Nearest("emb", vec(123), 5, core.L2)
+	ex, err := q.Explain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ex.Plan.Access != query.VectorIndex || ex.Plan.Lists != 8 || ex.Plan.Probes != 2 || ex.Stats.RowsExamined >= 400 {
+		t.Errorf("expected two of eight lists read, got %+v / %+v", ex.Plan, ex.Stats)
+	}
+	rows, _ := q.Execute()
+	if len(rows) != 5 || !core.Equal(rows[0]["id"], 123) || rows[0][query.DistanceField] != 0.0 {
+		t.Fatalf("unexpected nearest rows: %v", rows)
+	}
+	for i := 1; i < len(rows); i++ {
+		if rows[i][query.DistanceField].(float64) < rows[i-1][query.DistanceField].(float64) {
+			t.Errorf("expected ascending distances, got %v", rows)
+		}
+	}
+
+	// Probing every list gives the exact answer, filters included.
+	keepA := func(i int) bool { return cat(i) == "a" }
+	q = query.NewQuery(db, "items")
+	q.Where(map[string]interface{}{"cat": "a"})
+	q.Near = &query.Nearest{Field: "emb", Vector: []float64{4.2, 7.7, 1}, K: 6, Metric: core.L2, Probes: 8}
+	rows, err = q.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := exact([]float64{4.2, 7.7, 1}, core.L2, keepA, 6); !same(ids(rows), want) {
+		t.Errorf("expected %v, got %v", want, ids(rows))
+	}
+
+	// A filter the nearest lists cannot satisfy widens the search.
+	few := func(i int) bool { return i < 3 }
+	q = query.NewQuery(db, "items").Nearest("emb", vec(399), 3, core.L2).Filter(func(r core.Row) bool {
+		return core.Compare(r["id"], 3) < 0
+	})
+	ex, _ = q.Explain()
+	rows, _ = q.Execute()
+	if want := exact(vec(399), core.L2, few, 3); !same(ids(rows), want) || ex.Plan.Probes != 8 {
+		t.Errorf("expected %v after widening, got %v (%+v)", want, ids(rows), ex.Plan)
+	}
+
+	// Without an index every row is compared, and order and columns apply
+	// to the k nearest.
+	all := func(int) bool { return true }
+	q = query.NewQuery(db, "items").Nearest("raw", []float64{1, 1, 1}, 4, core.Cosine).Select("id").OrderBy("id", false)
+	ex, _ = q.Explain()
+	rows, _ = q.Execute()
+	want := exact([]float64{1, 1, 1}, core.Cosine, all, 4)
+	sort.Ints(want)
+	if ex.Plan.Access != query.FullScan || !same(ids(rows), want) || rows[0][query.DistanceField] == nil {
+		t.Errorf("expected %v by id with distances, got %v (%v)", want, rows, ex.Plan.Access)
+	}
+
+	if _, err := query.NewQuery(db, "items").Nearest("emb", []float64{1, 2}, 3, core.Dot).Execute(); err == nil {
+		t.Error("expected a dimension mismatch")
+	}
+	if _, err := query.NewQuery(db, "items").Nearest("cat", []float64{1, 2, 3}, 3, core.Dot).Execute(); err == nil {
+		t.Error("expected a non-vector field to be rejected")
+	}
+
+	// Updates move rows between lists.
+	safety.Update(db, "items", func(r core.Row) bool { return core.Equal(r["id"], 7) }, core.Row{"emb": []float64{50, 50, 1}})
+	rows, _ = query.NewQuery(db, "items").Nearest("emb", []float64{50, 50, 1}, 1, core.L2).Execute()
+	if len(rows) != 1 || !core.Equal(rows[0]["id"], 7) {
+		t.Errorf("expected the updated row, got %v", rows)
+	}
+	db.Close()
+
+	// The index comes back from the data file.
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	q = query.NewQuery(db, "items").Nearest("emb", vec(123), 5, core.L2)
+	ex, _ = q.Explain()
+	rows, _ = q.Execute()
+	if ex.Plan.Access != query.VectorIndex || len(rows) != 5 || !core.Equal(rows[0]["id"], 123) {
+		t.Errorf("unexpected result after reopening: %v (%+v)", ids(rows), ex.Plan)
+	}
+	rows, _ = query.NewQuery(db, "items").Nearest("emb", []float64{50, 50, 1}, 1, core.L2).Execute()
+	if len(rows) != 1 || !core.Equal(rows[0]["id"], 7) {
+		t.Errorf("expected the updated row after reopening, got %v", rows)
+	}
+}
@@ -0,0 +1,279 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/ikwerre-dev/EmojiDB/core"
+	"github.com/ikwerre-dev/EmojiDB/query"
+	"github.com/ikwerre-dev/EmojiDB/safety"
+)
+
+// groupsOf reads a grouped view into a map from its key field to the row.
+func groupsOf(t *testing.T, db *core.Database, view, key string) map[interface{}]core.Row {
+	t.Helper()
+	rows, err := query.NewQuery(db, view).Execute()
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", view, err)
+	}
+	out := make(map[interface{}]core.Row)
+	for _, r := range rows {
+		out[r[key]] = r
+	}
+	return out
+}
+
+func TestViews(t *testing.T) {
+	dbPath := "test_views.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "region", Type: core.FieldTypeString},
+		{Name: "total", Type: core.FieldTypeInt},
+		{Name: "paid", Type: core.FieldTypeBool},
+	})
+	db.BulkInsert("orders", []core.Row{
+		{"id": 1, "region": "eu", "total": 10, "paid": true},
+		{"id": 2, "region": "eu", "total": 5, "paid": false},
+		{"id": 3, "region": "us", "total": 7, "paid": true},
+	})
+
+	q := query.NewQuery(db, "orders").Select("id", "total")
+	if err := q.Where(map[string]interface{}{"paid": true}); err != nil {
+		t.Fatal(err)
+	}
+	paid, err := q.View(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateView("paid", paid); err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateView("by_region", core.View{
+		Table:   "orders",
+		GroupBy: []string{"region"},
+		Aggregates: []core.ViewAggregate{
+			{Func: core.AggCount, As: "orders"},
+			{Func: core.AggSum, Field: "total", As: "revenue"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := core.View{Table: "orders", Aggregates: []core.ViewAggregate{{Func: core.AggSum, Field: "region", As: "x"}}}
+	if err := db.CreateView("bad", bad); err == nil {
+		t.Error("expected a sum of strings to be rejected")
+	}
+
+	// A plain view is computed from its table whenever it is read.
+	db.Insert("orders", core.Row{"id": 4, "region": "us", "total": 3, "paid": true})
+	if n, _ := db.Count("paid", nil); n != 3 {
+		t.Errorf("expected 3 paid orders, got %d", n)
+	}
+	rows, _ := query.NewQuery(db, "paid").Execute()
+	for _, r := range rows {
+		if _, ok := r["region"]; ok {
+			t.Errorf("expected only the selected columns, got %v", r)
+		}
+	}
+	groups := groupsOf(t, db, "by_region", "region")
+	if !core.Equal(groups["eu"]["orders"], 2) || !core.Equal(groups["eu"]["revenue"], 15) {
+		t.Errorf("expected eu to have 2 orders worth 15, got %v", groups["eu"])
+	}
+	if !core.Equal(groups["us"]["revenue"], 10) {
+		t.Errorf("expected us revenue 10, got %v", groups["us"])
+	}
+
+	// Views are read-only and keep their table.
+	if err := db.Insert("paid", core.Row{"id": 9, "total": 1}); err == nil {
+		t.Error("expected an insert into a view to fail")
+	}
+	if err := safety.Delete(db, "paid", func(core.Row) bool { return true }); err == nil {
+		t.Error("expected a delete from a view to fail")
+	}
+	if err := db.DropTable("orders"); err == nil {
+		t.Error("expected dropping the table of a view to fail")
+	}
+	if err := db.SyncSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "region", Type: core.FieldTypeString},
+		{Name: "paid", Type: core.FieldTypeBool},
+	}, true); err == nil {
+		t.Error("expected removing a field a view reads to fail")
+	}
+}
+
+func TestMaterializedViews(t *testing.T) {
+	dbPath := "test_materialized.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	db.DefineSchema("orders", []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "region", Type: core.FieldTypeString},
+		{Name: "total", Type: core.FieldTypeFloat},
+	})
+	db.BulkInsert("orders", []core.Row{
+		{"id": 1, "region": "eu", "total": 10.0},
+		{"id": 2, "region": "eu", "total": 4.0},
+	})
+	err = db.CreateView("stats", core.View{
+		Table:   "orders",
+		GroupBy: []string{"region"},
+		Aggregates: []core.ViewAggregate{
+			{Func: core.AggCount, As: "orders"},
+			{Func: core.AggAvg, Field: "total", As: "average"},
+			{Func: core.AggMin, Field: "total", As: "smallest"},
+		},
+		Materialized: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateView("big", core.View{
+		Table:        "orders",
+		Match:        map[string]interface{}{"total": map[string]interface{}{"$gte": 10}},
+		Columns:      []string{"id", "total"},
+		Materialized: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := groupsOf(t, db, "stats", "region")
+	if !core.Equal(groups["eu"]["average"], 7.0) || !core.Equal(groups["eu"]["smallest"], 4.0) {
+		t.Fatalf("expected eu to average 7 from 4, got %v", groups["eu"])
+	}
+
+	// The state kept for upkeep is not part of the rows read.
+	if _, ok := groups["eu"][core.ViewStateField]; ok {
+		t.Errorf("expected the group state to be hidden, got %v", groups["eu"])
+	}
+	big, _ := query.NewQuery(db, "big").Execute()
+	for _, r := range big {
+		if _, ok := r[core.ViewSourceField]; ok {
+			t.Errorf("expected the source id to be hidden, got %v", r)
+		}
+	}
+
+	// Writes reach the view before it is read again.
+	db.Insert("orders", core.Row{"id": 3, "region": "us", "total": 20.0})
+	safety.Update(db, "orders", func(r core.Row) bool { return core.Equal(r["id"], 2) }, core.Row{"total": 12.0})
+	groups = groupsOf(t, db, "stats", "region")
+	if !core.Equal(groups["eu"]["smallest"], 10.0) || !core.Equal(groups["eu"]["average"], 11.0) {
+		t.Errorf("expected the minimum to move to 10 and the average to 11, got %v", groups["eu"])
+	}
+	if !core.Equal(groups["us"]["orders"], 1) {
+		t.Errorf("expected a us group of one order, got %v", groups["us"])
+	}
+	if n, _ := db.Count("big", nil); n != 3 {
+		t.Errorf("expected 3 big orders, got %d", n)
+	}
+
+	// A group with no rows left is removed.
+	safety.Delete(db, "orders", func(r core.Row) bool { return core.Equal(r["region"], "us") })
+	if groups = groupsOf(t, db, "stats", "region"); len(groups) != 1 {
+		t.Errorf("expected only the eu group, got %v", groups)
+	}
+	if n, _ := db.Count("big", nil); n != 2 {
+		t.Errorf("expected 2 big orders after the delete, got %d", n)
+	}
+	db.Close()
+
+	// The stored rows carry on from where they were after reopening.
+	db, err = core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	if db.Schemas["stats"].View == nil {
+		t.Fatal("expected the view to be kept with the schema")
+	}
+	db.Insert("orders", core.Row{"id": 5, "region": "eu", "total": 2.0})
+	groups = groupsOf(t, db, "stats", "region")
+	if !core.Equal(groups["eu"]["orders"], 3) || !core.Equal(groups["eu"]["smallest"], 2.0) || !core.Equal(groups["eu"]["average"], 8.0) {
+		t.Errorf("expected 3 eu orders averaging 8 from 2, got %v", groups["eu"])
+	}
+
+	// Renaming the table takes its views along.
+	err = db.Migrate("orders", []core.MigrationStep{{Kind: core.MigrateRenameTable, To: "sales"}}, []core.Field{
+		{Name: "id", Type: core.FieldTypeInt, Unique: true},
+		{Name: "region", Type: core.FieldTypeString},
+		{Name: "total", Type: core.FieldTypeFloat},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Schemas["stats"].View.Table; got != "sales" {
+		t.Errorf("expected the view to read sales, got %s", got)
+	}
+	db.Insert("sales", core.Row{"id": 6, "region": "eu", "total": 30.0})
+	if groups = groupsOf(t, db, "stats", "region"); !core.Equal(groups["eu"]["orders"], 4) {
+		t.Errorf("expected 4 eu orders after the rename, got %v", groups["eu"])
+	}
+}
+
+func TestMaterializedViewExtremes(t *testing.T) {
+	dbPath := "test_view_extremes.db"
+	resetDB(dbPath)
+	defer resetDB(dbPath)
+
+	db, err := core.Open(dbPath, "secret")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+
+	db.DefineSchema("scores", []core.Field{
+		{Name: "g", Type: core.FieldTypeInt},
+		{Name: "total", Type: core.FieldTypeInt},
+	})
+	err = db.CreateView("bounds", core.View{
+		Table:   "scores",
+		GroupBy: []string{"g"},
+		Aggregates: []core.ViewAggregate{
+			{Func: core.AggCount, As: "n"},
+			{Func: core.AggMin, Field: "total", As: "mn"},
+			{Func: core.AggMax, Field: "total", As: "mx"},
+		},
+		Materialized: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the minimum makes the view read the table again while the
+	// next delete may already be in it; that delete must not count twice.
+	const trials = 200
+	for g := 0; g < trials; g++ {
+		db.BulkInsert("scores", []core.Row{
+			{"g": g, "total": 5},
+			{"g": g, "total": 10},
+			{"g": g, "total": 20},
+		})
+		for _, total := range []int{5, 10} {
+			safety.Delete(db, "scores", func(r core.Row) bool {
+				return core.Equal(r["g"], g) && core.Equal(r["total"], total)
+			})
+		}
+	}
+	groups := groupsOf(t, db, "bounds", "g")
+	for g := 0; g < trials; g++ {
+		row := groups[g]
+		if !core.Equal(row["n"], 1) || !core.Equal(row["mn"], 20) || !core.Equal(row["mx"], 20) {
+			t.Fatalf("group %d: expected one row of 20, got %v", g, row)
+		}
+	}
+}